@@ -0,0 +1,201 @@
+// Package client talks to the control API dvnet serves on its Unix socket.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pcolladosoto/dvnet/dvnet"
+)
+
+// Client issues requests against dvnet's control API.
+type Client struct {
+	httpCli *http.Client
+}
+
+// Error is returned whenever the API rejects a request.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dvnet API: %s (%d)", e.Message, e.StatusCode)
+}
+
+// New returns a Client talking to the control API served on socketPath.
+// An empty socketPath stands for the default one.
+func New(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = dvnet.APISocket()
+	}
+	return &Client{httpCli: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}}
+}
+
+// Networks summarises every network dvnet manages.
+func (c *Client) Networks(ctx context.Context) ([]dvnet.NetworkStatus, error) {
+	statuses := []dvnet.NetworkStatus{}
+	return statuses, c.do(ctx, http.MethodGet, "networks", nil, &statuses)
+}
+
+// Network describes the subnets, nodes and links of a network
+// given its name, its ID or a prefix of the latter.
+func (c *Client) Network(ctx context.Context, network string) (dvnet.NetworkInfo, error) {
+	var info dvnet.NetworkInfo
+	return info, c.do(ctx, http.MethodGet, "networks/"+url.PathEscape(network), nil, &info)
+}
+
+// State returns the whole state dvnet keeps on a network.
+func (c *Client) State(ctx context.Context, network string) (*dvnet.NetworkState, error) {
+	ns := &dvnet.NetworkState{}
+	if err := c.do(ctx, http.MethodGet, "networks/"+url.PathEscape(network)+"/state", nil, ns); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// AddNode adds a host or a router to a running network.
+func (c *Client) AddNode(ctx context.Context, network string, node dvnet.NodeRequest) error {
+	return c.do(ctx, http.MethodPost, "networks/"+url.PathEscape(network)+"/nodes", node, nil)
+}
+
+// RemoveNode removes a host or a router from a running network.
+func (c *Client) RemoveNode(ctx context.Context, network, node string) error {
+	return c.do(ctx, http.MethodDelete, "networks/"+url.PathEscape(network)+"/nodes/"+url.PathEscape(node), nil, nil)
+}
+
+// SetLinkState brings the link between node and subnet up or down.
+func (c *Client) SetLinkState(ctx context.Context, network, node, subnet string, up bool) error {
+	path := fmt.Sprintf("networks/%s/links/%s/%s", url.PathEscape(network), url.PathEscape(node), url.PathEscape(subnet))
+	return c.do(ctx, http.MethodPut, path, dvnet.LinkStateRequest{Up: up}, nil)
+}
+
+// SetNodeState brings every link of node up or down.
+func (c *Client) SetNodeState(ctx context.Context, network, node string, up bool) error {
+	path := fmt.Sprintf("networks/%s/nodes/%s", url.PathEscape(network), url.PathEscape(node))
+	return c.do(ctx, http.MethodPut, path, dvnet.LinkStateRequest{Up: up}, nil)
+}
+
+// SetLinkImpairments changes the impairments on the link between node and
+// subnet. Empty impairments remove whatever impairments the link had.
+func (c *Client) SetLinkImpairments(ctx context.Context, network, node, subnet string, li dvnet.LinkImpairments) error {
+	path := fmt.Sprintf("networks/%s/links/%s/%s/impairments", url.PathEscape(network), url.PathEscape(node), url.PathEscape(subnet))
+	return c.do(ctx, http.MethodPut, path, li, nil)
+}
+
+// StartCapture starts capturing on the link or bridge described by req.
+func (c *Client) StartCapture(ctx context.Context, network string, req dvnet.CaptureRequest) (*dvnet.CaptureInfo, error) {
+	info := &dvnet.CaptureInfo{}
+	if err := c.do(ctx, http.MethodPost, "networks/"+url.PathEscape(network)+"/captures", req, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Captures lists the captures running on a network.
+func (c *Client) Captures(ctx context.Context, network string) ([]dvnet.CaptureInfo, error) {
+	captures := []dvnet.CaptureInfo{}
+	if err := c.do(ctx, http.MethodGet, "networks/"+url.PathEscape(network)+"/captures", nil, &captures); err != nil {
+		return nil, err
+	}
+	return captures, nil
+}
+
+// StopCapture stops a capture, returning how many packets it got.
+func (c *Client) StopCapture(ctx context.Context, network, id string) (*dvnet.CaptureInfo, error) {
+	info := &dvnet.CaptureInfo{}
+	path := fmt.Sprintf("networks/%s/captures/%s", url.PathEscape(network), url.PathEscape(id))
+	if err := c.do(ctx, http.MethodDelete, path, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// CheckConnectivity probes every node of a network from every one of its hosts.
+func (c *Client) CheckConnectivity(ctx context.Context, network string, opts dvnet.ConnectivityOptions) (*dvnet.ConnectivityReport, error) {
+	report := &dvnet.ConnectivityReport{}
+	if err := c.do(ctx, http.MethodPost, "networks/"+url.PathEscape(network)+"/connectivity", opts, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// RunAssertions checks a network against the given assertions.
+func (c *Client) RunAssertions(ctx context.Context, network string, suite dvnet.AssertionSuite) (*dvnet.AssertionReport, error) {
+	report := &dvnet.AssertionReport{}
+	if err := c.do(ctx, http.MethodPost, "networks/"+url.PathEscape(network)+"/assertions", suite, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// CheckRoutes compares the routing tables of a network's nodes with what they should hold.
+func (c *Client) CheckRoutes(ctx context.Context, network string) (*dvnet.RouteReport, error) {
+	report := &dvnet.RouteReport{}
+	if err := c.do(ctx, http.MethodGet, "networks/"+url.PathEscape(network)+"/routes", nil, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// DetectDrift looks for differences between a network and the kernel and Docker state of its host.
+func (c *Client) DetectDrift(ctx context.Context, network string) (*dvnet.DriftReport, error) {
+	report := &dvnet.DriftReport{}
+	if err := c.do(ctx, http.MethodGet, "networks/"+url.PathEscape(network)+"/drift", nil, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// do sends body (if any) as JSON to the given path and decodes the response into out (if any).
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		rawBody, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(rawBody)
+	}
+
+	// The host is ignored as we always dial the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://dvnet/v1/"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpCli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr dvnet.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			apiErr.Error = resp.Status
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: apiErr.Error}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
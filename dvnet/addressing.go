@@ -31,20 +31,35 @@ func newSubnetAddresser(ns *NetworkState, subnetName string, subnetBlock net.IPN
 	ns.Addressers[subnetName] = subnetAddresser{
 		cidrBlock: subnetBlock, currentIP: make(net.IP, len(subnetBlock.IP)), AssignedIPs: map[string]net.IP{}}
 	copy(ns.Addressers[subnetName].currentIP, subnetBlock.IP)
+	// A /31 has no network nor broadcast addresses (RFC 3021): both of its
+	// addresses are handed out, so start right before the first one.
+	if ones, bits := subnetBlock.Mask.Size(); bits-ones == 1 {
+		currentIP := ns.Addressers[subnetName].currentIP
+		binary.BigEndian.PutUint32(currentIP, binary.BigEndian.Uint32(currentIP)-1)
+	}
 	return ns.Addressers[subnetName], nil
 }
 
 func (sA subnetAddresser) nextIP(hostName string) string {
 	binary.BigEndian.PutUint32(sA.currentIP, binary.BigEndian.Uint32(sA.currentIP)+1)
-	sA.AssignedIPs[hostName] = sA.currentIP
-	return sA.currentIP.String()
+	// Hand out a copy: currentIP will keep on changing as we go.
+	assignedIP := make(net.IP, len(sA.currentIP))
+	copy(assignedIP, sA.currentIP)
+	sA.AssignedIPs[hostName] = assignedIP
+	return assignedIP.String()
+}
+
+// release forgets the address assigned to hostName. Addresses
+// are not reused: we'll just keep on handing out new ones.
+func (sA subnetAddresser) release(hostName string) {
+	delete(sA.AssignedIPs, hostName)
 }
 
 func (sA subnetAddresser) nextCIDR(hostName string) string {
 	return fmt.Sprintf("%s/%s", sA.nextIP(hostName), strings.Split(sA.cidrBlock.String(), "/")[1])
 }
 
-func addressContainer(cidr string, iface netlink.Link, containerPID int) error {
+func (linuxBackend) addressContainer(cidr string, iface netlink.Link, containerPID int) error {
 	netlinkCIDR, err := netlink.ParseAddr(cidr)
 	if err != nil {
 		return err
@@ -75,7 +90,11 @@ func addressContainer(cidr string, iface netlink.Link, containerPID int) error {
 }
 
 func dumpAddressAssignments(ns *NetworkState, path string) error {
-	addressers, err := json.Marshal(ns.Addressers)
+	assignments := map[string]struct{ AssignedIPs map[string]net.IP }{}
+	for subnetName, addresser := range ns.Addressers {
+		assignments[subnetName] = struct{ AssignedIPs map[string]net.IP }{addresser.AssignedIPs}
+	}
+	addressers, err := json.Marshal(assignments)
 	if err != nil {
 		return err
 	}
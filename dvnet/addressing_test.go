@@ -2,6 +2,8 @@ package dvnet
 
 import (
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestAddresserInstantiation(t *testing.T) {
@@ -13,12 +15,36 @@ func TestAddresserInstantiation(t *testing.T) {
 		{"10.0.0.0/24", "10.0.0.1/24"},
 	}
 
-	ns := NetworkState{}
-
 	for _, test := range tests {
-		addresser, _ := newSubnetAddresser(&ns, "addresserTest", cidrParserWrapper(test.in))
+		ns := newNetworkState(newPlanBackend(), globalOpts{})
+		addresser, err := newSubnetAddresser(ns, "addresserTest", cidrParserWrapper(test.in))
+		if err != nil {
+			t.Fatalf("newSubnetAddresser(%s) err %v", test.in, err)
+		}
 		if nextCIDR := addresser.nextCIDR("dummy-host"); nextCIDR != test.want {
 			t.Errorf("nextCIDR(%s); netDef = %s; wanted %s", test.in, nextCIDR, test.want)
 		}
 	}
 }
+
+func TestP2PAddressing(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"10.0.2.0/31", []string{"10.0.2.0/31", "10.0.2.1/31"}},
+		{"10.0.2.4/30", []string{"10.0.2.5/30", "10.0.2.6/30"}},
+	}
+
+	for _, test := range tests {
+		ns := NetworkState{Addressers: map[string]subnetAddresser{}}
+		addresser, err := newSubnetAddresser(&ns, "p2p", cidrParserWrapper(test.in))
+		if err != nil {
+			t.Fatalf("newSubnetAddresser(%s) err %v", test.in, err)
+		}
+		got := []string{addresser.nextCIDR("R-1"), addresser.nextCIDR("R-2")}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("nextCIDR() on %s = %v; wanted %v", test.in, got, test.want)
+		}
+	}
+}
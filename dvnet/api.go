@@ -0,0 +1,334 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	apiSocketEnv string = "DVNET_API_SOCKET"
+	apiPrefix    string = "/v1/"
+)
+
+// DefaultAPISocket is where the control API listens unless told otherwise
+// through the DVNET_API_SOCKET environment variable.
+var DefaultAPISocket string = "/run/dvnet/api.sock"
+
+// APISocket returns the path to the control API's Unix socket.
+func APISocket() string {
+	if envSocket := os.Getenv(apiSocketEnv); envSocket != "" {
+		return envSocket
+	}
+	return DefaultAPISocket
+}
+
+// APIError is the body of every unsuccessful response of the control API.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// LinkStateRequest is the body of requests altering the
+// administrative state of a link or of every link of a node.
+type LinkStateRequest struct {
+	Up bool `json:"up"`
+}
+
+// ServeAPI serves the control API over the Unix socket at socketPath.
+// The API is versioned: every endpoint lives under /v1/.
+//
+//	GET    /v1/networks                            summary of every network
+//	GET    /v1/networks/<network>                  subnets, nodes and links of a network
+//	GET    /v1/networks/<network>/state            the network's whole NetworkState
+//	POST   /v1/networks/<network>/nodes            add the node described by a NodeRequest
+//	PUT    /v1/networks/<network>/nodes/<node>     set every link of a node up or down given a LinkStateRequest
+//	DELETE /v1/networks/<network>/nodes/<node>     remove a node
+//	PUT    /v1/networks/<network>/links/<node>/<subnet>  set a link up or down given a LinkStateRequest
+//	PUT    /v1/networks/<network>/links/<node>/<subnet>/impairments  impair a link as described by LinkImpairments
+//	GET    /v1/networks/<network>/captures         the network's running captures
+//	POST   /v1/networks/<network>/captures         start the capture described by a CaptureRequest
+//	DELETE /v1/networks/<network>/captures/<id>    stop a capture
+//	POST   /v1/networks/<network>/connectivity     probe every node from every host as told by ConnectivityOptions
+//	POST   /v1/networks/<network>/assertions       check the network against an AssertionSuite
+//	GET    /v1/networks/<network>/routes           compare the routing tables of the network's nodes with what they should hold
+//	GET    /v1/networks/<network>/drift            look for differences between the network and the host's state
+//
+// Networks can be referred to by name, ID or ID prefix.
+func (d Driver) ServeAPI(socketPath string) error {
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+
+	log.info("serving the control API on %s\n", socketPath)
+	return http.Serve(listener, d.apiHandler())
+}
+
+// listen listens on addr, taking absolute paths as Unix sockets
+// and anything else as TCP addresses.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "/") {
+		return listenUnix(addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a Unix socket at socketPath only root and its group can use.
+func listenUnix(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create the directory for socket %s: %w", socketPath, err)
+	}
+	// Get rid of sockets left behind by previous instances.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (d Driver) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"networks", d.handleNetworks)
+	mux.HandleFunc(apiPrefix+"networks/", d.handleNetwork)
+	return mux
+}
+
+func (d Driver) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed on %s", r.Method, r.URL.Path))
+		return
+	}
+	statuses, err := d.Status()
+	if err != nil {
+		writeAPIError(w, apiErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleNetwork dispatches requests under /v1/networks/<network>/.
+func (d Driver) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	// Split the escaped path so that names holding slashes stay in one piece.
+	path := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix+"networks/"), "/")
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("malformed path %s: %w", r.URL.EscapedPath(), err))
+			return
+		}
+		segments[i] = unescaped
+	}
+	network, resource := segments[0], segments[1:]
+
+	notAllowed := func() {
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed on %s", r.Method, r.URL.Path))
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+	status := http.StatusOK
+
+	switch {
+	case network == "":
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no network given"))
+		return
+
+	case len(resource) == 0:
+		if r.Method != http.MethodGet {
+			notAllowed()
+			return
+		}
+		result, err = d.Inspect(network)
+
+	case len(resource) == 1 && resource[0] == "state":
+		if r.Method != http.MethodGet {
+			notAllowed()
+			return
+		}
+		result, err = d.State(network)
+
+	case len(resource) == 1 && resource[0] == "nodes":
+		if r.Method != http.MethodPost {
+			notAllowed()
+			return
+		}
+		var req NodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("couldn't decode the node: %w", err))
+			return
+		}
+		status = http.StatusCreated
+		if err = d.AddNode(network, req); err == nil {
+			result, err = d.Inspect(network)
+		}
+
+	case len(resource) == 2 && resource[0] == "nodes":
+		switch r.Method {
+		case http.MethodDelete:
+			status, err = http.StatusNoContent, d.RemoveNode(network, resource[1])
+		case http.MethodPut:
+			var req LinkStateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("couldn't decode the node state: %w", err))
+				return
+			}
+			status, err = http.StatusNoContent, d.SetNodeState(network, resource[1], req.Up)
+		default:
+			notAllowed()
+			return
+		}
+
+	case len(resource) == 3 && resource[0] == "links":
+		if r.Method != http.MethodPut {
+			notAllowed()
+			return
+		}
+		var req LinkStateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("couldn't decode the link state: %w", err))
+			return
+		}
+		status, err = http.StatusNoContent, d.SetLinkState(network, resource[1], resource[2], req.Up)
+
+	case len(resource) == 4 && resource[0] == "links" && resource[3] == "impairments":
+		if r.Method != http.MethodPut {
+			notAllowed()
+			return
+		}
+		var li LinkImpairments
+		if err := json.NewDecoder(r.Body).Decode(&li); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("couldn't decode the impairments: %w", err))
+			return
+		}
+		status, err = http.StatusNoContent, d.SetLinkImpairments(network, resource[1], resource[2], &li)
+
+	case len(resource) == 1 && resource[0] == "captures":
+		switch r.Method {
+		case http.MethodGet:
+			result, err = d.Captures(network)
+		case http.MethodPost:
+			var req CaptureRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("couldn't decode the capture: %w", err))
+				return
+			}
+			status = http.StatusCreated
+			result, err = d.StartCapture(network, req)
+		default:
+			notAllowed()
+			return
+		}
+
+	case len(resource) == 2 && resource[0] == "captures":
+		if r.Method != http.MethodDelete {
+			notAllowed()
+			return
+		}
+		result, err = d.StopCapture(network, resource[1])
+
+	case len(resource) == 1 && resource[0] == "connectivity":
+		if r.Method != http.MethodPost {
+			notAllowed()
+			return
+		}
+		var opts ConnectivityOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("couldn't decode the connectivity options: %w", err))
+			return
+		}
+		result, err = d.CheckConnectivity(network, opts)
+
+	case len(resource) == 1 && resource[0] == "assertions":
+		if r.Method != http.MethodPost {
+			notAllowed()
+			return
+		}
+		var suite AssertionSuite
+		if err := json.NewDecoder(r.Body).Decode(&suite); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("couldn't decode the assertions: %w", err))
+			return
+		}
+		result, err = d.RunAssertions(network, suite)
+
+	case len(resource) == 1 && resource[0] == "routes":
+		if r.Method != http.MethodGet {
+			notAllowed()
+			return
+		}
+		result, err = d.CheckRoutes(network)
+
+	case len(resource) == 1 && resource[0] == "drift":
+		if r.Method != http.MethodGet {
+			notAllowed()
+			return
+		}
+		result, err = d.DetectDrift(network)
+
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown resource %s", r.URL.Path))
+		return
+	}
+
+	if err != nil {
+		writeAPIError(w, apiErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, status, result)
+}
+
+// State returns the whole state of the network with the given name, ID or ID prefix.
+func (d Driver) State(network string) (*NetworkState, error) {
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	return d.network(networkID)
+}
+
+func apiErrorStatus(err error) int {
+	var (
+		nfErr  notFoundError
+		invErr invalidError
+	)
+	if errors.As(err, &nfErr) {
+		return http.StatusNotFound
+	}
+	if errors.As(err, &invErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.error("couldn't encode the API response: %v\n", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, APIError{Error: err.Error()})
+}
@@ -0,0 +1,131 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testDriver returns a Driver working on a throwaway store through a planBackend
+// with the quagga demo network already up.
+func testDriver(t *testing.T) (Driver, *planBackend) {
+	t.Helper()
+	t.Setenv(stateDirEnv, t.TempDir())
+	store, err := newStateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb := newPlanBackend()
+	d := Driver{backend: pb, store: store, mu: &sync.Mutex{}, captures: newCaptureSet(), metrics: newDriverMetrics()}
+
+	rawDef, err := os.ReadFile("../demos/quagga/net.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defPath := filepath.Join(t.TempDir(), "net.json")
+	if err := os.WriteFile(defPath, rawDef, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.createNetwork("0123456789abcdef", originCLI, globalOpts{netDefPath: defPath}); err != nil {
+		t.Fatalf("createNetwork() err %v", err)
+	}
+	return d, pb
+}
+
+func TestAPI(t *testing.T) {
+	d, pb := testDriver(t)
+	srv := httptest.NewServer(d.apiHandler())
+	defer srv.Close()
+
+	request := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Names can hold slashes as long as they're escaped.
+	other, err := d.store.load("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Definition.Name = "Lab/1"
+	if err := d.store.save("fedcba9876543210", other); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, body string
+		wantStatus         int
+	}{
+		{http.MethodGet, "/v1/networks/Test Net 0", "", http.StatusOK},
+		{http.MethodGet, "/v1/networks/Lab%2F1/state", "", http.StatusOK},
+		{http.MethodGet, "/v1/networks/Lab/1/state", "", http.StatusNotFound},
+		{http.MethodGet, "/v1/networks/0123", "", http.StatusOK},
+		{http.MethodGet, "/v1/networks/0123/state", "", http.StatusOK},
+		{http.MethodGet, "/v1/networks/nope", "", http.StatusNotFound},
+		{http.MethodGet, "/v1/networks/0123/bogus", "", http.StatusNotFound},
+		{http.MethodDelete, "/v1/networks/0123", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v1/networks/0123/nodes", `{"name": "A-3", "kind": "host", "subnet": "Z"}`, http.StatusNotFound},
+		{http.MethodPost, "/v1/networks/0123/nodes", `{"name": "A-1", "kind": "host", "subnet": "A"}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/networks/0123/nodes", `{"name": "A-3"`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/networks/0123/nodes", `{"name": "A-3", "kind": "host", "subnet": "A", "image": "pcollado/dhost"}`, http.StatusCreated},
+		{http.MethodPut, "/v1/networks/0123/links/A-1/A", `{"up": false}`, http.StatusNoContent},
+		{http.MethodPut, "/v1/networks/0123/links/A-1/B", `{"up": false}`, http.StatusNotFound},
+		{http.MethodDelete, "/v1/networks/0123/nodes/R-9", "", http.StatusNotFound},
+		{http.MethodPost, "/v1/networks/0123/connectivity", `{"timeout": "soon"}`, http.StatusBadRequest},
+		{http.MethodGet, "/v1/networks/0123/connectivity", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v1/networks/0123/assertions", `{"assertions": ["A-1 has route to 10.0.0.0/24"]}`, http.StatusOK},
+		{http.MethodPost, "/v1/networks/0123/assertions", `{"assertions": ["A-1 likes B-1"]}`, http.StatusBadRequest},
+		{http.MethodGet, "/v1/networks/0123/routes", "", http.StatusOK},
+		{http.MethodPost, "/v1/networks/0123/routes", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v1/networks/0123/drift", "", http.StatusOK},
+		{http.MethodPut, "/v1/networks/0123/drift", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		resp := request(tt.method, tt.path, tt.body)
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s %s got status %d; wanted %d", tt.method, tt.path, resp.StatusCode, tt.wantStatus)
+		}
+	}
+
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, ok := ns.Links[linkKey("A-3", "A")]; !ok || link.CIDR != "10.0.0.4/24" {
+		t.Errorf("A-3 should have been plugged into A with 10.0.0.4/24; got %+v", link)
+	}
+	if _, ok := ns.Definition.Subnets["A"].Hosts["A-3"]; !ok {
+		t.Errorf("A-3 should have been added to the network's definition")
+	}
+	if !contains(pb.plan.Steps, "set bth-a-1 down") {
+		t.Errorf("A-1's link should have been set down")
+	}
+
+	if resp := request(http.MethodDelete, "/v1/networks/0123/nodes/A-3", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE A-3 got status %d; wanted %d", resp.StatusCode, http.StatusNoContent)
+	}
+	var info NetworkInfo
+	resp := request(http.MethodGet, "/v1/networks/0123", "")
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range info.Nodes {
+		if node.Name == "A-3" {
+			t.Errorf("A-3 should have been removed")
+		}
+	}
+}
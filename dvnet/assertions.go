@@ -0,0 +1,539 @@
+package dvnet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Kinds of assertions.
+const (
+	assertReach   string = "reach"
+	assertNoReach string = "no reach"
+	assertTrace   string = "traceroute"
+	assertRoute   string = "route"
+	assertNoRoute string = "no route"
+)
+
+// maxTraceHops is how far traceroutes go before giving up.
+const maxTraceHops = 16
+
+// AssertionSuite is a list of expectations about a running network, as read
+// from an assertions file. Every assertion is a sentence such as:
+//
+//	A-1 can reach B-2 tcp/22
+//	B-1 cannot reach A-2 icmp
+//	traceroute A-1 -> B-1 goes through R-1, R-2
+//	R-1 has route to 10.0.1.0/24 via R-2
+//
+// Targets are nodes or addresses. Reaching a node means reaching every
+// one of its addresses, over ICMP unless a TCP port is given. Timeout is
+// how long each probe waits for an answer, e.g. 500ms.
+type AssertionSuite struct {
+	Name       string   `json:"name"`
+	Timeout    string   `json:"timeout,omitempty"`
+	Assertions []string `json:"assertions"`
+
+	timeout time.Duration
+	parsed  []assertion
+}
+
+// assertion is what one of the sentences of a suite boils down to.
+type assertion struct {
+	kind    string
+	from    string
+	target  string
+	service probeTarget
+	through []string
+	dst     string
+	gw      string
+}
+
+// AssertionsPath returns where the assertions for the network defined at defPath live by default.
+func AssertionsPath(defPath string) string {
+	return strings.TrimSuffix(defPath, filepath.Ext(defPath)) + ".tests.json"
+}
+
+// LoadAssertions reads and validates the assertions file at path.
+func LoadAssertions(path string) (AssertionSuite, error) {
+	rawSuite, err := os.ReadFile(path)
+	if err != nil {
+		return AssertionSuite{}, err
+	}
+	var suite AssertionSuite
+	if err := json.Unmarshal(rawSuite, &suite); err != nil {
+		return AssertionSuite{}, err
+	}
+	return suite, suite.validate()
+}
+
+// validate parses every assertion of the suite.
+func (suite *AssertionSuite) validate() error {
+	suite.timeout = DefaultProbeTimeout
+	if suite.Timeout != "" {
+		timeout, err := time.ParseDuration(suite.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid probe timeout %q", suite.Timeout)
+		}
+		suite.timeout = timeout
+	}
+
+	suite.parsed = []assertion{}
+	for i, text := range suite.Assertions {
+		a, err := parseAssertion(text)
+		if err != nil {
+			return fmt.Errorf("assertion %d (%q): %w", i, text, err)
+		}
+		suite.parsed = append(suite.parsed, a)
+	}
+	return nil
+}
+
+func parseAssertion(text string) (assertion, error) {
+	words := strings.Fields(strings.NewReplacer("→", " -> ", ",", " ").Replace(text))
+	switch {
+	case len(words) >= 4 && words[0] == "traceroute" && words[2] == "->":
+		return parseTraceAssertion(words)
+	case len(words) >= 4 && words[1] == "can" && words[2] == "reach":
+		return parseReachAssertion(assertReach, words[0], words[3:])
+	case len(words) >= 4 && words[1] == "cannot" && words[2] == "reach":
+		return parseReachAssertion(assertNoReach, words[0], words[3:])
+	case len(words) >= 5 && words[1] == "has" && words[2] == "route" && words[3] == "to":
+		return parseRouteAssertion(assertRoute, words[0], words[4:])
+	case len(words) >= 6 && words[1] == "has" && words[2] == "no" && words[3] == "route" && words[4] == "to":
+		return parseRouteAssertion(assertNoRoute, words[0], words[5:])
+	}
+	return assertion{}, errors.New(`it should look like "<node> can|cannot reach <node|address> [icmp|tcp/<port>]",` +
+		` "traceroute <node> -> <node|address> goes through <router>, ..." or "<node> has [no] route to <CIDR> [via <node|address>]"`)
+}
+
+// parseReachAssertion parses what follows "can reach" or "cannot reach".
+func parseReachAssertion(kind, from string, words []string) (assertion, error) {
+	a := assertion{kind: kind, from: from, target: words[0], service: probeTarget{Protocol: ProbeICMP}}
+	switch {
+	case len(words) == 1:
+	case len(words) == 2 && words[1] == ProbeICMP:
+	case len(words) == 2 && strings.HasPrefix(words[1], ProbeTCP+"/"):
+		port, err := strconv.Atoi(strings.TrimPrefix(words[1], ProbeTCP+"/"))
+		if err != nil || port <= 0 || port > 65535 {
+			return assertion{}, fmt.Errorf("invalid TCP port in %s", words[1])
+		}
+		a.service = probeTarget{Protocol: ProbeTCP, Port: port}
+	default:
+		return assertion{}, fmt.Errorf("unknown service %s: it should be icmp or tcp/<port>", strings.Join(words[1:], " "))
+	}
+	return a, nil
+}
+
+// parseTraceAssertion parses a whole "traceroute" sentence.
+// Going "directly" means there are no hops in between.
+func parseTraceAssertion(words []string) (assertion, error) {
+	a := assertion{kind: assertTrace, from: words[1], target: words[3], through: []string{}}
+	switch {
+	case len(words) == 6 && words[4] == "goes" && words[5] == "directly":
+	case len(words) >= 7 && words[4] == "goes" && words[5] == "through":
+		a.through = words[6:]
+	default:
+		return assertion{}, errors.New(`traceroutes should go on with "goes through <router>, ..." or "goes directly"`)
+	}
+	return a, nil
+}
+
+// parseRouteAssertion parses what follows "has route to" or "has no route to".
+func parseRouteAssertion(kind, from string, words []string) (assertion, error) {
+	_, dst, err := net.ParseCIDR(words[0])
+	if err != nil {
+		return assertion{}, fmt.Errorf("invalid destination %s: it should be a CIDR such as 10.0.1.0/24", words[0])
+	}
+	a := assertion{kind: kind, from: from, dst: dst.String()}
+	switch {
+	case len(words) == 1:
+	case len(words) == 3 && words[1] == "via":
+		a.gw = words[2]
+	default:
+		return assertion{}, errors.New(`routes can only be followed by "via <node|address>"`)
+	}
+	return a, nil
+}
+
+// AssertionResult is the outcome of checking an assertion. Message tells
+// what was found, whether that's what was asserted or not.
+type AssertionResult struct {
+	Assertion  string  `json:"assertion"`
+	Passed     bool    `json:"passed"`
+	Message    string  `json:"message"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// AssertionReport holds the outcome of checking a suite against a network.
+type AssertionReport struct {
+	Suite   string            `json:"suite"`
+	Network string            `json:"network"`
+	Results []AssertionResult `json:"results"`
+}
+
+// Failed returns the results of the assertions which didn't hold.
+func (ar *AssertionReport) Failed() []AssertionResult {
+	failed := []AssertionResult{}
+	for _, res := range ar.Results {
+		if !res.Passed {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// RunAssertions checks every assertion of the suite against the network with
+// the given name, ID or ID prefix. Like connectivity checks, probes and
+// traceroutes run in the nodes' network namespaces, so their images need
+// no tools of their own.
+func (d Driver) RunAssertions(network string, suite AssertionSuite) (*AssertionReport, error) {
+	if err := suite.validate(); err != nil {
+		return nil, invalidError{err}
+	}
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return nil, err
+	}
+	return runAssertions(ns, suite), nil
+}
+
+// runAssertions checks the assertions of a validated suite concurrently.
+func runAssertions(ns *NetworkState, suite AssertionSuite) *AssertionReport {
+	report := &AssertionReport{Suite: suite.Name, Network: ns.Definition.Name, Results: make([]AssertionResult, len(suite.parsed))}
+	slots := make(chan struct{}, probeParallelism)
+	var wg sync.WaitGroup
+	for i, a := range suite.parsed {
+		report.Results[i].Assertion = suite.Assertions[i]
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(res *AssertionResult, a assertion) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			start := time.Now()
+			res.Passed, res.Message = checkAssertion(ns, a, suite.timeout)
+			res.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+			ns.log().with("node", a.from).debug("checked %q: passed %t: %s\n", res.Assertion, res.Passed, res.Message)
+		}(&report.Results[i], a)
+	}
+	wg.Wait()
+	return report
+}
+
+// checkAssertion tells whether a holds on the network and what was found.
+func checkAssertion(ns *NetworkState, a assertion, timeout time.Duration) (bool, string) {
+	pid, ok := ns.nodePID(a.from)
+	if !ok {
+		return false, errUnknownNode(a.from).Error()
+	}
+
+	switch a.kind {
+	case assertReach, assertNoReach:
+		addrs, err := targetAddrs(ns, a.target)
+		if err != nil {
+			return false, err.Error()
+		}
+		return checkReach(ns, pid, a, addrs, timeout)
+	case assertTrace:
+		addrs, err := targetAddrs(ns, a.target)
+		if err != nil {
+			return false, err.Error()
+		}
+		return checkTrace(ns, pid, a, addrs[0], timeout)
+	}
+	return checkRoute(ns, pid, a)
+}
+
+// targetAddrs returns the addresses of target, which is either a node or an address.
+func targetAddrs(ns *NetworkState, target string) ([]string, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	addrs, ok := nodeAddrs(ns)[target]
+	if !ok {
+		return nil, fmt.Errorf("%s is neither an address nor a node with one", target)
+	}
+	return addrs, nil
+}
+
+func checkReach(ns *NetworkState, pid int, a assertion, addrs []string, timeout time.Duration) (bool, string) {
+	service := ProbeResult{Protocol: a.service.Protocol, Port: a.service.Port}.Service()
+	reached, unreached := []string{}, []string{}
+	for _, addr := range addrs {
+		target := a.service
+		target.Address = addr
+		rtt, err := ns.backend.probe(pid, target, timeout)
+		switch {
+		case errors.Is(err, errProbeRefused):
+			reached = append(reached, fmt.Sprintf("%s in %s, but the connection was refused", addr, rtt.Round(time.Microsecond)))
+		case err == nil:
+			reached = append(reached, fmt.Sprintf("%s in %s", addr, rtt.Round(time.Microsecond)))
+		default:
+			unreached = append(unreached, fmt.Sprintf("%s: %v", addr, err))
+		}
+	}
+
+	if a.kind == assertReach {
+		if len(unreached) > 0 {
+			return false, fmt.Sprintf("couldn't reach %s over %s", strings.Join(unreached, "; "), service)
+		}
+		return true, fmt.Sprintf("reached %s over %s", strings.Join(reached, "; "), service)
+	}
+	if len(reached) > 0 {
+		return false, fmt.Sprintf("reached %s over %s", strings.Join(reached, "; "), service)
+	}
+	return true, fmt.Sprintf("couldn't reach %s over %s", strings.Join(addrs, ", "), service)
+}
+
+// checkTrace traces the route to addr and names the nodes answering on the way.
+func checkTrace(ns *NetworkState, pid int, a assertion, addr string, timeout time.Duration) (bool, string) {
+	owners := map[string]string{}
+	for _, link := range ns.Links {
+		if link.CIDR != "" {
+			owners[strings.Split(link.CIDR, "/")[0]] = link.Node
+		}
+	}
+	hops, err := ns.backend.traceroute(pid, addr, maxTraceHops, timeout)
+	names := []string{}
+	for _, hop := range hops {
+		switch {
+		case hop == "":
+			names = append(names, "*")
+		case owners[hop] != "":
+			names = append(names, owners[hop])
+		default:
+			names = append(names, hop)
+		}
+	}
+	if err != nil {
+		if len(names) == 0 {
+			return false, fmt.Sprintf("traceroute to %s failed: %v", addr, err)
+		}
+		return false, fmt.Sprintf("traceroute to %s failed after going through %s: %v", addr, strings.Join(names, ", "), err)
+	}
+
+	// The last hop is the target itself.
+	through := names[:len(names)-1]
+	path := "directly"
+	if len(through) > 0 {
+		path = "through " + strings.Join(through, ", ")
+	}
+	if strings.Join(through, " ") != strings.Join(a.through, " ") {
+		return false, fmt.Sprintf("went to %s %s", addr, path)
+	}
+	return true, fmt.Sprintf("went to %s %s", addr, path)
+}
+
+func checkRoute(ns *NetworkState, pid int, a assertion) (bool, string) {
+	gws := []string{}
+	if a.gw != "" {
+		var err error
+		if gws, err = targetAddrs(ns, a.gw); err != nil {
+			return false, err.Error()
+		}
+	}
+	routes, err := ns.backend.routes(pid)
+	if err != nil {
+		return false, fmt.Sprintf("couldn't read the routing table: %v", err)
+	}
+
+	found := []routeInfo{}
+	for _, route := range routes {
+		if route.Dst == a.dst && (len(gws) == 0 || contains(gws, route.Gw)) {
+			found = append(found, route)
+		}
+	}
+	if a.kind == assertRoute {
+		if len(found) == 0 {
+			return false, fmt.Sprintf("no route to %s among %s", a.dst, describeRoutes(routes))
+		}
+		return true, fmt.Sprintf("found %s", describeRoutes(found))
+	}
+	if len(found) > 0 {
+		return false, fmt.Sprintf("found %s", describeRoutes(found))
+	}
+	return true, fmt.Sprintf("no route to %s among %s", a.dst, describeRoutes(routes))
+}
+
+func describeRoutes(routes []routeInfo) string {
+	if len(routes) == 0 {
+		return "no routes"
+	}
+	described := []string{}
+	for _, route := range routes {
+		if route.Gw == "" {
+			described = append(described, route.Dst+" (directly connected)")
+		} else {
+			described = append(described, route.Dst+" via "+route.Gw)
+		}
+	}
+	return strings.Join(described, ", ")
+}
+
+// Write writes the report in the given format.
+func (ar *AssertionReport) Write(w io.Writer, format string) error {
+	return writeReport(w, format, ar, ar.WriteText, ar.WriteJUnit)
+}
+
+// WriteText writes a line per assertion telling whether it held and what was found.
+func (ar *AssertionReport) WriteText(w io.Writer) error {
+	for _, res := range ar.Results {
+		verdict := "PASS"
+		if !res.Passed {
+			verdict = "FAIL"
+		}
+		if _, err := fmt.Fprintf(w, "%s %s: %s\n", verdict, res.Assertion, res.Message); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d assertions, %d failed\n", len(ar.Results), len(ar.Failed()))
+	return err
+}
+
+// WriteJUnit writes the report as a JUnit XML test suite
+// where every assertion is a test case.
+func (ar *AssertionReport) WriteJUnit(w io.Writer) error {
+	name := ar.Suite
+	if name == "" {
+		name = "assertions"
+	}
+	suite := junitSuite{Name: name + " on " + ar.Network, Cases: []junitCase{}}
+	for _, res := range ar.Results {
+		c := junitCase{Name: res.Assertion, ClassName: ar.Network, Time: fmt.Sprintf("%.6f", res.DurationMS/1000)}
+		if !res.Passed {
+			c.Failure = &junitFailure{Message: res.Message, Type: "failed assertion"}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	return writeJUnit(w, suite)
+}
+
+// traceroute sends ICMP echo requests to addr from within the network namespace
+// of the container whose PID is containerPID, with increasing TTLs. It returns
+// the address of every hop, the last one being addr itself, and an empty string
+// for those which didn't answer.
+func (linuxBackend) traceroute(containerPID int, addr string, maxHops int, timeout time.Duration) ([]string, error) {
+	var hops []string
+	err := inContainerNS(containerPID, func() error {
+		var err error
+		hops, err = traceICMP(addr, maxHops, timeout)
+		return err
+	})
+	return hops, err
+}
+
+func traceICMP(addr string, maxHops int, timeout time.Duration) ([]string, error) {
+	dst := net.ParseIP(addr)
+	if dst == nil {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open an ICMP socket: %w", err)
+	}
+	defer conn.Close()
+
+	hops := []string{}
+	buf := make([]byte, 1500)
+	id := os.Getpid() & 0xffff
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := conn.IPv4PacketConn().SetTTL(ttl); err != nil {
+			return hops, err
+		}
+		seq := int(atomic.AddUint32(&probeSeq, 1) & 0xffff)
+		request, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("dvnet")}}).Marshal(nil)
+		if err != nil {
+			return hops, err
+		}
+		if _, err := conn.WriteTo(request, &net.IPAddr{IP: dst}); err != nil {
+			return hops, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return hops, err
+		}
+
+		hop, last, err := awaitHop(conn, buf, dst, id, seq)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			hops = append(hops, "")
+			continue
+		} else if err != nil {
+			return hops, err
+		}
+		hops = append(hops, hop)
+		if last {
+			if hop != dst.String() {
+				return hops, fmt.Errorf("%s is unreachable", addr)
+			}
+			return hops, nil
+		}
+	}
+	return hops, fmt.Errorf("%s wasn't reached within %d hops", addr, maxHops)
+}
+
+// awaitHop waits for the answer to the echo request with the given ID and
+// sequence number. It returns who answered and whether that's the end of the
+// road: either the destination replied or someone found it unreachable.
+func awaitHop(conn *icmp.PacketConn, buf []byte, dst net.IP, id, seq int) (string, bool, error) {
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", false, err
+		}
+		peerAddr, ok := peer.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		// Raw sockets get every ICMP message, so others' have to be skipped.
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			continue
+		}
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type == ipv4.ICMPTypeEchoReply && body.ID == id && body.Seq == seq && peerAddr.IP.Equal(dst) {
+				return peerAddr.IP.String(), true, nil
+			}
+		case *icmp.TimeExceeded:
+			if quotesEcho(body.Data, id, seq) {
+				return peerAddr.IP.String(), false, nil
+			}
+		case *icmp.DstUnreach:
+			if quotesEcho(body.Data, id, seq) {
+				return peerAddr.IP.String(), true, nil
+			}
+		}
+	}
+}
+
+// quotesEcho tells whether data, the start of the datagram an ICMP error is
+// about, holds our echo request with the given ID and sequence number.
+func quotesEcho(data []byte, id, seq int) bool {
+	if len(data) < ipv4.HeaderLen {
+		return false
+	}
+	hdrLen := int(data[0]&0x0f) * 4
+	if len(data) < hdrLen+8 || data[hdrLen] != byte(ipv4.ICMPTypeEcho) {
+		return false
+	}
+	return int(binary.BigEndian.Uint16(data[hdrLen+4:])) == id && int(binary.BigEndian.Uint16(data[hdrLen+6:])) == seq
+}
@@ -0,0 +1,152 @@
+package dvnet
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// traceBackend is a probeBackend whose traceroutes go along the hops returned by trace.
+type traceBackend struct {
+	probeBackend
+	trace func(containerPID int, addr string) ([]string, error)
+}
+
+func (tb traceBackend) traceroute(containerPID int, addr string, maxHops int, timeout time.Duration) ([]string, error) {
+	return tb.trace(containerPID, addr)
+}
+
+func TestParseAssertion(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    assertion
+		wantErr bool
+	}{
+		{"A-1 can reach B-2 tcp/22", assertion{kind: assertReach, from: "A-1", target: "B-2", service: probeTarget{Protocol: ProbeTCP, Port: 22}}, false},
+		{"B-1 cannot reach 10.0.0.2", assertion{kind: assertNoReach, from: "B-1", target: "10.0.0.2", service: probeTarget{Protocol: ProbeICMP}}, false},
+		{"traceroute A-1 → B-1 goes through R-1, R-2", assertion{kind: assertTrace, from: "A-1", target: "B-1", through: []string{"R-1", "R-2"}}, false},
+		{"traceroute A-1 -> A-2 goes directly", assertion{kind: assertTrace, from: "A-1", target: "A-2", through: []string{}}, false},
+		{"R-1 has route to 10.0.1.7/24 via R-2", assertion{kind: assertRoute, from: "R-1", dst: "10.0.1.0/24", gw: "R-2"}, false},
+		{"R-1 has no route to 0.0.0.0/0", assertion{kind: assertNoRoute, from: "R-1", dst: "0.0.0.0/0"}, false},
+		{"A-1 can reach B-2 udp/53", assertion{}, true},
+		{"A-1 can reach B-2 tcp/99999", assertion{}, true},
+		{"traceroute A-1 -> B-1 goes somewhere", assertion{}, true},
+		{"R-1 has route to B", assertion{}, true},
+		{"A-1 likes B-1", assertion{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAssertion(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAssertion(%q) err %v; wanted error %t", tt.text, err, tt.wantErr)
+			continue
+		}
+		if !cmp.Equal(got, tt.want, cmp.AllowUnexported(assertion{}, probeTarget{})) {
+			t.Errorf("parseAssertion(%q) = %+v; wanted %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLoadAssertions(t *testing.T) {
+	suite, err := LoadAssertions(AssertionsPath("../demos/quagga/net.json"))
+	if err != nil {
+		t.Fatalf("LoadAssertions() err %v", err)
+	}
+	if len(suite.parsed) != len(suite.Assertions) || suite.timeout != 500*time.Millisecond {
+		t.Errorf("LoadAssertions() parsed %d of %d assertions with a timeout of %s", len(suite.parsed), len(suite.Assertions), suite.timeout)
+	}
+}
+
+func TestRunAssertions(t *testing.T) {
+	d, pb := testDriver(t)
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrOf := func(node, subnet string) string {
+		return strings.Split(ns.Links[linkKey(node, subnet)].CIDR, "/")[0]
+	}
+
+	// Everything answers but B-1, which A-2 can't reach. TCP ports are all closed.
+	pidA2, _ := ns.nodePID("A-2")
+	d.backend = traceBackend{
+		probeBackend{pb, func(containerPID int, target probeTarget) (time.Duration, error) {
+			if containerPID == pidA2 && target.Address == addrOf("B-1", "B") {
+				return 0, errors.New("no reply within 1s")
+			}
+			if target.Protocol == ProbeTCP {
+				return time.Millisecond, errProbeRefused
+			}
+			return 2 * time.Millisecond, nil
+		}},
+		// Hops answer from the address on the subnet traffic came in from.
+		func(containerPID int, addr string) ([]string, error) {
+			return []string{addrOf("R-1", "A"), "", addrOf("R-2", "C"), addr}, nil
+		},
+	}
+
+	suite := AssertionSuite{Name: "lab", Assertions: []string{
+		"A-1 can reach B-1 tcp/22",
+		"A-2 can reach B-1",
+		"A-2 cannot reach B-2",
+		"A-2 cannot reach " + addrOf("B-1", "B"),
+		"traceroute A-1 -> B-1 goes through R-1, *, R-2",
+		"traceroute A-1 -> B-1 goes through R-1, R-2",
+		"A-1 has route to 10.0.0.0/24",
+		"R-1 has route to 10.0.1.0/24 via R-2",
+		"R-1 has no route to 10.0.1.0/24",
+		"Z-9 can reach A-1",
+	}}
+	if _, err := d.RunAssertions("0123", AssertionSuite{Assertions: []string{"A-1 likes B-1"}}); err == nil {
+		t.Errorf("RunAssertions() should reject invalid assertions")
+	}
+	report, err := d.RunAssertions("0123", suite)
+	if err != nil {
+		t.Fatalf("RunAssertions() err %v", err)
+	}
+
+	passed := []bool{}
+	for _, res := range report.Results {
+		passed = append(passed, res.Passed)
+	}
+	if want := []bool{true, false, false, true, true, false, true, false, true, false}; !cmp.Equal(passed, want) {
+		t.Errorf("RunAssertions() passed %v; wanted %v", passed, want)
+	}
+	for i, want := range map[int]string{
+		0: "reached " + addrOf("B-1", "B") + " in 1ms, but the connection was refused over tcp/22",
+		1: "couldn't reach " + addrOf("B-1", "B") + ": no reply within 1s over icmp",
+		5: "went to " + addrOf("B-1", "B") + " through R-1, *, R-2",
+		7: "no route to 10.0.1.0/24 among ",
+		9: errUnknownNode("Z-9").Error(),
+	} {
+		if !strings.Contains(report.Results[i].Message, want) {
+			t.Errorf("%q: message %q lacks %q", report.Results[i].Assertion, report.Results[i].Message, want)
+		}
+	}
+
+	text := &strings.Builder{}
+	if err := report.Write(text, ReportText); err != nil {
+		t.Fatalf("Write(%s) err %v", ReportText, err)
+	}
+	for _, want := range []string{"PASS A-1 can reach B-1 tcp/22: ", "FAIL A-2 can reach B-1: ", "10 assertions, 5 failed\n"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text report lacks %q; got\n%s", want, text)
+		}
+	}
+
+	junit := &strings.Builder{}
+	if err := report.Write(junit, ReportJUnit); err != nil {
+		t.Fatalf("Write(%s) err %v", ReportJUnit, err)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal([]byte(junit.String()), &suites); err != nil {
+		t.Fatalf("couldn't parse the JUnit report: %v\n%s", err, junit)
+	}
+	if suites.Tests != 10 || suites.Failures != 5 || suites.Suites[0].Name != "lab on Test Net 0" {
+		t.Errorf("JUnit report has %d tests and %d failures in suite %q; wanted 10 and 5 in \"lab on Test Net 0\"",
+			suites.Tests, suites.Failures, suites.Suites[0].Name)
+	}
+}
@@ -0,0 +1,233 @@
+package dvnet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	sysctl "github.com/lorenzosaino/go-sysctl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/bpf"
+)
+
+// bridgeBackend creates the bridges backing subnets and plugs ports into them.
+// Linux bridges are the default but subnets can be backed by Open vSwitch too.
+type bridgeBackend interface {
+	createBridge(name string) (*netlink.Bridge, error)
+	removeBridge(bridge *netlink.Bridge) error
+	connectToBridge(vethEnd netlink.Link, bridge *netlink.Bridge) error
+	disconnectFromBridge(portName string, bridge *netlink.Bridge) error
+}
+
+// hostBackend carries out every operation touching the host, be it
+// through its kernel or through its Docker daemon, when bringing a
+// network up or down. Swapping it out lets us see what would be
+// done without actually doing it.
+type hostBackend interface {
+	getSysctl(name string) (string, error)
+	setSysctl(name, value string) error
+	ensureDir(path string) error
+
+	// Bridges not backing regular subnets, such as trunks, switches
+	// and the hop bridge, are always Linux bridges.
+	bridgeBackend
+	bridgeBackendFor(ovs *ovsDef) bridgeBackend
+	addressBridge(cidr string, bridge *netlink.Bridge) error
+	createTrunkBridge(name string) (*netlink.Bridge, error)
+	createSwitch(name string, stp bool, priority *int) (*netlink.Bridge, error)
+	addPortVLAN(portName string, vlan int, access bool) error
+	delPortVLAN(portName string, vlan int) error
+	addVLANIface(parent string, vlan, containerPID int) (netlink.Link, error)
+	removeVLANIface(name string, containerPID int) error
+
+	createVethPair(name, peerName string) (*netlink.Veth, netlink.Link, netlink.Link, error)
+	removeVeth(name string, containerPID int) error
+	setLinkUp(name string, containerPID int, up bool) error
+	impairLink(iface string, containerPID int, li *LinkImpairments, sp *ShapingPolicy) error
+	connectToContainer(vethEnd netlink.Link, containerPID int) error
+	addressContainer(cidr string, iface netlink.Link, containerPID int) error
+	interfaces(containerPID int) (map[string]ifaceState, error)
+
+	addRoute(route routeInfo, containerPID int) error
+	delRoute(route routeInfo, containerPID int) error
+	routes(containerPID int) ([]routeInfo, error)
+
+	runContainer(img, name string, opts ContainerOptions) (string, int, error)
+	removeContainer(id string) error
+	inspectContainer(id string) (containerStatus, error)
+
+	natOut(cidr string) error
+	restoreNAT(cidr string) error
+	enableForwarding(hopBridgeName string) error
+	restoreForwarding(hopBridgeName string) error
+	installFWRules(containerPID int, policy string, specs [][]string) error
+	fwRules(containerPID int) (string, [][]string, error)
+
+	openCapture(iface string, containerPID int, filter []bpf.RawInstruction) (packetSource, error)
+	mirrorPort(iface, dest string, both bool) error
+	ifaceStats(containerPID int) (map[string]ifaceStats, error)
+	probe(containerPID int, target probeTarget, timeout time.Duration) (time.Duration, error)
+	traceroute(containerPID int, addr string, maxHops int, timeout time.Duration) ([]string, error)
+}
+
+// linuxBackend is the hostBackend actually doing things
+// through netlink, iptables(8) and the Docker daemon.
+type linuxBackend struct{}
+
+// bridgeBackendFor returns the backend for Open vSwitch bridges with the given
+// settings or, if there are none, the linuxBackend itself.
+func (lb linuxBackend) bridgeBackendFor(ovs *ovsDef) bridgeBackend {
+	if ovs == nil {
+		return lb
+	}
+	return ovsBackend{socket: ovsdbSocket, def: *ovs}
+}
+
+func (linuxBackend) getSysctl(name string) (string, error) {
+	return sysctl.Get(name)
+}
+
+func (linuxBackend) setSysctl(name, value string) error {
+	return sysctl.Set(name, value)
+}
+
+func (linuxBackend) ensureDir(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.debug("creating %s\n", path)
+		return os.Mkdir(path, 0755)
+	}
+	log.debug("directory %s already existed\n", path)
+	return nil
+}
+
+// removeVeth removes the veth pair one of whose ends is name. Just like
+// with impairLink, a zero containerPID means name lives on the host.
+func (linuxBackend) removeVeth(name string, containerPID int) error {
+	remove := func() error {
+		veth, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("couldn't find veth %s: %w", name, err)
+		}
+		// Removing one end of a veth pair removes its peer too.
+		return netlink.LinkDel(veth)
+	}
+	if containerPID == 0 {
+		return remove()
+	}
+	return inContainerNS(containerPID, remove)
+}
+
+func (linuxBackend) setLinkUp(name string, containerPID int, up bool) error {
+	set := func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("couldn't find link %s: %w", name, err)
+		}
+		if up {
+			return netlink.LinkSetUp(link)
+		}
+		return netlink.LinkSetDown(link)
+	}
+	if containerPID == 0 {
+		return set()
+	}
+	return inContainerNS(containerPID, set)
+}
+
+// ifaceState is what the kernel says about an interface: its kind (e.g. veth,
+// vlan or bridge), the bridge it's plugged into, if any, and its IPv4 addresses.
+type ifaceState struct {
+	Kind   string
+	Master string
+	Addrs  []string
+}
+
+// interfaces returns every interface but the loopback one in the network
+// namespace of containerPID or, if it's zero, in the host's.
+func (linuxBackend) interfaces(containerPID int) (map[string]ifaceState, error) {
+	ifaces := map[string]ifaceState{}
+	list := func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		names := map[int]string{}
+		for _, link := range links {
+			names[link.Attrs().Index] = link.Attrs().Name
+		}
+		for _, link := range links {
+			attrs := link.Attrs()
+			if attrs.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return fmt.Errorf("couldn't list the addresses of %s: %w", attrs.Name, err)
+			}
+			state := ifaceState{Kind: link.Type(), Master: names[attrs.MasterIndex], Addrs: []string{}}
+			for _, addr := range addrs {
+				state.Addrs = append(state.Addrs, addr.IPNet.String())
+			}
+			ifaces[attrs.Name] = state
+		}
+		return nil
+	}
+	if containerPID == 0 {
+		return ifaces, list()
+	}
+	return ifaces, inContainerNS(containerPID, list)
+}
+
+func (linuxBackend) addRoute(route routeInfo, containerPID int) error {
+	nlRoute, err := route.netlinkRoute()
+	if err != nil {
+		return err
+	}
+	return inContainerNS(containerPID, func() error { return netlink.RouteAdd(nlRoute) })
+}
+
+func (linuxBackend) delRoute(route routeInfo, containerPID int) error {
+	nlRoute, err := route.netlinkRoute()
+	if err != nil {
+		return err
+	}
+	return inContainerNS(containerPID, func() error { return netlink.RouteDel(nlRoute) })
+}
+
+// routes reads the main IPv4 routing table of a container, be the routes
+// ours, the kernel's or those of whatever routing daemon runs within it.
+// Directly connected routes have no gateway and multipath
+// routes come back as a route per gateway.
+func (linuxBackend) routes(containerPID int) ([]routeInfo, error) {
+	var nlRoutes []netlink.Route
+	err := inContainerNS(containerPID, func() error {
+		var err error
+		nlRoutes, err = netlink.RouteList(nil, netlink.FAMILY_V4)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []routeInfo{}
+	for _, nlRoute := range nlRoutes {
+		route := routeInfo{Dst: defaultRoute}
+		if nlRoute.Dst != nil {
+			route.Dst = nlRoute.Dst.String()
+		}
+		for _, nextHop := range nlRoute.MultiPath {
+			if nextHop.Gw != nil {
+				routes = append(routes, routeInfo{Dst: route.Dst, Gw: nextHop.Gw.String()})
+			}
+		}
+		if len(nlRoute.MultiPath) > 0 {
+			continue
+		}
+		if nlRoute.Gw != nil {
+			route.Gw = nlRoute.Gw.String()
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
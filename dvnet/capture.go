@@ -0,0 +1,446 @@
+package dvnet
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	captureSnaplen     uint32        = 65535
+	captureReadTimeout time.Duration = 250 * time.Millisecond
+)
+
+// errCaptureTimeout signals no packet showed up within captureReadTimeout.
+var errCaptureTimeout = errors.New("no packets within the read timeout")
+
+// CaptureRequest asks for the traffic going through a link or a bridge to be
+// captured into a pcapng file within Dir, which must be an absolute path.
+// The link between Node and Subnet is captured on if Node is given. If it
+// names one of Subnet's switches the switch's bridge is captured on instead,
+// just like the subnet's own bridge when there's no Node at all. Filter is
+// an expression written in a subset of the syntax of pcap-filter(7).
+type CaptureRequest struct {
+	Node   string `json:"node,omitempty"`
+	Subnet string `json:"subnet"`
+	Filter string `json:"filter,omitempty"`
+	Dir    string `json:"dir"`
+}
+
+// CaptureInfo describes a capture: what it's capturing on and where the
+// packets go. Captures which stopped on their own carry the Error doing so.
+type CaptureInfo struct {
+	ID        string    `json:"id"`
+	Node      string    `json:"node,omitempty"`
+	Subnet    string    `json:"subnet"`
+	Interface string    `json:"interface"`
+	Filter    string    `json:"filter,omitempty"`
+	File      string    `json:"file"`
+	Started   time.Time `json:"started"`
+	Packets   uint64    `json:"packets"`
+	Running   bool      `json:"running"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// packetSource reads the packets going through an interface. Reads
+// give up with errCaptureTimeout after captureReadTimeout.
+type packetSource interface {
+	readPacket(buf []byte) (capturedPacket, error)
+	close() error
+}
+
+// capture is a capture running on behalf of the network with ID networkID.
+type capture struct {
+	networkID string
+	info      CaptureInfo
+	packets   uint64
+	stop      chan struct{}
+	done      chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// captureSet keeps track of the captures we're running. They don't
+// outlive the process running them, so they're not part of the state.
+type captureSet struct {
+	mu       sync.Mutex
+	captures map[string]*capture
+}
+
+func newCaptureSet() *captureSet {
+	return &captureSet{captures: map[string]*capture{}}
+}
+
+// captureTarget returns the interface to capture on as asked by req, the PID of
+// the container it lives in (zero if it's on the host) and a description of it.
+func captureTarget(ns *NetworkState, req CaptureRequest) (string, int, string, error) {
+	subnet, ok := ns.Subnets[req.Subnet]
+	if !ok {
+		return "", 0, "", notFoundError{fmt.Sprintf("subnet %s is not part of the network", req.Subnet)}
+	}
+
+	if sw, ok := ns.Switches[req.Node]; ok {
+		if sw.Subnet != req.Subnet {
+			return "", 0, "", notFoundError{fmt.Sprintf("there's no switch %s on subnet %s", req.Node, req.Subnet)}
+		}
+		return sw.BridgeName, 0, fmt.Sprintf("switch %s on subnet %s", req.Node, req.Subnet), nil
+	}
+
+	if req.Node == "" {
+		// Open vSwitch bridges only hand their internal port what's meant for it.
+		if !subnet.ownsBridge() || subnet.OVS != nil {
+			return "", 0, "", invalidError{fmt.Errorf("subnet %s has no Linux bridge of its own: capture on one of its links instead", req.Subnet)}
+		}
+		return subnet.BridgeName, 0, fmt.Sprintf("bridge of subnet %s", req.Subnet), nil
+	}
+
+	link, ok := ns.Links[linkKey(req.Node, req.Subnet)]
+	if !ok {
+		return "", 0, "", notFoundError{fmt.Sprintf("node %s is not attached to subnet %s", req.Node, req.Subnet)}
+	}
+	desc := fmt.Sprintf("link between %s and subnet %s", req.Node, req.Subnet)
+	if link.ownsBridgeEnd() {
+		return link.BridgeEnd, 0, desc, nil
+	}
+	pid, ok := ns.nodePID(req.Node)
+	if !ok {
+		return "", 0, "", errUnknownNode(req.Node)
+	}
+	return link.NodeEnd, pid, desc, nil
+}
+
+// captureFileName returns a name for the file holding a capture
+// which can't clash with others and is safe to use as a path.
+func captureFileName(network, node, subnet, id string) string {
+	parts := []string{network}
+	if node != "" {
+		parts = append(parts, node)
+	}
+	parts = append(parts, subnet, id)
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+	return name + ".pcapng"
+}
+
+func newCaptureID() (string, error) {
+	rawID := make([]byte, 6)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(rawID), nil
+}
+
+// StartCapture starts capturing the packets going through the link or the bridge
+// req points to on the network with the given name, ID or ID prefix. The capture
+// runs in the background until it's stopped with StopCapture.
+func (d Driver) StartCapture(network string, req CaptureRequest) (CaptureInfo, error) {
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+
+	if !filepath.IsAbs(req.Dir) {
+		return CaptureInfo{}, invalidError{fmt.Errorf("captures need an absolute path to the directory to write them to; got %q", req.Dir)}
+	}
+	iface, pid, desc, err := captureTarget(ns, req)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+	filter, err := compileFilter(req.Filter, captureSnaplen)
+	if err != nil {
+		return CaptureInfo{}, invalidError{err}
+	}
+
+	id, err := newCaptureID()
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+	if err := os.MkdirAll(req.Dir, 0755); err != nil {
+		return CaptureInfo{}, fmt.Errorf("couldn't create %s: %w", req.Dir, err)
+	}
+	path := filepath.Join(req.Dir, captureFileName(ns.Definition.Name, req.Node, req.Subnet, id))
+	f, err := os.Create(path)
+	if err != nil {
+		return CaptureInfo{}, fmt.Errorf("couldn't create %s: %w", path, err)
+	}
+
+	comments := []string{
+		fmt.Sprintf("network: %s (%s)", ns.Definition.Name, networkID),
+		fmt.Sprintf("capturing on: %s", desc),
+	}
+	if cInfo, ok := ns.nodeInfo(req.Node); ok {
+		comments = append(comments, fmt.Sprintf("node: %s (container %.12s)", req.Node, cInfo.ID))
+	}
+	if link, ok := ns.Links[linkKey(req.Node, req.Subnet)]; ok {
+		comments = append(comments, fmt.Sprintf("link: %s (%s) <-> %s", link.NodeEnd, link.CIDR, link.BridgeEnd))
+	}
+	if req.Filter != "" {
+		comments = append(comments, fmt.Sprintf("filter: %s", req.Filter))
+	}
+	bw := bufio.NewWriter(f)
+	pw, err := newPcapngWriter(bw, comments, iface, desc, captureSnaplen)
+	if err != nil {
+		f.Close()
+		return CaptureInfo{}, fmt.Errorf("couldn't write to %s: %w", path, err)
+	}
+
+	log.debug("capturing on %s (PID %d) into %s\n", iface, pid, path)
+	src, err := ns.backend.openCapture(iface, pid, filter)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return CaptureInfo{}, fmt.Errorf("couldn't capture on %s: %w", iface, err)
+	}
+
+	c := &capture{
+		networkID: networkID,
+		info: CaptureInfo{ID: id, Node: req.Node, Subnet: req.Subnet, Interface: iface,
+			Filter: req.Filter, File: path, Started: time.Now()},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	d.captures.mu.Lock()
+	d.captures.captures[id] = c
+	d.captures.mu.Unlock()
+
+	go c.run(src, pw, bw, f)
+	return c.status(), nil
+}
+
+// run writes whatever src reads until the capture's stopped or src fails,
+// flushing what's been written whenever there's nothing to read.
+func (c *capture) run(src packetSource, pw *pcapngWriter, bw *bufio.Writer, f *os.File) {
+	defer close(c.done)
+	defer f.Close()
+	defer src.close()
+
+	buf := make([]byte, captureSnaplen)
+	for {
+		select {
+		case <-c.stop:
+			c.fail(bw.Flush())
+			return
+		default:
+		}
+
+		pkt, err := src.readPacket(buf)
+		if errors.Is(err, errCaptureTimeout) {
+			if err := bw.Flush(); err != nil {
+				c.fail(err)
+				return
+			}
+			continue
+		}
+		if err == nil {
+			err = pw.writePacket(pkt)
+		}
+		if err != nil {
+			log.error("capture %s stopped: %v\n", c.info.ID, err)
+			c.fail(err)
+			bw.Flush()
+			return
+		}
+		atomic.AddUint64(&c.packets, 1)
+	}
+}
+
+func (c *capture) fail(err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func (c *capture) status() CaptureInfo {
+	info := c.info
+	info.Packets = atomic.LoadUint64(&c.packets)
+	select {
+	case <-c.done:
+	default:
+		info.Running = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		info.Error = c.err.Error()
+	}
+	return info
+}
+
+// StopCapture stops the capture with the given ID on the network with the given
+// name, ID or ID prefix and forgets about it, returning how it ended up.
+func (d Driver) StopCapture(network, id string) (CaptureInfo, error) {
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+
+	d.captures.mu.Lock()
+	c, ok := d.captures.captures[id]
+	if ok && c.networkID == networkID {
+		delete(d.captures.captures, id)
+	}
+	d.captures.mu.Unlock()
+	if !ok || c.networkID != networkID {
+		return CaptureInfo{}, notFoundError{fmt.Sprintf("there's no capture %s on network %s", id, network)}
+	}
+
+	close(c.stop)
+	<-c.done
+	log.debug("stopped capture %s into %s\n", id, c.info.File)
+	return c.status(), nil
+}
+
+// Captures lists the captures on the network with the given name, ID or ID prefix.
+func (d Driver) Captures(network string) ([]CaptureInfo, error) {
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+
+	d.captures.mu.Lock()
+	defer d.captures.mu.Unlock()
+	captures := []CaptureInfo{}
+	for _, c := range d.captures.captures {
+		if c.networkID == networkID {
+			captures = append(captures, c.status())
+		}
+	}
+	sort.Slice(captures, func(i, j int) bool { return captures[i].Started.Before(captures[j].Started) })
+	return captures, nil
+}
+
+// stopCaptures stops every capture on the network with ID networkID.
+func (d Driver) stopCaptures(networkID string) {
+	d.captures.mu.Lock()
+	stopping := []*capture{}
+	for id, c := range d.captures.captures {
+		if c.networkID == networkID {
+			stopping = append(stopping, c)
+			delete(d.captures.captures, id)
+		}
+	}
+	d.captures.mu.Unlock()
+
+	for _, c := range stopping {
+		close(c.stop)
+		<-c.done
+	}
+}
+
+// afPacketSource reads packets off a packet(7) socket.
+type afPacketSource struct {
+	fd int
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// openCapture opens a packet socket bound to iface, which lives within the
+// container with the given PID unless it's zero. The socket stays within the
+// container's network namespace even after we've left it. The interface is
+// made promiscuous so that bridges see the frames they forward too.
+func (linuxBackend) openCapture(iface string, containerPID int, filter []bpf.RawInstruction) (packetSource, error) {
+	src := &afPacketSource{fd: -1}
+	open := func() error {
+		link, err := netlink.LinkByName(iface)
+		if err != nil {
+			return fmt.Errorf("couldn't find %s: %w", iface, err)
+		}
+		// Sockets with no protocol get nothing until they're bound, which we do after
+		// attaching the filter so that no unfiltered packets sneak in.
+		fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("couldn't open a packet socket: %w", err)
+		}
+		src.fd = fd
+
+		if len(filter) != 0 {
+			sockFilter := make([]unix.SockFilter, len(filter))
+			for i, insn := range filter {
+				sockFilter[i] = unix.SockFilter{Code: insn.Op, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+			}
+			prog := unix.SockFprog{Len: uint16(len(sockFilter)), Filter: &sockFilter[0]}
+			if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+				return fmt.Errorf("couldn't attach the filter: %w", err)
+			}
+		}
+		timeout := unix.NsecToTimeval(captureReadTimeout.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+			return fmt.Errorf("couldn't set the read timeout: %w", err)
+		}
+		if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: link.Attrs().Index}); err != nil {
+			return fmt.Errorf("couldn't bind to %s: %w", iface, err)
+		}
+		mreq := unix.PacketMreq{Ifindex: int32(link.Attrs().Index), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+			return fmt.Errorf("couldn't make %s promiscuous: %w", iface, err)
+		}
+		return nil
+	}
+
+	var err error
+	if containerPID == 0 {
+		err = open()
+	} else {
+		err = inContainerNS(containerPID, open)
+	}
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// readPacket reads a packet into buf. Packets larger than
+// buf are truncated, but we still get their original length.
+func (src *afPacketSource) readPacket(buf []byte) (capturedPacket, error) {
+	n, from, err := unix.Recvfrom(src.fd, buf, unix.MSG_TRUNC)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return capturedPacket{}, errCaptureTimeout
+		}
+		return capturedPacket{}, err
+	}
+	captured := n
+	if captured > len(buf) {
+		captured = len(buf)
+	}
+	pkt := capturedPacket{data: buf[:captured], origLen: n, when: time.Now()}
+	if ll, ok := from.(*unix.SockaddrLinklayer); ok {
+		pkt.outgoing = ll.Pkttype == unix.PACKET_OUTGOING
+	}
+	return pkt, nil
+}
+
+func (src *afPacketSource) close() error {
+	if src.fd < 0 {
+		return nil
+	}
+	return unix.Close(src.fd)
+}
@@ -0,0 +1,387 @@
+package dvnet
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// Offsets within Ethernet frames carrying untagged IPv4 or IPv6 packets.
+const (
+	etherTypeOff   uint32 = 12
+	ipv4ProtoOff   uint32 = 23
+	ipv4FlagsOff   uint32 = 20
+	ipv4SrcOff     uint32 = 26
+	ipv4DstOff     uint32 = 30
+	ipv6NextHdrOff uint32 = 20
+	ipv4HeaderOff  uint32 = 14
+	ipv6PayloadOff uint32 = 54
+
+	etherTypeIPv4 uint32 = 0x0800
+	etherTypeARP  uint32 = 0x0806
+	etherTypeIPv6 uint32 = 0x86dd
+	ipProtoICMP   uint32 = 1
+	ipProtoTCP    uint32 = 6
+	ipProtoUDP    uint32 = 17
+	ipv4FragMask  uint32 = 0x1fff
+)
+
+// filterNode is an expression filtering packets. Leaves test a field of the packet
+// whilst the rest combine them: compiling them yields classic BPF programs.
+type filterNode interface{}
+
+type filterAnd struct{ a, b filterNode }
+type filterOr struct{ a, b filterNode }
+type filterNot struct{ a filterNode }
+
+// filterTest checks whether the size bytes at off, masked with mask if it's
+// not zero, equal val. Indirect offsets are relative to the end of the IPv4
+// header, whose length varies.
+type filterTest struct {
+	off      uint32
+	size     int
+	mask     uint32
+	val      uint32
+	indirect bool
+}
+
+// compileFilter turns expr, written in a subset of the syntax of pcap-filter(7),
+// into a BPF program accepting up to snaplen bytes of matching packets. These
+// primitives are understood, combined with and (&&), or (||), not (!) and
+// parentheses:
+//
+//	ip, ip6, arp, icmp, tcp, udp
+//	[src|dst] host <IPv4 address>
+//	[src|dst] net <IPv4 CIDR>
+//	[tcp|udp] [src|dst] port <port>
+//
+// An empty expression yields an empty program, which doesn't filter anything out.
+func compileFilter(expr string, snaplen uint32) ([]bpf.RawInstruction, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", expr, tok)
+	}
+
+	var a filterAssembler
+	accept, reject := a.newLabel(), a.newLabel()
+	a.compile(root, accept, reject)
+	a.place(accept)
+	a.emit(bpf.RetConstant{Val: snaplen})
+	a.place(reject)
+	a.emit(bpf.RetConstant{Val: 0})
+
+	insns, err := a.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("filter %q is too long: %w", expr, err)
+	}
+	return bpf.Assemble(insns)
+}
+
+func tokenizeFilter(expr string) []string {
+	for _, op := range []string{"(", ")", "!", "&&", "||"} {
+		expr = strings.ReplaceAll(expr, op, " "+op+" ")
+	}
+	return strings.Fields(expr)
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		other, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		node = filterOr{node, other}
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		other, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		node = filterAnd{node, other}
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch tok := p.next(); tok {
+	case "not", "!":
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node}, nil
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return node, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return p.parsePrimitive(tok)
+	}
+}
+
+// parsePrimitive parses the primitive starting with tok.
+func (p *filterParser) parsePrimitive(tok string) (filterNode, error) {
+	proto := ""
+	if tok == "tcp" || tok == "udp" {
+		// Protocols qualify the port primitive following them, if any.
+		if next := p.peek(); next != "port" && !(isFilterDir(next) && p.peekAt(1) == "port") {
+			return transportFilter(tok), nil
+		}
+		proto, tok = tok, p.next()
+	}
+
+	dir := ""
+	if isFilterDir(tok) {
+		dir, tok = tok, p.next()
+		if tok != "host" && tok != "net" && tok != "port" {
+			return nil, fmt.Errorf("%s can't qualify %q", dir, tok)
+		}
+	}
+
+	switch tok {
+	case "ip":
+		return filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv4}, nil
+	case "ip6":
+		return filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv6}, nil
+	case "arp":
+		return filterTest{off: etherTypeOff, size: 2, val: etherTypeARP}, nil
+	case "icmp":
+		return filterAnd{filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv4}, filterTest{off: ipv4ProtoOff, size: 1, val: ipProtoICMP}}, nil
+	case "host":
+		arg := p.next()
+		ip := net.ParseIP(arg).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 address", arg)
+		}
+		return addressFilter(dir, ipToUint32(ip), 0xffffffff), nil
+	case "net":
+		arg := p.next()
+		_, cidr, err := net.ParseCIDR(arg)
+		if err != nil || cidr.IP.To4() == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 CIDR block", arg)
+		}
+		return addressFilter(dir, ipToUint32(cidr.IP.To4()), ipToUint32(net.IP(cidr.Mask))), nil
+	case "port":
+		arg := p.next()
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a port", arg)
+		}
+		return portFilter(proto, dir, uint32(port)), nil
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unknown primitive %q", tok)
+}
+
+func (p *filterParser) peekAt(ahead int) string {
+	if p.pos+ahead >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos+ahead]
+}
+
+func isFilterDir(tok string) bool {
+	return tok == "src" || tok == "dst"
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+// either matches any of nodes, which must be at least one.
+func either(nodes ...filterNode) filterNode {
+	node := nodes[0]
+	for _, other := range nodes[1:] {
+		node = filterOr{node, other}
+	}
+	return node
+}
+
+// transportFilter matches TCP or UDP over both IPv4 and IPv6. Extension
+// headers aren't followed, so IPv6 packets carrying them won't match.
+func transportFilter(proto string) filterNode {
+	ipProto := ipProtoTCP
+	if proto == "udp" {
+		ipProto = ipProtoUDP
+	}
+	return either(
+		filterAnd{filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv4}, filterTest{off: ipv4ProtoOff, size: 1, val: ipProto}},
+		filterAnd{filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv6}, filterTest{off: ipv6NextHdrOff, size: 1, val: ipProto}},
+	)
+}
+
+// addressFilter matches IPv4 packets whose source and/or destination is within
+// the block given by addr and mask.
+func addressFilter(dir string, addr, mask uint32) filterNode {
+	src := filterTest{off: ipv4SrcOff, size: 4, mask: mask, val: addr & mask}
+	dst := filterTest{off: ipv4DstOff, size: 4, mask: mask, val: addr & mask}
+	isIPv4 := filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv4}
+	switch dir {
+	case "src":
+		return filterAnd{isIPv4, src}
+	case "dst":
+		return filterAnd{isIPv4, dst}
+	}
+	return filterAnd{isIPv4, filterOr{src, dst}}
+}
+
+// portFilter matches TCP and/or UDP segments going from and/or to port.
+// Only the first fragment of IPv4 packets carries the transport header.
+func portFilter(proto, dir string, port uint32) filterNode {
+	protos := []uint32{ipProtoTCP, ipProtoUDP}
+	if proto == "tcp" {
+		protos = protos[:1]
+	} else if proto == "udp" {
+		protos = protos[1:]
+	}
+
+	ports := func(indirect bool, base uint32) filterNode {
+		src := filterTest{off: base, size: 2, val: port, indirect: indirect}
+		dst := filterTest{off: base + 2, size: 2, val: port, indirect: indirect}
+		switch dir {
+		case "src":
+			return src
+		case "dst":
+			return dst
+		}
+		return filterOr{src, dst}
+	}
+
+	v4Protos, v6Protos := []filterNode{}, []filterNode{}
+	for _, ipProto := range protos {
+		v4Protos = append(v4Protos, filterTest{off: ipv4ProtoOff, size: 1, val: ipProto})
+		v6Protos = append(v6Protos, filterTest{off: ipv6NextHdrOff, size: 1, val: ipProto})
+	}
+	v4 := filterAnd{filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv4}, filterAnd{either(v4Protos...),
+		filterAnd{filterTest{off: ipv4FlagsOff, size: 2, mask: ipv4FragMask, val: 0}, ports(true, 0)}}}
+	v6 := filterAnd{filterTest{off: etherTypeOff, size: 2, val: etherTypeIPv6}, filterAnd{either(v6Protos...), ports(false, ipv6PayloadOff)}}
+	return filterOr{v4, v6}
+}
+
+// filterInsn is an instruction whose jumps, if any, go to labels yet to be placed.
+type filterInsn struct {
+	insn   bpf.Instruction
+	jump   bool
+	cond   bpf.JumpTest
+	val    uint32
+	jt, jf int
+}
+
+// filterAssembler lays out filter programs. Every jump goes forward
+// to a label, which is resolved into an offset once it's been placed.
+type filterAssembler struct {
+	insns  []filterInsn
+	labels []int
+}
+
+func (a *filterAssembler) newLabel() int {
+	a.labels = append(a.labels, -1)
+	return len(a.labels) - 1
+}
+
+func (a *filterAssembler) place(label int) {
+	a.labels[label] = len(a.insns)
+}
+
+func (a *filterAssembler) emit(insn bpf.Instruction) {
+	a.insns = append(a.insns, filterInsn{insn: insn})
+}
+
+// compile emits the code for node, which jumps to ifTrue if it matches or to ifFalse otherwise.
+func (a *filterAssembler) compile(node filterNode, ifTrue, ifFalse int) {
+	switch n := node.(type) {
+	case filterAnd:
+		mid := a.newLabel()
+		a.compile(n.a, mid, ifFalse)
+		a.place(mid)
+		a.compile(n.b, ifTrue, ifFalse)
+	case filterOr:
+		mid := a.newLabel()
+		a.compile(n.a, ifTrue, mid)
+		a.place(mid)
+		a.compile(n.b, ifTrue, ifFalse)
+	case filterNot:
+		a.compile(n.a, ifFalse, ifTrue)
+	case filterTest:
+		if n.indirect {
+			a.emit(bpf.LoadMemShift{Off: ipv4HeaderOff})
+			a.emit(bpf.LoadIndirect{Off: ipv4HeaderOff + n.off, Size: n.size})
+		} else {
+			a.emit(bpf.LoadAbsolute{Off: n.off, Size: n.size})
+		}
+		if n.mask != 0 {
+			a.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.mask})
+		}
+		a.insns = append(a.insns, filterInsn{jump: true, cond: bpf.JumpEqual, val: n.val, jt: ifTrue, jf: ifFalse})
+	}
+}
+
+// resolve turns the jumps to labels into the offsets classic BPF wants, which
+// can't go beyond 255 instructions for conditional jumps.
+func (a *filterAssembler) resolve() ([]bpf.Instruction, error) {
+	insns := []bpf.Instruction{}
+	for i, insn := range a.insns {
+		if !insn.jump {
+			insns = append(insns, insn.insn)
+			continue
+		}
+		skipTrue, skipFalse := a.labels[insn.jt]-i-1, a.labels[insn.jf]-i-1
+		if skipTrue > 255 || skipFalse > 255 {
+			return nil, fmt.Errorf("jumps can't skip more than 255 instructions")
+		}
+		insns = append(insns, bpf.JumpIf{Cond: insn.cond, Val: insn.val, SkipTrue: uint8(skipTrue), SkipFalse: uint8(skipFalse)})
+	}
+	return insns, nil
+}
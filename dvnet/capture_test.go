@@ -0,0 +1,295 @@
+package dvnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/bpf"
+)
+
+// testFrame builds an Ethernet frame carrying an IPv4 packet with the given
+// protocol, addresses and ports. The IPv4 header is ihl 32-bit words long.
+func testFrame(proto byte, src, dst string, srcPort, dstPort uint16, ihl int, fragOff uint16) []byte {
+	frame := make([]byte, 14+ihl*4+8)
+	binary.BigEndian.PutUint16(frame[12:], uint16(etherTypeIPv4))
+	frame[14] = 0x40 | byte(ihl)
+	binary.BigEndian.PutUint16(frame[20:], fragOff)
+	frame[23] = proto
+	copy(frame[26:], net.ParseIP(src).To4())
+	copy(frame[30:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(frame[14+ihl*4:], srcPort)
+	binary.BigEndian.PutUint16(frame[14+ihl*4+2:], dstPort)
+	return frame
+}
+
+func TestCompileFilter(t *testing.T) {
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:], uint16(etherTypeARP))
+	ipv6TCP := make([]byte, 14+40+20)
+	binary.BigEndian.PutUint16(ipv6TCP[12:], uint16(etherTypeIPv6))
+	ipv6TCP[20] = byte(ipProtoTCP)
+	binary.BigEndian.PutUint16(ipv6TCP[56:], 179)
+
+	packets := map[string][]byte{
+		"bgp":      testFrame(byte(ipProtoTCP), "10.0.0.2", "10.0.2.3", 40000, 179, 5, 0),
+		"bgp-opts": testFrame(byte(ipProtoTCP), "10.0.0.2", "10.0.2.3", 40000, 179, 6, 0),
+		"frag":     testFrame(byte(ipProtoTCP), "10.0.0.2", "10.0.2.3", 40000, 179, 5, 0x0010),
+		"dns":      testFrame(byte(ipProtoUDP), "10.0.1.2", "1.1.1.1", 5353, 53, 5, 0),
+		"ping":     testFrame(byte(ipProtoICMP), "10.0.1.2", "10.0.0.2", 0, 0, 5, 0),
+		"arp":      arp,
+		"ipv6-bgp": ipv6TCP,
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"arp", "bgp", "bgp-opts", "dns", "frag", "ipv6-bgp", "ping"}},
+		{"ip", []string{"bgp", "bgp-opts", "dns", "frag", "ping"}},
+		{"ip6", []string{"ipv6-bgp"}},
+		{"arp", []string{"arp"}},
+		{"icmp", []string{"ping"}},
+		{"tcp", []string{"bgp", "bgp-opts", "frag", "ipv6-bgp"}},
+		{"not tcp and not arp", []string{"dns", "ping"}},
+		{"port 179", []string{"bgp", "bgp-opts", "ipv6-bgp"}},
+		{"tcp dst port 179", []string{"bgp", "bgp-opts", "ipv6-bgp"}},
+		{"tcp src port 179", []string{}},
+		{"udp port 53 or icmp", []string{"dns", "ping"}},
+		{"host 10.0.0.2", []string{"bgp", "bgp-opts", "frag", "ping"}},
+		{"src host 10.0.0.2", []string{"bgp", "bgp-opts", "frag"}},
+		{"dst net 10.0.0.0/16 && !(tcp)", []string{"ping"}},
+		{"net 10.0.1.0/24 and (udp || dst host 10.0.0.2)", []string{"dns", "ping"}},
+	}
+
+	for _, test := range tests {
+		prog, err := compileFilter(test.filter, captureSnaplen)
+		if err != nil {
+			t.Errorf("compileFilter(%q) err %v", test.filter, err)
+			continue
+		}
+		got := []string{}
+		for _, name := range sortedKeys(packets) {
+			if prog == nil {
+				got = append(got, name)
+				continue
+			}
+			insns, _ := bpf.Disassemble(prog)
+			vm, err := bpf.NewVM(insns)
+			if err != nil {
+				t.Fatalf("compileFilter(%q) yielded an invalid program: %v", test.filter, err)
+			}
+			if n, err := vm.Run(packets[name]); err != nil {
+				t.Errorf("running %q on %s: %v", test.filter, name, err)
+			} else if n != 0 {
+				got = append(got, name)
+			}
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("%q matched %v; wanted %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"tcp and",
+		"(udp",
+		"udp)",
+		"host 10.0.0.256",
+		"host fe80::1",
+		"net 10.0.0.0",
+		"port 70000",
+		"src tcp",
+		"vlan 10",
+	} {
+		if _, err := compileFilter(filter, captureSnaplen); err == nil {
+			t.Errorf("compileFilter(%q) should have failed", filter)
+		}
+	}
+}
+
+// pcapngBlock is a block read back from a pcapng file.
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readPcapng(t *testing.T, raw []byte) []pcapngBlock {
+	t.Helper()
+	blocks := []pcapngBlock{}
+	for len(raw) != 0 {
+		if len(raw) < 12 {
+			t.Fatalf("truncated block: %v", raw)
+		}
+		blockType, totalLen := binary.LittleEndian.Uint32(raw), binary.LittleEndian.Uint32(raw[4:])
+		if totalLen%4 != 0 || int(totalLen) > len(raw) {
+			t.Fatalf("block %#x has a bogus length %d", blockType, totalLen)
+		}
+		if trailer := binary.LittleEndian.Uint32(raw[totalLen-4:]); trailer != totalLen {
+			t.Fatalf("block %#x has length %d but its trailer says %d", blockType, totalLen, trailer)
+		}
+		blocks = append(blocks, pcapngBlock{blockType, raw[8 : totalLen-4]})
+		raw = raw[totalLen:]
+	}
+	return blocks
+}
+
+func TestPcapngWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	pw, err := newPcapngWriter(buf, []string{"network: Test Net 0", "node: R-1"}, "bth-r-1-c", "link between R-1 and subnet C", captureSnaplen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := testFrame(byte(ipProtoICMP), "10.0.2.1", "10.0.2.2", 0, 0, 5, 0)[:37]
+	when := time.Unix(1700000000, 123456789)
+	if err := pw.writePacket(capturedPacket{data: frame, origLen: 60, when: when, outgoing: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readPcapng(t, buf.Bytes())
+	types := []uint32{}
+	for _, block := range blocks {
+		types = append(types, block.blockType)
+	}
+	if want := []uint32{pcapngSHB, pcapngIDB, pcapngEPB}; !cmp.Equal(types, want) {
+		t.Fatalf("got blocks %#x; wanted %#x", types, want)
+	}
+
+	if magic := binary.LittleEndian.Uint32(blocks[0].body); magic != pcapngByteOrder {
+		t.Errorf("byte order magic = %#x; wanted %#x", magic, pcapngByteOrder)
+	}
+	for _, want := range []string{"network: Test Net 0", "node: R-1", "dvnet"} {
+		if !bytes.Contains(blocks[0].body, []byte(want)) {
+			t.Errorf("the section header should carry %q", want)
+		}
+	}
+	if !bytes.Contains(blocks[1].body, []byte("bth-r-1-c")) {
+		t.Errorf("the interface description should carry its name")
+	}
+
+	epb := blocks[2].body
+	ts := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+	if ts != uint64(when.UnixNano()) {
+		t.Errorf("timestamp = %d; wanted %d", ts, when.UnixNano())
+	}
+	if capLen, origLen := binary.LittleEndian.Uint32(epb[12:]), binary.LittleEndian.Uint32(epb[16:]); capLen != 37 || origLen != 60 {
+		t.Errorf("lengths = %d/%d; wanted 37/60", capLen, origLen)
+	}
+	if !bytes.Equal(epb[20:20+37], frame) {
+		t.Errorf("the packet's data got mangled")
+	}
+	// The flags option follows the padded data.
+	opts := epb[20+40:]
+	if code, flags := binary.LittleEndian.Uint16(opts), binary.LittleEndian.Uint32(opts[4:]); code != pcapngOptEPBFlags || flags != pcapngFlagOutbound {
+		t.Errorf("flags option = %d: %d; wanted %d: %d", code, flags, pcapngOptEPBFlags, pcapngFlagOutbound)
+	}
+}
+
+func TestCaptureTarget(t *testing.T) {
+	d, _ := testDriver(t)
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req       CaptureRequest
+		wantIface string
+		wantErr   bool
+	}{
+		{CaptureRequest{Node: "A-1", Subnet: "A"}, "bth-a-1", false},
+		{CaptureRequest{Node: "R-1", Subnet: "C"}, "bth-r-1-c", false},
+		{CaptureRequest{Subnet: "C"}, "dvn-c", false},
+		{CaptureRequest{Node: "A-1", Subnet: "B"}, "", true},
+		{CaptureRequest{Subnet: "Z"}, "", true},
+	}
+	for _, test := range tests {
+		iface, pid, _, err := captureTarget(ns, test.req)
+		if (err != nil) != test.wantErr {
+			t.Errorf("captureTarget(%+v) err %v; wanted an error: %t", test.req, err, test.wantErr)
+			continue
+		}
+		if iface != test.wantIface || pid != 0 {
+			t.Errorf("captureTarget(%+v) = %s (PID %d); wanted %s on the host", test.req, iface, pid, test.wantIface)
+		}
+	}
+}
+
+func TestCaptureAPI(t *testing.T) {
+	d, pb := testDriver(t)
+	srv := httptest.NewServer(d.apiHandler())
+	defer srv.Close()
+	dir := t.TempDir()
+
+	request := func(method, path, body string, out interface{}) int {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	for _, body := range []string{
+		`{"node": "A-1", "subnet": "A", "dir": "relative"}`,
+		`{"node": "A-1", "subnet": "A", "filter": "tcp port", "dir": "` + dir + `"}`,
+	} {
+		if status := request(http.MethodPost, "/v1/networks/0123/captures", body, nil); status != http.StatusBadRequest {
+			t.Errorf("POST %s got status %d; wanted %d", body, status, http.StatusBadRequest)
+		}
+	}
+
+	var started CaptureInfo
+	body := `{"node": "A-1", "subnet": "A", "filter": "icmp", "dir": "` + dir + `"}`
+	if status := request(http.MethodPost, "/v1/networks/0123/captures", body, &started); status != http.StatusCreated {
+		t.Fatalf("POST %s got status %d; wanted %d", body, status, http.StatusCreated)
+	}
+	if !started.Running || started.Interface != "bth-a-1" {
+		t.Errorf("got capture %+v; wanted a running one on bth-a-1", started)
+	}
+	if !contains(pb.plan.Steps, "capture on bth-a-1 with 6 filter instructions") {
+		t.Errorf("a capture should have been opened on bth-a-1 with the filter: %v", pb.plan.Steps)
+	}
+
+	var captures []CaptureInfo
+	if status := request(http.MethodGet, "/v1/networks/0123/captures", "", &captures); status != http.StatusOK || len(captures) != 1 {
+		t.Errorf("GET captures got status %d and %v; wanted the running capture", status, captures)
+	}
+
+	var stopped CaptureInfo
+	if status := request(http.MethodDelete, "/v1/networks/0123/captures/"+started.ID, "", &stopped); status != http.StatusOK {
+		t.Fatalf("DELETE capture got status %d; wanted %d", status, http.StatusOK)
+	}
+	if stopped.Running || stopped.Error != "" {
+		t.Errorf("got capture %+v; wanted a cleanly stopped one", stopped)
+	}
+	if status := request(http.MethodDelete, "/v1/networks/0123/captures/"+started.ID, "", nil); status != http.StatusNotFound {
+		t.Errorf("stopping the capture twice got status %d; wanted %d", status, http.StatusNotFound)
+	}
+
+	raw, err := os.ReadFile(started.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readPcapng(t, raw)
+	if len(blocks) != 2 || !bytes.Contains(blocks[0].body, []byte("network: Test Net 0 (0123456789abcdef)")) {
+		t.Errorf("the capture should hold a section header describing the network and an interface description")
+	}
+}
@@ -2,8 +2,10 @@ package dvnet
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
+	"sort"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -15,6 +17,7 @@ type rawNetDef struct {
 	AutomaticRouting bool                    `json:"automatic_routing"`
 	Subnets          map[string]rawSubnetDef `json:"subnets" validate:"required"`
 	Routers          map[string]routerDef    `json:"routers" validate:"required"`
+	Switches         map[string]switchDef    `json:"switches,omitempty"`
 }
 
 type RawOutboundAccessDef struct {
@@ -34,26 +37,78 @@ type netDef struct {
 	AutomaticRouting bool                 `json:"automatic_routing"`
 	Subnets          map[string]subnetDef `json:"subnets" validate:"required"`
 	Routers          map[string]routerDef `json:"routers" validate:"required"`
+	Switches         map[string]switchDef `json:"switches,omitempty"`
 }
 
+// Types of subnets. Bridged subnets are backed by a Linux bridge every node
+// is plugged into whilst point-to-point ones join exactly two nodes through
+// a single veth pair.
+const (
+	subnetTypeBridge string = "bridge"
+	subnetTypeP2P    string = "p2p"
+)
+
 type rawSubnetDef struct {
 	CIDRBlock string             `json:"cidr" validate:"required,cidr4"`
+	Type      string             `json:"type,omitempty"`
+	VLAN      int                `json:"vlan,omitempty"`
+	Trunk     string             `json:"trunk,omitempty"`
+	OVS       *ovsDef            `json:"ovs,omitempty"`
+	Shaping   *BandwidthShaping  `json:"shaping,omitempty"`
+	Mirror    *mirrorDef         `json:"mirror,omitempty"`
 	Hosts     map[string]HostDef `json:"hosts" validate:"required,unique,dive,required"`
 }
 
+// HostDef describes a host. Hosts on subnets made up of switches
+// are plugged into their Switch or into the subnet's first one.
+// Their Shaping overrides the one of their subnet, if any.
 type HostDef struct {
-	Image string `json:"image"`
+	Image   string            `json:"image"`
+	Link    *LinkImpairments  `json:"link,omitempty"`
+	Switch  string            `json:"switch,omitempty"`
+	Shaping *BandwidthShaping `json:"shaping,omitempty"`
+	ContainerOptions
 }
 
+// subnetDef describes a subnet. Subnets with a VLAN ID share the bridge
+// of their Trunk with VLAN filtering enabled instead of having their own.
+// Subnets with OVS settings are backed by an Open vSwitch bridge instead.
+// Shaping applies to every host on the subnet without shaping of its own
+// and Mirror copies the traffic on some of its ports to one of its hosts.
 type subnetDef struct {
 	CIDRBlock net.IPNet          `json:"cidr" validate:"required,cidr4"`
+	Type      string             `json:"type,omitempty"`
+	VLAN      int                `json:"vlan,omitempty"`
+	Trunk     string             `json:"trunk,omitempty"`
+	OVS       *ovsDef            `json:"ovs,omitempty"`
+	Shaping   *BandwidthShaping  `json:"shaping,omitempty"`
+	Mirror    *mirrorDef         `json:"mirror,omitempty"`
 	Hosts     map[string]HostDef `json:"hosts" validate:"required,unique,dive,required"`
 }
 
+// routerDef describes a router. With TrunkPorts set, the router is attached
+// to the VLAN subnets it's on through a single tagged port per trunk and an
+// 802.1Q sub-interface per VLAN instead of through an access port per subnet.
+// Switches picks the switch the router's plugged into on switched subnets.
 type routerDef struct {
-	Subnets []string  `json:"subnets" validate:"required,unique,dive,required"`
-	FWRules fwRuleDef `json:"fw_rules"`
-	Image   string    `json:"image"`
+	Subnets    []string                   `json:"subnets" validate:"required,unique,dive,required"`
+	FWRules    fwRuleDef                  `json:"fw_rules"`
+	Image      string                     `json:"image"`
+	Links      map[string]LinkImpairments `json:"links,omitempty"`
+	TrunkPorts bool                       `json:"trunk_ports,omitempty"`
+	Switches   map[string]string          `json:"switches,omitempty"`
+	ContainerOptions
+}
+
+// switchDef describes a layer-2 switch on a subnet, which is then made up of
+// the switches on it instead of being a single bridge. Links are the switches
+// it's wired to: they're undirected, so declaring them on one end is enough.
+// Priority is the switch's bridge priority for the spanning tree protocol.
+type switchDef struct {
+	Subnet   string   `json:"subnet" validate:"required"`
+	STP      bool     `json:"stp,omitempty"`
+	Priority *int     `json:"priority,omitempty"`
+	Links    []string `json:"links,omitempty"`
 }
 
 type fwRuleDef struct {
@@ -65,7 +120,10 @@ type fwRuleDef struct {
 type fwTargetDef interface{}
 
 func cidrParserWrapper(rawCIDR string) net.IPNet {
-	_, netAddr, _ := net.ParseCIDR(rawCIDR)
+	_, netAddr, err := net.ParseCIDR(rawCIDR)
+	if err != nil {
+		return net.IPNet{}
+	}
 	return *netAddr
 }
 
@@ -86,8 +144,17 @@ func parseDef(rawDef []byte) (netDef, error) {
 
 	parsedSubnets := map[string]subnetDef{}
 	for subnetName, rawSubnet := range rDef.Subnets {
+		if _, _, err := net.ParseCIDR(rawSubnet.CIDRBlock); err != nil {
+			return netDef{}, fmt.Errorf("subnet %s: %w", subnetName, err)
+		}
 		parsedSubnets[subnetName] = subnetDef{
 			CIDRBlock: cidrParserWrapper(rawSubnet.CIDRBlock),
+			Type:      rawSubnet.Type,
+			VLAN:      rawSubnet.VLAN,
+			Trunk:     rawSubnet.Trunk,
+			OVS:       rawSubnet.OVS,
+			Shaping:   rawSubnet.Shaping,
+			Mirror:    rawSubnet.Mirror,
 			Hosts:     rawSubnet.Hosts,
 		}
 	}
@@ -104,6 +171,7 @@ func parseDef(rawDef []byte) (netDef, error) {
 		AutomaticRouting: rDef.AutomaticRouting,
 		Subnets:          parsedSubnets,
 		Routers:          rDef.Routers,
+		Switches:         rDef.Switches,
 	}
 
 	return def, validateDef(def)
@@ -115,5 +183,123 @@ func validateDef(def netDef) error {
 	if err := validate.Struct(def); err != nil {
 		return err
 	}
+
+	if err := validateVLANs(def); err != nil {
+		return err
+	}
+	if err := validateSwitches(def); err != nil {
+		return err
+	}
+	if err := validateOVS(def); err != nil {
+		return err
+	}
+	if err := validateMirrors(def); err != nil {
+		return err
+	}
+	if err := validateShaping(def); err != nil {
+		return err
+	}
+
+	for subnetName, subnet := range def.Subnets {
+		if err := validateSubnetType(def, subnetName, subnet); err != nil {
+			return err
+		}
+		for host, hDef := range subnet.Hosts {
+			if err := hDef.ContainerOptions.validate(); err != nil {
+				return fmt.Errorf("host %s on subnet %s: %w", host, subnetName, err)
+			}
+			if hDef.Link == nil {
+				continue
+			}
+			if err := hDef.Link.validate(); err != nil {
+				return fmt.Errorf("host %s on subnet %s: %w", host, subnetName, err)
+			}
+		}
+	}
+
+	for routerName, router := range def.Routers {
+		if err := validateFWRules(router.FWRules); err != nil {
+			return fmt.Errorf("router %s: %w", routerName, err)
+		}
+		if err := router.ContainerOptions.validate(); err != nil {
+			return fmt.Errorf("router %s: %w", routerName, err)
+		}
+		for subnetName, li := range router.Links {
+			if !contains(router.Subnets, subnetName) {
+				return fmt.Errorf("router %s: impaired link to subnet %s it's not attached to", routerName, subnetName)
+			}
+			if err := li.validate(); err != nil {
+				return fmt.Errorf("router %s on subnet %s: %w", routerName, subnetName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSubnetType checks point-to-point subnets join exactly two nodes
+// and have room for both of them: anything from a /31 down will do.
+func validateSubnetType(def netDef, subnetName string, subnet subnetDef) error {
+	switch subnet.Type {
+	case "", subnetTypeBridge:
+		return nil
+	case subnetTypeP2P:
+	default:
+		return fmt.Errorf("subnet %s: unknown type %q: it should be either %s or %s",
+			subnetName, subnet.Type, subnetTypeBridge, subnetTypeP2P)
+	}
+
+	if ones, _ := subnet.CIDRBlock.Mask.Size(); ones > 31 {
+		return fmt.Errorf("subnet %s: point-to-point subnets need at least a /31", subnetName)
+	}
+	if endpoints := p2pEndpoints(def, subnetName); len(endpoints) != 2 {
+		return fmt.Errorf("subnet %s: point-to-point subnets join exactly two nodes, not %d: %v",
+			subnetName, len(endpoints), endpoints)
+	}
+	return nil
+}
+
+// p2pEndpoints returns the sorted names of the nodes attached to subnetName.
+func p2pEndpoints(def netDef, subnetName string) []string {
+	endpoints := sortedKeys(def.Subnets[subnetName].Hosts)
+	for _, routerName := range sortedKeys(def.Routers) {
+		if contains(def.Routers[routerName].Subnets, subnetName) {
+			endpoints = append(endpoints, routerName)
+		}
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+func (subnet subnetDef) isP2P() bool {
+	return subnet.Type == subnetTypeP2P
+}
+
+// validateVLANs checks VLAN IDs are valid and unique within their trunk
+// and that trunk bridges don't clash with the bridges of other subnets.
+func validateVLANs(def netDef) error {
+	vlans := map[string]string{}
+	for _, subnetName := range sortedKeys(def.Subnets) {
+		subnet := def.Subnets[subnetName]
+		if subnet.VLAN == 0 {
+			if subnet.Trunk != "" {
+				return fmt.Errorf("subnet %s: only subnets with a VLAN ID can be on trunk %s", subnetName, subnet.Trunk)
+			}
+			continue
+		}
+		if subnet.VLAN < minVLAN || subnet.VLAN > maxVLAN {
+			return fmt.Errorf("subnet %s: VLAN ID %d is not within [%d, %d]", subnetName, subnet.VLAN, minVLAN, maxVLAN)
+		}
+		if subnet.isP2P() {
+			return fmt.Errorf("subnet %s: point-to-point subnets can't be on a VLAN", subnetName)
+		}
+		if _, ok := def.Subnets[subnet.trunk()]; ok {
+			return fmt.Errorf("subnet %s: trunk %s has the same name as a subnet", subnetName, subnet.trunk())
+		}
+		key := fmt.Sprintf("%s/%d", subnet.trunk(), subnet.VLAN)
+		if other, ok := vlans[key]; ok {
+			return fmt.Errorf("subnets %s and %s share VLAN %d on trunk %s", other, subnetName, subnet.VLAN, subnet.trunk())
+		}
+		vlans[key] = subnetName
+	}
 	return nil
 }
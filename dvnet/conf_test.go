@@ -152,10 +152,10 @@ func TestNetDefLoading(t *testing.T) {
 				UpdateHostsFile: true,
 				Subnets: map[string]subnetDef{
 					"A": {CIDRBlock: cidrParserWrapper("10.0.0.0/24"), Hosts: map[string]HostDef{
-						"A-1": {"pcollado/dhost"}, "A-2": {"pcollado/dhost"},
+						"A-1": {Image: "pcollado/dhost"}, "A-2": {Image: "pcollado/dhost"},
 					}},
 					"B": {CIDRBlock: cidrParserWrapper("10.0.1.0/24"), Hosts: map[string]HostDef{
-						"B-1": {"pcollado/dhost"}, "B-2": {"pcollado/dhost"},
+						"B-1": {Image: "pcollado/dhost"}, "B-2": {Image: "pcollado/dhost"},
 					}}},
 				Routers: map[string]routerDef{
 					"R-1": {
@@ -178,13 +178,13 @@ func TestNetDefLoading(t *testing.T) {
 				UpdateHostsFile: false,
 				Subnets: map[string]subnetDef{
 					"A": {CIDRBlock: cidrParserWrapper("10.0.0.0/24"), Hosts: map[string]HostDef{
-						"A-1": {"pcollado/dhost"}, "A-2": {"pcollado/dhost"}, "A-3": {"pcollado/dhost"},
+						"A-1": {Image: "pcollado/dhost"}, "A-2": {Image: "pcollado/dhost"}, "A-3": {Image: "pcollado/dhost"},
 					}},
 					"B": {CIDRBlock: cidrParserWrapper("10.0.1.0/24"), Hosts: map[string]HostDef{
-						"B-1": {"pcollado/dhost"}, "B-2": {"pcollado/dhost"}, "B-3": {"pcollado/dhost"},
+						"B-1": {Image: "pcollado/dhost"}, "B-2": {Image: "pcollado/dhost"}, "B-3": {Image: "pcollado/dhost"},
 					}},
 					"C": {CIDRBlock: cidrParserWrapper("10.0.2.0/24"), Hosts: map[string]HostDef{
-						"C-1": {"pcollado/dhost"}, "C-2": {"pcollado/dhost"}, "C-3": {"pcollado/dhost"},
+						"C-1": {Image: "pcollado/dhost"}, "C-2": {Image: "pcollado/dhost"}, "C-3": {Image: "pcollado/dhost"},
 					}}},
 				Routers: map[string]routerDef{
 					"R-1": {
@@ -212,40 +212,40 @@ func TestNetDefLoading(t *testing.T) {
 				UpdateHostsFile: true,
 				Subnets: map[string]subnetDef{
 					"A": {CIDRBlock: cidrParserWrapper("10.0.0.0/24"), Hosts: map[string]HostDef{
-						"A-1": {"pcollado/dhost"}, "A-2": {"pcollado/dhost"}, "A-3": {"pcollado/dhost"},
+						"A-1": {Image: "pcollado/dhost"}, "A-2": {Image: "pcollado/dhost"}, "A-3": {Image: "pcollado/dhost"},
 					}},
 					"B": {CIDRBlock: cidrParserWrapper("10.0.1.0/24"), Hosts: map[string]HostDef{
-						"B-1": {"pcollado/dhost"}, "B-2": {"pcollado/dhost"}, "B-3": {"pcollado/dhost"},
+						"B-1": {Image: "pcollado/dhost"}, "B-2": {Image: "pcollado/dhost"}, "B-3": {Image: "pcollado/dhost"},
 					}},
 					"C": {CIDRBlock: cidrParserWrapper("10.0.2.0/24"), Hosts: map[string]HostDef{
-						"C-1": {"pcollado/dhost"}, "C-2": {"pcollado/dhost"}, "C-3": {"pcollado/dhost"},
+						"C-1": {Image: "pcollado/dhost"}, "C-2": {Image: "pcollado/dhost"}, "C-3": {Image: "pcollado/dhost"},
 					}},
 					"D": {CIDRBlock: cidrParserWrapper("10.0.3.0/24"), Hosts: map[string]HostDef{
-						"D-1": {"pcollado/dhost"}, "D-2": {"pcollado/dhost"}, "D-3": {"pcollado/dhost"},
+						"D-1": {Image: "pcollado/dhost"}, "D-2": {Image: "pcollado/dhost"}, "D-3": {Image: "pcollado/dhost"},
 					}},
 					"E": {CIDRBlock: cidrParserWrapper("10.0.4.0/24"), Hosts: map[string]HostDef{
-						"E-1": {"pcollado/dhost"}, "E-2": {"pcollado/dhost"}, "E-3": {"pcollado/dhost"},
+						"E-1": {Image: "pcollado/dhost"}, "E-2": {Image: "pcollado/dhost"}, "E-3": {Image: "pcollado/dhost"},
 					}},
 					"F": {CIDRBlock: cidrParserWrapper("10.0.5.0/24"), Hosts: map[string]HostDef{
-						"F-1": {"pcollado/dhost"}, "F-2": {"pcollado/dhost"}, "F-3": {"pcollado/dhost"},
+						"F-1": {Image: "pcollado/dhost"}, "F-2": {Image: "pcollado/dhost"}, "F-3": {Image: "pcollado/dhost"},
 					}},
 					"G": {CIDRBlock: cidrParserWrapper("10.0.6.0/24"), Hosts: map[string]HostDef{
-						"G-1": {"pcollado/dhost"}, "G-2": {"pcollado/dhost"}, "G-3": {"pcollado/dhost"},
+						"G-1": {Image: "pcollado/dhost"}, "G-2": {Image: "pcollado/dhost"}, "G-3": {Image: "pcollado/dhost"},
 					}},
 					"H": {CIDRBlock: cidrParserWrapper("10.0.7.0/24"), Hosts: map[string]HostDef{
-						"H-1": {"pcollado/dhost"}, "H-2": {"pcollado/dhost"}, "H-3": {"pcollado/dhost"},
+						"H-1": {Image: "pcollado/dhost"}, "H-2": {Image: "pcollado/dhost"}, "H-3": {Image: "pcollado/dhost"},
 					}},
 					"I": {CIDRBlock: cidrParserWrapper("10.0.8.0/24"), Hosts: map[string]HostDef{
-						"I-1": {"pcollado/dhost"}, "I-2": {"pcollado/dhost"}, "I-3": {"pcollado/dhost"},
+						"I-1": {Image: "pcollado/dhost"}, "I-2": {Image: "pcollado/dhost"}, "I-3": {Image: "pcollado/dhost"},
 					}},
 					"J": {CIDRBlock: cidrParserWrapper("10.0.9.0/24"), Hosts: map[string]HostDef{
-						"J-1": {"pcollado/dhost"}, "J-2": {"pcollado/dhost"}, "J-3": {"pcollado/dhost"},
+						"J-1": {Image: "pcollado/dhost"}, "J-2": {Image: "pcollado/dhost"}, "J-3": {Image: "pcollado/dhost"},
 					}},
 					"K": {CIDRBlock: cidrParserWrapper("10.0.10.0/24"), Hosts: map[string]HostDef{
-						"K-1": {"pcollado/dhost"}, "K-2": {"pcollado/dhost"}, "K-3": {"pcollado/dhost"},
+						"K-1": {Image: "pcollado/dhost"}, "K-2": {Image: "pcollado/dhost"}, "K-3": {Image: "pcollado/dhost"},
 					}},
 					"L": {CIDRBlock: cidrParserWrapper("10.0.11.0/24"), Hosts: map[string]HostDef{
-						"L-1": {"pcollado/dhost"}, "L-2": {"pcollado/dhost"}, "L-3": {"pcollado/dhost"},
+						"L-1": {Image: "pcollado/dhost"}, "L-2": {Image: "pcollado/dhost"}, "L-3": {Image: "pcollado/dhost"},
 					}}},
 				Routers: map[string]routerDef{
 					"R-1": {
@@ -288,3 +288,142 @@ func TestNetDefValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestP2PValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnets string
+		routers string
+		wantErr bool
+	}{
+		{
+			"two routers",
+			`"C": {"cidr": "10.0.2.0/31", "type": "p2p", "hosts": {}}`,
+			`"R-1": {"subnets": ["C"]}, "R-2": {"subnets": ["C"]}`,
+			false,
+		},
+		{
+			"a host and a router",
+			`"C": {"cidr": "10.0.2.0/30", "type": "p2p", "hosts": {"C-1": {"image": "pcollado/dhost"}}}`,
+			`"R-1": {"subnets": ["C"]}`,
+			false,
+		},
+		{
+			"three routers",
+			`"C": {"cidr": "10.0.2.0/29", "type": "p2p", "hosts": {}}`,
+			`"R-1": {"subnets": ["C"]}, "R-2": {"subnets": ["C"]}, "R-3": {"subnets": ["C"]}`,
+			true,
+		},
+		{
+			"a lonely router",
+			`"C": {"cidr": "10.0.2.0/31", "type": "p2p", "hosts": {}}`,
+			`"R-1": {"subnets": ["C"]}`,
+			true,
+		},
+		{
+			"no room for two",
+			`"C": {"cidr": "10.0.2.0/32", "type": "p2p", "hosts": {}}`,
+			`"R-1": {"subnets": ["C"]}, "R-2": {"subnets": ["C"]}`,
+			true,
+		},
+		{
+			"unknown type",
+			`"C": {"cidr": "10.0.2.0/24", "type": "mesh", "hosts": {}}`,
+			`"R-1": {"subnets": ["C"]}`,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		rawDef := `{"name": "P2P", "subnets": {` + test.subnets + `}, "routers": {` + test.routers + `}}`
+		if _, err := parseDef([]byte(rawDef)); (err != nil) != test.wantErr {
+			t.Errorf("%s: parseDef() err %v; wanted an error: %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestVLANValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnets string
+		wantErr bool
+	}{
+		{"two VLANs on the default trunk", `"A": {"cidr": "10.0.0.0/24", "vlan": 10, "hosts": {}}, "B": {"cidr": "10.0.1.0/24", "vlan": 20, "hosts": {}}`, false},
+		{"the same VLAN on different trunks", `"A": {"cidr": "10.0.0.0/24", "vlan": 10, "hosts": {}}, "B": {"cidr": "10.0.1.0/24", "vlan": 10, "trunk": "core", "hosts": {}}`, false},
+		{"the same VLAN on the same trunk", `"A": {"cidr": "10.0.0.0/24", "vlan": 10, "hosts": {}}, "B": {"cidr": "10.0.1.0/24", "vlan": 10, "hosts": {}}`, true},
+		{"an out of range VLAN", `"A": {"cidr": "10.0.0.0/24", "vlan": 4095, "hosts": {}}`, true},
+		{"a trunk without a VLAN", `"A": {"cidr": "10.0.0.0/24", "trunk": "core", "hosts": {}}`, true},
+		{"a trunk named after a subnet", `"A": {"cidr": "10.0.0.0/24", "vlan": 10, "trunk": "B", "hosts": {}}, "B": {"cidr": "10.0.1.0/24", "hosts": {}}`, true},
+	}
+
+	for _, test := range tests {
+		rawDef := `{"name": "VLAN", "subnets": {` + test.subnets + `}, "routers": {}}`
+		if _, err := parseDef([]byte(rawDef)); (err != nil) != test.wantErr {
+			t.Errorf("%s: parseDef() err %v; wanted an error: %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestSwitchValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnets  string
+		switches string
+		wantErr  bool
+	}{
+		{"a loop of switches", `"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "h", "switch": "S-2"}}}`,
+			`"S-1": {"subnet": "A", "stp": true, "links": ["S-2"]}, "S-2": {"subnet": "A", "stp": true, "priority": 4096, "links": ["S-1"]}`, false},
+		{"a switch on a missing subnet", `"A": {"cidr": "10.0.0.0/24", "hosts": {}}`, `"S-1": {"subnet": "B"}`, true},
+		{"a link to a missing switch", `"A": {"cidr": "10.0.0.0/24", "hosts": {}}`, `"S-1": {"subnet": "A", "links": ["S-2"]}`, true},
+		{"a link across subnets", `"A": {"cidr": "10.0.0.0/24", "hosts": {}}, "B": {"cidr": "10.0.1.0/24", "hosts": {}}`,
+			`"S-1": {"subnet": "A", "links": ["S-2"]}, "S-2": {"subnet": "B"}`, true},
+		{"a priority without STP", `"A": {"cidr": "10.0.0.0/24", "hosts": {}}`, `"S-1": {"subnet": "A", "priority": 4096}`, true},
+		{"an out of range priority", `"A": {"cidr": "10.0.0.0/24", "hosts": {}}`, `"S-1": {"subnet": "A", "stp": true, "priority": 65536}`, true},
+		{"a switch on a VLAN", `"A": {"cidr": "10.0.0.0/24", "vlan": 10, "hosts": {}}`, `"S-1": {"subnet": "A"}`, true},
+		{"a switch named after a subnet", `"A": {"cidr": "10.0.0.0/24", "hosts": {}}`, `"A": {"subnet": "A"}`, true},
+		{"a host on a missing switch", `"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "h", "switch": "S-2"}}}`,
+			`"S-1": {"subnet": "A"}`, true},
+	}
+
+	for _, test := range tests {
+		rawDef := `{"name": "Switches", "subnets": {` + test.subnets + `}, "switches": {` + test.switches + `}, "routers": {}}`
+		if _, err := parseDef([]byte(rawDef)); (err != nil) != test.wantErr {
+			t.Errorf("%s: parseDef() err %v; wanted an error: %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestContainerOptionsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		wantErr bool
+	}{
+		{"every option", `"command": ["sleep", "infinity"], "entrypoint": ["/bin/sh", "-c"], "env": {"LAB": "1"},
+			"volumes": ["/srv/lab:/lab:ro", "captures:/captures"], "cpus": 0.5, "memory": "256m",
+			"cap_add": ["cap_net_raw", "SYS_PTRACE"], "privileged": true, "sysctls": {"net.ipv4.tcp_syncookies": "0"},
+			"workdir": "/lab"`, false},
+		{"an environment variable without a name", `"env": {"": "1"}`, true},
+		{"a volume without a target", `"volumes": ["/srv/lab"]`, true},
+		{"a volume with a relative target", `"volumes": ["/srv/lab:lab"]`, true},
+		{"a volume with a relative source", `"volumes": ["./lab:/lab"]`, true},
+		{"a volume with an unknown mode", `"volumes": ["/srv/lab:/lab:rx"]`, true},
+		{"negative CPUs", `"cpus": -1`, true},
+		{"memory without a size", `"memory": "lots"`, true},
+		{"too little memory", `"memory": "1m"`, true},
+		{"an unknown capability", `"cap_add": ["NET_TELEPATHY"]`, true},
+		{"a host-wide sysctl", `"sysctls": {"vm.swappiness": "10"}`, true},
+		{"a relative working directory", `"workdir": "lab"`, true},
+	}
+
+	for _, test := range tests {
+		for _, rawDef := range []string{
+			`{"name": "Options", "subnets": {"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "h", ` + test.options + `}}}}, "routers": {}}`,
+			`{"name": "Options", "subnets": {"A": {"cidr": "10.0.0.0/24", "hosts": {}}}, "routers": {"R-1": {"subnets": ["A"], "image": "r", ` + test.options + `}}}`,
+		} {
+			if _, err := parseDef([]byte(rawDef)); (err != nil) != test.wantErr {
+				t.Errorf("%s: parseDef() err %v; wanted an error: %t", test.name, err, test.wantErr)
+			}
+		}
+	}
+}
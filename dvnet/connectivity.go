@@ -0,0 +1,488 @@
+package dvnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/RyanCarrier/dijkstra"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Protocols probes can be sent over.
+const (
+	ProbeICMP string = "icmp"
+	ProbeTCP  string = "tcp"
+)
+
+// Formats reports can be written in: text is meant for humans, JSON
+// for scripts and JUnit XML for CI systems and autograders.
+const (
+	ReportText  string = "text"
+	ReportJSON  string = "json"
+	ReportJUnit string = "junit"
+)
+
+const (
+	// DefaultProbeTimeout is how long probes wait for an answer unless told otherwise.
+	DefaultProbeTimeout = time.Second
+
+	// probeParallelism is how many probes can be in flight at once.
+	probeParallelism = 16
+)
+
+// errProbeRefused means a TCP probe was answered with a reset: nothing
+// listens on the port, but the network did carry us there and back.
+var errProbeRefused = errors.New("connection refused")
+
+// probeTarget is what a probe tries to reach: an address and, over TCP, a port on it.
+type probeTarget struct {
+	Protocol string
+	Address  string
+	Port     int
+}
+
+// ConnectivityOptions tunes a connectivity check. Every pair of nodes is
+// probed over ICMP and, if there are any TCPPorts, on each one of them too.
+// Timeout is how long each probe waits for an answer, e.g. 500ms.
+type ConnectivityOptions struct {
+	TCPPorts []int  `json:"tcp_ports,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+// ProbeResult is the outcome of probing Address, which belongs to node To,
+// from node From. Predicted tells whether the definition's routing and
+// firewall rules say the probe should've gotten through, Path being the
+// routers it's expected to go through and Reason why it wouldn't get there.
+// TCP probes met with a reset are Reachable but Refused.
+type ProbeResult struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Address   string   `json:"address"`
+	Protocol  string   `json:"protocol"`
+	Port      int      `json:"port,omitempty"`
+	Reachable bool     `json:"reachable"`
+	Refused   bool     `json:"refused,omitempty"`
+	LatencyMS float64  `json:"latency_ms,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Predicted bool     `json:"predicted"`
+	Path      []string `json:"path,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// Service names what was probed: icmp or tcp/<port>.
+func (pr ProbeResult) Service() string {
+	if pr.Protocol == ProbeTCP {
+		return fmt.Sprintf("%s/%d", ProbeTCP, pr.Port)
+	}
+	return pr.Protocol
+}
+
+// Unexpected tells whether the probe's outcome differs from the prediction.
+func (pr ProbeResult) Unexpected() bool {
+	return pr.Reachable != pr.Predicted
+}
+
+func (pr ProbeResult) String() string {
+	return fmt.Sprintf("%s -> %s (%s) %s", pr.From, pr.To, pr.Address, pr.Service())
+}
+
+// explain tells what happened to the probe and what was expected instead.
+func (pr ProbeResult) explain() string {
+	outcome := "unreachable"
+	switch {
+	case pr.Refused:
+		outcome = fmt.Sprintf("reachable in %.2fms, but refused", pr.LatencyMS)
+	case pr.Reachable:
+		outcome = fmt.Sprintf("reachable in %.2fms", pr.LatencyMS)
+	case pr.Error != "":
+		outcome += ": " + pr.Error
+	}
+
+	switch {
+	case pr.Predicted && len(pr.Path) > 0:
+		return fmt.Sprintf("%s; expected it to be reachable through %s", outcome, strings.Join(pr.Path, ", "))
+	case pr.Predicted:
+		return fmt.Sprintf("%s; expected it to be reachable on a shared subnet", outcome)
+	}
+	return fmt.Sprintf("%s; expected it to be unreachable as %s", outcome, pr.Reason)
+}
+
+// ConnectivityReport holds the outcome of probing
+// every node of a network from every one of its hosts.
+type ConnectivityReport struct {
+	Network string        `json:"network"`
+	Probes  []ProbeResult `json:"probes"`
+}
+
+// Unexpected returns the probes whose outcome differs from the prediction.
+func (cr *ConnectivityReport) Unexpected() []ProbeResult {
+	unexpected := []ProbeResult{}
+	for _, pr := range cr.Probes {
+		if pr.Unexpected() {
+			unexpected = append(unexpected, pr)
+		}
+	}
+	return unexpected
+}
+
+// CheckConnectivity probes every address of every node of the network with the
+// given name, ID or ID prefix from within each one of its hosts. Probes run in
+// the nodes' network namespaces, so their images need no tools of their own.
+func (d Driver) CheckConnectivity(network string, opts ConnectivityOptions) (*ConnectivityReport, error) {
+	timeout := DefaultProbeTimeout
+	if opts.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(opts.Timeout); err != nil || timeout <= 0 {
+			return nil, invalidError{fmt.Errorf("invalid probe timeout %q", opts.Timeout)}
+		}
+	}
+	for _, port := range opts.TCPPorts {
+		if port <= 0 || port > 65535 {
+			return nil, invalidError{fmt.Errorf("invalid TCP port %d", port)}
+		}
+	}
+
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return nil, err
+	}
+	return checkConnectivity(ns, opts.TCPPorts, timeout)
+}
+
+func checkConnectivity(ns *NetworkState, tcpPorts []int, timeout time.Duration) (*ConnectivityReport, error) {
+	graph, err := genGraph(ns.Definition)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't build the network's graph: %w", err)
+	}
+
+	addrs := nodeAddrs(ns)
+	hosts := []string{}
+	for _, subnet := range ns.Subnets {
+		for host := range subnet.Containers {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	report := &ConnectivityReport{Network: ns.Definition.Name, Probes: []ProbeResult{}}
+	for _, src := range hosts {
+		for _, dstNode := range sortedKeys(addrs) {
+			if dstNode == src {
+				continue
+			}
+			for _, addr := range addrs[dstNode] {
+				predicted, path, reason := predictReach(ns, graph, src, dstNode, addr)
+				base := ProbeResult{From: src, To: dstNode, Address: addr, Predicted: predicted, Path: path, Reason: reason}
+				for _, target := range probeTargets(addr, tcpPorts) {
+					pr := base
+					pr.Protocol, pr.Port = target.Protocol, target.Port
+					report.Probes = append(report.Probes, pr)
+				}
+			}
+		}
+	}
+
+	ns.log().debug("sending %d probes\n", len(report.Probes))
+	runProbes(ns, report.Probes, timeout)
+	return report, nil
+}
+
+func probeTargets(addr string, tcpPorts []int) []probeTarget {
+	targets := []probeTarget{{Protocol: ProbeICMP, Address: addr}}
+	for _, port := range tcpPorts {
+		targets = append(targets, probeTarget{Protocol: ProbeTCP, Address: addr, Port: port})
+	}
+	return targets
+}
+
+// nodeAddrs returns the addresses of every node within the network,
+// leaving out the ones used to reach the outside world.
+func nodeAddrs(ns *NetworkState) map[string][]string {
+	addrs := map[string][]string{}
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		if link.Subnet == outboundSubnetName || link.CIDR == "" {
+			continue
+		}
+		addrs[link.Node] = append(addrs[link.Node], strings.Split(link.CIDR, "/")[0])
+	}
+	return addrs
+}
+
+// predictReach tells whether traffic from src should make it to address dstAddr
+// of dstNode and back. Nodes sharing a subnet reach each other directly. Others
+// go along the shortest path between them in the definition's graph, which is
+// what automatic routing installs routes for, as long as the firewalls of the
+// routers on it let the traffic through both ways. It also returns the routers
+// on that path or, if traffic isn't expected to get there, the reason why.
+func predictReach(ns *NetworkState, graph *dijkstra.Graph, src, dstNode, dstAddr string) (bool, []string, string) {
+	for _, link := range ns.Links {
+		if link.Node == dstNode && strings.Split(link.CIDR, "/")[0] == dstAddr {
+			if _, ok := ns.Links[linkKey(src, link.Subnet)]; ok {
+				return true, nil, ""
+			}
+			break
+		}
+	}
+
+	srcID, srcErr := graph.GetMapping(src)
+	dstID, dstErr := graph.GetMapping(dstNode)
+	if srcErr != nil || dstErr != nil {
+		return false, nil, fmt.Sprintf("the definition doesn't place both %s and %s", src, dstNode)
+	}
+	best, err := graph.Shortest(srcID, dstID)
+	if err != nil {
+		return false, nil, fmt.Sprintf("there's no path from %s to %s", src, dstNode)
+	}
+	path := []string{}
+	for _, vertex := range best.Path {
+		name, _ := graph.GetMapped(vertex)
+		// Switches are transparent as far as routing is concerned.
+		if _, isSwitch := ns.Definition.Switches[name]; !isSwitch {
+			path = append(path, name)
+		}
+	}
+	hops := path[1 : len(path)-1]
+
+	srcAddr := ""
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		if _, ok := ns.Links[linkKey(path[1], link.Subnet)]; link.Node == src && ok {
+			srcAddr = strings.Split(link.CIDR, "/")[0]
+			break
+		}
+	}
+
+	for _, hop := range hops {
+		if _, isRouter := ns.Routers[hop]; !isRouter {
+			return false, hops, fmt.Sprintf("%s is a host, which doesn't forward traffic", hop)
+		}
+		for _, flow := range [][2]string{{srcAddr, dstAddr}, {dstAddr, srcAddr}} {
+			if fwVerdict(ns, hop, flow[0], flow[1]) == "DROP" {
+				return false, hops, fmt.Sprintf("%s's firewall drops traffic from %s to %s", hop, flow[0], flow[1])
+			}
+		}
+	}
+	return true, hops, ""
+}
+
+// runProbes sends every probe in results from within the namespace of
+// its source node and records its outcome on it. Probes run concurrently.
+func runProbes(ns *NetworkState, results []ProbeResult, timeout time.Duration) {
+	slots := make(chan struct{}, probeParallelism)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(pr *ProbeResult) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			pid, ok := ns.nodePID(pr.From)
+			if !ok {
+				pr.Error = errUnknownNode(pr.From).Error()
+				return
+			}
+			rtt, err := ns.backend.probe(pid, probeTarget{Protocol: pr.Protocol, Address: pr.Address, Port: pr.Port}, timeout)
+			pr.Reachable = err == nil || errors.Is(err, errProbeRefused)
+			pr.Refused = errors.Is(err, errProbeRefused)
+			if pr.Reachable {
+				pr.LatencyMS = float64(rtt.Microseconds()) / 1000
+			} else if err != nil {
+				pr.Error = err.Error()
+			}
+			ns.log().with("node", pr.From).debug("probed %s: reachable %t after %s\n", pr, pr.Reachable, rtt)
+		}(&results[i])
+	}
+	wg.Wait()
+}
+
+// probeSeq tells apart the ICMP echo requests of concurrent probes.
+var probeSeq uint32
+
+// probe sends a probe to target from within the network namespace of the
+// container whose PID is containerPID. It returns the round trip time.
+func (linuxBackend) probe(containerPID int, target probeTarget, timeout time.Duration) (time.Duration, error) {
+	var rtt time.Duration
+	err := inContainerNS(containerPID, func() error {
+		var err error
+		if target.Protocol == ProbeTCP {
+			rtt, err = dialTCP(target, timeout)
+		} else {
+			rtt, err = pingICMP(target.Address, timeout)
+		}
+		return err
+	})
+	return rtt, err
+}
+
+func dialTCP(target probeTarget, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort(target.Address, fmt.Sprint(target.Port)), timeout)
+	rtt := time.Since(start)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return rtt, errProbeRefused
+		}
+		return 0, err
+	}
+	conn.Close()
+	return rtt, nil
+}
+
+// pingICMP sends an ICMP echo request to addr and waits for the matching reply.
+// Sockets stay within the namespace they're created in, so this must be called
+// from within the namespace of the node we're probing from.
+func pingICMP(addr string, timeout time.Duration) (time.Duration, error) {
+	dst := net.ParseIP(addr)
+	if dst == nil {
+		return 0, fmt.Errorf("invalid address %q", addr)
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open an ICMP socket: %w", err)
+	}
+	defer conn.Close()
+
+	id, seq := os.Getpid()&0xffff, int(atomic.AddUint32(&probeSeq, 1)&0xffff)
+	request, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("dvnet")}}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(request, &net.IPAddr{IP: dst}); err != nil {
+		return 0, err
+	}
+	if err := conn.SetReadDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return 0, fmt.Errorf("no reply within %s", timeout)
+			}
+			return 0, err
+		}
+		// Raw sockets get every ICMP message, so others' have to be skipped.
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); !ok || echo.ID != id || echo.Seq != seq {
+			continue
+		}
+		if peerAddr, ok := peer.(*net.IPAddr); !ok || !peerAddr.IP.Equal(dst) {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+// Write writes the report in the given format.
+func (cr *ConnectivityReport) Write(w io.Writer, format string) error {
+	return writeReport(w, format, cr, cr.WriteText, cr.WriteJUnit)
+}
+
+// WriteText writes a reachability matrix per service with the hosts probed
+// from as rows and the addresses probed as columns. Cells hold the latency
+// of reachable addresses and an x otherwise, followed by a ! if that's not
+// what the definition predicts. Unexpected outcomes are then explained.
+func (cr *ConnectivityReport) WriteText(w io.Writer) error {
+	services, sources, targets := []string{}, []string{}, []string{}
+	seen := map[*[]string]map[string]bool{&services: {}, &sources: {}, &targets: {}}
+	add := func(list *[]string, item string) {
+		if !seen[list][item] {
+			seen[list][item] = true
+			*list = append(*list, item)
+		}
+	}
+	cells := map[[3]string]ProbeResult{}
+	for _, pr := range cr.Probes {
+		target := pr.To + " " + pr.Address
+		add(&services, pr.Service())
+		add(&sources, pr.From)
+		add(&targets, target)
+		cells[[3]string{pr.Service(), pr.From, target}] = pr
+	}
+	// Nodes don't probe themselves, so the first one's addresses would come last.
+	sort.SliceStable(targets, func(i, j int) bool {
+		return strings.Fields(targets[i])[0] < strings.Fields(targets[j])[0]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, service := range services {
+		fmt.Fprintf(tw, "%s\t%s\n", service, strings.Join(targets, "\t"))
+		for _, src := range sources {
+			row := []string{src}
+			for _, target := range targets {
+				pr, ok := cells[[3]string{service, src, target}]
+				cell := "-"
+				switch {
+				case !ok:
+				case pr.Refused:
+					cell = "refused"
+				case pr.Reachable:
+					cell = fmt.Sprintf("%.2fms", pr.LatencyMS)
+				default:
+					cell = "x"
+				}
+				if ok && pr.Unexpected() {
+					cell += "!"
+				}
+				row = append(row, cell)
+			}
+			fmt.Fprintf(tw, "%s\n", strings.Join(row, "\t"))
+		}
+		fmt.Fprintf(tw, "\n")
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	unexpected := cr.Unexpected()
+	for _, pr := range unexpected {
+		if _, err := fmt.Fprintf(w, "unexpected: %s is %s\n", pr, pr.explain()); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d probes, %d unexpected\n", len(cr.Probes), len(unexpected))
+	return err
+}
+
+// WriteJUnit writes the report as a JUnit XML test suite: every probe is a
+// test case which fails if its outcome differs from the prediction.
+func (cr *ConnectivityReport) WriteJUnit(w io.Writer) error {
+	suite := junitSuite{Name: "connectivity of " + cr.Network, Cases: []junitCase{}}
+	for _, pr := range cr.Probes {
+		c := junitCase{Name: pr.String(), ClassName: cr.Network + "." + pr.From}
+		if pr.Reachable {
+			c.Time = fmt.Sprintf("%.6f", pr.LatencyMS/1000)
+		}
+		if pr.Unexpected() {
+			c.Failure = &junitFailure{Message: pr.explain(), Type: "unexpected reachability", Details: pr.Error}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	return writeJUnit(w, suite)
+}
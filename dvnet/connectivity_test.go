@@ -0,0 +1,152 @@
+package dvnet
+
+import (
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// probeBackend is a planBackend whose probes are answered by answer.
+type probeBackend struct {
+	*planBackend
+	answer func(containerPID int, target probeTarget) (time.Duration, error)
+}
+
+func (pb probeBackend) probe(containerPID int, target probeTarget, timeout time.Duration) (time.Duration, error) {
+	return pb.answer(containerPID, target)
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	d, pb := testDriver(t)
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// R-1 keeps A-1 away from subnet B.
+	if err := applyFWRules(ns, "R-1", fwRuleDef{Policy: "ACCEPT", Drop: [][]fwTargetDef{{"A-1", "B"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.store.save(ns.ID, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything answers but B-1, which A-2 can't reach. TCP ports are all closed.
+	pidA2, _ := ns.nodePID("A-2")
+	addrB1 := strings.Split(ns.Links[linkKey("B-1", "B")].CIDR, "/")[0]
+	d.backend = probeBackend{pb, func(containerPID int, target probeTarget) (time.Duration, error) {
+		if containerPID == pidA2 && target.Address == addrB1 {
+			return 0, errors.New("no reply within 1s")
+		}
+		if target.Protocol == ProbeTCP {
+			return time.Millisecond, errProbeRefused
+		}
+		return 2 * time.Millisecond, nil
+	}}
+
+	if _, err := d.CheckConnectivity("0123", ConnectivityOptions{Timeout: "soon"}); err == nil {
+		t.Errorf("CheckConnectivity() should reject invalid timeouts")
+	}
+	report, err := d.CheckConnectivity("0123", ConnectivityOptions{TCPPorts: []int{22}, Timeout: "100ms"})
+	if err != nil {
+		t.Fatalf("CheckConnectivity() err %v", err)
+	}
+
+	// 4 hosts probe the 7 addresses of every other node (hosts have one and routers two) over ICMP and TCP.
+	if len(report.Probes) != 4*7*2 {
+		t.Errorf("CheckConnectivity() sent %d probes; wanted %d", len(report.Probes), 4*7*2)
+	}
+	probes := map[string]ProbeResult{}
+	for _, pr := range report.Probes {
+		probes[pr.From+" "+pr.Address+" "+pr.Service()] = pr
+	}
+	addrOf := func(node, subnet string) string {
+		return strings.Split(ns.Links[linkKey(node, subnet)].CIDR, "/")[0]
+	}
+
+	if pr := probes["A-2 "+addrB1+" icmp"]; pr.Reachable || !pr.Predicted || !cmp.Equal(pr.Path, []string{"R-1", "R-2"}) {
+		t.Errorf("A-2 -> B-1 should be unreachable though expected through R-1 and R-2; got %+v", pr)
+	}
+	if pr := probes["A-1 "+addrB1+" icmp"]; !pr.Reachable || pr.Predicted || !strings.Contains(pr.Reason, "R-1's firewall drops") {
+		t.Errorf("A-1 -> B-1 should be reachable though R-1's firewall should drop it; got %+v", pr)
+	}
+	if pr := probes["A-1 "+addrOf("R-2", "C")+" tcp/22"]; !pr.Reachable || !pr.Refused || !pr.Predicted || pr.LatencyMS != 1 {
+		t.Errorf("A-1 -> R-2 on C over TCP should be refused in 1ms as expected; got %+v", pr)
+	}
+	// Replies to B-1 come from A-1, so they're dropped too.
+	if pr := probes["B-1 "+addrOf("A-1", "A")+" icmp"]; pr.Predicted || !strings.Contains(pr.Reason, "from "+addrOf("A-1", "A")+" to "+addrB1) {
+		t.Errorf("B-1 -> A-1 shouldn't be expected to work as R-1 drops the replies; got %+v", pr)
+	}
+	if pr := probes["B-1 "+addrOf("A-2", "A")+" icmp"]; !pr.Predicted {
+		t.Errorf("B-1 -> A-2 should be expected to work; got %+v", pr)
+	}
+
+	unexpected := []string{}
+	for _, pr := range report.Unexpected() {
+		if pr.Protocol == ProbeICMP {
+			unexpected = append(unexpected, pr.From+" "+pr.To+" "+pr.Address)
+		}
+	}
+	sort.Strings(unexpected)
+	wantUnexpected := []string{"A-1 B-1 " + addrB1, "A-1 B-2 " + addrOf("B-2", "B"), "A-1 R-2 " + addrOf("R-2", "B"),
+		"A-2 B-1 " + addrB1, "B-1 A-1 " + addrOf("A-1", "A"), "B-2 A-1 " + addrOf("A-1", "A")}
+	if !cmp.Equal(unexpected, wantUnexpected) {
+		t.Errorf("Unexpected() over ICMP = %v; wanted %v", unexpected, wantUnexpected)
+	}
+
+	text := &strings.Builder{}
+	if err := report.Write(text, ReportText); err != nil {
+		t.Fatalf("Write(%s) err %v", ReportText, err)
+	}
+	for _, want := range []string{
+		"A-2 -> B-1 (" + addrB1 + ") icmp is unreachable: no reply within 1s; expected it to be reachable through R-1, R-2\n",
+		"56 probes, 12 unexpected\n",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text report lacks %q; got\n%s", want, text)
+		}
+	}
+
+	junit := &strings.Builder{}
+	if err := report.Write(junit, ReportJUnit); err != nil {
+		t.Fatalf("Write(%s) err %v", ReportJUnit, err)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal([]byte(junit.String()), &suites); err != nil {
+		t.Fatalf("couldn't parse the JUnit report: %v\n%s", err, junit)
+	}
+	if suites.Tests != 56 || suites.Failures != 12 || len(suites.Suites) != 1 {
+		t.Errorf("JUnit report has %d tests and %d failures in %d suites; wanted 56, 12 and 1", suites.Tests, suites.Failures, len(suites.Suites))
+	}
+
+	if err := report.Write(junit, "html"); err == nil {
+		t.Errorf("Write() should reject unknown formats")
+	}
+}
+
+func TestFWVerdict(t *testing.T) {
+	ns := &NetworkState{
+		Definition: netDef{Routers: map[string]routerDef{"R-1": {FWRules: fwRuleDef{Policy: "drop"}}}},
+		FWRules: map[string][][]string{"R-1": {
+			{fwChain, "-s", "10.0.0.1", "-d", "10.0.1.0/24", "-j", "ACCEPT"},
+			{fwChain, "-d", "10.0.2.0/24", "-j", "ACCEPT"},
+		}},
+	}
+	tests := []struct {
+		src, dst, want string
+	}{
+		{"10.0.0.1", "10.0.1.7", "ACCEPT"},
+		{"10.0.0.2", "10.0.1.7", "DROP"},
+		{"10.0.0.2", "10.0.2.1", "ACCEPT"},
+		{"10.0.1.7", "10.0.0.1", "DROP"},
+	}
+	for _, test := range tests {
+		if got := fwVerdict(ns, "R-1", test.src, test.dst); got != test.want {
+			t.Errorf("fwVerdict(%s -> %s) = %s; wanted %s", test.src, test.dst, got, test.want)
+		}
+	}
+}
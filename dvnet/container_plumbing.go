@@ -2,12 +2,188 @@ package dvnet
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
 )
 
+// Capabilities and sysctls every node's container gets on top of its own.
+var (
+	defaultCaps    = []string{"SYS_ADMIN", "NET_ADMIN"}
+	defaultSysctls = map[string]string{
+		"net.ipv4.ip_forward":                "1",
+		"net.ipv6.conf.all.disable_ipv6":     "0",
+		"net.bridge.bridge-nf-call-iptables": "0",
+	}
+)
+
+// minContainerMemory is the least memory the Docker daemon lets a container have.
+const minContainerMemory int64 = 6 * 1024 * 1024
+
+// ContainerOptions tune the container running a node. Command and Entrypoint
+// replace the image's, Env holds its environment variables and Volumes are
+// either bind mounts (/host/path:/container/path) or named volumes
+// (name:/container/path), optionally followed by :ro or :rw. CPUs can be
+// fractional and Memory takes a unit (e.g. 512m). CapAdd and Sysctls are
+// added to the ones every node gets, Sysctls overriding the defaults.
+type ContainerOptions struct {
+	Command    []string          `json:"command,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Volumes    []string          `json:"volumes,omitempty"`
+	CPUs       float64           `json:"cpus,omitempty"`
+	Memory     string            `json:"memory,omitempty"`
+	CapAdd     []string          `json:"cap_add,omitempty"`
+	Privileged bool              `json:"privileged,omitempty"`
+	Sysctls    map[string]string `json:"sysctls,omitempty"`
+	WorkDir    string            `json:"workdir,omitempty"`
+}
+
+// capabilities are the Linux capabilities containers can be given, ALL standing for every one of them.
+var capabilities = []string{"ALL",
+	"AUDIT_CONTROL", "AUDIT_READ", "AUDIT_WRITE", "BLOCK_SUSPEND", "BPF", "CHECKPOINT_RESTORE", "CHOWN",
+	"DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER", "FSETID", "IPC_LOCK", "IPC_OWNER", "KILL", "LEASE",
+	"LINUX_IMMUTABLE", "MAC_ADMIN", "MAC_OVERRIDE", "MKNOD", "NET_ADMIN", "NET_BIND_SERVICE", "NET_BROADCAST",
+	"NET_RAW", "PERFMON", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_ADMIN", "SYS_BOOT", "SYS_CHROOT",
+	"SYS_MODULE", "SYS_NICE", "SYS_PACCT", "SYS_PTRACE", "SYS_RAWIO", "SYS_RESOURCE", "SYS_TIME",
+	"SYS_TTY_CONFIG", "SYSLOG", "WAKE_ALARM",
+}
+
+// Sysctls are namespaced, and thus settable on a single container, if they're
+// one of namespacedSysctls or start with one of namespacedSysctlPrefixes.
+var (
+	namespacedSysctls = []string{"kernel.msgmax", "kernel.msgmnb", "kernel.msgmni", "kernel.sem",
+		"kernel.shmall", "kernel.shmmax", "kernel.shmmni", "kernel.shm_rmid_forced"}
+	namespacedSysctlPrefixes = []string{"fs.mqueue.", "net."}
+)
+
+var volumeNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// capName turns a capability as written in a definition (e.g. cap_net_raw) into its canonical name.
+func capName(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+}
+
+func (opts ContainerOptions) validate() error {
+	for key := range opts.Env {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("environment variable %q: names can't be empty nor contain =", key)
+		}
+	}
+	for _, volume := range opts.Volumes {
+		if err := validateVolume(volume); err != nil {
+			return err
+		}
+	}
+	if opts.CPUs < 0 {
+		return fmt.Errorf("cpus can't be negative: %g", opts.CPUs)
+	}
+	if opts.Memory != "" {
+		memory, err := units.RAMInBytes(opts.Memory)
+		if err != nil {
+			return fmt.Errorf("memory: %w", err)
+		}
+		if memory < minContainerMemory {
+			return fmt.Errorf("memory: %s is less than the minimum of %s", opts.Memory, units.BytesSize(float64(minContainerMemory)))
+		}
+	}
+	for _, capability := range opts.CapAdd {
+		if !contains(capabilities, capName(capability)) {
+			return fmt.Errorf("unknown capability %q", capability)
+		}
+	}
+	for name := range opts.Sysctls {
+		if !namespacedSysctl(name) {
+			return fmt.Errorf("sysctl %s isn't namespaced, so it can't be set on a single container", name)
+		}
+	}
+	if opts.WorkDir != "" && !path.IsAbs(opts.WorkDir) {
+		return fmt.Errorf("working directory %s isn't an absolute path", opts.WorkDir)
+	}
+	return nil
+}
+
+// validateVolume checks volume looks like source:target[:ro|rw], where source
+// is either an absolute path on the host or the name of a volume.
+func validateVolume(volume string) error {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("volume %q should look like source:target[:ro|rw]", volume)
+	}
+	if source := parts[0]; !path.IsAbs(source) && !volumeNameRe.MatchString(source) {
+		return fmt.Errorf("volume %q: %s is neither an absolute path nor a volume name", volume, source)
+	}
+	if !path.IsAbs(parts[1]) {
+		return fmt.Errorf("volume %q: %s isn't an absolute path", volume, parts[1])
+	}
+	if len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw" {
+		return fmt.Errorf("volume %q: mode %s should be either ro or rw", volume, parts[2])
+	}
+	return nil
+}
+
+func namespacedSysctl(name string) bool {
+	if contains(namespacedSysctls, name) {
+		return true
+	}
+	for _, prefix := range namespacedSysctlPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// configs returns what the container running node on img should be created with.
+func (opts ContainerOptions) configs(img, name string) (*container.Config, *container.HostConfig, error) {
+	config := &container.Config{
+		Image:      img,
+		Hostname:   name,
+		Labels:     map[string]string{nodeLabel: name},
+		Cmd:        opts.Command,
+		Entrypoint: opts.Entrypoint,
+		WorkingDir: opts.WorkDir,
+	}
+	for _, key := range sortedKeys(opts.Env) {
+		config.Env = append(config.Env, key+"="+opts.Env[key])
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode: "none",
+		Sysctls:     map[string]string{},
+		CapAdd:      append([]string{}, defaultCaps...),
+		Privileged:  opts.Privileged,
+		Binds:       opts.Volumes,
+		DNS:         []string{"1.1.1.1", "8.8.8.8"},
+	}
+	for name, value := range defaultSysctls {
+		hostConfig.Sysctls[name] = value
+	}
+	for name, value := range opts.Sysctls {
+		hostConfig.Sysctls[name] = value
+	}
+	for _, capability := range opts.CapAdd {
+		if capability = capName(capability); !contains(hostConfig.CapAdd, capability) {
+			hostConfig.CapAdd = append(hostConfig.CapAdd, capability)
+		}
+	}
+	hostConfig.NanoCPUs = int64(opts.CPUs * 1e9)
+	if opts.Memory != "" {
+		memory, err := units.RAMInBytes(opts.Memory)
+		if err != nil {
+			return nil, nil, fmt.Errorf("memory: %w", err)
+		}
+		hostConfig.Memory = memory
+	}
+	return config, hostConfig, nil
+}
+
 type containerInfo struct {
 	ID  string
 	PID int
@@ -15,27 +191,54 @@ type containerInfo struct {
 
 var dockerCli *client.Client
 
-func runContainer(img, name string) (string, int, error) {
-	ctx := context.Background()
-	resp, err := dockerCli.ContainerCreate(ctx, &container.Config{
-		Image:    img,
-		Hostname: name,
-	},
-		&container.HostConfig{
-			NetworkMode: "none",
-			Sysctls: map[string]string{
-				"net.ipv4.ip_forward":                "1",
-				"net.ipv6.conf.all.disable_ipv6":     "0",
-				"net.bridge.bridge-nf-call-iptables": "0",
-			},
-			CapAdd: []string{"SYS_ADMIN", "NET_ADMIN"},
-			DNS:    []string{"1.1.1.1", "8.8.8.8"},
-		},
-		nil,
-		nil,
-		name,
-	)
+func initDockerClient() error {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	dockerCli = cli
+	return nil
+}
+
+// containerState returns the status of container id as reported by
+// the Docker daemon (e.g. running or exited) or missing if it's gone.
+func containerState(id string) string {
+	info, err := dockerCli.ContainerInspect(context.Background(), id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return "missing"
+		}
+		return "unknown"
+	}
+	return info.State.Status
+}
+
+// containerStatus is what the Docker daemon says about one of our containers:
+// its state (e.g. running or exited, or missing if it's gone) and the PID of
+// its init process, which changes whenever it's restarted.
+type containerStatus struct {
+	State string
+	PID   int
+}
 
+func (linuxBackend) inspectContainer(id string) (containerStatus, error) {
+	info, err := dockerCli.ContainerInspect(context.Background(), id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return containerStatus{State: "missing"}, nil
+		}
+		return containerStatus{}, err
+	}
+	return containerStatus{State: info.State.Status, PID: info.State.Pid}, nil
+}
+
+func (linuxBackend) runContainer(img, name string, opts ContainerOptions) (string, int, error) {
+	ctx := context.Background()
+	config, hostConfig, err := opts.configs(img, name)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := dockerCli.ContainerCreate(ctx, config, hostConfig, nil, nil, name)
 	if err != nil {
 		// log.error("couldn't create container %s: %v\n", name, err)
 		return "", 0, err
@@ -53,7 +256,7 @@ func runContainer(img, name string) (string, int, error) {
 	return resp.ID, containerInfo.State.Pid, nil
 }
 
-func removeContainer(id string) error {
+func (linuxBackend) removeContainer(id string) error {
 	ctx := context.Background()
 	dockerCli.ContainerStop(ctx, id, nil)
 	return dockerCli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{})
@@ -0,0 +1,54 @@
+package dvnet
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestContainerConfigs(t *testing.T) {
+	opts := ContainerOptions{
+		Command:    []string{"sleep", "infinity"},
+		Env:        map[string]string{"LAB": "1", "DEBUG": "yes"},
+		Volumes:    []string{"/srv/lab:/lab:ro"},
+		CPUs:       1.5,
+		Memory:     "256m",
+		CapAdd:     []string{"cap_net_raw", "NET_ADMIN"},
+		Privileged: true,
+		Sysctls:    map[string]string{"net.ipv4.ip_forward": "0"},
+		WorkDir:    "/lab",
+	}
+	config, hostConfig, err := opts.configs("pcollado/dhost", "A-1")
+	if err != nil {
+		t.Fatalf("configs() err %v", err)
+	}
+
+	if !cmp.Equal(config.Cmd, strslice.StrSlice{"sleep", "infinity"}) || config.WorkingDir != "/lab" ||
+		config.Labels[nodeLabel] != "A-1" || config.Hostname != "A-1" {
+		t.Errorf("configs() container config = %+v", config)
+	}
+	if want := []string{"DEBUG=yes", "LAB=1"}; !cmp.Equal(config.Env, want) {
+		t.Errorf("configs() env = %v; wanted %v", config.Env, want)
+	}
+	if want := []string{"SYS_ADMIN", "NET_ADMIN", "NET_RAW"}; !cmp.Equal([]string(hostConfig.CapAdd), want) {
+		t.Errorf("configs() capabilities = %v; wanted %v", hostConfig.CapAdd, want)
+	}
+	if hostConfig.Sysctls["net.ipv4.ip_forward"] != "0" || hostConfig.Sysctls["net.bridge.bridge-nf-call-iptables"] != "0" {
+		t.Errorf("configs() sysctls = %v; wanted ours overriding the defaults", hostConfig.Sysctls)
+	}
+	if hostConfig.NanoCPUs != 1500000000 || hostConfig.Memory != 256*1024*1024 || !hostConfig.Privileged ||
+		!cmp.Equal(hostConfig.Binds, opts.Volumes) || hostConfig.NetworkMode != "none" {
+		t.Errorf("configs() host config = %+v", hostConfig)
+	}
+
+	// Nodes without options get what they always did.
+	_, hostConfig, err = ContainerOptions{}.configs("pcollado/drouter", "R-1")
+	if err != nil {
+		t.Fatalf("configs() err %v", err)
+	}
+	if !cmp.Equal(hostConfig.Sysctls, defaultSysctls) || !cmp.Equal([]string(hostConfig.CapAdd), defaultCaps) ||
+		hostConfig.NanoCPUs != 0 || hostConfig.Memory != 0 {
+		t.Errorf("configs() without options = %+v", hostConfig)
+	}
+}
@@ -0,0 +1,478 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const driftIntervalEnv string = "DVNET_DRIFT_INTERVAL"
+
+// DefaultDriftInterval is how often running networks are checked for drift
+// unless told otherwise through the DVNET_DRIFT_INTERVAL environment variable.
+var DefaultDriftInterval = 5 * time.Minute
+
+// DriftInterval returns how often running networks should be checked for drift.
+func DriftInterval() time.Duration {
+	if envInterval := os.Getenv(driftIntervalEnv); envInterval != "" {
+		if interval, err := time.ParseDuration(envInterval); err == nil {
+			return interval
+		}
+		log.warn("ignoring %s: %q isn't a duration\n", driftIntervalEnv, envInterval)
+	}
+	return DefaultDriftInterval
+}
+
+// Resources drift is looked for in.
+const (
+	driftContainer string = "container"
+	driftBridge    string = "bridge"
+	driftInterface string = "interface"
+	driftAddress   string = "address"
+	driftFirewall  string = "firewall"
+	driftSysctl    string = "sysctl"
+)
+
+// How resources drift. Unknown means they couldn't be looked at.
+const (
+	driftMissing string = "missing"
+	driftExtra   string = "extra"
+	driftChanged string = "changed"
+	driftUnknown string = "unknown"
+)
+
+// Drift is a difference between what a network should look like and what the
+// host's kernel and Docker daemon say it looks like. Resources within a node
+// carry its name: the rest live on the host.
+type Drift struct {
+	Resource string `json:"resource"`
+	Kind     string `json:"kind"`
+	Node     string `json:"node,omitempty"`
+	Name     string `json:"name"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (d Drift) String() string {
+	what := d.Resource + " " + d.Name
+	if d.Node != "" {
+		what += " on " + d.Node
+	}
+	switch d.Kind {
+	case driftMissing:
+		if d.Expected != "" {
+			return fmt.Sprintf("%s is missing: it should be %s", what, d.Expected)
+		}
+		return what + " is missing"
+	case driftExtra:
+		if d.Actual != "" {
+			return fmt.Sprintf("%s shouldn't be there: it's %s", what, d.Actual)
+		}
+		return what + " shouldn't be there"
+	case driftUnknown:
+		return fmt.Sprintf("%s couldn't be checked: %s", what, d.Actual)
+	}
+	return fmt.Sprintf("%s is %s instead of %s", what, d.Actual, d.Expected)
+}
+
+// DriftReport holds the differences between a network's state and the host's.
+type DriftReport struct {
+	Network   string    `json:"network"`
+	CheckedAt time.Time `json:"checked_at"`
+	Drifts    []Drift   `json:"drifts"`
+}
+
+func (dr *DriftReport) add(d Drift) {
+	dr.Drifts = append(dr.Drifts, d)
+}
+
+// DetectDrift compares the network with the given name, ID or ID prefix as we
+// left it with what the host's kernel and Docker daemon say it looks like.
+// Networks being altered would drift halfway through, so it waits for them.
+func (d Driver) DetectDrift(network string) (*DriftReport, error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return nil, err
+	}
+	return detectDrift(ns), nil
+}
+
+// detectDrift looks for containers which stopped or were restarted, bridges
+// and veths which went missing, were plugged elsewhere or showed up out of
+// nowhere, addresses which changed, firewall rules which were altered and
+// sysctls which changed since we set them. Restarted containers come back
+// with a new network namespace, so nothing within them is looked at.
+func detectDrift(ns *NetworkState) *DriftReport {
+	report := &DriftReport{Network: ns.Definition.Name, CheckedAt: time.Now(), Drifts: []Drift{}}
+
+	live := map[string]int{}
+	nodes := ns.nodes()
+	for _, node := range sortedKeys(nodes) {
+		info := nodes[node]
+		status, err := ns.backend.inspectContainer(info.ID)
+		switch {
+		case err != nil:
+			report.add(Drift{Resource: driftContainer, Kind: driftUnknown, Node: node, Name: shortID(info.ID), Actual: err.Error()})
+		case status.State == "missing":
+			report.add(Drift{Resource: driftContainer, Kind: driftMissing, Node: node, Name: shortID(info.ID)})
+		case status.State != "running":
+			report.add(Drift{Resource: driftContainer, Kind: driftChanged, Node: node, Name: shortID(info.ID),
+				Expected: "running", Actual: status.State})
+		case status.PID != info.PID:
+			report.add(Drift{Resource: driftContainer, Kind: driftChanged, Node: node, Name: shortID(info.ID),
+				Expected: fmt.Sprintf("running with PID %d", info.PID), Actual: fmt.Sprintf("restarted with PID %d", status.PID)})
+		default:
+			live[node] = info.PID
+		}
+	}
+
+	hostDrift(ns, report, live)
+	for _, node := range sortedKeys(live) {
+		nodeDrift(ns, report, node, live[node])
+	}
+	for _, routerName := range sortedKeys(ns.Routers) {
+		if pid, ok := live[routerName]; ok {
+			firewallDrift(ns, report, routerName, pid)
+		}
+	}
+	for _, name := range sortedKeys(ns.PreviousSysctls) {
+		want := configurableSysctls[name]
+		if got, err := ns.backend.getSysctl(name); err != nil {
+			report.add(Drift{Resource: driftSysctl, Kind: driftUnknown, Name: name, Actual: err.Error()})
+		} else if got != want {
+			report.add(Drift{Resource: driftSysctl, Kind: driftChanged, Name: name, Expected: want, Actual: got})
+		}
+	}
+	return report
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// hostDrift checks the bridges on the host and the veth ends plugged into
+// them. Veths nobody claims which are plugged into our bridges are extra.
+func hostDrift(ns *NetworkState, report *DriftReport, live map[string]int) {
+	ifaces, err := ns.backend.interfaces(0)
+	if err != nil {
+		report.add(Drift{Resource: driftInterface, Kind: driftUnknown, Name: "*", Actual: err.Error()})
+		return
+	}
+
+	bridges := map[string]bool{}
+	for subnetName, subnet := range ns.Subnets {
+		if subnet.ownsBridge() {
+			bridges[ns.Subnets[subnetName].BridgeName] = true
+		}
+	}
+	for _, bridgeName := range ns.Trunks {
+		bridges[bridgeName] = true
+	}
+	for _, sw := range ns.Switches {
+		bridges[sw.BridgeName] = true
+	}
+	for _, bridgeName := range sortedKeys(bridges) {
+		if _, ok := ifaces[bridgeName]; !ok {
+			report.add(Drift{Resource: driftBridge, Kind: driftMissing, Name: bridgeName})
+		}
+	}
+
+	// Ends plugged into Open vSwitch bridges have the datapath as their master.
+	// Those of nodes which aren't live are claimed but left unchecked.
+	masters, claimed := map[string]string{}, map[string]bool{}
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		if link.BridgeEnd == "" || link.Peer != "" {
+			continue
+		}
+		claimed[link.BridgeEnd] = true
+		if _, ok := live[link.Node]; !ok {
+			continue
+		}
+		master := ns.Subnets[link.Subnet].BridgeName
+		if link.Switch != "" {
+			master = ns.Switches[link.Switch].BridgeName
+		}
+		if ns.Subnets[link.Subnet].OVS != nil {
+			master = ""
+		}
+		masters[link.BridgeEnd] = master
+	}
+	for _, key := range sortedKeys(ns.SwitchLinks) {
+		swLink := ns.SwitchLinks[key]
+		for i, end := range swLink.Ends {
+			masters[end] = ns.Switches[swLink.Switches[i]].BridgeName
+			claimed[end] = true
+		}
+	}
+
+	for _, end := range sortedKeys(masters) {
+		iface, ok := ifaces[end]
+		switch {
+		case !ok:
+			report.add(Drift{Resource: driftInterface, Kind: driftMissing, Name: end, Expected: pluggedInto(masters[end])})
+		case masters[end] != "" && iface.Master != masters[end]:
+			report.add(Drift{Resource: driftInterface, Kind: driftChanged, Name: end,
+				Expected: pluggedInto(masters[end]), Actual: pluggedInto(iface.Master)})
+		}
+	}
+	for _, name := range sortedKeys(ifaces) {
+		iface := ifaces[name]
+		if !claimed[name] && iface.Master != "" && bridges[iface.Master] {
+			report.add(Drift{Resource: driftInterface, Kind: driftExtra, Name: name, Actual: pluggedInto(iface.Master)})
+		}
+	}
+}
+
+func pluggedInto(bridge string) string {
+	if bridge == "" {
+		return "unplugged"
+	}
+	return "plugged into " + bridge
+}
+
+// nodeDrift checks the interfaces of node and their addresses. Only veths and
+// VLAN sub-interfaces are ever ours, so other kinds of interfaces are let be.
+func nodeDrift(ns *NetworkState, report *DriftReport, node string, pid int) {
+	ifaces, err := ns.backend.interfaces(pid)
+	if err != nil {
+		report.add(Drift{Resource: driftInterface, Kind: driftUnknown, Node: node, Name: "*", Actual: err.Error()})
+		return
+	}
+
+	claimed := map[string]bool{}
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		if link.Node != node {
+			continue
+		}
+		claimed[link.NodeEnd] = true
+		if link.Trunk {
+			// The sub-interface hangs from the veth plugged into the trunk.
+			claimed[link.NodeEnd[:strings.LastIndex(link.NodeEnd, ".")]] = true
+		}
+
+		iface, ok := ifaces[link.NodeEnd]
+		if !ok {
+			report.add(Drift{Resource: driftInterface, Kind: driftMissing, Node: node, Name: link.NodeEnd,
+				Expected: "on subnet " + link.Subnet})
+			continue
+		}
+		if link.CIDR == "" || contains(iface.Addrs, link.CIDR) {
+			continue
+		}
+		d := Drift{Resource: driftAddress, Kind: driftMissing, Node: node, Name: link.NodeEnd, Expected: link.CIDR}
+		if len(iface.Addrs) > 0 {
+			d.Kind, d.Actual = driftChanged, strings.Join(iface.Addrs, ", ")
+		}
+		report.add(d)
+	}
+
+	for _, name := range sortedKeys(ifaces) {
+		if kind := ifaces[name].Kind; !claimed[name] && (kind == "veth" || kind == "vlan") {
+			report.add(Drift{Resource: driftInterface, Kind: driftExtra, Node: node, Name: name, Actual: "a " + kind})
+		}
+	}
+}
+
+// firewallDrift checks the policy and the rules of routerName's firewall,
+// as long as we ever installed one.
+func firewallDrift(ns *NetworkState, report *DriftReport, routerName string, pid int) {
+	def := ns.Definition.Routers[routerName].FWRules
+	if def.Policy == "" && len(ns.FWRules[routerName]) == 0 {
+		return
+	}
+	policy, specs, err := ns.backend.fwRules(pid)
+	if err != nil {
+		report.add(Drift{Resource: driftFirewall, Kind: driftUnknown, Node: routerName, Name: fwChain, Actual: err.Error()})
+		return
+	}
+
+	wantPolicy := strings.ToUpper(def.Policy)
+	if wantPolicy == "" {
+		wantPolicy = "ACCEPT"
+	}
+	if policy != wantPolicy {
+		report.add(Drift{Resource: driftFirewall, Kind: driftChanged, Node: routerName, Name: "FORWARD policy",
+			Expected: wantPolicy, Actual: policy})
+	}
+
+	want, got := []string{}, []string{}
+	for _, spec := range ns.FWRules[routerName] {
+		want = append(want, canonicalFWSpec(spec))
+	}
+	for _, spec := range specs {
+		got = append(got, canonicalFWSpec(spec))
+	}
+	for _, rule := range want {
+		if !contains(got, rule) {
+			report.add(Drift{Resource: driftFirewall, Kind: driftMissing, Node: routerName, Name: "rule " + rule})
+		}
+	}
+	for _, rule := range got {
+		if !contains(want, rule) {
+			report.add(Drift{Resource: driftFirewall, Kind: driftExtra, Node: routerName, Name: "rule " + rule})
+		}
+	}
+}
+
+// Write writes the report in the given format: text or JSON.
+func (dr *DriftReport) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportText:
+		return dr.WriteText(w)
+	case ReportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(dr)
+	}
+	return fmt.Errorf("unknown report format %q: it should be either %s or %s", format, ReportText, ReportJSON)
+}
+
+// WriteText writes a line per drift followed by how many there are.
+func (dr *DriftReport) WriteText(w io.Writer) error {
+	for _, d := range dr.Drifts {
+		if _, err := fmt.Fprintf(w, "drift: %s\n", d); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d drifts on %s as of %s\n", len(dr.Drifts), dr.Network, dr.CheckedAt.Format(time.RFC3339))
+	return err
+}
+
+// WatchDrift checks every network for drift once every interval, logging the
+// drift which shows up or goes away and exporting how much there is as metrics.
+func (d Driver) WatchDrift(interval time.Duration) {
+	log.info("checking networks for drift every %s\n", interval)
+	seen := map[string]map[string]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.checkDrift(seen)
+	}
+}
+
+// checkDrift checks every network for drift once. Seen holds the drift found on
+// each network, by ID, the last time around so that only changes get logged.
+func (d Driver) checkDrift(seen map[string]map[string]bool) {
+	networkIDs, err := d.store.ids()
+	if err != nil {
+		log.error("couldn't list the networks we manage: %v\n", err)
+		return
+	}
+
+	reports := map[string]*DriftReport{}
+	for _, networkID := range networkIDs {
+		ns, report, err := d.checkNetworkDrift(networkID)
+		if err != nil {
+			log.warn("couldn't check network %s for drift: %v\n", networkID, err)
+			continue
+		}
+		reports[networkID] = report
+
+		current := map[string]bool{}
+		for _, drift := range report.Drifts {
+			current[drift.String()] = true
+			if !seen[networkID][drift.String()] {
+				ns.log().with("resource", drift.Resource, "kind", drift.Kind, "node", drift.Node).warn("drift: %s\n", drift)
+			}
+		}
+		for drift := range seen[networkID] {
+			if !current[drift] {
+				ns.log().info("drift gone: %s\n", drift)
+			}
+		}
+		seen[networkID] = current
+	}
+	for networkID := range seen {
+		if !contains(networkIDs, networkID) {
+			delete(seen, networkID)
+		}
+	}
+	d.metrics.observeDrift(reports)
+}
+
+// checkNetworkDrift looks for drift on networkID while holding the lock, just like DetectDrift.
+func (d Driver) checkNetworkDrift(networkID string) (*NetworkState, *DriftReport, error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	ns, err := d.network(networkID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ns, detectDrift(ns), nil
+}
+
+type driftKey struct {
+	resource string
+	kind     string
+}
+
+// observeDrift replaces the drift found on every network with the latest
+// reports, which are keyed by network ID.
+func (m *driverMetrics) observeDrift(reports map[string]*DriftReport) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.driftReports = reports
+}
+
+// driftFamilies returns how much drift the last check found and when it ran.
+// Network names needn't be unique, so samples carry the network's ID too.
+func (m *driverMetrics) driftFamilies() []*metricFamily {
+	drifts := &metricFamily{name: "dvnet_drift", kind: "gauge",
+		help: "Differences between each network's state and the host's found by the last drift check."}
+	checks := &metricFamily{name: "dvnet_drift_last_check_timestamp_seconds", kind: "gauge",
+		help: "When each network was last checked for drift."}
+	if m == nil {
+		return []*metricFamily{drifts, checks}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, networkID := range sortedKeys(m.driftReports) {
+		report := m.driftReports[networkID]
+		counts := map[driftKey]int{}
+		for _, d := range report.Drifts {
+			counts[driftKey{resource: d.Resource, kind: d.Kind}]++
+		}
+		keys := make([]driftKey, 0, len(counts))
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].resource != keys[j].resource {
+				return keys[i].resource < keys[j].resource
+			}
+			return keys[i].kind < keys[j].kind
+		})
+		for _, key := range keys {
+			drifts.add("", float64(counts[key]), "network", report.Network, "network_id", networkID, "resource", key.resource, "kind", key.kind)
+		}
+		checks.add("", float64(report.CheckedAt.Unix()), "network", report.Network, "network_id", networkID)
+	}
+	return []*metricFamily{drifts, checks}
+}
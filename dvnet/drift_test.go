@@ -0,0 +1,124 @@
+package dvnet
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDetectDrift(t *testing.T) {
+	d, pb := testDriver(t)
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := d.DetectDrift("0123")
+	if err != nil {
+		t.Fatalf("DetectDrift() err %v", err)
+	}
+	if len(report.Drifts) != 0 {
+		t.Fatalf("a network just created shouldn't drift; got %v", report.Drifts)
+	}
+
+	// A-1 got a new address, B-2 was restarted, a veth was plugged into A's
+	// bridge and R-2's end moved to C's, R-1's firewall now drops everything
+	// and somebody turned forwarding off.
+	linkA1, linkR2 := ns.Links[linkKey("A-1", "A")], ns.Links[linkKey("R-2", "B")]
+	pidA1, _ := ns.nodePID("A-1")
+	pidR1, _ := ns.nodePID("R-1")
+	pb.ifaces[pidA1][linkA1.NodeEnd].Addrs = []string{"10.0.0.200/24"}
+	pb.containers[ns.Subnets["B"].Containers["B-2"].ID] = 4242
+	pb.ifaces[0]["rogue"] = &ifaceState{Kind: "veth", Master: ns.Subnets["A"].BridgeName, Addrs: []string{}}
+	pb.ifaces[0][linkR2.BridgeEnd].Master = ns.Subnets["C"].BridgeName
+	pb.firewalls[pidR1] = plannedFirewall{Policy: "DROP", Rules: [][]string{{fwChain, "-s", "10.0.0.2", "-j", "ACCEPT"}}}
+	pb.sysctls["net.ipv4.ip_forward"] = "0"
+	ns.PreviousSysctls["net.ipv4.ip_forward"] = "1"
+
+	report = detectDrift(ns)
+	want := []Drift{
+		{Resource: driftContainer, Kind: driftChanged, Node: "B-2", Name: "planned-B-2",
+			Expected: "running with PID " + strconv.Itoa(ns.Subnets["B"].Containers["B-2"].PID), Actual: "restarted with PID 4242"},
+		{Resource: driftInterface, Kind: driftChanged, Name: linkR2.BridgeEnd,
+			Expected: "plugged into " + ns.Subnets["B"].BridgeName, Actual: "plugged into " + ns.Subnets["C"].BridgeName},
+		{Resource: driftInterface, Kind: driftExtra, Name: "rogue", Actual: "plugged into " + ns.Subnets["A"].BridgeName},
+		{Resource: driftAddress, Kind: driftChanged, Node: "A-1", Name: linkA1.NodeEnd, Expected: linkA1.CIDR, Actual: "10.0.0.200/24"},
+		{Resource: driftFirewall, Kind: driftChanged, Node: "R-1", Name: "FORWARD policy", Expected: "ACCEPT", Actual: "DROP"},
+		{Resource: driftFirewall, Kind: driftExtra, Node: "R-1", Name: "rule DVNET-FW -s 10.0.0.2/32 -j ACCEPT"},
+		{Resource: driftSysctl, Kind: driftChanged, Name: "net.ipv4.ip_forward", Expected: "1", Actual: "0"},
+	}
+	if diff := cmp.Diff(want, report.Drifts); diff != "" {
+		t.Errorf("detectDrift() mismatch (-want +got):\n%s", diff)
+	}
+
+	text := &strings.Builder{}
+	if err := report.Write(text, ReportText); err != nil {
+		t.Fatalf("Write(%s) err %v", ReportText, err)
+	}
+	for _, want := range []string{
+		"drift: interface rogue shouldn't be there: it's plugged into " + ns.Subnets["A"].BridgeName + "\n",
+		"drift: address " + linkA1.NodeEnd + " on A-1 is 10.0.0.200/24 instead of " + linkA1.CIDR + "\n",
+		"7 drifts on Test Net 0",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text report lacks %q; got\n%s", want, text)
+		}
+	}
+
+	// Removing the address altogether and the container too shows up as missing.
+	pb.ifaces[pidA1][linkA1.NodeEnd].Addrs = []string{}
+	delete(pb.containers, ns.Subnets["B"].Containers["B-2"].ID)
+	for _, d := range detectDrift(ns).Drifts {
+		if (d.Resource == driftAddress || d.Resource == driftContainer) && d.Kind != driftMissing {
+			t.Errorf("%s should be missing; got %s", d.Name, d)
+		}
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	d, pb := testDriver(t)
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb.ifaces[0]["rogue"] = &ifaceState{Kind: "veth", Master: ns.Subnets["A"].BridgeName, Addrs: []string{}}
+
+	// A second network sharing every resource and even the name with the first one drifts just as much.
+	if err := d.store.save("fedcba9876543210", ns); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]map[string]bool{}
+	d.checkDrift(seen)
+	for _, networkID := range []string{"0123456789abcdef", "fedcba9876543210"} {
+		if len(seen[networkID]) != 1 {
+			t.Errorf("checkDrift() should have seen 1 drift on %s; got %v", networkID, seen)
+		}
+	}
+	samples := d.metrics.driftFamilies()[0].samples
+	if len(samples) != 2 {
+		t.Fatalf("dvnet_drift should count the extra interface on each network; got %+v", samples)
+	}
+	for i, networkID := range []string{"0123456789abcdef", "fedcba9876543210"} {
+		if !contains(samples[i].labels, networkID) || !contains(samples[i].labels, driftExtra) || samples[i].value != 1 {
+			t.Errorf("dvnet_drift should count the extra interface on %s; got %+v", networkID, samples[i])
+		}
+	}
+	if cmp.Equal(samples[0].labels, samples[1].labels) {
+		t.Errorf("dvnet_drift should tell networks sharing a name apart; got %+v", samples)
+	}
+
+	delete(pb.ifaces[0], "rogue")
+	if err := d.store.remove("fedcba9876543210"); err != nil {
+		t.Fatal(err)
+	}
+	d.checkDrift(seen)
+	if len(seen["0123456789abcdef"]) != 0 {
+		t.Errorf("checkDrift() should have forgotten the drift gone; got %v", seen)
+	}
+	if _, ok := seen["fedcba9876543210"]; ok {
+		t.Errorf("checkDrift() should have forgotten the network gone; got %v", seen)
+	}
+}
@@ -2,12 +2,13 @@ package dvnet
 
 import (
 	"fmt"
+	"os"
 	"strings"
+	"sync"
 
+	"github.com/RyanCarrier/dijkstra"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/vishvananda/netlink"
-
-	"github.com/docker/docker/client"
 )
 
 const (
@@ -19,6 +20,7 @@ const (
 	containerEthPrefix        string = "eth"
 	defaultHopBridgePrefix    string = "hth-"
 	defaultHopContainerPrefix string = "dth-"
+	outboundSubnetName        string = "outboundSubnet"
 
 	genericOptPrefix string = "com.docker.network.generic"
 
@@ -26,6 +28,7 @@ const (
 	modeOption       string = "net.dvnet.mode"
 	bridgeNameOption string = "net.dvnet.name"
 	netDefOption     string = "net.dvnet.def"
+	topologyOption   string = "net.dvnet.topology"
 
 	modeNAT  string = "nat"
 	modeFlat string = "flat"
@@ -46,18 +49,57 @@ type globalOpts struct {
 	bridgeName string
 	gateway    string
 	mask       string
+
+	// topologyFormats are the formats the network's topology
+	// is exported in once it's up.
+	topologyFormats []string
 }
 
+// Driver manages dvnet networks, be it on behalf of the Docker
+// daemon or of the CLI. The state of every network lives on
+// its store so that both can manage networks created by the other.
 type Driver struct {
-	networks map[string]*NetworkState
+	backend hostBackend
+	store   stateStore
+
+	// mu serialises the operations altering the networks we manage:
+	// the Docker daemon and a reload might try to do so concurrently.
+	// The store's lock does the same across processes.
+	mu *sync.Mutex
+
+	captures *captureSet
+	metrics  *driverMetrics
 }
 
+// SubnetResources are what backs a subnet. Point-to-point
+// subnets have no bridge: their nodes are joined directly.
+// VLAN subnets share the bridge of their Trunk instead and
+// Switched subnets are made up of the bridges of their switches.
 type SubnetResources struct {
-	Bridge     *netlink.Bridge
+	Bridge     *netlink.Bridge `json:"-"`
+	BridgeName string
+	P2P        bool    `json:",omitempty"`
+	VLAN       int     `json:",omitempty"`
+	Trunk      string  `json:",omitempty"`
+	Switched   bool    `json:",omitempty"`
+	OVS        *ovsDef `json:",omitempty"`
 	Containers map[string]containerInfo
 }
 
+// ownsBridge tells whether the subnet is backed by a bridge of its own.
+func (subnet SubnetResources) ownsBridge() bool {
+	return !subnet.P2P && subnet.VLAN == 0 && !subnet.Switched
+}
+
+// Origins of a network: the Docker daemon or the CLI.
+const (
+	originPlugin string = "plugin"
+	originCLI    string = "cli"
+)
+
 type NetworkState struct {
+	ID              string
+	Origin          string
 	BridgeName      string
 	BridgeInst      *netlink.Bridge
 	HopCIDR         string
@@ -69,6 +111,114 @@ type NetworkState struct {
 	Subnets         map[string]SubnetResources
 	Addressers      map[string]subnetAddresser
 	Routers         map[string]containerInfo
+	Links           map[string]linkInfo
+	Trunks          map[string]string
+	Switches        map[string]switchInfo
+	SwitchLinks     map[string]switchLinkInfo
+	Routes          map[string][]routeInfo
+	FWRules         map[string][][]string
+	DefPath         string
+	Definition      netDef
+
+	backend hostBackend
+	metrics *driverMetrics
+	// step is the step of creating or deleting the network we're on.
+	step string
+}
+
+// linkInfo describes the attachment of a node to a subnet: the
+// veth pair joining them and the address the node was given.
+// Down is set when the link's been administratively brought down.
+// Mirror tells how the link is mirrored to the subnet's MirrorSink.
+// On point-to-point subnets there's no bridge end: the other end
+// of the veth pair lives within the Peer node instead. Trunk links
+// share their bridge end with every other VLAN the node is on.
+type linkInfo struct {
+	Node        string            `json:"node"`
+	Subnet      string            `json:"subnet"`
+	BridgeEnd   string            `json:"bridge_end"`
+	NodeEnd     string            `json:"node_end"`
+	Peer        string            `json:"peer,omitempty"`
+	Switch      string            `json:"switch,omitempty"`
+	CIDR        string            `json:"cidr"`
+	Impairments *LinkImpairments  `json:"impairments,omitempty"`
+	Shaping     *BandwidthShaping `json:"shaping,omitempty"`
+	Mirror      *linkMirror       `json:"mirror,omitempty"`
+	MirrorSink  bool              `json:"mirror_sink,omitempty"`
+	Down        bool              `json:"down,omitempty"`
+	Trunk       bool              `json:"trunk,omitempty"`
+}
+
+// ownsBridgeEnd tells whether the link's bridge end is only used by
+// the link itself and can thus be acted upon on its behalf.
+func (link linkInfo) ownsBridgeEnd() bool {
+	return link.Peer == "" && !link.Trunk
+}
+
+// linkKey identifies the link between node and subnet within
+// a NetworkState's Links.
+func linkKey(node, subnet string) string {
+	return node + "/" + subnet
+}
+
+// nodeInfo returns the container running node, be it a host or a router.
+func (ns *NetworkState) nodeInfo(node string) (containerInfo, bool) {
+	if info, ok := ns.Routers[node]; ok {
+		return info, true
+	}
+	for _, subnet := range ns.Subnets {
+		if info, ok := subnet.Containers[node]; ok {
+			return info, true
+		}
+	}
+	return containerInfo{}, false
+}
+
+// nodes returns the containers running every node, be it a host or a router.
+func (ns *NetworkState) nodes() map[string]containerInfo {
+	nodes := map[string]containerInfo{}
+	for routerName, info := range ns.Routers {
+		nodes[routerName] = info
+	}
+	for _, subnet := range ns.Subnets {
+		for host, info := range subnet.Containers {
+			nodes[host] = info
+		}
+	}
+	return nodes
+}
+
+// nodePID returns the PID of the container running node, be it a host or a router.
+func (ns *NetworkState) nodePID(node string) (int, bool) {
+	info, ok := ns.nodeInfo(node)
+	return info.PID, ok
+}
+
+// notFoundError signals an operation referred to a network, node
+// or link we know nothing about.
+type notFoundError struct {
+	msg string
+}
+
+func (e notFoundError) Error() string {
+	return e.msg
+}
+
+// invalidError signals an operation was asked to do something nonsensical.
+type invalidError struct {
+	err error
+}
+
+func (e invalidError) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidError) Unwrap() error {
+	return e.err
+}
+
+func errUnknownNode(node string) error {
+	return notFoundError{fmt.Sprintf("node %s is not part of the network", node)}
 }
 
 // GetCapabilities tells the Docker daemon the reach of the
@@ -84,82 +234,85 @@ func (d Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
 func (d Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
 	log.debug("CreateNetwork() request: %+v\n", req)
 
-	prevSysctls, err := systemSetup()
+	unlock, err := d.lock()
 	if err != nil {
-		log.error("couldn't configure the host system: %v\n", err)
-		return d.failWithCleanup(req.NetworkID, err)
+		return err
 	}
+	defer unlock()
 
 	var netOpts globalOpts
 
 	parseOptions(req, &netOpts)
 	log.debug("configured options: %+v\n", netOpts)
 
-	ns := &NetworkState{
-		BridgeName: netOpts.bridgeName,
-		// BridgeInst:      bridgeInst,
-		MTU:             defaultMTU,
-		Mode:            defaultMode,
-		Gateway:         netOpts.gateway,
-		GatewayMask:     netOpts.mask,
-		PreviousSysctls: prevSysctls,
-		HopCIDR:         "",
-		Subnets:         map[string]SubnetResources{},
-		Addressers:      map[string]subnetAddresser{},
-		Routers:         map[string]containerInfo{},
+	return d.createNetwork(req.NetworkID, originPlugin, netOpts)
+}
+
+// lock keeps both other goroutines and other dvnet processes from
+// altering the networks we manage until the returned function is called.
+func (d Driver) lock() (func(), error) {
+	d.mu.Lock()
+	unlockStore, err := d.store.lock()
+	if err != nil {
+		d.mu.Unlock()
+		return nil, fmt.Errorf("couldn't lock the state store: %w", err)
 	}
+	return func() {
+		unlockStore()
+		d.mu.Unlock()
+	}, nil
+}
 
-	d.networks[req.NetworkID] = ns
+// network returns the state of the network identified by networkID.
+func (d Driver) network(networkID string) (*NetworkState, error) {
+	ns, err := d.store.load(networkID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, notFoundError{fmt.Sprintf("the network driver is unaware of network %s", networkID)}
+		}
+		return nil, err
+	}
+	ns.backend, ns.metrics = d.backend, d.metrics
+	return ns, nil
+}
+
+func (d Driver) createNetwork(networkID, origin string, netOpts globalOpts) error {
+	ns := newNetworkState(d.backend, netOpts)
+	ns.ID = networkID
+	ns.Origin = origin
+	ns.metrics = d.metrics
+
+	prevSysctls, err := systemSetup(ns.backend)
+	if err != nil {
+		log.error("couldn't configure the host system: %v\n", err)
+		return d.failWithCleanup(ns, err)
+	}
+	ns.PreviousSysctls = prevSysctls
 
 	netDefinition, err := loadDef(netOpts.netDefPath)
 	if err != nil {
 		log.error("couldn't load the network definition: %v\n", err)
-		return d.failWithCleanup(req.NetworkID, err)
+		return d.failWithCleanup(ns, err)
 	}
 
 	log.debug("loaded network definition: %+v\n", netDefinition)
 
 	netGraph, err := genGraph(netDefinition)
 	if err != nil {
-		return d.failWithCleanup(req.NetworkID, err)
+		return d.failWithCleanup(ns, err)
 	}
 
 	netGrapPath := fmt.Sprintf("%s.netg", strings.Split(netOpts.netDefPath, ".")[0])
 	log.debug("exported network graph to %s\n", netGrapPath)
 	netGraph.ExportToFile(netGrapPath)
 
-	for subnetName, subnetDef := range netDefinition.Subnets {
-		if err := createSubnet(ns, subnetName, subnetDef); err != nil {
-			return d.failWithCleanup(req.NetworkID, err)
-		}
+	if err := buildNetwork(ns, netDefinition, netGraph); err != nil {
+		return d.failWithCleanup(ns, err)
 	}
 
-	for routerName, def := range netDefinition.Routers {
-		if err := createRouter(ns, routerName, def); err != nil {
-			return d.failWithCleanup(req.NetworkID, err)
-		}
-	}
-
-	if netDefinition.AutomaticRouting {
-		for subnetName, subnetDef := range netDefinition.Subnets {
-			routes, err := findSubnetRoutes(netGraph, netDefinition, subnetDef)
-			if err != nil {
-				return d.failWithCleanup(req.NetworkID, err)
-			}
-			for host := range subnetDef.Hosts {
-				for _, route := range routes {
-					if err := routeContainer(ns, subnetName, route, ns.Subnets[subnetName].Containers[host].PID); err != nil {
-						return d.failWithCleanup(req.NetworkID, err)
-					}
-				}
-			}
-		}
-	}
-
-	if netDefinition.OutboundAccess.Enabled {
-		if err := confOutboundAccess(ns, defaultGatewayName, netDefinition.OutboundAccess.HopCIDR); err != nil {
-			return d.failWithCleanup(req.NetworkID, err)
-		}
+	if err := d.store.save(networkID, ns); err != nil {
+		log.error("couldn't save the state of network %s: %v\n", networkID, err)
+		return d.failWithCleanup(ns, err)
 	}
 
 	ipAddressesPath := fmt.Sprintf("%s.ipaddr", strings.Split(netOpts.netDefPath, ".")[0])
@@ -168,62 +321,200 @@ func (d Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
 	}
 	log.debug("exported assigned addresses to to %s\n", ipAddressesPath)
 
+	if err := exportTopology(ns, netOpts.topologyFormats); err != nil {
+		log.error("couldn't export the network's topology: %v\n", err)
+	}
+
 	log.debug("built network state: %#v\n", *ns)
 
 	return nil
 }
 
-func (d Driver) failWithCleanup(networkID string, err error) error {
-	d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: networkID})
+func newNetworkState(backend hostBackend, netOpts globalOpts) *NetworkState {
+	return &NetworkState{
+		BridgeName: netOpts.bridgeName,
+		// BridgeInst:      bridgeInst,
+		MTU:             defaultMTU,
+		Mode:            defaultMode,
+		Gateway:         netOpts.gateway,
+		GatewayMask:     netOpts.mask,
+		PreviousSysctls: map[string]string{},
+		HopCIDR:         "",
+		Subnets:         map[string]SubnetResources{},
+		Addressers:      map[string]subnetAddresser{},
+		Routers:         map[string]containerInfo{},
+		Links:           map[string]linkInfo{},
+		Trunks:          map[string]string{},
+		Switches:        map[string]switchInfo{},
+		SwitchLinks:     map[string]switchLinkInfo{},
+		Routes:          map[string][]routeInfo{},
+		FWRules:         map[string][][]string{},
+		DefPath:         netOpts.netDefPath,
+		backend:         backend,
+	}
+}
+
+// buildNetwork brings up everything netDefinition describes on top of ns.
+func buildNetwork(ns *NetworkState, netDefinition netDef, netGraph *dijkstra.Graph) error {
+	ns.Definition = netDefinition
+
+	return ns.runSteps(opCreate, []opStep{
+		// Switches go first: hosts are plugged into them as their subnets are created.
+		{"switches", func() error {
+			return createSwitches(ns, netDefinition)
+		}},
+		{"subnets", func() error {
+			for subnetName, subnetDef := range netDefinition.Subnets {
+				if err := createSubnet(ns, subnetName, subnetDef); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"routers", func() error {
+			for routerName, def := range netDefinition.Routers {
+				if err := createRouter(ns, routerName, def); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"point-to-point links", func() error {
+			return connectP2PSubnets(ns, netDefinition)
+		}},
+		{"impairments", func() error {
+			return applyImpairments(ns, netDefinition)
+		}},
+		{"mirrors", func() error {
+			return applyMirrors(ns, netDefinition)
+		}},
+		// Rules can reference any node, so wait for every one of them to be addressed.
+		{"firewalls", func() error {
+			for routerName, def := range netDefinition.Routers {
+				if err := applyFWRules(ns, routerName, def.FWRules); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"routes", func() error {
+			if !netDefinition.AutomaticRouting {
+				return nil
+			}
+			for subnetName, subnetDef := range netDefinition.Subnets {
+				if len(subnetDef.Hosts) == 0 {
+					continue
+				}
+				routes, err := findSubnetRoutes(netGraph, netDefinition, subnetDef)
+				if err != nil {
+					return err
+				}
+				for host := range subnetDef.Hosts {
+					for _, route := range routes {
+						if err := routeContainer(ns, subnetName, host, route); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			return nil
+		}},
+		{"outbound access", func() error {
+			if !netDefinition.OutboundAccess.Enabled {
+				return nil
+			}
+			return confOutboundAccess(ns, defaultGatewayName, netDefinition.OutboundAccess.HopCIDR)
+		}},
+	})
+}
+
+func (d Driver) failWithCleanup(ns *NetworkState, err error) error {
+	teardownNetwork(ns)
 	return err
 }
 
 func (d Driver) DeleteNetwork(req *network.DeleteNetworkRequest) error {
 	log.debug("DeleteNetwork() request: %+v\n", req)
-	ns, ok := d.networks[req.NetworkID]
-	if !ok {
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := d.store.load(req.NetworkID); os.IsNotExist(err) {
+		// It might have been brought down through the CLI already.
 		log.warn("trying to remove a network we are unaware of: %s\n", req.NetworkID)
-		return fmt.Errorf("the network driver is unaware of this network")
+		return nil
 	}
 
-	log.debug("trying to delete network whose state is %#v\n", *ns)
+	return d.deleteNetwork(req.NetworkID)
+}
 
-	if err := restoreSysctls(ns.PreviousSysctls); err != nil {
-		log.error("%v\n", err)
+func (d Driver) deleteNetwork(networkID string) error {
+	ns, err := d.network(networkID)
+	if err != nil {
+		log.warn("trying to remove a network we are unaware of: %s\n", networkID)
 		return err
 	}
 
-	if err := restoreNAT(ns.HopCIDR); err != nil {
-		log.error("%v\n", err)
+	d.stopCaptures(networkID)
+	if err := teardownNetwork(ns); err != nil {
 		return err
 	}
 
-	if err := restoreForwarding(bridgePrefix + strings.ToLower(defaultGatewayName)); err != nil {
-		log.error("%v\n", err)
-		return err
-	}
+	return d.store.remove(networkID)
+}
 
-	for _, subnet := range ns.Subnets {
-		removeBridge(subnet.Bridge)
+func teardownNetwork(ns *NetworkState) error {
+	log.debug("trying to delete network whose state is %#v\n", *ns)
 
-		for _, containerInfo := range subnet.Containers {
-			log.debug("removing container with ID %s\n", containerInfo.ID)
-			if err := removeContainer(containerInfo.ID); err != nil {
-				log.error("couldn't remove container with ID %s: %v\n", containerInfo.ID, err)
+	err := ns.runSteps(opDelete, []opStep{
+		{"sysctls", func() error {
+			return restoreSysctls(ns.backend, ns.PreviousSysctls)
+		}},
+		{"outbound access", func() error {
+			if err := ns.backend.restoreNAT(ns.HopCIDR); err != nil {
+				return err
 			}
-		}
-	}
+			return ns.backend.restoreForwarding(bridgePrefix + strings.ToLower(defaultGatewayName))
+		}},
+		{"subnets", func() error {
+			for _, subnet := range ns.Subnets {
+				if subnet.ownsBridge() {
+					ns.backend.bridgeBackendFor(subnet.OVS).removeBridge(subnet.Bridge)
+				}
 
-	for _, containerInfo := range ns.Routers {
-		log.debug("removing container with ID %s\n", containerInfo.ID)
-		if err := removeContainer(containerInfo.ID); err != nil {
-			log.error("couldn't remove container with ID %s: %v\n", containerInfo.ID, err)
-		}
+				for _, containerInfo := range subnet.Containers {
+					log.debug("removing container with ID %s\n", containerInfo.ID)
+					if err := ns.backend.removeContainer(containerInfo.ID); err != nil {
+						log.error("couldn't remove container with ID %s: %v\n", containerInfo.ID, err)
+					}
+				}
+			}
+			return nil
+		}},
+		{"routers", func() error {
+			for _, containerInfo := range ns.Routers {
+				log.debug("removing container with ID %s\n", containerInfo.ID)
+				if err := ns.backend.removeContainer(containerInfo.ID); err != nil {
+					log.error("couldn't remove container with ID %s: %v\n", containerInfo.ID, err)
+				}
+			}
+			return nil
+		}},
+		{"switches", func() error {
+			for _, bridgeName := range ns.Trunks {
+				ns.backend.removeBridge(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}})
+			}
+			removeSwitches(ns)
+			return nil
+		}},
+	})
+	if err != nil {
+		log.error("%v\n", err)
 	}
-
-	d.networks[req.NetworkID] = nil
-
-	return nil
+	return err
 }
 
 func (d Driver) AllocateNetwork(req *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
@@ -285,15 +576,26 @@ func (d Driver) RevokeExternalConnectivity(req *network.RevokeExternalConnectivi
 	return nil
 }
 
-func GetHandler() *network.Handler {
-	d := Driver{networks: make(map[string]*NetworkState)}
-	h := network.NewHandler(d)
+// NewDriver returns a Driver working on the networks in the state store.
+func NewDriver() (Driver, error) {
+	if err := initDockerClient(); err != nil {
+		return Driver{}, fmt.Errorf("couldn't get a docker client: %w", err)
+	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	store, err := newStateStore()
 	if err != nil {
-		log.error("couldn't get a docker client: %v\n", err)
+		return Driver{}, err
 	}
-	dockerCli = cli
+
+	return Driver{backend: linuxBackend{}, store: store, mu: &sync.Mutex{}, captures: newCaptureSet(), metrics: newDriverMetrics()}, nil
+}
+
+// GetHandler returns the handler serving d over the Docker plugin protocol.
+func GetHandler(d Driver) *network.Handler {
+	h := network.NewHandler(d)
+
+	go d.watchReloads()
+	go d.watchRestarts()
 
 	return h
 }
@@ -0,0 +1,117 @@
+package dvnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/sys/unix"
+)
+
+// Exec runs cmd within the container running node on the network with the given
+// name, ID or ID prefix, wiring it up to our standard streams just like
+// docker exec -i would. If our standard input is a terminal the command gets
+// one too. It returns the command's exit code.
+func (d Driver) Exec(network, node string, cmd []string) (int, error) {
+	containerID, err := d.NodeContainer(network, node)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	tty := isTerminal(os.Stdin) && isTerminal(os.Stdout)
+
+	execResp, err := dockerCli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd:          cmd,
+		Tty:          tty,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create the exec instance on %s: %w", node, err)
+	}
+
+	hijacked, err := dockerCli.ContainerExecAttach(ctx, execResp.ID, types.ExecStartCheck{Tty: tty})
+	if err != nil {
+		return 0, fmt.Errorf("couldn't attach to the exec instance on %s: %w", node, err)
+	}
+	defer hijacked.Close()
+
+	if tty {
+		restore, err := makeRaw(os.Stdin)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't set the terminal to raw mode: %w", err)
+		}
+		defer restore()
+
+		resize := func() {
+			if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil {
+				dockerCli.ContainerExecResize(ctx, execResp.ID, types.ResizeOptions{Height: uint(ws.Row), Width: uint(ws.Col)})
+			}
+		}
+		resize()
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				resize()
+			}
+		}()
+	}
+
+	go func() {
+		io.Copy(hijacked.Conn, os.Stdin)
+		hijacked.CloseWrite()
+	}()
+
+	// Without a TTY the daemon multiplexes stdout and stderr over the same stream.
+	if tty {
+		_, err = io.Copy(os.Stdout, hijacked.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, hijacked.Reader)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("couldn't relay the command's output: %w", err)
+	}
+
+	execInfo, err := dockerCli.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get the command's exit code: %w", err)
+	}
+	return execInfo.ExitCode, nil
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// makeRaw puts the terminal f refers to in raw mode so that every keystroke
+// reaches the container untouched. The returned function restores it.
+func makeRaw(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	prev, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *prev
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, unix.TCSETS, prev) }, nil
+}
@@ -0,0 +1,304 @@
+package dvnet
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// fwChain is the chain within each router's filter table holding the
+// rules coming from its definition. Hanging every rule from a chain
+// of our own lets us flush them without touching anything else.
+const fwChain string = "DVNET-FW"
+
+var fwAnyTargets = map[string]bool{"": true, "*": true, "any": true}
+
+// parseFWRule unpacks a rule such as ["A-1", "B-1", true]: traffic going from
+// A-1 to B-1 (and the other way round, as the last element is true).
+func parseFWRule(rule []fwTargetDef) (src string, dst string, bidirectional bool, err error) {
+	if len(rule) != 2 && len(rule) != 3 {
+		return "", "", false, fmt.Errorf("firewall rule %v should look like [src, dst] or [src, dst, bidirectional]", rule)
+	}
+	src, okSrc := rule[0].(string)
+	dst, okDst := rule[1].(string)
+	if !okSrc || !okDst {
+		return "", "", false, fmt.Errorf("the source and destination of firewall rule %v should be strings", rule)
+	}
+	if len(rule) == 3 {
+		if bidirectional, ok := rule[2].(bool); ok {
+			return src, dst, bidirectional, nil
+		}
+		return "", "", false, fmt.Errorf("the last element of firewall rule %v should be a boolean", rule)
+	}
+	return src, dst, false, nil
+}
+
+func validateFWRules(def fwRuleDef) error {
+	switch strings.ToUpper(def.Policy) {
+	case "", "ACCEPT", "DROP":
+	default:
+		return fmt.Errorf("unknown firewall policy %q", def.Policy)
+	}
+	for _, rule := range append(append([][]fwTargetDef{}, def.Accept...), def.Drop...) {
+		if _, _, _, err := parseFWRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveFWTarget translates a rule's source or destination into the
+// addresses iptables(8) should match: targets can be nodes, subnets,
+// raw addresses or CIDR blocks. A nil slice matches anything.
+func resolveFWTarget(ns *NetworkState, target string) ([]string, error) {
+	if fwAnyTargets[strings.ToLower(target)] {
+		return nil, nil
+	}
+	if addresser, ok := ns.Addressers[target]; ok && target != outboundSubnetName {
+		return []string{addresser.cidrBlock.String()}, nil
+	}
+
+	addrs := []string{}
+	for _, link := range ns.Links {
+		if link.Node == target && link.Subnet != outboundSubnetName {
+			addrs = append(addrs, strings.Split(link.CIDR, "/")[0])
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	if _, _, err := net.ParseCIDR(target); err == nil {
+		return []string{target}, nil
+	}
+	if net.ParseIP(target) != nil {
+		return []string{target}, nil
+	}
+	return nil, fmt.Errorf("firewall target %s is neither a node, a subnet nor an address", target)
+}
+
+// fwRuleSpecs expands the rules in def into the iptables(8) rule specs to
+// append to fwChain. Accepted traffic goes first so that it takes precedence.
+func fwRuleSpecs(ns *NetworkState, def fwRuleDef) ([][]string, error) {
+	specs := [][]string{}
+	for _, group := range []struct {
+		verdict string
+		rules   [][]fwTargetDef
+	}{{"ACCEPT", def.Accept}, {"DROP", def.Drop}} {
+		for _, rule := range group.rules {
+			src, dst, bidirectional, err := parseFWRule(rule)
+			if err != nil {
+				return nil, err
+			}
+			srcAddrs, err := resolveFWTarget(ns, src)
+			if err != nil {
+				return nil, err
+			}
+			dstAddrs, err := resolveFWTarget(ns, dst)
+			if err != nil {
+				return nil, err
+			}
+			specs = append(specs, expandFWRule(srcAddrs, dstAddrs, group.verdict)...)
+			if bidirectional {
+				specs = append(specs, expandFWRule(dstAddrs, srcAddrs, group.verdict)...)
+			}
+		}
+	}
+	return specs, nil
+}
+
+func expandFWRule(srcAddrs, dstAddrs []string, verdict string) [][]string {
+	srcMatches, dstMatches := fwMatches("-s", srcAddrs), fwMatches("-d", dstAddrs)
+	specs := [][]string{}
+	for _, srcMatch := range srcMatches {
+		for _, dstMatch := range dstMatches {
+			spec := append([]string{fwChain}, srcMatch...)
+			spec = append(spec, dstMatch...)
+			specs = append(specs, append(spec, "-j", verdict))
+		}
+	}
+	return specs
+}
+
+func fwMatches(flag string, addrs []string) [][]string {
+	if addrs == nil {
+		return [][]string{{}}
+	}
+	matches := [][]string{}
+	for _, addr := range addrs {
+		matches = append(matches, []string{flag, addr})
+	}
+	return matches
+}
+
+// fwVerdict tells what routerName's firewall does with the traffic it forwards
+// from address src to address dst going by the rules we installed on it:
+// the verdict of the first rule matching or else the chain's policy.
+func fwVerdict(ns *NetworkState, routerName, src, dst string) string {
+	for _, spec := range ns.FWRules[routerName] {
+		if fwSpecMatches(spec, src, dst) {
+			return spec[len(spec)-1]
+		}
+	}
+	if policy := strings.ToUpper(ns.Definition.Routers[routerName].FWRules.Policy); policy != "" {
+		return policy
+	}
+	return "ACCEPT"
+}
+
+// fwSpecMatches tells whether a rule spec built by expandFWRule matches traffic from src to dst.
+func fwSpecMatches(spec []string, src, dst string) bool {
+	for i := 1; i+1 < len(spec); i += 2 {
+		addr := ""
+		switch spec[i] {
+		case "-s":
+			addr = src
+		case "-d":
+			addr = dst
+		default:
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if _, block, err := net.ParseCIDR(spec[i+1]); err == nil {
+			if !block.Contains(ip) {
+				return false
+			}
+		} else if !net.ParseIP(spec[i+1]).Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyFWRules (re)installs the rules in def on routerName, replacing the ones
+// we might have installed before. The rules in place are recorded on ns.
+func applyFWRules(ns *NetworkState, routerName string, def fwRuleDef) error {
+	if def.Policy == "" && len(def.Accept) == 0 && len(def.Drop) == 0 && len(ns.FWRules[routerName]) == 0 {
+		return nil
+	}
+
+	routerInfo, ok := ns.Routers[routerName]
+	if !ok {
+		return errUnknownNode(routerName)
+	}
+
+	specs, err := fwRuleSpecs(ns, def)
+	if err != nil {
+		return fmt.Errorf("couldn't build the firewall rules for %s: %w", routerName, err)
+	}
+
+	policy := strings.ToUpper(def.Policy)
+	if policy == "" {
+		policy = "ACCEPT"
+	}
+
+	ns.log().with("node", routerName).debug("installing %d firewall rules with policy %s\n", len(specs), policy)
+	if err := ns.backend.installFWRules(routerInfo.PID, policy, specs); err != nil {
+		return fmt.Errorf("couldn't install the firewall rules on %s: %w", routerName, err)
+	}
+
+	ns.FWRules[routerName] = specs
+	return nil
+}
+
+// installFWRules flushes fwChain on the container whose PID is containerPID
+// before appending specs to it and setting the FORWARD chain's policy.
+func (linuxBackend) installFWRules(containerPID int, policy string, specs [][]string) error {
+	return inContainerNS(containerPID, func() error {
+		if err := ensureFWChain(); err != nil {
+			return err
+		}
+		if err := nsIptables("-F", fwChain); err != nil {
+			return err
+		}
+		if err := nsIptables("-P", "FORWARD", policy); err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			if err := nsIptables(append([]string{"-A"}, spec...)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func ensureFWChain() error {
+	if err := nsIptables("-n", "-L", fwChain); err != nil {
+		if err := nsIptables("-N", fwChain); err != nil {
+			return err
+		}
+	}
+	if err := nsIptables("-C", "FORWARD", "-j", fwChain); err != nil {
+		return nsIptables("-I", "FORWARD", "-j", fwChain)
+	}
+	return nil
+}
+
+// nsIptables runs iptables(8) in the network namespace of the calling
+// thread, which lets us configure the firewall of containers whose
+// images don't ship iptables(8) themselves.
+func nsIptables(args ...string) error {
+	_, err := nsIptablesOutput(args...)
+	return err
+}
+
+func nsIptablesOutput(args ...string) (string, error) {
+	output, err := exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// fwRules returns the policy of the FORWARD chain of the container whose PID
+// is containerPID and the rule specs in its fwChain, as in iptables -S. A
+// missing fwChain holds no rules.
+func (linuxBackend) fwRules(containerPID int) (string, [][]string, error) {
+	policy, specs := "", [][]string{}
+	err := inContainerNS(containerPID, func() error {
+		forward, err := nsIptablesOutput("-S", "FORWARD")
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(forward, "\n") {
+			if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "-P" {
+				policy = fields[2]
+			}
+		}
+		if err := nsIptables("-n", "-L", fwChain); err != nil {
+			return nil
+		}
+		rules, err := nsIptablesOutput("-S", fwChain)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(rules, "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "-A" {
+				specs = append(specs, fields[1:])
+			}
+		}
+		return nil
+	})
+	return policy, specs, err
+}
+
+// canonicalFWSpec writes spec down the way iptables -S does,
+// which always gives addresses a prefix length.
+func canonicalFWSpec(spec []string) string {
+	canonical := append([]string{}, spec...)
+	for i := 0; i+1 < len(canonical); i++ {
+		if canonical[i] != "-s" && canonical[i] != "-d" {
+			continue
+		}
+		addr := canonical[i+1]
+		if !strings.Contains(addr, "/") {
+			addr += "/32"
+		}
+		if _, block, err := net.ParseCIDR(addr); err == nil {
+			canonical[i+1] = block.String()
+		}
+	}
+	return strings.Join(canonical, " ")
+}
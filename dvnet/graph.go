@@ -21,6 +21,35 @@ func genGraph(net netDef) (*dijkstra.Graph, error) {
 		}
 	}
 
+	// Switches are vertices too: nodes on switched subnets reach
+	// each other through the switches they're plugged into.
+	for _, switchName := range sortedKeys(net.Switches) {
+		assignedID := netTopology.AddMappedVertex(switchName)
+		log.debug("graphGen: currentID -> %d, assignedID -> %d", currentID, assignedID)
+		if currentID != assignedID {
+			return nil, fmt.Errorf("switch %s has the same name as a host", switchName)
+		}
+		currentID++
+	}
+	for _, pair := range switchLinks(net) {
+		netTopology.AddMappedArc(pair[0], pair[1], 1)
+		netTopology.AddMappedArc(pair[1], pair[0], 1)
+	}
+	for subnetName, subnetDef := range net.Subnets {
+		switches := subnetSwitches(net, subnetName)
+		if len(switches) == 0 {
+			continue
+		}
+		for host, hDef := range subnetDef.Hosts {
+			switchName := switches[0]
+			if hDef.Switch != "" {
+				switchName = hDef.Switch
+			}
+			netTopology.AddMappedArc(host, switchName, 1)
+			netTopology.AddMappedArc(switchName, host, 1)
+		}
+	}
+
 	for routerName, routerDef := range net.Routers {
 		assignedID := netTopology.AddMappedVertex(routerName)
 		log.debug("graphGen: currentID -> %d, assignedID -> %d", currentID, assignedID)
@@ -34,6 +63,15 @@ func genGraph(net netDef) (*dijkstra.Graph, error) {
 				return nil, fmt.Errorf("router %s should be connected to subnet %s but it doesn't exist",
 					routerName, subnet)
 			}
+			if switches := subnetSwitches(net, subnet); len(switches) != 0 {
+				switchName := switches[0]
+				if routerDef.Switches[subnet] != "" {
+					switchName = routerDef.Switches[subnet]
+				}
+				netTopology.AddMappedArc(routerName, switchName, 1)
+				netTopology.AddMappedArc(switchName, routerName, 1)
+				continue
+			}
 			for host := range subnetDef.Hosts {
 				netTopology.AddMappedArc(routerName, host, 1)
 				netTopology.AddMappedArc(host, routerName, 1)
@@ -41,6 +79,22 @@ func genGraph(net netDef) (*dijkstra.Graph, error) {
 		}
 	}
 
+	// Routers sharing a subnet can reach each other directly, which is
+	// the only way through subnets without hosts such as point-to-point ones.
+	for routerName, routerDef := range net.Routers {
+		for neighName, neighDef := range net.Routers {
+			if routerName == neighName {
+				continue
+			}
+			for _, subnet := range routerDef.Subnets {
+				if contains(neighDef.Subnets, subnet) {
+					netTopology.AddMappedArc(routerName, neighName, 1)
+					break
+				}
+			}
+		}
+	}
+
 	return netTopology, nil
 }
 
@@ -59,6 +113,19 @@ func findSubnetRoutes(netGraph *dijkstra.Graph, netDefinition netDef, srcSubnet
 			dst = k
 			break
 		}
+		// Subnets without hosts are reached through any router attached to them.
+		dstIsRouter := false
+		if dst == "" {
+			for _, routerName := range sortedKeys(netDefinition.Routers) {
+				if contains(netDefinition.Routers[routerName].Subnets, dstSubnetName) {
+					dst, dstIsRouter = routerName, true
+					break
+				}
+			}
+			if dst == "" {
+				continue
+			}
+		}
 		shortestPath, err := netGraph.Shortest(
 			netGraph.AddMappedVertex(src), netGraph.AddMappedVertex(dst))
 		if err != nil {
@@ -67,13 +134,19 @@ func findSubnetRoutes(netGraph *dijkstra.Graph, netDefinition netDef, srcSubnet
 		}
 		shortestPathMapped := []string{}
 		for _, vertex := range shortestPath.Path {
-			shortestPathMapped = append(
-				shortestPathMapped, func(vID int) string { vMID, _ := netGraph.GetMapped(vID); return vMID }(vertex))
+			vMID, _ := netGraph.GetMapped(vertex)
+			// Switches are transparent as far as routing is concerned.
+			if _, isSwitch := netDefinition.Switches[vMID]; isSwitch {
+				continue
+			}
+			shortestPathMapped = append(shortestPathMapped, vMID)
 		}
 		log.debug("shortest path from %s to %s: %v\n", src, dst, shortestPathMapped)
-		shortestPaths[dstSubnetName] = graphRoute{
-			destCIDR: dstSubnet.CIDRBlock,
-			rawPath:  shortestPathMapped[1 : len(shortestPathMapped)-1]}
+		rawPath := shortestPathMapped[1 : len(shortestPathMapped)-1]
+		if dstIsRouter {
+			rawPath = shortestPathMapped[1:]
+		}
+		shortestPaths[dstSubnetName] = graphRoute{destCIDR: dstSubnet.CIDRBlock, rawPath: rawPath}
 	}
 	log.debug("discovered shortest paths from subnet %s: %v\n", srcSubnet.CIDRBlock.String(), shortestPaths)
 	return shortestPaths, nil
@@ -0,0 +1,312 @@
+package dvnet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// LinkImpairments degrade a link the way tc-netem(8) does. They apply
+// in each direction: a 100ms delay makes for a 200ms round trip.
+type LinkImpairments struct {
+	Delay     string  `json:"delay,omitempty"`
+	Jitter    string  `json:"jitter,omitempty"`
+	Loss      float32 `json:"loss,omitempty"`
+	Duplicate float32 `json:"duplicate,omitempty"`
+	Reorder   float32 `json:"reorder,omitempty"`
+	Corrupt   float32 `json:"corrupt,omitempty"`
+	Rate      string  `json:"rate,omitempty"`
+
+	// Limit is the number of packets netem can hold on to.
+	Limit uint32 `json:"limit,omitempty"`
+}
+
+// Handles of the qdiscs impairing a link: netem at the root and,
+// if the rate is limited, a tbf below it.
+var (
+	netemHandle uint32 = netlink.MakeHandle(1, 0)
+	tbfHandle   uint32 = netlink.MakeHandle(10, 0)
+)
+
+func (li LinkImpairments) String() string {
+	parts := []string{}
+	if li.Delay != "" {
+		parts = append(parts, "delay "+li.Delay)
+	}
+	if li.Jitter != "" {
+		parts = append(parts, "jitter "+li.Jitter)
+	}
+	for _, p := range []struct {
+		name  string
+		value float32
+	}{{"loss", li.Loss}, {"duplicate", li.Duplicate}, {"reorder", li.Reorder}, {"corrupt", li.Corrupt}} {
+		if p.value != 0 {
+			parts = append(parts, fmt.Sprintf("%s %g%%", p.name, p.value))
+		}
+	}
+	if li.Rate != "" {
+		parts = append(parts, "rate "+li.Rate)
+	}
+	if li.Limit != 0 {
+		parts = append(parts, fmt.Sprintf("limit %d", li.Limit))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (li LinkImpairments) validate() error {
+	delay, err := parseImpairmentDuration("delay", li.Delay)
+	if err != nil {
+		return err
+	}
+	if _, err := parseImpairmentDuration("jitter", li.Jitter); err != nil {
+		return err
+	}
+	if li.Jitter != "" && delay == 0 {
+		return fmt.Errorf("jitter requires a delay")
+	}
+	if li.Reorder != 0 && delay == 0 {
+		return fmt.Errorf("reordering requires a delay")
+	}
+
+	for _, p := range []struct {
+		name  string
+		value float32
+	}{{"loss", li.Loss}, {"duplicate", li.Duplicate}, {"reorder", li.Reorder}, {"corrupt", li.Corrupt}} {
+		if p.value < 0 || p.value > 100 {
+			return fmt.Errorf("%s should be a percentage; got %g", p.name, p.value)
+		}
+	}
+
+	if li.Rate != "" {
+		if _, err := parseRate(li.Rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseImpairmentDuration(name, raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("wrong %s %q: it should look like 100ms", name, raw)
+	}
+	return d, nil
+}
+
+// rateUnits are the ones tc(8) understands: bits and bytes per second.
+var rateUnits = []struct {
+	suffix     string
+	bitsPerSec uint64
+}{
+	{"gbit", 1000 * 1000 * 1000}, {"mbit", 1000 * 1000}, {"kbit", 1000}, {"bit", 1},
+	{"gbps", 8 * 1000 * 1000 * 1000}, {"mbps", 8 * 1000 * 1000}, {"kbps", 8 * 1000}, {"bps", 8},
+}
+
+// parseRate returns rate (e.g. 10mbit) in bytes per second.
+func parseRate(rate string) (uint64, error) {
+	lowerRate := strings.ToLower(rate)
+	for _, unit := range rateUnits {
+		if !strings.HasSuffix(lowerRate, unit.suffix) {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSuffix(lowerRate, unit.suffix), 64)
+		if err != nil || value <= 0 {
+			break
+		}
+		return uint64(value * float64(unit.bitsPerSec) / 8), nil
+	}
+	return 0, fmt.Errorf("wrong rate %q: it should look like 10mbit", rate)
+}
+
+// qdiscs returns the qdiscs to be installed on the link with the
+// given index so that it's impaired as described by li.
+func (li LinkImpairments) qdiscs(linkIndex int) ([]netlink.Qdisc, error) {
+	if err := li.validate(); err != nil {
+		return nil, err
+	}
+	delay, _ := parseImpairmentDuration("delay", li.Delay)
+	jitter, _ := parseImpairmentDuration("jitter", li.Jitter)
+
+	netem := netlink.NewNetem(
+		netlink.QdiscAttrs{LinkIndex: linkIndex, Handle: netemHandle, Parent: netlink.HANDLE_ROOT},
+		netlink.NetemQdiscAttrs{
+			Latency:     uint32(delay.Microseconds()),
+			Jitter:      uint32(jitter.Microseconds()),
+			Loss:        li.Loss,
+			Duplicate:   li.Duplicate,
+			ReorderProb: li.Reorder,
+			CorruptProb: li.Corrupt,
+			Limit:       li.Limit,
+		})
+	qdiscs := []netlink.Qdisc{netem}
+
+	if li.Rate != "" {
+		rate, _ := parseRate(li.Rate)
+		// Let bursts of 10ms worth of traffic through and queue up to 50ms worth.
+		burst := uint32(rate / 100)
+		if burst < 3000 {
+			burst = 3000
+		}
+		qdiscs = append(qdiscs, &netlink.Tbf{
+			QdiscAttrs: netlink.QdiscAttrs{LinkIndex: linkIndex, Handle: tbfHandle, Parent: netlink.MakeHandle(1, 1)},
+			Rate:       rate,
+			Limit:      uint32(rate/20) + burst,
+			Buffer:     uint32(netlink.Xmittime(rate, burst)),
+		})
+	}
+	return qdiscs, nil
+}
+
+// desiredImpairments returns the impairments def places on the link between node and subnet.
+func desiredImpairments(def netDef, node, subnet string) *LinkImpairments {
+	if hDef, ok := def.Subnets[subnet].Hosts[node]; ok {
+		return hDef.Link
+	}
+	if rDef, ok := def.Routers[node]; ok {
+		if li, ok := rDef.Links[subnet]; ok {
+			return &li
+		}
+	}
+	return nil
+}
+
+// applyImpairments brings the impairments and shaping on every link in line
+// with def. Both ends of each link are impaired so that both directions are
+// affected. Point-to-point and trunk links are the exception: each node's end
+// carries the impairments defined for it, so they only affect what that node
+// sends. As for shaping, the node's end shapes its egress traffic whilst the
+// bridge end, which sends whatever the node receives, shapes its ingress.
+func applyImpairments(ns *NetworkState, def netDef) error {
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		want := desiredImpairments(def, link.Node, link.Subnet)
+		wantShaping := desiredShaping(def, link.Node, link.Subnet)
+		if sameSettings(want, link.Impairments) && sameSettings(wantShaping, link.Shaping) {
+			continue
+		}
+
+		pid, ok := ns.nodePID(link.Node)
+		if !ok {
+			return errUnknownNode(link.Node)
+		}
+		log.debug("impairing the link between %s and %s: %v %v\n", link.Node, link.Subnet, want, wantShaping)
+		if link.ownsBridgeEnd() {
+			if err := ns.backend.impairLink(link.BridgeEnd, 0, want, wantShaping.ingress()); err != nil {
+				return fmt.Errorf("couldn't impair %s: %w", link.BridgeEnd, err)
+			}
+		}
+		if err := ns.backend.impairLink(link.NodeEnd, pid, want, wantShaping.egress()); err != nil {
+			return fmt.Errorf("couldn't impair %s on %s: %w", link.NodeEnd, link.Node, err)
+		}
+
+		link.Impairments, link.Shaping = want, wantShaping
+		ns.Links[key] = link
+	}
+	return nil
+}
+
+// impairLink replaces whatever qdiscs iface had with the ones impairing it as
+// described by li and shaping it as described by sp, or just removes them if
+// both are nil. An iface within a container is given by its PID: a zero PID
+// refers to the host.
+func (linuxBackend) impairLink(iface string, containerPID int, li *LinkImpairments, sp *ShapingPolicy) error {
+	impair := func() error {
+		link, err := netlink.LinkByName(iface)
+		if err != nil {
+			return err
+		}
+
+		// Dropping the root qdisc drops every qdisc below it too. It's
+		// either the netem impairing the link or the HTB shaping it.
+		for _, root := range []*netlink.GenericQdisc{
+			{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: netemHandle, Parent: netlink.HANDLE_ROOT}, QdiscType: "netem"},
+			{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: htbHandle, Parent: netlink.HANDLE_ROOT}, QdiscType: "htb"},
+		} {
+			if err := netlink.QdiscDel(root); err != nil {
+				log.debug("no previous %s qdisc on %s: %v\n", root.QdiscType, iface, err)
+			}
+		}
+
+		htbParent := uint32(netlink.HANDLE_ROOT)
+		if li != nil {
+			if li.Rate != "" && sp != nil {
+				return fmt.Errorf("rate impairments can't be combined with shaping")
+			}
+			qdiscs, err := li.qdiscs(link.Attrs().Index)
+			if err != nil {
+				return err
+			}
+			for _, qdisc := range qdiscs {
+				if err := netlink.QdiscAdd(qdisc); err != nil {
+					return fmt.Errorf("couldn't add the %s qdisc: %w", qdisc.Type(), err)
+				}
+			}
+			htbParent = netlink.MakeHandle(1, 1)
+		}
+		if sp == nil {
+			return nil
+		}
+
+		htb, classes, filters, err := sp.tc(link.Attrs().Index, htbParent)
+		if err != nil {
+			return err
+		}
+		if err := netlink.QdiscAdd(htb); err != nil {
+			return fmt.Errorf("couldn't add the htb qdisc: %w", err)
+		}
+		for _, class := range classes {
+			if err := netlink.ClassAdd(class); err != nil {
+				return fmt.Errorf("couldn't add HTB class %x: %w", class.Attrs().Handle, err)
+			}
+		}
+		for _, filter := range filters {
+			if err := netlink.FilterAdd(filter); err != nil {
+				return fmt.Errorf("couldn't add a DSCP filter: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if containerPID == 0 {
+		return impair()
+	}
+	return inContainerNS(containerPID, impair)
+}
+
+// SetLinkImpairments changes the impairments on the link between node and
+// subnet. A nil li removes them. Just like nodes added through the API, the
+// change will be reverted on the next reload unless the definition is updated.
+func (d Driver) SetLinkImpairments(network, node, subnet string, li *LinkImpairments) error {
+	if li != nil && *li == (LinkImpairments{}) {
+		li = nil
+	}
+	return d.alterDefinition(network, func(def *netDef) error {
+		if subnetDef, ok := def.Subnets[subnet]; ok {
+			if hDef, ok := subnetDef.Hosts[node]; ok {
+				hDef.Link = li
+				subnetDef.Hosts[node] = hDef
+				return nil
+			}
+		}
+		rDef, ok := def.Routers[node]
+		if !ok || !contains(rDef.Subnets, subnet) {
+			return notFoundError{fmt.Sprintf("node %s is not attached to subnet %s", node, subnet)}
+		}
+		if li == nil {
+			delete(rDef.Links, subnet)
+			return nil
+		}
+		if rDef.Links == nil {
+			rDef.Links = map[string]LinkImpairments{}
+		}
+		rDef.Links[subnet] = *li
+		def.Routers[node] = rDef
+		return nil
+	})
+}
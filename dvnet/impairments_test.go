@@ -0,0 +1,122 @@
+package dvnet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    uint64
+		wantErr bool
+	}{
+		{"10mbit", 1250000, false},
+		{"1Gbit", 125000000, false},
+		{"512kbit", 64000, false},
+		{"2.5mbps", 2500000, false},
+		{"800bit", 100, false},
+		{"10", 0, true},
+		{"fastmbit", 0, true},
+		{"-1mbit", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.rate)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseRate(%q) = %d, %v; wanted %d (error %t)", tt.rate, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLinkImpairmentsValidation(t *testing.T) {
+	tests := []struct {
+		li      LinkImpairments
+		wantErr bool
+	}{
+		{LinkImpairments{Delay: "100ms", Jitter: "10ms", Loss: 1.5, Reorder: 25, Rate: "10mbit"}, false},
+		{LinkImpairments{Loss: 100, Duplicate: 0.5, Corrupt: 0.1}, false},
+		{LinkImpairments{Delay: "100"}, true},
+		{LinkImpairments{Delay: "-10ms"}, true},
+		{LinkImpairments{Jitter: "10ms"}, true},
+		{LinkImpairments{Reorder: 25}, true},
+		{LinkImpairments{Loss: 101}, true},
+		{LinkImpairments{Rate: "fast"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.li.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.validate() err %v; wanted error %t", tt.li, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLinkImpairmentsQdiscs(t *testing.T) {
+	qdiscs, err := LinkImpairments{Delay: "100ms", Loss: 1}.qdiscs(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qdiscs) != 1 || qdiscs[0].Type() != "netem" || qdiscs[0].Attrs().Parent != netlink.HANDLE_ROOT {
+		t.Fatalf("qdiscs() = %v; wanted just a root netem", qdiscs)
+	}
+
+	qdiscs, err = LinkImpairments{Rate: "8mbit"}.qdiscs(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qdiscs) != 2 {
+		t.Fatalf("qdiscs() = %v; wanted a netem and a tbf", qdiscs)
+	}
+	tbf, ok := qdiscs[1].(*netlink.Tbf)
+	if !ok || tbf.Rate != 1000000 || tbf.Parent != netlink.MakeHandle(1, 1) || tbf.LinkIndex != 7 {
+		t.Errorf("qdiscs() tbf = %+v; wanted 1000000 bytes/s below the netem on link 7", qdiscs[1])
+	}
+}
+
+func TestSetLinkImpairments(t *testing.T) {
+	d, pb := testDriver(t)
+
+	li := &LinkImpairments{Delay: "50ms", Loss: 2}
+	if err := d.SetLinkImpairments("0123", "R-1", "C", li); err != nil {
+		t.Fatalf("SetLinkImpairments() err %v", err)
+	}
+	if err := d.SetLinkImpairments("0123", "A-1", "A", &LinkImpairments{Rate: "1mbit"}); err != nil {
+		t.Fatalf("SetLinkImpairments() err %v", err)
+	}
+
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{
+		"impair bth-r-1-c on the host: delay 50ms loss 2%",
+		fmt.Sprintf("impair ethr-1-c on container #%d: delay 50ms loss 2%%", ns.Routers["R-1"].PID),
+		"impair bth-a-1 on the host: rate 1mbit",
+	} {
+		if !contains(pb.plan.Steps, step) {
+			t.Errorf("SetLinkImpairments() should have done %q", step)
+		}
+	}
+	if got := ns.Links[linkKey("R-1", "C")].Impairments; got == nil || *got != *li {
+		t.Errorf("R-1's link to C impairments = %v; wanted %v", got, li)
+	}
+	if got := ns.Definition.Routers["R-1"].Links["C"]; got != *li {
+		t.Errorf("R-1's definition impairments = %v; wanted %v", got, li)
+	}
+
+	if err := d.SetLinkImpairments("0123", "R-1", "C", &LinkImpairments{}); err != nil {
+		t.Fatalf("SetLinkImpairments() err %v", err)
+	}
+	if !contains(pb.plan.Steps, "remove the impairments on bth-r-1-c on the host") {
+		t.Errorf("SetLinkImpairments() should have removed R-1's impairments")
+	}
+
+	for _, tt := range []struct{ node, subnet string }{{"R-1", "B"}, {"A-1", "B"}, {"Z-1", "A"}} {
+		if err := d.SetLinkImpairments("0123", tt.node, tt.subnet, li); err == nil {
+			t.Errorf("SetLinkImpairments(%s, %s) should have failed", tt.node, tt.subnet)
+		}
+	}
+	if err := d.SetLinkImpairments("0123", "A-1", "A", &LinkImpairments{Loss: 200}); err == nil {
+		t.Errorf("SetLinkImpairments() should have rejected a 200%% loss")
+	}
+}
@@ -0,0 +1,168 @@
+package dvnet
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NetworkInfo describes a running network in detail: its subnets and switches,
+// its nodes together with their addresses and the links joining them.
+type NetworkInfo struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Origin   string        `json:"origin"`
+	Subnets  []SubnetInfo  `json:"subnets"`
+	Switches []SwitchInfo  `json:"switches,omitempty"`
+	Nodes    []NodeInfo    `json:"nodes"`
+	Links    []LinkDetails `json:"links"`
+}
+
+// SubnetInfo describes a subnet and the bridge backing it, if any,
+// which is an Open vSwitch one if OVS is set.
+type SubnetInfo struct {
+	Name   string `json:"name"`
+	CIDR   string `json:"cidr"`
+	Type   string `json:"type"`
+	VLAN   int    `json:"vlan,omitempty"`
+	Bridge string `json:"bridge"`
+	OVS    bool   `json:"ovs,omitempty"`
+}
+
+// SwitchInfo describes a switch, the bridge backing it and the switches it's linked to.
+type SwitchInfo struct {
+	Name     string   `json:"name"`
+	Subnet   string   `json:"subnet"`
+	Bridge   string   `json:"bridge"`
+	STP      bool     `json:"stp"`
+	Priority *int     `json:"priority,omitempty"`
+	Links    []string `json:"links"`
+}
+
+// NodeInfo describes a host or router and its interfaces.
+type NodeInfo struct {
+	Name        string          `json:"name"`
+	Kind        string          `json:"kind"`
+	ContainerID string          `json:"container_id"`
+	PID         int             `json:"pid"`
+	Interfaces  []InterfaceInfo `json:"interfaces"`
+}
+
+// InterfaceInfo describes one of a node's interfaces.
+type InterfaceInfo struct {
+	Name    string `json:"name"`
+	Subnet  string `json:"subnet"`
+	Address string `json:"address"`
+}
+
+// LinkDetails describes the veth pair joining a node to a subnet's bridge,
+// to its Switch on switched subnets or, on point-to-point subnets, to its Peer.
+type LinkDetails struct {
+	Node        string            `json:"node"`
+	NodeEnd     string            `json:"node_end"`
+	Subnet      string            `json:"subnet"`
+	Bridge      string            `json:"bridge"`
+	BridgeEnd   string            `json:"bridge_end"`
+	Peer        string            `json:"peer,omitempty"`
+	Switch      string            `json:"switch,omitempty"`
+	Impairments *LinkImpairments  `json:"impairments,omitempty"`
+	Shaping     *BandwidthShaping `json:"shaping,omitempty"`
+	MirroredTo  string            `json:"mirrored_to,omitempty"`
+	Down        bool              `json:"down,omitempty"`
+}
+
+// Inspect describes the network with the given name, ID or ID prefix.
+func (d Driver) Inspect(network string) (NetworkInfo, error) {
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	return networkInfo(ns), nil
+}
+
+func networkInfo(ns *NetworkState) NetworkInfo {
+	info := NetworkInfo{ID: ns.ID, Name: ns.Definition.Name, Origin: ns.Origin,
+		Subnets: []SubnetInfo{}, Nodes: []NodeInfo{}, Links: []LinkDetails{}}
+
+	for _, subnetName := range sortedKeys(ns.Subnets) {
+		addresser := ns.Addressers[subnetName]
+		subnetType := subnetTypeBridge
+		if ns.Subnets[subnetName].P2P {
+			subnetType = subnetTypeP2P
+		}
+		info.Subnets = append(info.Subnets, SubnetInfo{
+			Name: subnetName, CIDR: addresser.cidrBlock.String(), Type: subnetType, VLAN: ns.Subnets[subnetName].VLAN, Bridge: ns.Subnets[subnetName].BridgeName, OVS: ns.Subnets[subnetName].OVS != nil})
+	}
+
+	for _, switchName := range sortedKeys(ns.Switches) {
+		sw := ns.Switches[switchName]
+		swDef := ns.Definition.Switches[switchName]
+		links := []string{}
+		for _, key := range sortedKeys(ns.SwitchLinks) {
+			switch pair := ns.SwitchLinks[key].Switches; switchName {
+			case pair[0]:
+				links = append(links, pair[1])
+			case pair[1]:
+				links = append(links, pair[0])
+			}
+		}
+		info.Switches = append(info.Switches, SwitchInfo{Name: switchName, Subnet: sw.Subnet,
+			Bridge: sw.BridgeName, STP: swDef.STP, Priority: swDef.Priority, Links: links})
+	}
+
+	interfaces := map[string][]InterfaceInfo{}
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		interfaces[link.Node] = append(interfaces[link.Node], InterfaceInfo{Name: link.NodeEnd, Subnet: link.Subnet, Address: link.CIDR})
+		bridgeName := ns.Subnets[link.Subnet].BridgeName
+		if link.Switch != "" {
+			bridgeName = ns.Switches[link.Switch].BridgeName
+		}
+		details := LinkDetails{Node: link.Node, NodeEnd: link.NodeEnd,
+			Subnet: link.Subnet, Bridge: bridgeName, BridgeEnd: link.BridgeEnd, Peer: link.Peer, Switch: link.Switch, Impairments: link.Impairments, Shaping: link.Shaping, Down: link.Down}
+		if link.Mirror != nil {
+			details.MirroredTo = link.Mirror.To
+		}
+		info.Links = append(info.Links, details)
+	}
+
+	addNode := func(name, kind string, cInfo containerInfo) {
+		ifaces := interfaces[name]
+		if ifaces == nil {
+			ifaces = []InterfaceInfo{}
+		}
+		info.Nodes = append(info.Nodes, NodeInfo{Name: name, Kind: kind, ContainerID: cInfo.ID, PID: cInfo.PID, Interfaces: ifaces})
+	}
+	for _, subnet := range ns.Subnets {
+		for host, cInfo := range subnet.Containers {
+			addNode(host, nodeKindHost, cInfo)
+		}
+	}
+	for routerName, cInfo := range ns.Routers {
+		addNode(routerName, nodeKindRouter, cInfo)
+	}
+	sort.Slice(info.Nodes, func(i, j int) bool { return info.Nodes[i].Name < info.Nodes[j].Name })
+
+	return info
+}
+
+// NodeContainer returns the ID of the container running node within
+// the network with the given name, ID or ID prefix.
+func (d Driver) NodeContainer(network, node string) (string, error) {
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return "", err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return "", err
+	}
+	info, ok := ns.nodeInfo(node)
+	if !ok {
+		return "", fmt.Errorf("network %s: %w", network, errUnknownNode(node))
+	}
+	return info.ID, nil
+}
@@ -0,0 +1,69 @@
+package dvnet
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNetworkInfo(t *testing.T) {
+	info := networkInfo(plannedState(t, "../demos/quagga/net.json"))
+
+	wantSubnets := []SubnetInfo{
+		{Name: "A", CIDR: "10.0.0.0/24", Type: subnetTypeBridge, Bridge: "dvn-a"},
+		{Name: "B", CIDR: "10.0.1.0/24", Type: subnetTypeBridge, Bridge: "dvn-b"},
+		{Name: "C", CIDR: "10.0.2.0/24", Type: subnetTypeBridge, Bridge: "dvn-c"},
+		{Name: outboundSubnetName, CIDR: "192.168.240.0/24", Type: subnetTypeBridge, Bridge: "dvn-dvhop"},
+	}
+	if diff := cmp.Diff(wantSubnets, info.Subnets); diff != "" {
+		t.Errorf("networkInfo() subnets mismatch (-want +got):\n%s", diff)
+	}
+
+	gotNodes := []string{}
+	for _, node := range info.Nodes {
+		gotNodes = append(gotNodes, node.Name+":"+node.Kind)
+	}
+	if want := []string{"A-1:host", "A-2:host", "B-1:host", "B-2:host", "R-1:router", "R-2:router"}; !cmp.Equal(gotNodes, want) {
+		t.Errorf("networkInfo() nodes = %v; wanted %v", gotNodes, want)
+	}
+
+	// Routers are attached in no particular order, so R-1 and R-2 could get either
+	// of C's first two addresses: those are compared as a set across both instead.
+	wantIfaces := []InterfaceInfo{
+		{"ethr-1-a", "A", "10.0.0.3/24"},
+		{"ethr-1-c", "C", ""},
+	}
+	gotIfaces, addrsOnC := []InterfaceInfo{}, []string{}
+	for _, node := range info.Nodes {
+		for _, iface := range node.Interfaces {
+			if iface.Subnet == "C" {
+				addrsOnC = append(addrsOnC, iface.Address)
+				iface.Address = ""
+			}
+			// Leave the outbound interface out: its address depends on the order nodes are connected in.
+			if node.Name == "R-1" && iface.Subnet != outboundSubnetName {
+				gotIfaces = append(gotIfaces, iface)
+			}
+		}
+	}
+	sort.Slice(gotIfaces, func(i, j int) bool { return gotIfaces[i].Name < gotIfaces[j].Name })
+	sort.Strings(addrsOnC)
+	if diff := cmp.Diff(wantIfaces, gotIfaces); diff != "" {
+		t.Errorf("networkInfo() R-1 interfaces mismatch (-want +got):\n%s", diff)
+	}
+	if want := []string{"10.0.2.1/24", "10.0.2.2/24"}; !cmp.Equal(addrsOnC, want) {
+		t.Errorf("networkInfo() addresses on C = %v; wanted %v", addrsOnC, want)
+	}
+
+	if len(info.Links) != 14 {
+		t.Errorf("networkInfo() got %d links; wanted 14", len(info.Links))
+	}
+	for _, link := range info.Links {
+		if link.Node == "A-1" && link.Subnet == "A" {
+			if want := (LinkDetails{Node: "A-1", NodeEnd: "etha-1", Subnet: "A", Bridge: "dvn-a", BridgeEnd: "bth-a-1"}); link != want {
+				t.Errorf("networkInfo() A-1 link = %+v; wanted %+v", link, want)
+			}
+		}
+	}
+}
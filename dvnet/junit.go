@@ -0,0 +1,79 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// junitSuites is the root of a JUnit XML report, which is what
+// CI systems and autograders expect test results to look like.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Details string `xml:",chardata"`
+}
+
+// writeJUnit writes suites as a JUnit XML report, counting their tests and failures.
+func writeJUnit(w io.Writer, suites ...junitSuite) error {
+	report := junitSuites{Suites: suites}
+	for i := range report.Suites {
+		suite := &report.Suites[i]
+		suite.Tests, suite.Failures = len(suite.Cases), 0
+		for _, c := range suite.Cases {
+			if c.Failure != nil {
+				suite.Failures++
+			}
+		}
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeReport writes v in the given format: through text, as indented JSON or through junit.
+func writeReport(w io.Writer, format string, v interface{}, text, junit func(io.Writer) error) error {
+	switch format {
+	case ReportText:
+		return text(w)
+	case ReportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(v)
+	case ReportJUnit:
+		return junit(w)
+	}
+	return fmt.Errorf("unknown report format %q: it should be one of %s, %s or %s", format, ReportText, ReportJSON, ReportJUnit)
+}
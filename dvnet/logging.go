@@ -1,6 +1,16 @@
 package dvnet
 
-import lg "log"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	lg "log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
 type logLevel uint
 
@@ -11,33 +21,200 @@ const (
 	LogLevelErr
 )
 
+var logLevelNames = map[logLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelErr:   "error",
+}
+
+// Formats log lines can be written in. Text ones are meant for humans
+// and the rest for log collectors: they carry the same fields.
+const (
+	LogFormatText   string = "text"
+	LogFormatJSON   string = "json"
+	LogFormatLogfmt string = "logfmt"
+)
+
+const (
+	logLevelEnv  string = "DVNET_LOG_LEVEL"
+	logFormatEnv string = "DVNET_LOG_FORMAT"
+)
+
+// ParseLogLevel returns the level called name: one of debug, info, warn or error.
+func ParseLogLevel(name string) (logLevel, error) {
+	if strings.ToLower(name) == "warning" {
+		return LogLevelWarn, nil
+	}
+	for level, levelName := range logLevelNames {
+		if strings.ToLower(name) == levelName {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q: it should be one of debug, info, warn or error", name)
+}
+
+// LogSettings returns the level and format to log with as given by the
+// DVNET_LOG_LEVEL and DVNET_LOG_FORMAT environment variables, if at all.
+func LogSettings() (string, string) {
+	level, format := os.Getenv(logLevelEnv), os.Getenv(logFormatEnv)
+	if level == "" {
+		level = logLevelNames[LogLevelInfo]
+	}
+	if format == "" {
+		format = LogFormatText
+	}
+	return level, format
+}
+
+// logger writes messages at or above its level together with its fields,
+// which are key and value pairs telling what the message is about.
 type logger struct {
-	level logLevel
+	level  logLevel
+	format string
+	fields []string
 }
 
 var log logger
 
-func (l *logger) debug(fmt string, args ...interface{}) {
-	if l.level < LogLevelInfo {
-		lg.Printf("DEBUG: "+fmt, args...)
+// logOut is where JSON and logfmt lines go. Text ones go through the
+// standard library's logger so that they keep its prefixes.
+var (
+	logOut   io.Writer = os.Stderr
+	logOutMu sync.Mutex
+)
+
+// with returns a logger adding the given key and value pairs to every
+// message. Empty values are left out.
+func (l logger) with(keysAndValues ...string) logger {
+	fields := make([]string, len(l.fields), len(l.fields)+len(keysAndValues))
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i+1] != "" {
+			fields = append(fields, keysAndValues[i], keysAndValues[i+1])
+		}
+	}
+	l.fields = fields
+	return l
+}
+
+func (l logger) debug(fmt string, args ...interface{}) {
+	l.write(LogLevelDebug, fmt, args...)
+}
+
+func (l logger) info(fmt string, args ...interface{}) {
+	l.write(LogLevelInfo, fmt, args...)
+}
+
+func (l logger) warn(fmt string, args ...interface{}) {
+	l.write(LogLevelWarn, fmt, args...)
+}
+
+func (l logger) error(fmt string, args ...interface{}) {
+	l.write(LogLevelErr, fmt, args...)
+}
+
+func (l logger) write(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+
+	var line string
+	switch l.format {
+	case LogFormatJSON:
+		line = l.jsonLine(level, msg)
+	case LogFormatLogfmt:
+		line = l.logfmtLine(level, msg)
+	default:
+		prefix := strings.ToUpper(logLevelNames[level])
+		if level == LogLevelWarn {
+			prefix = "WARNING"
+		}
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			msg += " " + l.fields[i] + "=" + logfmtValue(l.fields[i+1])
+		}
+		lg.Printf("%s: %s\n", prefix, msg)
+		return
 	}
+
+	logOutMu.Lock()
+	defer logOutMu.Unlock()
+	io.WriteString(logOut, line+"\n")
 }
 
-func (l *logger) info(fmt string, args ...interface{}) {
-	if l.level < LogLevelInfo {
-		lg.Printf("INFO: "+fmt, args...)
+func (l logger) jsonLine(level logLevel, msg string) string {
+	quote := func(s string) string {
+		raw, _ := json.Marshal(s)
+		return string(raw)
+	}
+	pairs := []string{
+		`"time":` + quote(time.Now().Format(time.RFC3339Nano)),
+		`"level":` + quote(logLevelNames[level]),
+		`"msg":` + quote(msg),
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		pairs = append(pairs, quote(l.fields[i])+":"+quote(l.fields[i+1]))
 	}
+	return "{" + strings.Join(pairs, ",") + "}"
 }
 
-func (l *logger) warn(fmt string, args ...interface{}) {
-	lg.Printf("WARNING: "+fmt, args...)
+func (l logger) logfmtLine(level logLevel, msg string) string {
+	pairs := []string{
+		"time=" + time.Now().Format(time.RFC3339Nano),
+		"level=" + logLevelNames[level],
+		"msg=" + logfmtValue(msg),
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		pairs = append(pairs, l.fields[i]+"="+logfmtValue(l.fields[i+1]))
+	}
+	return strings.Join(pairs, " ")
 }
 
-func (l *logger) error(fmt string, args ...interface{}) {
-	lg.Printf("ERROR: "+fmt, args...)
+// logfmtValue quotes v if it'd otherwise be mistaken for several values.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\\n\t") {
+		return strconv.Quote(v)
+	}
+	return v
 }
 
+// InitLogger logs messages at or above level as text unless the
+// DVNET_LOG_LEVEL and DVNET_LOG_FORMAT environment variables say otherwise.
 func InitLogger(level logLevel) {
-	lg.SetFlags(lg.Flags() & ^(lg.Lmicroseconds | lg.Ldate))
-	log = logger{level}
+	format := LogFormatText
+	if envLevel := os.Getenv(logLevelEnv); envLevel != "" {
+		parsed, err := ParseLogLevel(envLevel)
+		if err != nil {
+			lg.Printf("WARNING: ignoring %s: %v\n", logLevelEnv, err)
+		} else {
+			level = parsed
+		}
+	}
+	if envFormat := os.Getenv(logFormatEnv); envFormat != "" {
+		format = envFormat
+	}
+	if err := ConfigureLogger(level, format); err != nil {
+		lg.Printf("WARNING: ignoring %s: %v\n", logFormatEnv, err)
+		ConfigureLogger(level, LogFormatText)
+	}
+}
+
+// ConfigureLogger logs messages at or above level in the given format.
+func ConfigureLogger(level logLevel, format string) error {
+	switch format {
+	case LogFormatText:
+		lg.SetFlags(lg.Flags() & ^(lg.Lmicroseconds | lg.Ldate))
+	case LogFormatJSON, LogFormatLogfmt:
+	default:
+		return fmt.Errorf("unknown log format %q: it should be one of %s, %s or %s", format, LogFormatText, LogFormatJSON, LogFormatLogfmt)
+	}
+	log = logger{level: level, format: format}
+	return nil
+}
+
+// log returns a logger tagging messages with the network they're about
+// and, while the network is being created or deleted, the step we're on.
+func (ns *NetworkState) log() logger {
+	return log.with("network", ns.Definition.Name, "network_id", ns.ID, "step", ns.step)
 }
@@ -0,0 +1,91 @@
+package dvnet
+
+import (
+	"bytes"
+	"encoding/json"
+	lg "log"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// captureLogs has log write to a buffer in the given format until the test is over.
+func captureLogs(t *testing.T, level logLevel, format string) *bytes.Buffer {
+	t.Helper()
+	prevLog, prevOut, prevWriter, prevFlags := log, logOut, lg.Writer(), lg.Flags()
+	buf := &bytes.Buffer{}
+	if err := ConfigureLogger(level, format); err != nil {
+		t.Fatalf("ConfigureLogger() err %v", err)
+	}
+	logOut = buf
+	lg.SetOutput(buf)
+	lg.SetFlags(0)
+	t.Cleanup(func() {
+		log, logOut = prevLog, prevOut
+		lg.SetOutput(prevWriter)
+		lg.SetFlags(prevFlags)
+	})
+	return buf
+}
+
+func TestLogLevels(t *testing.T) {
+	buf := captureLogs(t, LogLevelInfo, LogFormatText)
+	log.debug("hidden\n")
+	log.info("shown\n")
+	log.with("node", "A-1", "subnet", "", "step", "two words").warn("careful\n")
+	log.error("oops\n")
+
+	want := "INFO: shown\nWARNING: careful node=A-1 step=\"two words\"\nERROR: oops\n"
+	if got := buf.String(); got != want {
+		t.Errorf("text logs = %q; wanted %q", got, want)
+	}
+}
+
+func TestStructuredLogs(t *testing.T) {
+	ns := &NetworkState{ID: "0123", Definition: netDef{Name: "Lab 1"}, step: "subnets"}
+
+	buf := captureLogs(t, LogLevelDebug, LogFormatJSON)
+	ns.log().with("node", "A-1").debug("assigning %s\n", "10.0.0.1/24")
+	line := map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("couldn't parse JSON log line %q: %v", buf.String(), err)
+	}
+	delete(line, "time")
+	want := map[string]string{"level": "debug", "msg": "assigning 10.0.0.1/24",
+		"network": "Lab 1", "network_id": "0123", "step": "subnets", "node": "A-1"}
+	if !cmp.Equal(line, want) {
+		t.Errorf("JSON log line = %v; wanted %v", line, want)
+	}
+
+	buf = captureLogs(t, LogLevelDebug, LogFormatLogfmt)
+	ns.log().with("subnet", "A").error("couldn't connect %q\n", "eth0")
+	got := buf.String()
+	if !strings.HasPrefix(got, "time=") {
+		t.Errorf("logfmt log line %q should start with the time", got)
+	}
+	if want := ` level=error msg="couldn't connect \"eth0\"" network="Lab 1" network_id=0123 step=subnets subnet=A` + "\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("logfmt log line = %q; wanted it to end with %q", got, want)
+	}
+}
+
+func TestLoggerConfiguration(t *testing.T) {
+	if level, err := ParseLogLevel("WARNING"); err != nil || level != LogLevelWarn {
+		t.Errorf("ParseLogLevel(WARNING) = %v, %v; wanted %v", level, err, LogLevelWarn)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Errorf("ParseLogLevel(verbose) should've failed")
+	}
+
+	captureLogs(t, LogLevelDebug, LogFormatText)
+	if err := ConfigureLogger(LogLevelDebug, "xml"); err == nil {
+		t.Errorf("ConfigureLogger() should reject unknown formats")
+	}
+
+	t.Setenv(logLevelEnv, "error")
+	t.Setenv(logFormatEnv, LogFormatLogfmt)
+	InitLogger(LogLevelWarn)
+	if log.level != LogLevelErr || log.format != LogFormatLogfmt {
+		t.Errorf("InitLogger() should've gone with the environment; got level %v and format %s", log.level, log.format)
+	}
+}
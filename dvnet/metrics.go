@@ -0,0 +1,391 @@
+package dvnet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	metricsAddrEnv     string = "DVNET_METRICS_ADDR"
+	metricsPath        string = "/metrics"
+	metricsContentType string = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DefaultMetricsAddr is where metrics are served unless told otherwise
+// through the DVNET_METRICS_ADDR environment variable.
+var DefaultMetricsAddr string = "127.0.0.1:9731"
+
+// MetricsAddr returns the address metrics are served on: either a TCP
+// address or, if it's an absolute path, a Unix socket.
+func MetricsAddr() string {
+	if envAddr := os.Getenv(metricsAddrEnv); envAddr != "" {
+		return envAddr
+	}
+	return DefaultMetricsAddr
+}
+
+// Operations whose steps are timed.
+const (
+	opCreate string = "create"
+	opDelete string = "delete"
+)
+
+// stepDurationBuckets are the upper bounds, in seconds, of the buckets
+// of step durations. Steps pulling images can take minutes.
+var stepDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// opStep is one of the steps an operation on a network is made up of.
+type opStep struct {
+	name string
+	run  func() error
+}
+
+// runSteps runs steps one after the other until one of them fails,
+// recording how long each one took and whether it failed.
+func (ns *NetworkState) runSteps(operation string, steps []opStep) error {
+	defer func() { ns.step = "" }()
+	for _, step := range steps {
+		ns.step = step.name
+		start := time.Now()
+		err := step.run()
+		took := time.Since(start)
+		ns.metrics.observeStep(stepKey{operation: operation, network: ns.Definition.Name, step: step.name}, took, err)
+		if err != nil {
+			ns.log().debug("failed after %v: %v\n", took, err)
+			return err
+		}
+		ns.log().debug("done in %v\n", took)
+	}
+	return nil
+}
+
+type stepKey struct {
+	operation string
+	network   string
+	step      string
+}
+
+// histogram counts observations into the buckets of stepDurationBuckets.
+// Counts aren't cumulative: they're added up when written out.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range stepDurationBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// driverMetrics keeps track of the operations carried out by the driver. A nil
+// *driverMetrics records nothing, which is what plans and the CLI go with.
+type driverMetrics struct {
+	mu           sync.Mutex
+	durations    map[stepKey]*histogram
+	failures     map[stepKey]uint64
+	driftReports map[string]*DriftReport
+}
+
+func newDriverMetrics() *driverMetrics {
+	return &driverMetrics{durations: map[stepKey]*histogram{}, failures: map[stepKey]uint64{}}
+}
+
+func (m *driverMetrics) observeStep(key stepKey, took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(stepDurationBuckets))}
+		m.durations[key] = h
+	}
+	h.observe(took.Seconds())
+	// Steps show up with no failures rather than not at all until they fail.
+	m.failures[key] += 0
+	if err != nil {
+		m.failures[key]++
+	}
+}
+
+// families returns the step durations and failures recorded so far.
+func (m *driverMetrics) families() []*metricFamily {
+	durations := &metricFamily{name: "dvnet_step_duration_seconds", kind: "histogram",
+		help: "How long each step of creating and deleting networks took."}
+	failures := &metricFamily{name: "dvnet_step_failures_total", kind: "counter",
+		help: "Steps of creating and deleting networks which failed."}
+	if m == nil {
+		return []*metricFamily{durations, failures}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]stepKey, 0, len(m.durations))
+	for key := range m.durations {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.operation != b.operation {
+			return a.operation < b.operation
+		}
+		if a.network != b.network {
+			return a.network < b.network
+		}
+		return a.step < b.step
+	})
+
+	for _, key := range keys {
+		labels := []string{"operation", key.operation, "network", key.network, "step", key.step}
+		h, cumulative := m.durations[key], uint64(0)
+		for i, bound := range stepDurationBuckets {
+			cumulative += h.counts[i]
+			durations.add("_bucket", float64(cumulative), append(labels, "le", formatMetricValue(bound))...)
+		}
+		durations.add("_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+		durations.add("_sum", h.sum, labels...)
+		durations.add("_count", float64(h.count), labels...)
+		failures.add("", float64(m.failures[key]), labels...)
+	}
+	return []*metricFamily{durations, failures}
+}
+
+// ifaceStats are the counters the kernel keeps for an interface.
+type ifaceStats struct {
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	RxDropped uint64
+	TxDropped uint64
+}
+
+// ifaceCounters are the metrics made out of ifaceStats.
+var ifaceCounters = []struct {
+	name  string
+	help  string
+	value func(ifaceStats) uint64
+}{
+	{"receive_bytes_total", "Bytes received", func(s ifaceStats) uint64 { return s.RxBytes }},
+	{"transmit_bytes_total", "Bytes sent", func(s ifaceStats) uint64 { return s.TxBytes }},
+	{"receive_packets_total", "Packets received", func(s ifaceStats) uint64 { return s.RxPackets }},
+	{"transmit_packets_total", "Packets sent", func(s ifaceStats) uint64 { return s.TxPackets }},
+	{"receive_drops_total", "Packets dropped on reception", func(s ifaceStats) uint64 { return s.RxDropped }},
+	{"transmit_drops_total", "Packets dropped on transmission", func(s ifaceStats) uint64 { return s.TxDropped }},
+}
+
+// ifaceStats returns the counters of every interface but the loopback one in
+// the network namespace of containerPID, or in the host's if it's zero.
+func (linuxBackend) ifaceStats(containerPID int) (map[string]ifaceStats, error) {
+	stats := map[string]ifaceStats{}
+	list := func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			attrs := link.Attrs()
+			if attrs.Statistics == nil || attrs.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			s := attrs.Statistics
+			stats[attrs.Name] = ifaceStats{
+				RxBytes: s.RxBytes, TxBytes: s.TxBytes, RxPackets: s.RxPackets,
+				TxPackets: s.TxPackets, RxDropped: s.RxDropped, TxDropped: s.TxDropped,
+			}
+		}
+		return nil
+	}
+	if containerPID == 0 {
+		return stats, list()
+	}
+	return stats, inContainerNS(containerPID, list)
+}
+
+// WriteMetrics writes how many networks and nodes there are, the counters of
+// every node's interfaces and of the bridge ports links are plugged into and
+// how long creating and deleting networks took in Prometheus' text format.
+// Counters are read when called, so nodes which can't be reached are skipped.
+func (d Driver) WriteMetrics(w io.Writer) error {
+	networkIDs, err := d.store.ids()
+	if err != nil {
+		return err
+	}
+
+	networks := &metricFamily{name: "dvnet_networks", kind: "gauge", help: "Networks being managed."}
+	nodes := &metricFamily{name: "dvnet_nodes", kind: "gauge", help: "Hosts and routers making up each network."}
+	ifaceFamilies, portFamilies := []*metricFamily{}, []*metricFamily{}
+	for _, counter := range ifaceCounters {
+		ifaceFamilies = append(ifaceFamilies, &metricFamily{name: "dvnet_interface_" + counter.name, kind: "counter",
+			help: counter.help + " by the interfaces of each node."})
+		portFamilies = append(portFamilies, &metricFamily{name: "dvnet_bridge_port_" + counter.name, kind: "counter",
+			help: counter.help + " by the bridge ports links are plugged into."})
+	}
+	addStats := func(families []*metricFamily, stats ifaceStats, labels ...string) {
+		for i, counter := range ifaceCounters {
+			families[i].add("", float64(counter.value(stats)), labels...)
+		}
+	}
+
+	var hostStats map[string]ifaceStats
+	managed := 0
+	for _, networkID := range networkIDs {
+		ns, err := d.network(networkID)
+		if err != nil {
+			log.warn("couldn't load the state of network %s: %v\n", networkID, err)
+			continue
+		}
+		managed++
+		name := ns.Definition.Name
+
+		pids := map[string]int{}
+		for routerName, info := range ns.Routers {
+			pids[routerName] = info.PID
+		}
+		for _, subnet := range ns.Subnets {
+			for host, info := range subnet.Containers {
+				pids[host] = info.PID
+			}
+		}
+		nodes.add("", float64(len(pids)), "network", name)
+
+		for _, node := range sortedKeys(pids) {
+			stats, err := d.backend.ifaceStats(pids[node])
+			if err != nil {
+				log.warn("couldn't read the interface counters of node %s: %v\n", node, err)
+				continue
+			}
+			for _, iface := range sortedKeys(stats) {
+				addStats(ifaceFamilies, stats[iface], "network", name, "node", node, "interface", iface)
+			}
+		}
+
+		for _, key := range sortedKeys(ns.Links) {
+			link := ns.Links[key]
+			if link.BridgeEnd == "" || !link.ownsBridgeEnd() {
+				continue
+			}
+			if hostStats == nil {
+				if hostStats, err = d.backend.ifaceStats(0); err != nil {
+					return fmt.Errorf("couldn't read the counters of the host's interfaces: %w", err)
+				}
+			}
+			stats, ok := hostStats[link.BridgeEnd]
+			if !ok {
+				continue
+			}
+			addStats(portFamilies, stats, "network", name, "subnet", link.Subnet, "node", link.Node, "port", link.BridgeEnd)
+		}
+	}
+	networks.add("", float64(managed))
+
+	families := append([]*metricFamily{networks, nodes}, ifaceFamilies...)
+	families = append(families, portFamilies...)
+	families = append(families, d.metrics.families()...)
+	families = append(families, d.metrics.driftFamilies()...)
+	return writeMetricFamilies(w, families)
+}
+
+// ServeMetrics serves the driver's metrics on /metrics for Prometheus to
+// scrape. Absolute paths are taken as Unix sockets and anything else as
+// TCP addresses.
+func (d Driver) ServeMetrics(addr string) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+
+	log.info("serving metrics on %s\n", addr)
+	return http.Serve(listener, d.metricsHandler())
+}
+
+func (d Driver) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, fmt.Sprintf("%s not allowed on %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		if err := d.WriteMetrics(w); err != nil {
+			log.error("couldn't write the metrics: %v\n", err)
+		}
+	})
+	return mux
+}
+
+// metricFamily is a metric and its samples in Prometheus' text format.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+// metricSample is a sample of a metricFamily. Suffix is appended to the family's
+// name (e.g. _bucket for histograms) and labels are name and value pairs.
+type metricSample struct {
+	suffix string
+	labels []string
+	value  float64
+}
+
+func (f *metricFamily) add(suffix string, value float64, labels ...string) {
+	f.samples = append(f.samples, metricSample{suffix: suffix, labels: labels, value: value})
+}
+
+// writeMetricFamilies writes families in the text format described in
+// https://prometheus.io/docs/instrumenting/exposition_formats/.
+func writeMetricFamilies(w io.Writer, families []*metricFamily) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+		for _, sample := range f.samples {
+			bw.WriteString(f.name + sample.suffix)
+			if len(sample.labels) != 0 {
+				pairs := []string{}
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					pairs = append(pairs, sample.labels[i]+`="`+escapeLabelValue(sample.labels[i+1])+`"`)
+				}
+				bw.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			bw.WriteString(" " + formatMetricValue(sample.value) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,109 @@
+package dvnet
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsBackend is a planBackend whose interfaces have been busy: every
+// node's eth0 has received 100 bytes per unit of its PID and every
+// port on the host has sent 7 packets.
+type statsBackend struct {
+	*planBackend
+}
+
+func (sb statsBackend) ifaceStats(containerPID int) (map[string]ifaceStats, error) {
+	if containerPID == 0 {
+		return map[string]ifaceStats{"bth-a-1": {TxPackets: 7}, "hth-a-1": {TxPackets: 7}}, nil
+	}
+	return map[string]ifaceStats{"eth0": {RxBytes: uint64(containerPID) * 100}}, nil
+}
+
+func TestWriteMetrics(t *testing.T) {
+	d, pb := testDriver(t)
+	d.backend = statsBackend{pb}
+	ns, err := d.network("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidA1, _ := ns.nodePID("A-1")
+
+	srv := httptest.NewServer(d.metricsHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + metricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("GET %s Content-Type = %q; wanted %q", metricsPath, ct, metricsContentType)
+	}
+	rawMetrics, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(rawMetrics)
+
+	for _, want := range []string{
+		"# TYPE dvnet_networks gauge\ndvnet_networks 1\n",
+		`dvnet_nodes{network="Test Net 0"} 6` + "\n",
+		`dvnet_interface_receive_bytes_total{network="Test Net 0",node="A-1",interface="eth0"} ` + formatMetricValue(float64(pidA1*100)) + "\n",
+		`dvnet_bridge_port_transmit_packets_total{network="Test Net 0",subnet="A",node="A-1",port="bth-a-1"} 7` + "\n",
+		`dvnet_bridge_port_transmit_packets_total{network="Test Net 0",subnet="outboundSubnet",node="A-1",port="hth-a-1"} 7` + "\n",
+		`dvnet_step_duration_seconds_bucket{operation="create",network="Test Net 0",step="subnets",le="+Inf"} 1` + "\n",
+		`dvnet_step_duration_seconds_count{operation="create",network="Test Net 0",step="routers"} 1` + "\n",
+		`dvnet_step_failures_total{operation="create",network="Test Net 0",step="routers"} 0` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics lack %q; got\n%s", want, metrics)
+		}
+	}
+	// Ports we couldn't read the counters of are left out.
+	if strings.Contains(metrics, `port="bth-a-2"`) {
+		t.Errorf("metrics shouldn't include ports without counters; got\n%s", metrics)
+	}
+}
+
+func TestStepMetrics(t *testing.T) {
+	m := newDriverMetrics()
+	ns := &NetworkState{Definition: netDef{Name: `Net "1"`}, metrics: m}
+
+	errStep := errors.New("couldn't do it")
+	ran := []string{}
+	err := ns.runSteps(opDelete, []opStep{
+		{"first", func() error { ran = append(ran, "first"); return nil }},
+		{"second", func() error { ran = append(ran, "second"); return errStep }},
+		{"third", func() error { ran = append(ran, "third"); return nil }},
+	})
+	if !errors.Is(err, errStep) {
+		t.Errorf("runSteps() err %v; wanted %v", err, errStep)
+	}
+	if strings.Join(ran, " ") != "first second" {
+		t.Errorf("runSteps() ran %v; it should've stopped after the second step", ran)
+	}
+	m.observeStep(stepKey{opDelete, `Net "1"`, "first"}, 3*time.Second, nil)
+
+	out := &strings.Builder{}
+	if err := writeMetricFamilies(out, m.families()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`dvnet_step_duration_seconds_bucket{operation="delete",network="Net \"1\"",step="first",le="2.5"} 1` + "\n",
+		`dvnet_step_duration_seconds_bucket{operation="delete",network="Net \"1\"",step="first",le="5"} 2` + "\n",
+		`dvnet_step_duration_seconds_count{operation="delete",network="Net \"1\"",step="first"} 2` + "\n",
+		`dvnet_step_failures_total{operation="delete",network="Net \"1\"",step="first"} 0` + "\n",
+		`dvnet_step_failures_total{operation="delete",network="Net \"1\"",step="second"} 1` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics lack %q; got\n%s", want, out)
+		}
+	}
+	if strings.Contains(out.String(), `step="third"`) {
+		t.Errorf("steps which didn't run shouldn't show up; got\n%s", out)
+	}
+}
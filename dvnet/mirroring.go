@@ -0,0 +1,172 @@
+package dvnet
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// mirrorDef copies the traffic going through some of a subnet's ports to the
+// port of host To, just like switches do with SPAN. Ports are the nodes whose
+// links are mirrored in both directions. Without them every frame entering the
+// subnet's bridge is mirrored once, save for those sent by To itself.
+type mirrorDef struct {
+	To    string   `json:"to" validate:"required"`
+	Ports []string `json:"ports,omitempty"`
+}
+
+// linkMirror is how a link is being mirrored: what enters the bridge through
+// it and, if Both is set, what leaves the bridge through it too.
+type linkMirror struct {
+	To   string `json:"to"`
+	Both bool   `json:"both,omitempty"`
+}
+
+// Handle and priority of the clsact qdisc and the filters mirroring a port.
+// The clsact qdisc lives alongside the root one, so mirroring doesn't get in
+// the way of impairments and shaping.
+var clsactHandle uint32 = netlink.MakeHandle(0xffff, 0)
+
+const mirrorFilterPrio uint16 = 1
+
+// validateMirrors checks mirrors send their copies to a host on their subnet and
+// only mirror the ports of nodes on it. Point-to-point subnets have no ports to
+// mirror and VLAN ones share theirs with other VLANs.
+func validateMirrors(def netDef) error {
+	for _, subnetName := range sortedKeys(def.Subnets) {
+		subnet := def.Subnets[subnetName]
+		if subnet.Mirror == nil {
+			continue
+		}
+		if subnet.isP2P() || subnet.VLAN != 0 {
+			return fmt.Errorf("subnet %s: point-to-point and VLAN subnets can't be mirrored", subnetName)
+		}
+		if _, ok := subnet.Hosts[subnet.Mirror.To]; !ok {
+			return fmt.Errorf("subnet %s: mirrors should send their copies to a host on the subnet; got %q", subnetName, subnet.Mirror.To)
+		}
+		seen := map[string]bool{}
+		for _, port := range subnet.Mirror.Ports {
+			if port == subnet.Mirror.To {
+				return fmt.Errorf("subnet %s: host %s can't be mirrored to itself", subnetName, port)
+			}
+			if seen[port] {
+				return fmt.Errorf("subnet %s: port %s is mirrored more than once", subnetName, port)
+			}
+			seen[port] = true
+			_, isHost := subnet.Hosts[port]
+			if router, isRouter := def.Routers[port]; !isHost && !(isRouter && contains(router.Subnets, subnetName)) {
+				return fmt.Errorf("subnet %s: can't mirror %s: it's not attached to the subnet", subnetName, port)
+			}
+		}
+	}
+	return nil
+}
+
+// desiredMirror returns how def mirrors the link between node and subnet, if at all.
+func desiredMirror(def netDef, node, subnet string) *linkMirror {
+	mirror := def.Subnets[subnet].Mirror
+	if mirror == nil || node == mirror.To {
+		return nil
+	}
+	if len(mirror.Ports) == 0 {
+		return &linkMirror{To: mirror.To}
+	}
+	if contains(mirror.Ports, node) {
+		return &linkMirror{To: mirror.To, Both: true}
+	}
+	return nil
+}
+
+// applyMirrors brings the mirroring on every link in line with def. Mirrors
+// refer to the port they copy to by its index, so when that port's link is
+// recreated everything mirrored to it must be mirrored again.
+func applyMirrors(ns *NetworkState, def netDef) error {
+	newSinks := map[string]bool{}
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		mirror := def.Subnets[link.Subnet].Mirror
+		isSink := mirror != nil && mirror.To == link.Node
+		if isSink && !link.MirrorSink {
+			newSinks[link.Subnet] = true
+		}
+		link.MirrorSink = isSink
+		ns.Links[key] = link
+	}
+
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		want := desiredMirror(def, link.Node, link.Subnet)
+		if sameSettings(want, link.Mirror) && (want == nil || !newSinks[link.Subnet]) {
+			continue
+		}
+
+		dest, both := "", false
+		if want != nil {
+			sink, ok := ns.Links[linkKey(want.To, link.Subnet)]
+			if !ok {
+				return fmt.Errorf("can't mirror %s to %s: it's not attached to subnet %s", link.Node, want.To, link.Subnet)
+			}
+			dest, both = sink.BridgeEnd, want.Both
+		}
+		log.debug("mirroring the link between %s and %s: %v\n", link.Node, link.Subnet, want)
+		if err := ns.backend.mirrorPort(link.BridgeEnd, dest, both); err != nil {
+			return fmt.Errorf("couldn't mirror %s: %w", link.BridgeEnd, err)
+		}
+		link.Mirror = want
+		ns.Links[key] = link
+	}
+	return nil
+}
+
+// mirrorPort mirrors the traffic entering the bridge through port iface (and
+// leaving it through iface too if both is set) to port dest with tc-mirred(8).
+// Whatever mirroring iface had is dropped first, so an empty dest removes it.
+func (linuxBackend) mirrorPort(iface, dest string, both bool) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+
+	// Dropping the clsact qdisc drops the filters attached to it too.
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: clsactHandle, Parent: netlink.HANDLE_CLSACT},
+		QdiscType:  "clsact",
+	}
+	if err := netlink.QdiscDel(clsact); err != nil {
+		log.debug("no previous clsact qdisc on %s: %v\n", iface, err)
+	}
+	if dest == "" {
+		return nil
+	}
+
+	destLink, err := netlink.LinkByName(dest)
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscAdd(clsact); err != nil {
+		return fmt.Errorf("couldn't add the clsact qdisc: %w", err)
+	}
+	parents := []uint32{netlink.HANDLE_MIN_INGRESS}
+	if both {
+		parents = append(parents, netlink.HANDLE_MIN_EGRESS)
+	}
+	// A u32 filter with an all-zero key matches every packet. Unlike
+	// matchall ones, they're available on every kernel with tc.
+	for _, parent := range parents {
+		filter := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{LinkIndex: link.Attrs().Index, Parent: parent, Priority: mirrorFilterPrio, Protocol: unix.ETH_P_ALL},
+			Sel:         &netlink.TcU32Sel{Flags: netlink.TC_U32_TERMINAL, Nkeys: 1, Keys: []netlink.TcU32Key{{Mask: 0, Val: 0}}},
+			Actions: []netlink.Action{&netlink.MirredAction{
+				// Let the original packet go on its way.
+				ActionAttrs:  netlink.ActionAttrs{Action: netlink.TC_ACT_PIPE},
+				MirredAction: netlink.TCA_EGRESS_MIRROR,
+				Ifindex:      destLink.Attrs().Index,
+			}},
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("couldn't add the mirroring filter: %w", err)
+		}
+	}
+	return nil
+}
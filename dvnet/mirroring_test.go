@@ -0,0 +1,111 @@
+package dvnet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMirrorValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnets string
+		wantErr bool
+	}{
+		{"a mirror of some ports", `"A": {"cidr": "10.0.0.0/24", "mirror": {"to": "A-2", "ports": ["A-1", "R-1"]}, "hosts": {"A-1": {}, "A-2": {}}}`, false},
+		{"a mirror of the whole bridge", `"A": {"cidr": "10.0.0.0/24", "mirror": {"to": "A-2"}, "hosts": {"A-1": {}, "A-2": {}}}`, false},
+		{"a mirror without a destination", `"A": {"cidr": "10.0.0.0/24", "mirror": {"ports": ["A-1"]}, "hosts": {"A-1": {}, "A-2": {}}}`, true},
+		{"a mirror to a router", `"A": {"cidr": "10.0.0.0/24", "mirror": {"to": "R-1"}, "hosts": {"A-1": {}}}`, true},
+		{"a mirror to itself", `"A": {"cidr": "10.0.0.0/24", "mirror": {"to": "A-2", "ports": ["A-2"]}, "hosts": {"A-1": {}, "A-2": {}}}`, true},
+		{"a mirror of a foreign node", `"A": {"cidr": "10.0.0.0/24", "mirror": {"to": "A-2", "ports": ["B-1"]}, "hosts": {"A-1": {}, "A-2": {}}},
+			"B": {"cidr": "10.0.1.0/24", "hosts": {"B-1": {}}}`, true},
+		{"a mirror of the same port twice", `"A": {"cidr": "10.0.0.0/24", "mirror": {"to": "A-2", "ports": ["A-1", "A-1"]}, "hosts": {"A-1": {}, "A-2": {}}}`, true},
+		{"a mirrored VLAN", `"A": {"cidr": "10.0.0.0/24", "vlan": 10, "mirror": {"to": "A-2"}, "hosts": {"A-1": {}, "A-2": {}}}`, true},
+	}
+
+	for _, test := range tests {
+		rawDef := `{"name": "Mirrors", "subnets": {` + test.subnets + `}, "routers": {"R-1": {"subnets": ["A"]}}}`
+		if _, err := parseDef([]byte(rawDef)); (err != nil) != test.wantErr {
+			t.Errorf("%s: parseDef() err %v; wanted an error: %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestPlanMirroredNetwork(t *testing.T) {
+	plan, err := PlanNetwork("../demos/mirroring/net.json")
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+
+	mirrorSteps := []string{}
+	for _, step := range plan.Steps {
+		if strings.HasPrefix(step, "mirror ") {
+			mirrorSteps = append(mirrorSteps, step)
+		}
+	}
+	want := []string{
+		"mirror what goes through bth-a-1 to bth-ids-1",
+		"mirror what enters through bth-b-1 to bth-ids-2",
+		"mirror what goes through bth-r-1-a to bth-ids-1",
+		"mirror what enters through bth-r-1-b to bth-ids-2",
+	}
+	if !cmp.Equal(mirrorSteps, want) {
+		t.Errorf("PlanNetwork() mirror steps = %v; wanted %v", mirrorSteps, want)
+	}
+}
+
+func TestApplyMirrors(t *testing.T) {
+	rawDef := `{
+		"name": "Mirrors",
+		"subnets": {"A": {"cidr": "10.0.0.0/24", "mirror": {"to": "A-3", "ports": ["A-1"]},
+			"hosts": {"A-1": {}, "A-2": {}, "A-3": {}}}},
+		"routers": {}
+	}`
+	ns := liveState(t, rawDef)
+	pb := newPlanBackend()
+	ns.backend = pb
+	for key, link := range ns.Links {
+		link.BridgeEnd = "bth-" + strings.ToLower(link.Node)
+		ns.Links[key] = link
+	}
+
+	if err := applyMirrors(ns, ns.Definition); err != nil {
+		t.Fatalf("applyMirrors() err %v", err)
+	}
+	if want := []string{"mirror what goes through bth-a-1 to bth-a-3"}; !cmp.Equal(pb.plan.Steps, want) {
+		t.Errorf("applyMirrors() steps = %v; wanted %v", pb.plan.Steps, want)
+	}
+
+	// Nothing changes the second time around...
+	pb.plan.Steps = nil
+	if err := applyMirrors(ns, ns.Definition); err != nil {
+		t.Fatalf("applyMirrors() err %v", err)
+	}
+	if len(pb.plan.Steps) != 0 {
+		t.Errorf("applyMirrors() should've left the mirrors alone; got %v", pb.plan.Steps)
+	}
+
+	// ...unless the host receiving the copies has been plugged in again.
+	sink := ns.Links[linkKey("A-3", "A")]
+	ns.Links[linkKey("A-3", "A")] = linkInfo{Node: sink.Node, Subnet: sink.Subnet, BridgeEnd: sink.BridgeEnd, CIDR: sink.CIDR}
+	if err := applyMirrors(ns, ns.Definition); err != nil {
+		t.Fatalf("applyMirrors() err %v", err)
+	}
+	if want := []string{"mirror what goes through bth-a-1 to bth-a-3"}; !cmp.Equal(pb.plan.Steps, want) {
+		t.Errorf("applyMirrors() steps = %v; wanted %v", pb.plan.Steps, want)
+	}
+
+	// Dropping the mirror stops mirroring altogether.
+	pb.plan.Steps = nil
+	newDef := ns.Definition.clone()
+	subnet := newDef.Subnets["A"]
+	subnet.Mirror = nil
+	newDef.Subnets["A"] = subnet
+	if err := applyMirrors(ns, newDef); err != nil {
+		t.Fatalf("applyMirrors() err %v", err)
+	}
+	if want := []string{"stop mirroring bth-a-1"}; !cmp.Equal(pb.plan.Steps, want) {
+		t.Errorf("applyMirrors() steps = %v; wanted %v", pb.plan.Steps, want)
+	}
+}
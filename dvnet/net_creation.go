@@ -3,107 +3,408 @@ package dvnet
 import (
 	"fmt"
 	"strings"
+
+	"github.com/vishvananda/netlink"
 )
 
 func createSubnet(netState *NetworkState, subnetName string, def subnetDef) error {
-	log.debug("creating subnet %s\n", subnetName)
+	netState.log().with("subnet", subnetName).debug("creating subnet %s\n", subnetName)
 
 	if _, ok := netState.Subnets[subnetName]; ok {
 		return fmt.Errorf("subnet %s has already been defined", subnetName)
 	}
 
-	subnetAddresser, err := newSubnetAddresser(netState, subnetName, def.CIDRBlock)
-	if err != nil {
+	if _, err := newSubnetAddresser(netState, subnetName, def.CIDRBlock); err != nil {
 		return err
 	}
 
-	subnetBridge, err := createBridge(subnetName)
-	if err != nil {
-		return fmt.Errorf("couldn't create bridge %s: %w", subnetName, err)
-	}
-
-	netState.Subnets[subnetName] = SubnetResources{Bridge: subnetBridge, Containers: map[string]containerInfo{}}
-
-	for host, hConf := range def.Hosts {
-		containerID, containerPID, err := runContainer(hConf.Image, host)
+	switch {
+	case def.isP2P():
+		// Hosts are joined to their peer by connectP2P once both are running.
+		netState.Subnets[subnetName] = SubnetResources{P2P: true, Containers: map[string]containerInfo{}}
+	case def.VLAN != 0:
+		trunkBridge, err := ensureTrunk(netState, def.trunk())
 		if err != nil {
-			return fmt.Errorf("couldn't start container for host %s: %w", host, err)
-		}
-		if _, ok := netState.Subnets[subnetName].Containers[host]; ok {
-			return fmt.Errorf("host %s has been defined more than once", host)
+			return err
 		}
-		log.debug("created container %s with ID[:5] %s and PID %d\n", host, containerID[:5], containerPID)
-		netState.Subnets[subnetName].Containers[host] = containerInfo{ID: containerID, PID: containerPID}
-		veth, bridgeEnd, containerEnd, err := createVethPair(bridgeEthPrefix, containerEthPrefix, strings.ToLower(host))
+		netState.Subnets[subnetName] = SubnetResources{Bridge: trunkBridge, BridgeName: trunkBridge.Name,
+			VLAN: def.VLAN, Trunk: def.trunk(), Containers: map[string]containerInfo{}}
+	case netState.isSwitched(subnetName):
+		// Nodes are plugged into the subnet's switches instead.
+		netState.Subnets[subnetName] = SubnetResources{Switched: true, Containers: map[string]containerInfo{}}
+	default:
+		subnetBridge, err := netState.backend.bridgeBackendFor(def.OVS).createBridge(subnetName)
 		if err != nil {
-			log.error("couldn't create veth %s-%s: %v\n", subnetBridge.Name, host, err)
-			return err
+			return fmt.Errorf("couldn't create bridge %s: %w", subnetName, err)
 		}
+		netState.Subnets[subnetName] = SubnetResources{Bridge: subnetBridge, BridgeName: subnetBridge.Name,
+			OVS: def.OVS, Containers: map[string]containerInfo{}}
+	}
 
-		log.debug("connecting %s to %s\n", veth.Name, subnetBridge.Name)
-		if err := connectToBridge(bridgeEnd, subnetBridge); err != nil {
-			log.error("couldn't connect %s to %s: %v\n", veth.Name, subnetBridge.Name, err)
+	for host, hConf := range def.Hosts {
+		if err := addHost(netState, subnetName, host, hConf); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// addHost runs the container for host and plugs it into subnetName,
+// which should have been created beforehand.
+func addHost(netState *NetworkState, subnetName, host string, hConf HostDef) error {
+	subnetResources, ok := netState.Subnets[subnetName]
+	if !ok {
+		return fmt.Errorf("subnet %s should exist at this point", subnetName)
+	}
+	if _, ok := subnetResources.Containers[host]; ok {
+		return fmt.Errorf("host %s has been defined more than once", host)
+	}
 
-		log.debug("connecting %s to %s\n", veth.PeerName, host)
-		if err := connectToContainer(containerEnd, containerPID); err != nil {
-			log.error("couldn't connect %s to %s: %v\n", veth.PeerName, host, err)
+	containerID, containerPID, err := netState.backend.runContainer(hConf.Image, host, hConf.ContainerOptions)
+	if err != nil {
+		return fmt.Errorf("couldn't start container for host %s: %w", host, err)
+	}
+	netState.log().with("subnet", subnetName, "node", host).debug(
+		"created container %s with ID[:5] %s and PID %d\n", host, containerID[:5], containerPID)
+	subnetResources.Containers[host] = containerInfo{ID: containerID, PID: containerPID}
+
+	if subnetResources.P2P {
+		return nil
+	}
+	return plugIntoSubnet(netState, subnetName, host, host, hConf.Switch, containerPID)
+}
+
+// removeHost tears down host's container, which takes its veth pairs along with it.
+func removeHost(netState *NetworkState, subnetName, host string) error {
+	info, ok := netState.Subnets[subnetName].Containers[host]
+	if !ok {
+		return fmt.Errorf("host %s is not part of subnet %s", host, subnetName)
+	}
+
+	netState.log().with("subnet", subnetName, "node", host).debug("removing container with ID %s\n", info.ID)
+	if err := netState.backend.removeContainer(info.ID); err != nil {
+		return fmt.Errorf("couldn't remove container with ID %s: %w", info.ID, err)
+	}
+	delete(netState.Subnets[subnetName].Containers, host)
+	forgetNode(netState, host)
+
+	return nil
+}
+
+// removeSubnet removes the hosts on subnetName together with its bridge, which
+// for VLAN subnets only goes away with the last subnet on the same trunk.
+// Routers must have been detached from it beforehand.
+func removeSubnet(netState *NetworkState, subnetName string) error {
+	subnetResources, ok := netState.Subnets[subnetName]
+	if !ok {
+		return fmt.Errorf("subnet %s is not part of the network", subnetName)
+	}
+
+	for host := range subnetResources.Containers {
+		if err := removeHost(netState, subnetName, host); err != nil {
 			return err
 		}
+	}
 
-		assignedCIDR := subnetAddresser.nextCIDR(host)
-		log.debug("assigning %s to %s on %s\n", assignedCIDR, veth.PeerName, host)
-		if err := addressContainer(assignedCIDR, containerEnd, containerPID); err != nil {
-			log.error("couldn't address %s to %s on %s: %v\n", assignedCIDR, veth.PeerName, host, err)
-			return err
+	if subnetResources.ownsBridge() {
+		if err := netState.bridgesFor(subnetName).removeBridge(subnetResources.Bridge); err != nil {
+			return fmt.Errorf("couldn't remove bridge %s: %w", subnetResources.Bridge.Name, err)
 		}
 	}
+	delete(netState.Subnets, subnetName)
+	delete(netState.Addressers, subnetName)
+
+	if subnetResources.VLAN != 0 {
+		return releaseTrunk(netState, subnetResources.Trunk)
+	}
+
 	return nil
 }
 
 func createRouter(netState *NetworkState, routerName string, def routerDef) error {
-	containerID, containerPID, err := runContainer(def.Image, routerName)
-	if err != nil {
-		return fmt.Errorf("couldn't start container for router %s: %w", routerName, err)
-	}
 	if _, ok := netState.Routers[routerName]; ok {
 		return fmt.Errorf("router %s has been defined more than once", routerName)
 	}
+	containerID, containerPID, err := netState.backend.runContainer(def.Image, routerName, def.ContainerOptions)
+	if err != nil {
+		return fmt.Errorf("couldn't start container for router %s: %w", routerName, err)
+	}
 	netState.Routers[routerName] = containerInfo{ID: containerID, PID: containerPID}
+	netState.log().with("node", routerName).debug(
+		"created container %s with ID[:5] %s and PID %d\n", routerName, containerID[:5], containerPID)
 
 	for _, subnetName := range def.Subnets {
-		subnetAddresser, okAddresses := netState.Addressers[subnetName]
-		subnetResources, okResources := netState.Subnets[subnetName]
-		if !okAddresses || !okResources {
-			return fmt.Errorf("subnet %s should exist at this point", subnetName)
+		if err := attachRouter(netState, routerName, subnetName, def); err != nil {
+			return err
 		}
-		veth, bridgeEnd, containerEnd, err := createVethPair(
-			bridgeEthPrefix, containerEthPrefix, strings.ToLower(fmt.Sprintf("%s-%s", routerName, subnetName)))
-		if err != nil {
-			log.error("couldn't create veth %s-%s: %v\n", subnetResources.Bridge.Name, routerName, err)
+	}
+
+	return nil
+}
+
+// attachRouter plugs an already running router into subnetName. Routers
+// on point-to-point subnets are joined to their peer by connectP2P instead.
+// VLAN subnets are attached to through a trunk port if the router wants to.
+func attachRouter(netState *NetworkState, routerName, subnetName string, def routerDef) error {
+	routerInfo, ok := netState.Routers[routerName]
+	if !ok {
+		return fmt.Errorf("router %s should exist at this point", routerName)
+	}
+	_, okAddresses := netState.Addressers[subnetName]
+	subnetResources, okResources := netState.Subnets[subnetName]
+	if !okAddresses || !okResources {
+		return fmt.Errorf("subnet %s should exist at this point", subnetName)
+	}
+	if subnetResources.P2P {
+		return nil
+	}
+	if def.TrunkPorts && subnetResources.VLAN != 0 {
+		return attachTrunkVLAN(netState, routerName, subnetName, routerInfo.PID)
+	}
+
+	return plugIntoSubnet(netState, subnetName, routerName,
+		fmt.Sprintf("%s-%s", routerName, subnetName), def.Switches[subnetName], routerInfo.PID)
+}
+
+// plugIntoSubnet plugs node into subnetName's bridge or, on switched
+// subnets, into switchName (or the subnet's first switch if empty).
+func plugIntoSubnet(netState *NetworkState, subnetName, node, suffix, switchName string, containerPID int) error {
+	subnetResources := netState.Subnets[subnetName]
+	if !subnetResources.Switched {
+		return plugNode(netState, subnetResources.Bridge, subnetName, node, suffix,
+			bridgeEthPrefix, containerEthPrefix, containerPID)
+	}
+
+	switchName, err := netState.switchOn(subnetName, switchName)
+	if err != nil {
+		return err
+	}
+	if err := plugNode(netState, netState.Switches[switchName].bridge(), subnetName, node, suffix,
+		bridgeEthPrefix, containerEthPrefix, containerPID); err != nil {
+		return err
+	}
+	link := netState.Links[linkKey(node, subnetName)]
+	link.Switch = switchName
+	netState.Links[linkKey(node, subnetName)] = link
+	return nil
+}
+
+// detachRouter unplugs routerName from subnetName leaving the router running.
+// On point-to-point subnets that takes the link of its peer along with it.
+func detachRouter(netState *NetworkState, routerName, subnetName string) error {
+	link, ok := netState.Links[linkKey(routerName, subnetName)]
+	if !ok {
+		if netState.Subnets[subnetName].P2P {
+			// Our peer was detached first and took our end along with it.
+			return nil
+		}
+		return fmt.Errorf("router %s is not attached to subnet %s", routerName, subnetName)
+	}
+
+	netState.log().with("subnet", subnetName, "node", routerName).debug("detaching %s from %s\n", routerName, subnetName)
+	pid, ok := netState.nodePID(routerName)
+	if !ok {
+		return errUnknownNode(routerName)
+	}
+	switch {
+	case link.Trunk:
+		if err := detachTrunkVLAN(netState, link, pid); err != nil {
 			return err
 		}
+	case link.Peer != "":
+		if err := netState.backend.removeVeth(link.NodeEnd, pid); err != nil {
+			return fmt.Errorf("couldn't remove veth %s on %s: %w", link.NodeEnd, routerName, err)
+		}
+		netState.Addressers[subnetName].release(link.Peer)
+		delete(netState.Links, linkKey(link.Peer, subnetName))
+	default:
+		if err := netState.bridgesFor(subnetName).disconnectFromBridge(link.BridgeEnd, netState.Subnets[subnetName].Bridge); err != nil {
+			return fmt.Errorf("couldn't disconnect %s from its bridge: %w", link.BridgeEnd, err)
+		}
+		if err := netState.backend.removeVeth(link.BridgeEnd, 0); err != nil {
+			return fmt.Errorf("couldn't remove veth %s: %w", link.BridgeEnd, err)
+		}
+	}
+
+	netState.Addressers[subnetName].release(routerName)
+	delete(netState.Links, linkKey(routerName, subnetName))
+
+	return nil
+}
+
+// removeRouter tears down routerName's container, which takes its veth pairs along with it.
+func removeRouter(netState *NetworkState, routerName string) error {
+	info, ok := netState.Routers[routerName]
+	if !ok {
+		return fmt.Errorf("router %s is not part of the network", routerName)
+	}
+
+	netState.log().with("node", routerName).debug("removing container with ID %s\n", info.ID)
+	if err := netState.backend.removeContainer(info.ID); err != nil {
+		return fmt.Errorf("couldn't remove container with ID %s: %w", info.ID, err)
+	}
+	delete(netState.Routers, routerName)
+	delete(netState.FWRules, routerName)
+	forgetNode(netState, routerName)
+
+	return nil
+}
+
+// plugNode connects the container running node to bridge through a new veth
+// pair whose ends are named after suffix and addresses the container's end
+// with the next address available on subnetName.
+func plugNode(netState *NetworkState, bridge *netlink.Bridge, subnetName, node, suffix,
+	bridgePfx, containerPfx string, containerPID int) error {
+	subnetAddresser := netState.Addressers[subnetName]
+	log := netState.log().with("subnet", subnetName, "node", node)
 
-		log.debug("connecting %s to %s\n", veth.Name, subnetResources.Bridge.Name)
-		if err := connectToBridge(bridgeEnd, subnetResources.Bridge); err != nil {
-			log.error("couldn't connect %s to %s: %v\n", veth.Name, subnetResources.Bridge.Name, err)
+	suffix = strings.ToLower(suffix)
+	veth, bridgeEnd, containerEnd, err := netState.backend.createVethPair(bridgePfx+suffix, containerPfx+suffix)
+	if err != nil {
+		log.error("couldn't create veth %s-%s: %v\n", bridge.Name, node, err)
+		return err
+	}
+
+	log.debug("connecting %s to %s\n", veth.Name, bridge.Name)
+	if err := netState.bridgesFor(subnetName).connectToBridge(bridgeEnd, bridge); err != nil {
+		log.error("couldn't connect %s to %s: %v\n", veth.Name, bridge.Name, err)
+		return err
+	}
+	if vlan := netState.Subnets[subnetName].VLAN; vlan != 0 {
+		log.debug("making %s an access port for VLAN %d\n", veth.Name, vlan)
+		if err := netState.backend.addPortVLAN(veth.Name, vlan, true); err != nil {
+			log.error("couldn't make %s an access port for VLAN %d: %v\n", veth.Name, vlan, err)
 			return err
 		}
+	}
+
+	log.debug("connecting %s to %s\n", veth.PeerName, node)
+	if err := netState.backend.connectToContainer(containerEnd, containerPID); err != nil {
+		log.error("couldn't connect %s to %s: %v\n", veth.PeerName, node, err)
+		return err
+	}
+
+	assignedCIDR := subnetAddresser.nextCIDR(node)
+	log.debug("assigning %s to %s on %s\n", assignedCIDR, veth.PeerName, node)
+	if err := netState.backend.addressContainer(assignedCIDR, containerEnd, containerPID); err != nil {
+		log.error("couldn't address %s to %s on %s: %v\n", assignedCIDR, veth.PeerName, node, err)
+		return err
+	}
+
+	netState.Links[linkKey(node, subnetName)] = linkInfo{
+		Node: node, Subnet: subnetName, BridgeEnd: veth.Name, NodeEnd: veth.PeerName, CIDR: assignedCIDR}
+
+	return nil
+}
+
+// connectP2P joins the two nodes on the point-to-point subnetName
+// with a veth pair and addresses both ends. Both nodes must be running.
+// Whatever's left of a previous link whose other end is gone is dropped
+// and addresses are handed out afresh: a /31 has no spare ones.
+func connectP2P(netState *NetworkState, def netDef, subnetName string) error {
+	log := netState.log().with("subnet", subnetName)
+	endpoints := p2pEndpoints(def, subnetName)
+	if len(endpoints) != 2 {
+		return fmt.Errorf("subnet %s should join exactly two nodes", subnetName)
+	}
+
+	linked := 0
+	for _, node := range endpoints {
+		if _, ok := netState.Links[linkKey(node, subnetName)]; ok {
+			linked++
+		}
+	}
+	if linked == 2 {
+		return nil
+	}
+	if linked == 1 {
+		for _, node := range endpoints {
+			log.with("node", node).debug("dropping what's left of the link between %s and %s\n", node, subnetName)
+			delete(netState.Links, linkKey(node, subnetName))
+		}
+	}
+	delete(netState.Addressers, subnetName)
+	subnetAddresser, err := newSubnetAddresser(netState, subnetName, def.Subnets[subnetName].CIDRBlock)
+	if err != nil {
+		return err
+	}
+
+	pids := [2]int{}
+	for i, node := range endpoints {
+		pid, ok := netState.nodePID(node)
+		if !ok {
+			return errUnknownNode(node)
+		}
+		pids[i] = pid
+	}
 
-		log.debug("connecting %s to %s\n", veth.PeerName, routerName)
-		if err := connectToContainer(containerEnd, containerPID); err != nil {
-			log.error("couldn't connect %s to %s: %v\n", veth.PeerName, routerName, err)
+	ends := [2]string{}
+	for i, node := range endpoints {
+		ends[i] = containerEthPrefix + strings.ToLower(fmt.Sprintf("%s-%s", node, subnetName))
+	}
+	veth, end, peerEnd, err := netState.backend.createVethPair(ends[0], ends[1])
+	if err != nil {
+		log.error("couldn't create veth %s-%s: %v\n", endpoints[0], endpoints[1], err)
+		return err
+	}
+
+	for i, iface := range []netlink.Link{end, peerEnd} {
+		node, peer := endpoints[i], endpoints[1-i]
+
+		log := log.with("node", node)
+
+		log.debug("connecting %s to %s\n", ends[i], node)
+		if err := netState.backend.connectToContainer(iface, pids[i]); err != nil {
+			log.error("couldn't connect %s to %s: %v\n", ends[i], node, err)
 			return err
 		}
 
-		assignedCIDR := subnetAddresser.nextCIDR(routerName)
-		log.debug("assigning %s to %s on %s\n", assignedCIDR, veth.PeerName, routerName)
-		if err := addressContainer(assignedCIDR, containerEnd, containerPID); err != nil {
-			log.error("couldn't address %s to %s on %s: %v\n", assignedCIDR, veth.PeerName, routerName, err)
+		assignedCIDR := subnetAddresser.nextCIDR(node)
+		log.debug("assigning %s to %s on %s\n", assignedCIDR, ends[i], node)
+		if err := netState.backend.addressContainer(assignedCIDR, iface, pids[i]); err != nil {
+			log.error("couldn't address %s to %s on %s: %v\n", assignedCIDR, ends[i], node, err)
 			return err
 		}
+
+		netState.Links[linkKey(node, subnetName)] = linkInfo{
+			Node: node, Subnet: subnetName, NodeEnd: ends[i], Peer: peer, CIDR: assignedCIDR}
 	}
+	log.debug("joined %s and %s through %s\n", endpoints[0], endpoints[1], veth.Name)
 
 	return nil
 }
+
+// connectP2PSubnets makes sure every point-to-point subnet on def joins its two nodes.
+func connectP2PSubnets(netState *NetworkState, def netDef) error {
+	for _, subnetName := range sortedKeys(def.Subnets) {
+		if !def.Subnets[subnetName].isP2P() {
+			continue
+		}
+		if err := connectP2P(netState, def, subnetName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetNode drops every trace of node from netState once its
+// container is gone: its links, its addresses and its routes.
+func forgetNode(netState *NetworkState, node string) {
+	for key, link := range netState.Links {
+		if link.Node != node {
+			continue
+		}
+		if addresser, ok := netState.Addressers[link.Subnet]; ok {
+			addresser.release(node)
+		}
+		// Open vSwitch bridges hold on to ports whose interface is gone.
+		if subnet := netState.Subnets[link.Subnet]; link.ownsBridgeEnd() {
+			if err := netState.bridgesFor(link.Subnet).disconnectFromBridge(link.BridgeEnd, subnet.Bridge); err != nil {
+				netState.log().with("subnet", link.Subnet, "node", node).error(
+					"couldn't disconnect %s from %s: %v\n", link.BridgeEnd, subnet.BridgeName, err)
+			}
+		}
+		delete(netState.Links, key)
+	}
+	delete(netState.Routes, node)
+}
@@ -11,7 +11,7 @@ import (
 	"github.com/vishvananda/netns"
 )
 
-func createBridge(name string) (*netlink.Bridge, error) {
+func (linuxBackend) createBridge(name string) (*netlink.Bridge, error) {
 	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)}}
 	if err := netlink.LinkAdd(bridge); err != nil {
 		return nil, err
@@ -19,14 +19,20 @@ func createBridge(name string) (*netlink.Bridge, error) {
 	return bridge, netlink.LinkSetUp(bridge)
 }
 
-func connectToBridge(vethEnd netlink.Link, bridge *netlink.Bridge) error {
+func (linuxBackend) connectToBridge(vethEnd netlink.Link, bridge *netlink.Bridge) error {
 	if err := netlink.LinkSetMaster(vethEnd, bridge); err != nil {
 		return err
 	}
 	return netlink.LinkSetUp(vethEnd)
 }
 
-func connectToContainer(vethEnd netlink.Link, containerPID int) error {
+// disconnectFromBridge does nothing: ports leave Linux
+// bridges on their own once their veth pair is removed.
+func (linuxBackend) disconnectFromBridge(portName string, bridge *netlink.Bridge) error {
+	return nil
+}
+
+func (linuxBackend) connectToContainer(vethEnd netlink.Link, containerPID int) error {
 	if err := netlink.LinkSetNsPid(vethEnd, containerPID); err != nil {
 		return err
 	}
@@ -52,29 +58,29 @@ func connectToContainer(vethEnd netlink.Link, containerPID int) error {
 	return netns.Set(origNS)
 }
 
-func createVethPair(bridgePrefix, containerPrefix, suffix string) (*netlink.Veth, netlink.Link, netlink.Link, error) {
+func (linuxBackend) createVethPair(name, peerName string) (*netlink.Veth, netlink.Link, netlink.Link, error) {
 	veth := &netlink.Veth{
-		LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + suffix},
-		PeerName:  containerPrefix + suffix,
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		PeerName:  peerName,
 	}
 
 	if err := netlink.LinkAdd(veth); err != nil {
 		return nil, nil, nil, err
 	}
 
-	bridgeEnd, err := netlink.LinkByName(veth.Name)
+	end, err := netlink.LinkByName(veth.Name)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	containerEnd, err := netlink.LinkByName(veth.PeerName)
+	peerEnd, err := netlink.LinkByName(veth.PeerName)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	return veth, bridgeEnd, containerEnd, nil
+	return veth, end, peerEnd, nil
 }
 
-func addressBridge(cidr string, bridge *netlink.Bridge) error {
+func (linuxBackend) addressBridge(cidr string, bridge *netlink.Bridge) error {
 	nlAddr, err := netlink.ParseAddr(cidr)
 	if err != nil {
 		log.warn("could't parse CIDR mask %s\n", cidr)
@@ -83,14 +89,14 @@ func addressBridge(cidr string, bridge *netlink.Bridge) error {
 	return netlink.AddrAdd(bridge, nlAddr)
 }
 
-func removeBridge(bridge *netlink.Bridge) error {
+func (linuxBackend) removeBridge(bridge *netlink.Bridge) error {
 	return netlink.LinkDel(bridge)
 }
 
 // natOut allows the provided CIDR to be NATted
 // out of the machine so that it can reach
 // external networks.
-func natOut(cidr string) error {
+func (linuxBackend) natOut(cidr string) error {
 	masquerade := []string{
 		"POSTROUTING", "-t", "nat",
 		"-s", cidr,
@@ -112,7 +118,7 @@ func natOut(cidr string) error {
 	return nil
 }
 
-func restoreNAT(cidr string) error {
+func (linuxBackend) restoreNAT(cidr string) error {
 	if cidr == "" {
 		return nil
 	}
@@ -137,7 +143,7 @@ func restoreNAT(cidr string) error {
 	return nil
 }
 
-func enableForwarding(hopBridgeName string) error {
+func (linuxBackend) enableForwarding(hopBridgeName string) error {
 	forwardingRules := [][]string{
 		{"FORWARD", "-i", hopBridgeName, "-j", "ACCEPT"},
 		{"FORWARD", "-o", hopBridgeName, "-j", "ACCEPT"},
@@ -160,7 +166,7 @@ func enableForwarding(hopBridgeName string) error {
 	return nil
 }
 
-func restoreForwarding(hopBridgeName string) error {
+func (linuxBackend) restoreForwarding(hopBridgeName string) error {
 	if hopBridgeName == "" {
 		return nil
 	}
@@ -187,93 +193,73 @@ func restoreForwarding(hopBridgeName string) error {
 }
 
 func confOutboundAccess(netState *NetworkState, hopBridgeName string, hopBridgeCIDR net.IPNet) error {
-	hopBrd, err := createBridge(hopBridgeName)
+	hopBrd, err := netState.backend.createBridge(hopBridgeName)
 	if err != nil {
 		return err
 	}
+	netState.log().with("subnet", outboundSubnetName).debug("created hop bridge %s for outbound access\n", hopBrd.Name)
 
-	netState.Subnets["outboundSubnet"] = SubnetResources{Bridge: hopBrd, Containers: map[string]containerInfo{}}
-	subnetAddresser, err := newSubnetAddresser(netState, "outboundSubnet", hopBridgeCIDR)
+	netState.Subnets[outboundSubnetName] = SubnetResources{Bridge: hopBrd, BridgeName: hopBrd.Name, Containers: map[string]containerInfo{}}
+	subnetAddresser, err := newSubnetAddresser(netState, outboundSubnetName, hopBridgeCIDR)
 	if err != nil {
 		return err
 	}
 	assignedHopBrdCIDR := subnetAddresser.nextCIDR(hopBridgeName)
-	assignedHopBrdIP := strings.Split(assignedHopBrdCIDR, "/")[0]
-	if err := addressBridge(assignedHopBrdCIDR, hopBrd); err != nil {
+	if err := netState.backend.addressBridge(assignedHopBrdCIDR, hopBrd); err != nil {
 		return err
 	}
 
-	if err := natOut(hopBridgeCIDR.String()); err != nil {
+	if err := netState.backend.natOut(hopBridgeCIDR.String()); err != nil {
 		return err
 	}
 	netState.HopCIDR = hopBridgeCIDR.String()
 
-	if err := enableForwarding(bridgePrefix + strings.ToLower(hopBridgeName)); err != nil {
+	if err := netState.backend.enableForwarding(bridgePrefix + strings.ToLower(hopBridgeName)); err != nil {
 		return err
 	}
 
 	for _, subnetResrc := range netState.Subnets {
-		for containerName, containerInfo := range subnetResrc.Containers {
-			veth, bridgeEnd, containerEnd, err := createVethPair(
-				defaultHopBridgePrefix, defaultHopContainerPrefix,
-				strings.ToLower(containerName))
-			if err != nil {
-				log.error("couldn't create veth %s-%s: %v\n", hopBrd.Name, containerName, err)
+		for containerName := range subnetResrc.Containers {
+			if err := connectOutbound(netState, containerName); err != nil {
 				return err
 			}
-
-			log.debug("connecting %s to %s\n", veth.Name, hopBrd.Name)
-			if err := connectToBridge(bridgeEnd, hopBrd); err != nil {
-				log.error("couldn't connect %s to %s: %v\n", veth.Name, hopBrd.Name, err)
-				return err
-			}
-
-			log.debug("connecting %s to %s\n", veth.PeerName, containerName)
-			if err := connectToContainer(containerEnd, containerInfo.PID); err != nil {
-				log.error("couldn't connect %s to %s: %v\n", veth.PeerName, containerName, err)
-				return err
-			}
-
-			assignedCIDR := subnetAddresser.nextCIDR(containerName)
-			log.debug("assigning %s to %s on %s\n", assignedCIDR, veth.PeerName, containerName)
-			if err := addressContainer(assignedCIDR, containerEnd, containerInfo.PID); err != nil {
-				log.error("couldn't address %s to %s on %s: %v\n", assignedCIDR, veth.PeerName, containerName, err)
-				return err
-			}
-			addDefaultRoute(net.ParseIP(assignedHopBrdIP), containerInfo.PID)
 		}
 	}
 
-	for routerName, routerInfo := range netState.Routers {
-		veth, bridgeEnd, containerEnd, err := createVethPair(
-			defaultHopBridgePrefix, defaultHopContainerPrefix,
-			strings.ToLower(fmt.Sprintf("%s-%s", routerName, "ob")))
-		if err != nil {
-			log.error("couldn't create veth %s-%s: %v\n", "ob", routerName, err)
+	for routerName := range netState.Routers {
+		if err := connectOutbound(netState, routerName); err != nil {
 			return err
 		}
+	}
 
-		log.debug("connecting %s to %s\n", veth.Name, "ob")
-		if err := connectToBridge(bridgeEnd, hopBrd); err != nil {
-			log.error("couldn't connect %s to %s: %v\n", veth.Name, "ob", err)
-			return err
-		}
+	return nil
+}
 
-		log.debug("connecting %s to %s\n", veth.PeerName, routerName)
-		if err := connectToContainer(containerEnd, routerInfo.PID); err != nil {
-			log.error("couldn't connect %s to %s: %v\n", veth.PeerName, routerName, err)
-			return err
-		}
+// connectOutbound plugs node into the outbound subnet set up by
+// confOutboundAccess and routes its default traffic through it.
+func connectOutbound(netState *NetworkState, node string) error {
+	hopSubnet, ok := netState.Subnets[outboundSubnetName]
+	if !ok {
+		return fmt.Errorf("outbound access has not been configured")
+	}
+	pid, ok := netState.nodePID(node)
+	if !ok {
+		return errUnknownNode(node)
+	}
 
-		assignedCIDR := subnetAddresser.nextCIDR(routerName)
-		log.debug("assigning %s to %s on %s\n", assignedCIDR, veth.PeerName, routerName)
-		if err := addressContainer(assignedCIDR, containerEnd, routerInfo.PID); err != nil {
-			log.error("couldn't address %s to %s on %s: %v\n", assignedCIDR, veth.PeerName, routerName, err)
-			return err
-		}
+	suffix := node
+	if _, ok := netState.Routers[node]; ok {
+		suffix = fmt.Sprintf("%s-%s", node, "ob")
+	}
 
-		addDefaultRoute(net.ParseIP(assignedHopBrdIP), routerInfo.PID)
+	if err := plugNode(netState, hopSubnet.Bridge, outboundSubnetName, node, suffix,
+		defaultHopBridgePrefix, defaultHopContainerPrefix, pid); err != nil {
+		return err
 	}
 
+	hopBrdIP := netState.Addressers[outboundSubnetName].AssignedIPs[defaultGatewayName]
+	if err := addDefaultRoute(netState, node, hopBrdIP); err != nil {
+		netState.log().with("subnet", outboundSubnetName, "node", node).warn("couldn't add the default route on %s: %v\n", node, err)
+	}
 	return nil
 }
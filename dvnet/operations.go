@@ -0,0 +1,242 @@
+package dvnet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of nodes.
+const (
+	nodeKindHost   string = "host"
+	nodeKindRouter string = "router"
+)
+
+// NodeRequest describes a node to be added to a running network.
+type NodeRequest struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+
+	// Subnet is the one a host is to be plugged into.
+	Subnet string `json:"subnet,omitempty"`
+
+	// Subnets are the ones a router is to be attached to.
+	Subnets []string `json:"subnets,omitempty"`
+
+	Image string `json:"image"`
+
+	// ContainerOptions tune the node's container just like in a definition.
+	ContainerOptions
+}
+
+// alterNetwork runs alter on the state of the network with the given name, ID or
+// ID prefix and saves whatever it changed, even if it fails halfway through.
+func (d Driver) alterNetwork(network string, alter func(ns *NetworkState) error) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return err
+	}
+
+	if err := alter(ns); err != nil {
+		log.error("network %s might have been partially altered: %v\n", networkID, err)
+		// Save whatever we did manage to change so that we can pick up from there.
+		if err := d.store.save(networkID, ns); err != nil {
+			log.error("couldn't save the state of network %s: %v\n", networkID, err)
+		}
+		return err
+	}
+
+	if err := d.store.save(networkID, ns); err != nil {
+		return fmt.Errorf("couldn't save the state of network %s: %w", networkID, err)
+	}
+
+	ipAddressesPath := fmt.Sprintf("%s.ipaddr", strings.Split(ns.DefPath, ".")[0])
+	if err := dumpAddressAssignments(ns, ipAddressesPath); err != nil {
+		log.error("couldn't dump the assigned IPv4 addresses: %v\n", err)
+	}
+
+	return nil
+}
+
+// clone returns a copy of def which can be altered without affecting def.
+func (def netDef) clone() netDef {
+	cDef := def
+	cDef.Subnets = map[string]subnetDef{}
+	for subnetName, subnet := range def.Subnets {
+		hosts := map[string]HostDef{}
+		for host, hDef := range subnet.Hosts {
+			hosts[host] = hDef
+		}
+		subnet.Hosts = hosts
+		cDef.Subnets[subnetName] = subnet
+	}
+	cDef.Routers = map[string]routerDef{}
+	for routerName, router := range def.Routers {
+		router.Subnets = append([]string{}, router.Subnets...)
+		links := map[string]LinkImpairments{}
+		for subnetName, li := range router.Links {
+			links[subnetName] = li
+		}
+		router.Links = links
+		if router.Switches != nil {
+			switches := map[string]string{}
+			for subnetName, switchName := range router.Switches {
+				switches[subnetName] = switchName
+			}
+			router.Switches = switches
+		}
+		cDef.Routers[routerName] = router
+	}
+	if def.Switches != nil {
+		cDef.Switches = map[string]switchDef{}
+		for switchName, sw := range def.Switches {
+			sw.Links = append([]string(nil), sw.Links...)
+			cDef.Switches[switchName] = sw
+		}
+	}
+	return cDef
+}
+
+// alterDefinition brings the network in line with its definition as changed by alter.
+// Nodes added or removed this way will be reverted on the next reload unless the
+// definition file is updated accordingly.
+func (d Driver) alterDefinition(network string, alter func(def *netDef) error) error {
+	return d.alterNetwork(network, func(ns *NetworkState) error {
+		newDef := ns.Definition.clone()
+		if err := alter(&newDef); err != nil {
+			return err
+		}
+		if err := validateDef(newDef); err != nil {
+			return invalidError{err}
+		}
+		return reconcileNetwork(ns, newDef)
+	})
+}
+
+// AddNode adds a host or a router to a running network.
+func (d Driver) AddNode(network string, req NodeRequest) error {
+	return d.alterDefinition(network, func(def *netDef) error {
+		if req.Name == "" {
+			return invalidError{fmt.Errorf("nodes must have a name")}
+		}
+		if definesNode(*def, req.Name) {
+			return invalidError{fmt.Errorf("node %s is already part of the network", req.Name)}
+		}
+
+		switch req.Kind {
+		case nodeKindHost:
+			subnet, ok := def.Subnets[req.Subnet]
+			if !ok {
+				return notFoundError{fmt.Sprintf("subnet %s is not part of the network", req.Subnet)}
+			}
+			subnet.Hosts[req.Name] = HostDef{Image: req.Image, ContainerOptions: req.ContainerOptions}
+		case nodeKindRouter:
+			for _, subnetName := range req.Subnets {
+				if _, ok := def.Subnets[subnetName]; !ok {
+					return notFoundError{fmt.Sprintf("subnet %s is not part of the network", subnetName)}
+				}
+			}
+			def.Routers[req.Name] = routerDef{Subnets: req.Subnets, Image: req.Image, ContainerOptions: req.ContainerOptions}
+		default:
+			return invalidError{fmt.Errorf("unknown node kind %q: it should be either %s or %s", req.Kind, nodeKindHost, nodeKindRouter)}
+		}
+		return nil
+	})
+}
+
+// RemoveNode removes a host or a router from a running network.
+func (d Driver) RemoveNode(network, node string) error {
+	return d.alterDefinition(network, func(def *netDef) error {
+		if _, ok := def.Routers[node]; ok {
+			delete(def.Routers, node)
+			return nil
+		}
+		for _, subnet := range def.Subnets {
+			if _, ok := subnet.Hosts[node]; ok {
+				delete(subnet.Hosts, node)
+				return nil
+			}
+		}
+		return errUnknownNode(node)
+	})
+}
+
+func definesNode(def netDef, node string) bool {
+	if _, ok := def.Routers[node]; ok {
+		return true
+	}
+	for _, subnet := range def.Subnets {
+		if _, ok := subnet.Hosts[node]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLinkState brings the link between node and subnet up or down. Only the
+// bridge's end is touched: the node sees its interface lose its carrier.
+// Point-to-point links have no bridge end and trunk links share theirs,
+// so the node's own end is used for both, and the routes through it are
+// reinstalled when it comes back up.
+func (d Driver) SetLinkState(network, node, subnet string, up bool) error {
+	return d.alterNetwork(network, func(ns *NetworkState) error {
+		key := linkKey(node, subnet)
+		if _, ok := ns.Links[key]; !ok {
+			return notFoundError{fmt.Sprintf("node %s is not attached to subnet %s", node, subnet)}
+		}
+		return setLinkState(ns, key, up)
+	})
+}
+
+// SetNodeState brings every link of node up or down, outbound access included,
+// which effectively isolates it from the rest of the network and back.
+func (d Driver) SetNodeState(network, node string, up bool) error {
+	return d.alterNetwork(network, func(ns *NetworkState) error {
+		if _, ok := ns.nodeInfo(node); !ok {
+			return errUnknownNode(node)
+		}
+		for _, key := range sortedKeys(ns.Links) {
+			if ns.Links[key].Node != node {
+				continue
+			}
+			if err := setLinkState(ns, key, up); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func setLinkState(ns *NetworkState, key string, up bool) error {
+	link := ns.Links[key]
+	ns.log().with("node", link.Node).debug("setting the link to %s up: %t\n", link.Subnet, up)
+	iface, pid := link.BridgeEnd, 0
+	if !link.ownsBridgeEnd() {
+		nodePID, ok := ns.nodePID(link.Node)
+		if !ok {
+			return errUnknownNode(link.Node)
+		}
+		iface, pid = link.NodeEnd, nodePID
+	}
+	if err := ns.backend.setLinkUp(iface, pid, up); err != nil {
+		return fmt.Errorf("couldn't set %s up (%t): %w", iface, up, err)
+	}
+	// Setting the node's own end down flushed the routes through it.
+	if up && !link.ownsBridgeEnd() {
+		if err := reinstallRoutesVia(ns, link.Node, link.CIDR); err != nil {
+			return err
+		}
+	}
+	link.Down = !up
+	ns.Links[key] = link
+	return nil
+}
@@ -0,0 +1,121 @@
+package dvnet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSetLinkAndNodeState(t *testing.T) {
+	d, pb := testDriver(t)
+
+	if err := d.SetLinkState("0123", "R-1", "C", false); err != nil {
+		t.Fatalf("SetLinkState() err %v", err)
+	}
+	if err := d.SetNodeState("0123", "B-1", false); err != nil {
+		t.Fatalf("SetNodeState() err %v", err)
+	}
+	for _, step := range []string{"set bth-r-1-c down", "set bth-b-1 down", "set hth-b-1 down"} {
+		if !contains(pb.plan.Steps, step) {
+			t.Errorf("should have done %q", step)
+		}
+	}
+
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := networkStatus(ns, func(string) string { return "running" })
+	got := map[string]NodeStatus{}
+	for _, node := range status.Nodes {
+		got[node.Name] = node
+	}
+	if r1 := got["R-1"]; !cmp.Equal(r1.DownLinks, []string{"C"}) || r1.Isolated {
+		t.Errorf("R-1 status = %+v; wanted just its link to C down", r1)
+	}
+	if b1 := got["B-1"]; !cmp.Equal(b1.DownLinks, []string{"B", outboundSubnetName}) || !b1.Isolated {
+		t.Errorf("B-1 status = %+v; wanted it isolated", b1)
+	}
+	if a1 := got["A-1"]; a1.DownLinks != nil || a1.Isolated {
+		t.Errorf("A-1 status = %+v; wanted every link up", a1)
+	}
+
+	if err := d.SetNodeState("0123", "B-1", true); err != nil {
+		t.Fatalf("SetNodeState() err %v", err)
+	}
+	if ns, _ = d.State("0123"); ns.Links[linkKey("B-1", "B")].Down {
+		t.Errorf("B-1's link to B should be back up")
+	}
+
+	if err := d.SetLinkState("0123", "R-1", "B", false); err == nil {
+		t.Errorf("SetLinkState() on a link that doesn't exist should fail")
+	}
+	if err := d.SetNodeState("0123", "Z-1", false); err == nil {
+		t.Errorf("SetNodeState() on a node that doesn't exist should fail")
+	}
+}
+
+func TestSetP2PLinkState(t *testing.T) {
+	ns := plannedState(t, "../demos/p2p/net.json")
+	pb := ns.backend.(*planBackend)
+
+	if err := setLinkState(ns, linkKey("R-1", "C"), false); err != nil {
+		t.Fatalf("setLinkState() err %v", err)
+	}
+	want := fmt.Sprintf("set ethr-1-c down on container #%d", ns.Routers["R-1"].PID)
+	if !contains(pb.plan.Steps, want) {
+		t.Errorf("should have done %q", want)
+	}
+	if !ns.Links[linkKey("R-1", "C")].Down {
+		t.Errorf("R-1's link to C should be down")
+	}
+}
+
+// p2pHostDef has a host on a point-to-point subnet reaching the others through R-1.
+var p2pHostDef = `{
+	"name": "P2P Host Net",
+	"automatic_routing": true,
+	"subnets": {
+		"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "pcollado/dhost"}}},
+		"B": {"cidr": "10.0.1.0/24", "hosts": {"B-1": {"image": "pcollado/dhost"}}},
+		"C": {"cidr": "10.0.2.0/31", "type": "p2p", "hosts": {"C-1": {"image": "pcollado/dhost"}}}
+	},
+	"routers": {
+		"R-1": {"subnets": ["A", "B", "C"], "image": "pcollado/drouter"}
+	}
+}`
+
+func TestSetP2PLinkStateKeepsRoutes(t *testing.T) {
+	defPath := filepath.Join(t.TempDir(), "net.json")
+	if err := os.WriteFile(defPath, []byte(p2pHostDef), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ns := plannedState(t, defPath)
+	pb := ns.backend.(*planBackend)
+	key, pid := linkKey("C-1", "C"), ns.Subnets["C"].Containers["C-1"].PID
+	if len(ns.Routes["C-1"]) == 0 {
+		t.Fatalf("C-1 should have routes through R-1")
+	}
+
+	// The kernel flushes the routes through C-1's end as it goes down...
+	if err := setLinkState(ns, key, false); err != nil {
+		t.Fatalf("setLinkState() err %v", err)
+	}
+	for _, route := range ns.Routes["C-1"] {
+		if containsRoute(pb.tables[pid], route) {
+			t.Errorf("bringing C-1's link down should have flushed the route to %s", route.Dst)
+		}
+	}
+	// ... so they must be put back as it comes up.
+	if err := setLinkState(ns, key, true); err != nil {
+		t.Fatalf("setLinkState() err %v", err)
+	}
+	for _, route := range ns.Routes["C-1"] {
+		if !containsRoute(pb.tables[pid], route) {
+			t.Errorf("the route to %s through %s wasn't installed again on C-1", route.Dst, route.Gw)
+		}
+	}
+}
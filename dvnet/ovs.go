@@ -0,0 +1,250 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ovsdbSocket   string        = "/var/run/openvswitch/db.sock"
+	ovsdbDatabase string        = "Open_vSwitch"
+	ovsdbTimeout  time.Duration = 5 * time.Second
+)
+
+// What Open vSwitch bridges do when they can't reach their controllers:
+// standalone ones behave like a regular learning switch whilst secure
+// ones only forward what the flows already installed let through.
+const (
+	ovsFailModeStandalone string = "standalone"
+	ovsFailModeSecure     string = "secure"
+)
+
+// ovsDef holds the settings of a subnet backed by an Open vSwitch bridge.
+// Controllers are the OpenFlow controllers (e.g. tcp:172.17.0.1:6653) the
+// bridge connects to, whose absence is handled as told by FailMode.
+type ovsDef struct {
+	Controllers []string `json:"controllers,omitempty"`
+	FailMode    string   `json:"fail_mode,omitempty"`
+}
+
+// validateOVS checks OVS subnets are plain ones with sensible settings: the
+// rest rely on features of Linux bridges such as VLAN filtering and STP.
+func validateOVS(def netDef) error {
+	for _, subnetName := range sortedKeys(def.Subnets) {
+		subnet := def.Subnets[subnetName]
+		if subnet.OVS == nil {
+			continue
+		}
+		if subnet.isP2P() || subnet.VLAN != 0 || len(subnetSwitches(def, subnetName)) != 0 {
+			return fmt.Errorf("subnet %s: point-to-point, VLAN and switched subnets can't be backed by Open vSwitch", subnetName)
+		}
+		switch subnet.OVS.FailMode {
+		case "", ovsFailModeStandalone, ovsFailModeSecure:
+		default:
+			return fmt.Errorf("subnet %s: unknown fail mode %q: it should be either %s or %s",
+				subnetName, subnet.OVS.FailMode, ovsFailModeStandalone, ovsFailModeSecure)
+		}
+		for _, target := range subnet.OVS.Controllers {
+			proto, _, found := strings.Cut(target, ":")
+			if !found || !contains([]string{"tcp", "ssl", "unix", "ptcp", "pssl", "punix"}, proto) {
+				return fmt.Errorf("subnet %s: controller %q should look like tcp:<address>:<port>", subnetName, target)
+			}
+		}
+	}
+	return nil
+}
+
+// bridgesFor returns the bridge backend behind subnetName's bridge.
+func (netState *NetworkState) bridgesFor(subnetName string) bridgeBackend {
+	return netState.backend.bridgeBackendFor(netState.Subnets[subnetName].OVS)
+}
+
+// ovsBackend is the bridgeBackend managing Open vSwitch bridges by talking
+// OVSDB (RFC 7047) to the database server over its local socket. Everything
+// else is left to ovs-vswitchd, which picks up the changes on its own.
+type ovsBackend struct {
+	socket string
+	def    ovsDef
+}
+
+type ovsdbOp map[string]interface{}
+
+type ovsdbResult struct {
+	Rows    []map[string]interface{} `json:"rows,omitempty"`
+	Error   string                   `json:"error,omitempty"`
+	Details string                   `json:"details,omitempty"`
+}
+
+type ovsdbRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     interface{}   `json:"id"`
+}
+
+type ovsdbResponse struct {
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+	ID     interface{} `json:"id"`
+}
+
+// ovsdbMessage is anything the server might send us: either
+// the response to our request or a request of its own.
+type ovsdbMessage struct {
+	Method string          `json:"method"`
+	Params []interface{}   `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  interface{}     `json:"error"`
+	ID     interface{}     `json:"id"`
+}
+
+func namedUUID(name string) []interface{} {
+	return []interface{}{"named-uuid", name}
+}
+
+func ovsdbSet(elems ...interface{}) []interface{} {
+	return []interface{}{"set", elems}
+}
+
+func whereName(name string) []interface{} {
+	return []interface{}{[]interface{}{"name", "==", name}}
+}
+
+// transact runs ops as a single transaction over a connection of its own,
+// answering the echo requests the server might send in the meantime.
+func (ob ovsBackend) transact(ops ...ovsdbOp) ([]ovsdbResult, error) {
+	conn, err := net.DialTimeout("unix", ob.socket, ovsdbTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't reach OVSDB at %s: %w", ob.socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ovsdbTimeout))
+
+	params := []interface{}{ovsdbDatabase}
+	for _, op := range ops {
+		params = append(params, op)
+	}
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	if err := enc.Encode(ovsdbRequest{Method: "transact", Params: params, ID: 0}); err != nil {
+		return nil, fmt.Errorf("couldn't send the transaction: %w", err)
+	}
+
+	for {
+		var msg ovsdbMessage
+		if err := dec.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("couldn't read the transaction's outcome: %w", err)
+		}
+		if msg.Method == "echo" {
+			if err := enc.Encode(ovsdbResponse{Result: msg.Params, ID: msg.ID}); err != nil {
+				return nil, fmt.Errorf("couldn't answer an echo request: %w", err)
+			}
+			continue
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("transaction failed: %v", msg.Error)
+		}
+
+		var results []ovsdbResult
+		if err := json.Unmarshal(msg.Result, &results); err != nil {
+			return nil, fmt.Errorf("couldn't decode the transaction's outcome: %w", err)
+		}
+		// Failed transactions are aborted as a whole: look for the culprit.
+		for _, result := range results {
+			if result.Error != "" {
+				return nil, fmt.Errorf("transaction failed: %s: %s", result.Error, result.Details)
+			}
+		}
+		return results, nil
+	}
+}
+
+// uuidOf returns the UUID of the row in table called name, if there's one.
+func (ob ovsBackend) uuidOf(table, name string) (string, bool, error) {
+	results, err := ob.transact(ovsdbOp{"op": "select", "table": table, "where": whereName(name), "columns": []string{"_uuid"}})
+	if err != nil {
+		return "", false, err
+	}
+	if len(results) == 0 || len(results[0].Rows) == 0 {
+		return "", false, nil
+	}
+	// UUIDs come as ["uuid", "<UUID>"].
+	if uuid, ok := results[0].Rows[0]["_uuid"].([]interface{}); ok && len(uuid) == 2 {
+		if id, ok := uuid[1].(string); ok {
+			return id, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("malformed UUID for %s %s", table, name)
+}
+
+// createBridge adds a bridge together with its internal port, just like
+// ovs-vsctl add-br does, and points it at the subnet's controllers.
+func (ob ovsBackend) createBridge(name string) (*netlink.Bridge, error) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)}}
+
+	ops := []ovsdbOp{
+		{"op": "insert", "table": "Interface", "uuid-name": "iface", "row": map[string]interface{}{"name": bridge.Name, "type": "internal"}},
+		{"op": "insert", "table": "Port", "uuid-name": "port", "row": map[string]interface{}{"name": bridge.Name, "interfaces": namedUUID("iface")}},
+	}
+	controllers := []interface{}{}
+	for i, target := range ob.def.Controllers {
+		uuidName := fmt.Sprintf("controller%d", i)
+		ops = append(ops, ovsdbOp{"op": "insert", "table": "Controller", "uuid-name": uuidName, "row": map[string]interface{}{"target": target}})
+		controllers = append(controllers, namedUUID(uuidName))
+	}
+	row := map[string]interface{}{"name": bridge.Name, "ports": namedUUID("port"), "controller": ovsdbSet(controllers...)}
+	if ob.def.FailMode != "" {
+		row["fail_mode"] = ob.def.FailMode
+	}
+	ops = append(ops,
+		ovsdbOp{"op": "insert", "table": "Bridge", "uuid-name": "bridge", "row": row},
+		ovsdbOp{"op": "mutate", "table": "Open_vSwitch", "where": []interface{}{},
+			"mutations": []interface{}{[]interface{}{"bridges", "insert", ovsdbSet(namedUUID("bridge"))}}},
+	)
+
+	if _, err := ob.transact(ops...); err != nil {
+		return nil, err
+	}
+	return bridge, nil
+}
+
+// removeBridge drops the bridge from the switch's configuration. Its ports,
+// interfaces and controllers aren't referenced by anything else after that,
+// so OVSDB garbage collects them.
+func (ob ovsBackend) removeBridge(bridge *netlink.Bridge) error {
+	uuid, ok, err := ob.uuidOf("Bridge", bridge.Name)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = ob.transact(ovsdbOp{"op": "mutate", "table": "Open_vSwitch", "where": []interface{}{},
+		"mutations": []interface{}{[]interface{}{"bridges", "delete", ovsdbSet([]interface{}{"uuid", uuid})}}})
+	return err
+}
+
+func (ob ovsBackend) connectToBridge(vethEnd netlink.Link, bridge *netlink.Bridge) error {
+	portName := vethEnd.Attrs().Name
+	if _, err := ob.transact(
+		ovsdbOp{"op": "insert", "table": "Interface", "uuid-name": "iface", "row": map[string]interface{}{"name": portName}},
+		ovsdbOp{"op": "insert", "table": "Port", "uuid-name": "port", "row": map[string]interface{}{"name": portName, "interfaces": namedUUID("iface")}},
+		ovsdbOp{"op": "mutate", "table": "Bridge", "where": whereName(bridge.Name),
+			"mutations": []interface{}{[]interface{}{"ports", "insert", ovsdbSet(namedUUID("port"))}}},
+	); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(vethEnd)
+}
+
+// disconnectFromBridge removes portName from the bridge. Unlike Linux bridges,
+// Open vSwitch keeps ports around even after their interface is gone.
+func (ob ovsBackend) disconnectFromBridge(portName string, bridge *netlink.Bridge) error {
+	uuid, ok, err := ob.uuidOf("Port", portName)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = ob.transact(ovsdbOp{"op": "mutate", "table": "Bridge", "where": whereName(bridge.Name),
+		"mutations": []interface{}{[]interface{}{"ports", "delete", ovsdbSet([]interface{}{"uuid", uuid})}}})
+	return err
+}
@@ -0,0 +1,174 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeOVSDB serves transactions over a unix socket, pestering every client with
+// an echo request first. It records the operations it gets and answers them
+// with whatever results returns. The returned function lists the transactions so far.
+func fakeOVSDB(t *testing.T, results func(ops []interface{}) []interface{}) (string, func() [][]interface{}) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "db.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	transactions := [][]interface{}{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+			enc.Encode(ovsdbRequest{Method: "echo", Params: []interface{}{"ping"}, ID: "echo"})
+			// The transaction and the answer to our echo request can come in any order.
+			echoed, answered := false, false
+			for !echoed || !answered {
+				var msg ovsdbMessage
+				if err := dec.Decode(&msg); err != nil {
+					break
+				}
+				switch {
+				case msg.ID == "echo":
+					echoed = true
+				case msg.Method == "transact":
+					mu.Lock()
+					transactions = append(transactions, msg.Params[1:])
+					mu.Unlock()
+					enc.Encode(ovsdbResponse{Result: results(msg.Params[1:]), ID: msg.ID})
+					answered = true
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return socket, func() [][]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return transactions
+	}
+}
+
+func TestOVSBackend(t *testing.T) {
+	socket, transactions := fakeOVSDB(t, func(ops []interface{}) []interface{} {
+		results := []interface{}{}
+		for _, op := range ops {
+			if op.(map[string]interface{})["op"] == "select" {
+				results = append(results, map[string]interface{}{"rows": []interface{}{
+					map[string]interface{}{"_uuid": []interface{}{"uuid", "0ae1e2d8-6c0e-4a68-8f49-0c2ad5a1d63c"}}}})
+			} else {
+				results = append(results, map[string]interface{}{})
+			}
+		}
+		return results
+	})
+	ob := ovsBackend{socket: socket, def: ovsDef{Controllers: []string{"tcp:127.0.0.1:6653"}, FailMode: ovsFailModeSecure}}
+
+	bridge, err := ob.createBridge("A")
+	if err != nil {
+		t.Fatalf("createBridge() err %v", err)
+	}
+	if bridge.Name != "dvn-a" {
+		t.Errorf("createBridge() bridge = %s; wanted dvn-a", bridge.Name)
+	}
+	if err := ob.disconnectFromBridge("bth-a-1", bridge); err != nil {
+		t.Fatalf("disconnectFromBridge() err %v", err)
+	}
+
+	txns := transactions()
+	if len(txns) != 3 {
+		t.Fatalf("got %d transactions; wanted 3", len(txns))
+	}
+	tables := []string{}
+	for _, op := range txns[0] {
+		tables = append(tables, op.(map[string]interface{})["table"].(string))
+	}
+	if want := []string{"Interface", "Port", "Controller", "Bridge", "Open_vSwitch"}; !cmp.Equal(tables, want) {
+		t.Errorf("createBridge() touched tables %v; wanted %v", tables, want)
+	}
+	bridgeRow := txns[0][3].(map[string]interface{})["row"].(map[string]interface{})
+	if bridgeRow["fail_mode"] != ovsFailModeSecure {
+		t.Errorf("createBridge() fail mode = %v; wanted %s", bridgeRow["fail_mode"], ovsFailModeSecure)
+	}
+	mutation := txns[2][0].(map[string]interface{})["mutations"].([]interface{})[0]
+	want := []interface{}{"ports", "delete", []interface{}{"set", []interface{}{[]interface{}{"uuid", "0ae1e2d8-6c0e-4a68-8f49-0c2ad5a1d63c"}}}}
+	if !cmp.Equal(mutation, want) {
+		t.Errorf("disconnectFromBridge() mutation = %v; wanted %v", mutation, want)
+	}
+}
+
+func TestOVSBackendErrors(t *testing.T) {
+	socket, _ := fakeOVSDB(t, func(ops []interface{}) []interface{} {
+		return []interface{}{map[string]interface{}{"error": "constraint violation", "details": "duplicate name"}}
+	})
+	ob := ovsBackend{socket: socket}
+	if _, err := ob.createBridge("A"); err == nil {
+		t.Errorf("createBridge() should have failed")
+	}
+
+	ob = ovsBackend{socket: filepath.Join(t.TempDir(), "missing.sock")}
+	if err := ob.removeBridge(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "dvn-a"}}); err == nil {
+		t.Errorf("removeBridge() should have failed without a server")
+	}
+}
+
+func TestOVSValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnets string
+		wantErr bool
+	}{
+		{"an OVS subnet", `"A": {"cidr": "10.0.0.0/24", "ovs": {"controllers": ["tcp:127.0.0.1:6653"], "fail_mode": "secure"}, "hosts": {}}`, false},
+		{"an OVS subnet without controllers", `"A": {"cidr": "10.0.0.0/24", "ovs": {}, "hosts": {}}`, false},
+		{"an unknown fail mode", `"A": {"cidr": "10.0.0.0/24", "ovs": {"fail_mode": "open"}, "hosts": {}}`, true},
+		{"a malformed controller", `"A": {"cidr": "10.0.0.0/24", "ovs": {"controllers": ["127.0.0.1:6653"]}, "hosts": {}}`, true},
+		{"an OVS VLAN", `"A": {"cidr": "10.0.0.0/24", "vlan": 10, "ovs": {}, "hosts": {}}`, true},
+	}
+
+	for _, test := range tests {
+		rawDef := `{"name": "OVS", "subnets": {` + test.subnets + `}, "routers": {}}`
+		if _, err := parseDef([]byte(rawDef)); (err != nil) != test.wantErr {
+			t.Errorf("%s: parseDef() err %v; wanted an error: %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestPlanOVSNetwork(t *testing.T) {
+	plan, err := PlanNetwork("../demos/ovs/net.json")
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+
+	wantBridges := []plannedBridge{
+		{Name: "dvn-a", OVS: &ovsDef{Controllers: []string{"tcp:172.17.0.1:6653"}, FailMode: ovsFailModeSecure}},
+		{Name: "dvn-b"},
+	}
+	if !cmp.Equal(plan.Bridges, wantBridges) {
+		t.Errorf("PlanNetwork() bridges = %v; wanted %v", plan.Bridges, wantBridges)
+	}
+
+	wantSteps := []string{
+		"create Open vSwitch bridge dvn-a",
+		"point dvn-a at controller tcp:172.17.0.1:6653",
+		"add port bth-a-1 to Open vSwitch bridge dvn-a",
+		"add port bth-r-1-a to Open vSwitch bridge dvn-a",
+		"attach bth-b-1 to bridge dvn-b",
+	}
+	for _, step := range wantSteps {
+		if !contains(plan.Steps, step) {
+			t.Errorf("PlanNetwork() should %q", step)
+		}
+	}
+}
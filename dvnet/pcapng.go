@@ -0,0 +1,139 @@
+package dvnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Block types and options of the pcapng format as described in
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html.
+// We always write little-endian sections holding a single interface.
+const (
+	pcapngSHB          uint32 = 0x0a0d0d0a
+	pcapngIDB          uint32 = 0x00000001
+	pcapngEPB          uint32 = 0x00000006
+	pcapngByteOrder    uint32 = 0x1a2b3c4d
+	pcapngLinkEthernet uint16 = 1
+
+	pcapngOptEnd         uint16 = 0
+	pcapngOptComment     uint16 = 1
+	pcapngOptSHBOS       uint16 = 3
+	pcapngOptSHBUserAppl uint16 = 4
+	pcapngOptIfName      uint16 = 2
+	pcapngOptIfDesc      uint16 = 3
+	pcapngOptIfTSResol   uint16 = 9
+	pcapngOptEPBFlags    uint16 = 2
+
+	pcapngFlagInbound  uint32 = 1
+	pcapngFlagOutbound uint32 = 2
+
+	// Timestamps are in nanoseconds rather than the default microseconds.
+	pcapngTSResolNano uint8 = 9
+)
+
+// pcapngOption is an option of a block: a code and its raw value.
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+// capturedPacket is a frame as read off an interface. Outgoing
+// ones were sent through the interface rather than received by it.
+type capturedPacket struct {
+	data     []byte
+	origLen  int
+	when     time.Time
+	outgoing bool
+}
+
+// pcapngWriter writes a pcapng section with a single Ethernet interface.
+type pcapngWriter struct {
+	w io.Writer
+}
+
+// newPcapngWriter writes the section header, tagged with the given comments,
+// and the description of the interface packets are captured on.
+func newPcapngWriter(w io.Writer, comments []string, ifName, ifDesc string, snaplen uint32) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+
+	shb := &bytes.Buffer{}
+	binary.Write(shb, binary.LittleEndian, pcapngByteOrder)
+	binary.Write(shb, binary.LittleEndian, uint16(1))
+	binary.Write(shb, binary.LittleEndian, uint16(0))
+	// The section's length is unknown up front.
+	binary.Write(shb, binary.LittleEndian, int64(-1))
+	shbOpts := []pcapngOption{}
+	for _, comment := range comments {
+		shbOpts = append(shbOpts, pcapngOption{pcapngOptComment, []byte(comment)})
+	}
+	shbOpts = append(shbOpts, pcapngOption{pcapngOptSHBOS, []byte("Linux")}, pcapngOption{pcapngOptSHBUserAppl, []byte("dvnet")})
+	if err := pw.writeBlock(pcapngSHB, shb.Bytes(), shbOpts); err != nil {
+		return nil, err
+	}
+
+	idb := &bytes.Buffer{}
+	binary.Write(idb, binary.LittleEndian, pcapngLinkEthernet)
+	binary.Write(idb, binary.LittleEndian, uint16(0))
+	binary.Write(idb, binary.LittleEndian, snaplen)
+	idbOpts := []pcapngOption{
+		{pcapngOptIfName, []byte(ifName)},
+		{pcapngOptIfDesc, []byte(ifDesc)},
+		{pcapngOptIfTSResol, []byte{pcapngTSResolNano}},
+	}
+	if err := pw.writeBlock(pcapngIDB, idb.Bytes(), idbOpts); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// writePacket writes pkt as an enhanced packet block on our only interface.
+func (pw *pcapngWriter) writePacket(pkt capturedPacket) error {
+	ts := uint64(pkt.when.UnixNano())
+	epb := &bytes.Buffer{}
+	binary.Write(epb, binary.LittleEndian, uint32(0))
+	binary.Write(epb, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(epb, binary.LittleEndian, uint32(ts))
+	binary.Write(epb, binary.LittleEndian, uint32(len(pkt.data)))
+	binary.Write(epb, binary.LittleEndian, uint32(pkt.origLen))
+	epb.Write(pkt.data)
+	epb.Write(make([]byte, pcapngPadding(len(pkt.data))))
+
+	direction := pcapngFlagInbound
+	if pkt.outgoing {
+		direction = pcapngFlagOutbound
+	}
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, direction)
+	return pw.writeBlock(pcapngEPB, epb.Bytes(), []pcapngOption{{pcapngOptEPBFlags, flags}})
+}
+
+// writeBlock writes a block whose body is made up of fixed and opts. Blocks
+// are padded to 32 bits and begin and end with their total length.
+func (pw *pcapngWriter) writeBlock(blockType uint32, fixed []byte, opts []pcapngOption) error {
+	body := bytes.NewBuffer(fixed)
+	if len(opts) != 0 {
+		for _, opt := range opts {
+			binary.Write(body, binary.LittleEndian, opt.code)
+			binary.Write(body, binary.LittleEndian, uint16(len(opt.value)))
+			body.Write(opt.value)
+			body.Write(make([]byte, pcapngPadding(len(opt.value))))
+		}
+		binary.Write(body, binary.LittleEndian, pcapngOptEnd)
+		binary.Write(body, binary.LittleEndian, uint16(0))
+	}
+
+	totalLen := uint32(body.Len() + 12)
+	block := &bytes.Buffer{}
+	binary.Write(block, binary.LittleEndian, blockType)
+	binary.Write(block, binary.LittleEndian, totalLen)
+	block.Write(body.Bytes())
+	binary.Write(block, binary.LittleEndian, totalLen)
+	_, err := pw.w.Write(block.Bytes())
+	return err
+}
+
+func pcapngPadding(n int) int {
+	return (4 - n%4) % 4
+}
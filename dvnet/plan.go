@@ -0,0 +1,764 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	sysctl "github.com/lorenzosaino/go-sysctl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/bpf"
+)
+
+// maxIfaceNameLen is the longest interface name the kernel accepts (IFNAMSIZ - 1).
+const maxIfaceNameLen int = 15
+
+// NetworkPlan describes everything bringing up a network definition entails.
+type NetworkPlan struct {
+	Name       string                     `json:"name"`
+	Sysctls    []plannedSysctl            `json:"sysctls"`
+	Bridges    []plannedBridge            `json:"bridges"`
+	Containers []plannedContainer         `json:"containers"`
+	Links      []linkInfo                 `json:"links"`
+	Routes     map[string][]routeInfo     `json:"routes"`
+	Firewalls  map[string]plannedFirewall `json:"firewalls"`
+	NAT        []string                   `json:"nat"`
+	Forwarding []string                   `json:"forwarding"`
+	Steps      []string                   `json:"steps"`
+	Warnings   []string                   `json:"warnings"`
+}
+
+type plannedSysctl struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type plannedBridge struct {
+	Name          string  `json:"name"`
+	Address       string  `json:"address,omitempty"`
+	VLANFiltering bool    `json:"vlan_filtering,omitempty"`
+	STP           bool    `json:"stp,omitempty"`
+	Priority      *int    `json:"priority,omitempty"`
+	OVS           *ovsDef `json:"ovs,omitempty"`
+}
+
+type plannedContainer struct {
+	Name    string            `json:"name"`
+	Image   string            `json:"image"`
+	Options *ContainerOptions `json:"options,omitempty"`
+}
+
+type plannedFirewall struct {
+	Policy string     `json:"policy"`
+	Rules  [][]string `json:"rules"`
+}
+
+// planBackend is a hostBackend which just writes down what it's asked to do.
+// It never touches the host, so it can be used without root privileges
+// and without a Docker daemon around.
+//
+// It does keep track of what the host would look like, though: the
+// interfaces within each namespace (the host's being 0), the routes,
+// firewalls and containers it would have and the sysctls it'd set.
+type planBackend struct {
+	plan       *NetworkPlan
+	bridges    map[string]*plannedBridge
+	nextPID    int
+	prevVals   map[string]string
+	tables     map[int][]routeInfo
+	ifaces     map[int]map[string]*ifaceState
+	peers      map[string]string
+	containers map[string]int
+	firewalls  map[int]plannedFirewall
+	sysctls    map[string]string
+}
+
+func newPlanBackend() *planBackend {
+	return &planBackend{
+		plan: &NetworkPlan{
+			Routes:    map[string][]routeInfo{},
+			Firewalls: map[string]plannedFirewall{},
+		},
+		bridges:    map[string]*plannedBridge{},
+		nextPID:    1,
+		prevVals:   map[string]string{},
+		tables:     map[int][]routeInfo{},
+		ifaces:     map[int]map[string]*ifaceState{0: {}},
+		peers:      map[string]string{},
+		containers: map[string]int{},
+		firewalls:  map[int]plannedFirewall{},
+		sysctls:    map[string]string{},
+	}
+}
+
+func (pb *planBackend) step(format string, args ...interface{}) {
+	pb.plan.Steps = append(pb.plan.Steps, fmt.Sprintf(format, args...))
+}
+
+func (pb *planBackend) checkIfaceName(name string) {
+	if len(name) > maxIfaceNameLen {
+		pb.plan.Warnings = append(pb.plan.Warnings, fmt.Sprintf(
+			"interface name %s is longer than %d characters: the kernel will reject it", name, maxIfaceNameLen))
+	}
+}
+
+// getSysctl reads the actual value unless we've set it ourselves:
+// that doesn't require any privileges.
+func (pb *planBackend) getSysctl(name string) (string, error) {
+	if val, ok := pb.sysctls[name]; ok {
+		return val, nil
+	}
+	val, err := sysctl.Get(name)
+	if err == nil {
+		pb.prevVals[name] = val
+	}
+	return val, err
+}
+
+func (pb *planBackend) setSysctl(name, value string) error {
+	from, ok := pb.prevVals[name]
+	if !ok {
+		from = "unknown"
+	}
+	pb.plan.Sysctls = append(pb.plan.Sysctls, plannedSysctl{Name: name, From: from, To: value})
+	pb.sysctls[name] = value
+	pb.step("set sysctl %s = %s", name, value)
+	return nil
+}
+
+func (pb *planBackend) ensureDir(path string) error {
+	pb.step("create directory %s if needed", path)
+	return nil
+}
+
+func (pb *planBackend) createBridge(name string) (*netlink.Bridge, error) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)}}
+	pb.checkIfaceName(bridge.Name)
+	pb.bridges[bridge.Name] = &plannedBridge{Name: bridge.Name}
+	pb.step("create bridge %s", bridge.Name)
+	return bridge, nil
+}
+
+func (pb *planBackend) bridgeBackendFor(ovs *ovsDef) bridgeBackend {
+	if ovs == nil {
+		return pb
+	}
+	return planOVSBackend{pb: pb, def: *ovs}
+}
+
+// disconnectFromBridge does nothing, just like the linuxBackend's.
+func (pb *planBackend) disconnectFromBridge(portName string, bridge *netlink.Bridge) error {
+	return nil
+}
+
+// planOVSBackend is the bridgeBackend writing down what
+// the ovsBackend would do instead of talking to OVSDB.
+type planOVSBackend struct {
+	pb  *planBackend
+	def ovsDef
+}
+
+func (ob planOVSBackend) createBridge(name string) (*netlink.Bridge, error) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)}}
+	ob.pb.checkIfaceName(bridge.Name)
+	ob.pb.bridges[bridge.Name] = &plannedBridge{Name: bridge.Name, OVS: &ob.def}
+	ob.pb.step("create Open vSwitch bridge %s", bridge.Name)
+	for _, target := range ob.def.Controllers {
+		ob.pb.step("point %s at controller %s", bridge.Name, target)
+	}
+	if ob.def.FailMode != "" {
+		ob.pb.step("set the fail mode of %s to %s", bridge.Name, ob.def.FailMode)
+	}
+	return bridge, nil
+}
+
+func (ob planOVSBackend) removeBridge(bridge *netlink.Bridge) error {
+	delete(ob.pb.bridges, bridge.Name)
+	ob.pb.step("remove Open vSwitch bridge %s", bridge.Name)
+	return nil
+}
+
+func (ob planOVSBackend) connectToBridge(vethEnd netlink.Link, bridge *netlink.Bridge) error {
+	ob.pb.step("add port %s to Open vSwitch bridge %s", vethEnd.Attrs().Name, bridge.Name)
+	return nil
+}
+
+func (ob planOVSBackend) disconnectFromBridge(portName string, bridge *netlink.Bridge) error {
+	ob.pb.step("delete port %s from Open vSwitch bridge %s", portName, bridge.Name)
+	return nil
+}
+
+func (pb *planBackend) addressBridge(cidr string, bridge *netlink.Bridge) error {
+	if planned, ok := pb.bridges[bridge.Name]; ok {
+		planned.Address = cidr
+	}
+	pb.step("assign %s to bridge %s", cidr, bridge.Name)
+	return nil
+}
+
+func (pb *planBackend) removeBridge(bridge *netlink.Bridge) error {
+	delete(pb.bridges, bridge.Name)
+	pb.step("remove bridge %s", bridge.Name)
+	return nil
+}
+
+func (pb *planBackend) createTrunkBridge(name string) (*netlink.Bridge, error) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)}}
+	pb.checkIfaceName(bridge.Name)
+	pb.bridges[bridge.Name] = &plannedBridge{Name: bridge.Name, VLANFiltering: true}
+	pb.step("create bridge %s with VLAN filtering", bridge.Name)
+	return bridge, nil
+}
+
+func (pb *planBackend) createSwitch(name string, stp bool, priority *int) (*netlink.Bridge, error) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)}}
+	pb.checkIfaceName(bridge.Name)
+	pb.bridges[bridge.Name] = &plannedBridge{Name: bridge.Name, STP: stp, Priority: priority}
+	switch {
+	case priority != nil:
+		pb.step("create bridge %s with STP enabled and priority %d", bridge.Name, *priority)
+	case stp:
+		pb.step("create bridge %s with STP enabled", bridge.Name)
+	default:
+		pb.step("create bridge %s", bridge.Name)
+	}
+	return bridge, nil
+}
+
+func (pb *planBackend) addPortVLAN(portName string, vlan int, access bool) error {
+	if access {
+		pb.step("make %s an access port for VLAN %d", portName, vlan)
+	} else {
+		pb.step("tag VLAN %d on trunk port %s", vlan, portName)
+	}
+	return nil
+}
+
+func (pb *planBackend) delPortVLAN(portName string, vlan int) error {
+	pb.step("untag VLAN %d on trunk port %s", vlan, portName)
+	return nil
+}
+
+func (pb *planBackend) addVLANIface(parent string, vlan, containerPID int) (netlink.Link, error) {
+	name := fmt.Sprintf("%s.%d", parent, vlan)
+	pb.checkIfaceName(name)
+	pb.step("create sub-interface %s for VLAN %d on container #%d", name, vlan, containerPID)
+	pb.namespace(containerPID)[name] = &ifaceState{Kind: "vlan", Addrs: []string{}}
+	return &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: name}, VlanId: vlan}, nil
+}
+
+func (pb *planBackend) removeVLANIface(name string, containerPID int) error {
+	pb.step("remove sub-interface %s on container #%d", name, containerPID)
+	delete(pb.namespace(containerPID), name)
+	return nil
+}
+
+func (pb *planBackend) createVethPair(name, peerName string) (*netlink.Veth, netlink.Link, netlink.Link, error) {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		PeerName:  peerName,
+	}
+	pb.checkIfaceName(veth.Name)
+	pb.checkIfaceName(veth.PeerName)
+	pb.step("create veth pair %s <-> %s", veth.Name, veth.PeerName)
+	pb.ifaces[0][veth.Name] = &ifaceState{Kind: "veth", Addrs: []string{}}
+	pb.ifaces[0][veth.PeerName] = &ifaceState{Kind: "veth", Addrs: []string{}}
+	pb.peers[veth.Name], pb.peers[veth.PeerName] = veth.PeerName, veth.Name
+	return veth, &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: veth.Name}},
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: veth.PeerName}}, nil
+}
+
+// where describes the namespace of the process whose PID is containerPID.
+func where(containerPID int) string {
+	if containerPID == 0 {
+		return "the host"
+	}
+	return fmt.Sprintf("container #%d", containerPID)
+}
+
+func (pb *planBackend) removeVeth(name string, containerPID int) error {
+	if containerPID == 0 {
+		pb.step("remove veth %s", name)
+	} else {
+		pb.step("remove veth %s on %s", name, where(containerPID))
+	}
+	pb.removeIface(name, containerPID)
+	return nil
+}
+
+// namespace returns the interfaces within the namespace of containerPID.
+func (pb *planBackend) namespace(containerPID int) map[string]*ifaceState {
+	if pb.ifaces[containerPID] == nil {
+		pb.ifaces[containerPID] = map[string]*ifaceState{}
+	}
+	return pb.ifaces[containerPID]
+}
+
+// removeIface removes name from the namespace of containerPID
+// and, as with any veth, its peer from wherever it is. The
+// routes through either go away with them.
+func (pb *planBackend) removeIface(name string, containerPID int) {
+	pb.flushRoutes(name, containerPID)
+	delete(pb.namespace(containerPID), name)
+	if peer, ok := pb.peers[name]; ok {
+		for pid, ifaces := range pb.ifaces {
+			pb.flushRoutes(peer, pid)
+			delete(ifaces, peer)
+		}
+		delete(pb.peers, name)
+		delete(pb.peers, peer)
+	}
+}
+
+// interfaces returns the interfaces the namespace of containerPID would have.
+// The host's include the bridges we'd create.
+func (pb *planBackend) interfaces(containerPID int) (map[string]ifaceState, error) {
+	ifaces := map[string]ifaceState{}
+	for name, iface := range pb.namespace(containerPID) {
+		ifaces[name] = ifaceState{Kind: iface.Kind, Master: iface.Master, Addrs: append([]string{}, iface.Addrs...)}
+	}
+	if containerPID == 0 {
+		for name, bridge := range pb.bridges {
+			ifaces[name] = ifaceState{Kind: "bridge", Addrs: []string{}}
+			if bridge.Address != "" {
+				ifaces[name] = ifaceState{Kind: "bridge", Addrs: []string{bridge.Address}}
+			}
+		}
+	}
+	return ifaces, nil
+}
+
+func (pb *planBackend) setLinkUp(name string, containerPID int, up bool) error {
+	state := "down"
+	if up {
+		state = "up"
+	}
+	if containerPID == 0 {
+		pb.step("set %s %s", name, state)
+	} else {
+		pb.step("set %s %s on %s", name, state, where(containerPID))
+	}
+	if !up {
+		pb.flushRoutes(name, containerPID)
+	}
+	return nil
+}
+
+// flushRoutes drops the routes of containerPID going through name,
+// which is what the kernel does when an interface goes down or away.
+func (pb *planBackend) flushRoutes(name string, containerPID int) {
+	iface, ok := pb.namespace(containerPID)[name]
+	if !ok {
+		return
+	}
+	kept := []routeInfo{}
+	for _, route := range pb.tables[containerPID] {
+		through := false
+		for _, addr := range iface.Addrs {
+			through = through || route.via(addr)
+		}
+		if !through {
+			kept = append(kept, route)
+		}
+	}
+	pb.tables[containerPID] = kept
+}
+
+func (pb *planBackend) impairLink(iface string, containerPID int, li *LinkImpairments, sp *ShapingPolicy) error {
+	where := where(containerPID)
+	if li == nil && sp == nil {
+		pb.step("remove the impairments on %s on %s", iface, where)
+		return nil
+	}
+	if li != nil {
+		if err := li.validate(); err != nil {
+			return err
+		}
+		pb.step("impair %s on %s: %s", iface, where, li)
+	}
+	if sp != nil {
+		if err := sp.validate(); err != nil {
+			return err
+		}
+		pb.step("shape %s on %s: %s", iface, where, sp)
+	}
+	return nil
+}
+
+func (pb *planBackend) mirrorPort(iface, dest string, both bool) error {
+	switch {
+	case dest == "":
+		pb.step("stop mirroring %s", iface)
+	case both:
+		pb.step("mirror what goes through %s to %s", iface, dest)
+	default:
+		pb.step("mirror what enters through %s to %s", iface, dest)
+	}
+	return nil
+}
+
+func (pb *planBackend) connectToBridge(vethEnd netlink.Link, bridge *netlink.Bridge) error {
+	pb.step("attach %s to bridge %s", vethEnd.Attrs().Name, bridge.Name)
+	if iface, ok := pb.ifaces[0][vethEnd.Attrs().Name]; ok {
+		iface.Master = bridge.Name
+	}
+	return nil
+}
+
+func (pb *planBackend) connectToContainer(vethEnd netlink.Link, containerPID int) error {
+	pb.step("move %s into the namespace of container #%d", vethEnd.Attrs().Name, containerPID)
+	if iface, ok := pb.ifaces[0][vethEnd.Attrs().Name]; ok {
+		pb.namespace(containerPID)[vethEnd.Attrs().Name] = iface
+		delete(pb.ifaces[0], vethEnd.Attrs().Name)
+	}
+	return nil
+}
+
+func (pb *planBackend) addressContainer(cidr string, iface netlink.Link, containerPID int) error {
+	pb.step("assign %s to %s on container #%d", cidr, iface.Attrs().Name, containerPID)
+	if planned, ok := pb.namespace(containerPID)[iface.Attrs().Name]; ok {
+		planned.Addrs = append(planned.Addrs, cidr)
+	}
+	// Just like the kernel, we get a route to the subnet out of it.
+	if _, subnet, err := net.ParseCIDR(cidr); err == nil {
+		pb.tables[containerPID] = append(pb.tables[containerPID], routeInfo{Dst: subnet.String()})
+	}
+	return nil
+}
+
+func (pb *planBackend) addRoute(route routeInfo, containerPID int) error {
+	pb.step("add route to %s through %s on container #%d", route.Dst, route.Gw, containerPID)
+	pb.tables[containerPID] = append(pb.tables[containerPID], route)
+	return nil
+}
+
+func (pb *planBackend) delRoute(route routeInfo, containerPID int) error {
+	pb.step("remove route to %s through %s on container #%d", route.Dst, route.Gw, containerPID)
+	pb.tables[containerPID] = removeRoute(pb.tables[containerPID], route)
+	return nil
+}
+
+// routes returns the routes the planned container would end up with.
+func (pb *planBackend) routes(containerPID int) ([]routeInfo, error) {
+	return append([]routeInfo{}, pb.tables[containerPID]...), nil
+}
+
+func (pb *planBackend) runContainer(img, name string, opts ContainerOptions) (string, int, error) {
+	pid := pb.nextPID
+	pb.nextPID++
+	planned := plannedContainer{Name: name, Image: img}
+	if !sameSettings(opts, ContainerOptions{}) {
+		planned.Options = &opts
+	}
+	pb.plan.Containers = append(pb.plan.Containers, planned)
+	pb.step("run container #%d %s from image %s", pid, name, img)
+	id := fmt.Sprintf("planned-%s", name)
+	pb.containers[id] = pid
+	return id, pid, nil
+}
+
+// removeContainer takes the container's namespace along
+// with it, just like removing the actual container would.
+func (pb *planBackend) removeContainer(id string) error {
+	pb.step("remove container %s", id)
+	if pid, ok := pb.containers[id]; ok {
+		for name := range pb.namespace(pid) {
+			pb.removeIface(name, pid)
+		}
+		delete(pb.ifaces, pid)
+		delete(pb.tables, pid)
+		delete(pb.firewalls, pid)
+		delete(pb.containers, id)
+	}
+	return nil
+}
+
+// inspectContainer finds planned containers running just as they were started.
+func (pb *planBackend) inspectContainer(id string) (containerStatus, error) {
+	pid, ok := pb.containers[id]
+	if !ok {
+		return containerStatus{State: "missing"}, nil
+	}
+	return containerStatus{State: "running", PID: pid}, nil
+}
+
+func (pb *planBackend) natOut(cidr string) error {
+	pb.plan.NAT = append(pb.plan.NAT, cidr)
+	pb.step("masquerade traffic coming from %s", cidr)
+	return nil
+}
+
+func (pb *planBackend) restoreNAT(cidr string) error {
+	pb.step("stop masquerading traffic coming from %s", cidr)
+	return nil
+}
+
+func (pb *planBackend) enableForwarding(hopBridgeName string) error {
+	pb.plan.Forwarding = append(pb.plan.Forwarding, hopBridgeName)
+	pb.step("forward traffic going through %s", hopBridgeName)
+	return nil
+}
+
+func (pb *planBackend) restoreForwarding(hopBridgeName string) error {
+	pb.step("stop forwarding traffic going through %s", hopBridgeName)
+	return nil
+}
+
+func (pb *planBackend) installFWRules(containerPID int, policy string, specs [][]string) error {
+	pb.step("install %d firewall rules with policy %s on container #%d", len(specs), policy, containerPID)
+	pb.firewalls[containerPID] = plannedFirewall{Policy: policy, Rules: specs}
+	return nil
+}
+
+// fwRules returns the firewall rules installed on the planned container, if any.
+func (pb *planBackend) fwRules(containerPID int) (string, [][]string, error) {
+	fw, ok := pb.firewalls[containerPID]
+	if !ok {
+		return "ACCEPT", [][]string{}, nil
+	}
+	return fw.Policy, append([][]string{}, fw.Rules...), nil
+}
+
+// openCapture returns a source which never reads anything: plans carry no traffic.
+func (pb *planBackend) openCapture(iface string, containerPID int, filter []bpf.RawInstruction) (packetSource, error) {
+	pb.step("capture on %s with %d filter instructions", iface, len(filter))
+	return idleSource{}, nil
+}
+
+// ifaceStats returns no counters: planned interfaces don't exist.
+func (pb *planBackend) ifaceStats(containerPID int) (map[string]ifaceStats, error) {
+	return map[string]ifaceStats{}, nil
+}
+
+// probe never gets an answer: plans carry no traffic.
+func (pb *planBackend) probe(containerPID int, target probeTarget, timeout time.Duration) (time.Duration, error) {
+	return 0, errors.New("planned networks carry no traffic")
+}
+
+// traceroute never gets anywhere either.
+func (pb *planBackend) traceroute(containerPID int, addr string, maxHops int, timeout time.Duration) ([]string, error) {
+	return nil, errors.New("planned networks carry no traffic")
+}
+
+type idleSource struct{}
+
+func (idleSource) readPacket(buf []byte) (capturedPacket, error) {
+	time.Sleep(captureReadTimeout)
+	return capturedPacket{}, errCaptureTimeout
+}
+
+func (idleSource) close() error {
+	return nil
+}
+
+// PlanNetwork works out what bringing up the network defined at defPath
+// would do without touching the host at all.
+func PlanNetwork(defPath string) (*NetworkPlan, error) {
+	ns, backend, err := planState(defPath)
+	if err != nil {
+		return nil, err
+	}
+	return backend.finish(ns, ns.Definition), nil
+}
+
+// planState builds the network defined at defPath through a planBackend,
+// returning the state it'd have once brought up.
+func planState(defPath string) (*NetworkState, *planBackend, error) {
+	netDefinition, err := loadDef(defPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't load the network definition: %w", err)
+	}
+
+	netGraph, err := genGraph(netDefinition)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backend := newPlanBackend()
+	ns := newNetworkState(backend, globalOpts{netDefPath: defPath})
+
+	if _, err := systemSetup(backend); err != nil {
+		return nil, nil, err
+	}
+	if err := buildNetwork(ns, netDefinition, netGraph); err != nil {
+		return nil, nil, err
+	}
+	return ns, backend, nil
+}
+
+// finish fills in what can only be known once the whole network has been built.
+func (pb *planBackend) finish(ns *NetworkState, def netDef) *NetworkPlan {
+	plan := pb.plan
+	plan.Name = def.Name
+
+	for _, bridge := range pb.bridges {
+		plan.Bridges = append(plan.Bridges, *bridge)
+	}
+	sort.Slice(plan.Bridges, func(i, j int) bool { return plan.Bridges[i].Name < plan.Bridges[j].Name })
+	sort.Slice(plan.Containers, func(i, j int) bool { return plan.Containers[i].Name < plan.Containers[j].Name })
+
+	for _, link := range ns.Links {
+		plan.Links = append(plan.Links, link)
+	}
+	sort.Slice(plan.Links, func(i, j int) bool {
+		return linkKey(plan.Links[i].Node, plan.Links[i].Subnet) < linkKey(plan.Links[j].Node, plan.Links[j].Subnet)
+	})
+
+	for node, routes := range ns.Routes {
+		plan.Routes[node] = routes
+	}
+
+	for routerName, specs := range ns.FWRules {
+		policy := strings.ToUpper(def.Routers[routerName].FWRules.Policy)
+		if policy == "" {
+			policy = "ACCEPT"
+		}
+		plan.Firewalls[routerName] = plannedFirewall{Policy: policy, Rules: specs}
+	}
+
+	return plan
+}
+
+// WriteJSON dumps the plan as an indented JSON document.
+func (plan *NetworkPlan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(plan)
+}
+
+// WriteText dumps the plan in a format meant for humans.
+func (plan *NetworkPlan) WriteText(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Plan for network %q\n", plan.Name)
+
+	fmt.Fprintf(&b, "\nSysctls:\n")
+	for _, s := range plan.Sysctls {
+		fmt.Fprintf(&b, "\t%s: %s -> %s\n", s.Name, s.From, s.To)
+	}
+
+	fmt.Fprintf(&b, "\nBridges:\n")
+	for _, bridge := range plan.Bridges {
+		switch {
+		case bridge.Address != "":
+			fmt.Fprintf(&b, "\t%s (%s)\n", bridge.Name, bridge.Address)
+		case bridge.VLANFiltering:
+			fmt.Fprintf(&b, "\t%s (VLAN filtering)\n", bridge.Name)
+		case bridge.OVS != nil && len(bridge.OVS.Controllers) != 0:
+			fmt.Fprintf(&b, "\t%s (Open vSwitch, controllers %s)\n", bridge.Name, strings.Join(bridge.OVS.Controllers, ", "))
+		case bridge.OVS != nil:
+			fmt.Fprintf(&b, "\t%s (Open vSwitch)\n", bridge.Name)
+		case bridge.Priority != nil:
+			fmt.Fprintf(&b, "\t%s (STP, priority %d)\n", bridge.Name, *bridge.Priority)
+		case bridge.STP:
+			fmt.Fprintf(&b, "\t%s (STP)\n", bridge.Name)
+		default:
+			fmt.Fprintf(&b, "\t%s\n", bridge.Name)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nContainers:\n")
+	for _, c := range plan.Containers {
+		if c.Options != nil {
+			fmt.Fprintf(&b, "\t%s: %s (%s)\n", c.Name, c.Image, describeOptions(*c.Options))
+		} else {
+			fmt.Fprintf(&b, "\t%s: %s\n", c.Name, c.Image)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nInterfaces:\n")
+	for _, link := range plan.Links {
+		if link.Peer != "" {
+			fmt.Fprintf(&b, "\t%s on %s: %s (peer %s) %s\n", link.Node, link.Subnet, link.NodeEnd, link.Peer, link.CIDR)
+		} else {
+			fmt.Fprintf(&b, "\t%s on %s: %s (bridge end %s) %s\n", link.Node, link.Subnet, link.NodeEnd, link.BridgeEnd, link.CIDR)
+		}
+		if link.Impairments != nil {
+			fmt.Fprintf(&b, "\t\timpaired with %s\n", link.Impairments)
+		}
+		if link.Shaping != nil {
+			fmt.Fprintf(&b, "\t\tshaped with %s\n", link.Shaping)
+		}
+		if link.Mirror != nil {
+			fmt.Fprintf(&b, "\t\tmirrored to %s\n", link.Mirror.To)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nRoutes:\n")
+	for _, node := range sortedKeys(plan.Routes) {
+		for _, route := range plan.Routes[node] {
+			fmt.Fprintf(&b, "\t%s: %s via %s\n", node, route.Dst, route.Gw)
+		}
+	}
+
+	fmt.Fprintf(&b, "\nFirewalls:\n")
+	for _, routerName := range sortedKeys(plan.Firewalls) {
+		fw := plan.Firewalls[routerName]
+		fmt.Fprintf(&b, "\t%s: iptables -P FORWARD %s\n", routerName, fw.Policy)
+		for _, spec := range fw.Rules {
+			fmt.Fprintf(&b, "\t%s: iptables -A %s\n", routerName, strings.Join(spec, " "))
+		}
+	}
+
+	if len(plan.NAT) > 0 || len(plan.Forwarding) > 0 {
+		fmt.Fprintf(&b, "\nHost iptables:\n")
+		for _, cidr := range plan.NAT {
+			fmt.Fprintf(&b, "\t-t nat -I POSTROUTING -s %s -j MASQUERADE\n", cidr)
+		}
+		for _, bridge := range plan.Forwarding {
+			fmt.Fprintf(&b, "\t-I FORWARD -i %s -j ACCEPT\n\t-I FORWARD -o %s -j ACCEPT\n", bridge, bridge)
+		}
+	}
+
+	if len(plan.Warnings) > 0 {
+		fmt.Fprintf(&b, "\nWarnings:\n")
+		for _, warning := range plan.Warnings {
+			fmt.Fprintf(&b, "\t%s\n", warning)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// describeOptions tells in a few words how a container is tuned.
+func describeOptions(opts ContainerOptions) string {
+	described := []string{}
+	if len(opts.Entrypoint) > 0 {
+		described = append(described, "entrypoint "+strings.Join(opts.Entrypoint, " "))
+	}
+	if len(opts.Command) > 0 {
+		described = append(described, "command "+strings.Join(opts.Command, " "))
+	}
+	if len(opts.Env) > 0 {
+		described = append(described, fmt.Sprintf("%d environment variables", len(opts.Env)))
+	}
+	for _, volume := range opts.Volumes {
+		described = append(described, "volume "+volume)
+	}
+	if opts.CPUs > 0 {
+		described = append(described, fmt.Sprintf("%g CPUs", opts.CPUs))
+	}
+	if opts.Memory != "" {
+		described = append(described, opts.Memory+" of memory")
+	}
+	if opts.Privileged {
+		described = append(described, "privileged")
+	}
+	if len(opts.CapAdd) > 0 {
+		described = append(described, "capabilities "+strings.Join(opts.CapAdd, ", "))
+	}
+	for _, name := range sortedKeys(opts.Sysctls) {
+		described = append(described, fmt.Sprintf("%s = %s", name, opts.Sysctls[name]))
+	}
+	if opts.WorkDir != "" {
+		described = append(described, "in "+opts.WorkDir)
+	}
+	return strings.Join(described, "; ")
+}
@@ -0,0 +1,191 @@
+package dvnet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPlanNetwork(t *testing.T) {
+	plan, err := PlanNetwork("../demos/quagga/net.json")
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+
+	gotBridges := []string{}
+	for _, bridge := range plan.Bridges {
+		gotBridges = append(gotBridges, bridge.Name)
+	}
+	if want := []string{"dvn-a", "dvn-b", "dvn-c", "dvn-dvhop"}; !cmp.Equal(gotBridges, want) {
+		t.Errorf("PlanNetwork() bridges = %v; wanted %v", gotBridges, want)
+	}
+
+	wantContainers := []plannedContainer{
+		{"A-1", "pcollado/dhost", nil}, {"A-2", "pcollado/dhost", nil}, {"B-1", "pcollado/dhost", nil},
+		{"B-2", "pcollado/dhost", nil}, {"R-1", "pcollado/drouter", nil}, {"R-2", "pcollado/drouter", nil},
+	}
+	if !cmp.Equal(plan.Containers, wantContainers) {
+		t.Errorf("PlanNetwork() containers = %v; wanted %v", plan.Containers, wantContainers)
+	}
+
+	// 4 hosts and 4 router attachments plus a link to the outbound subnet for each of the 6 nodes.
+	if len(plan.Links) != 14 {
+		t.Errorf("PlanNetwork() planned %d links; wanted 14", len(plan.Links))
+	}
+	for node, routes := range plan.Routes {
+		if len(routes) != 1 || routes[0] != (routeInfo{Dst: defaultRoute, Gw: "192.168.240.1"}) {
+			t.Errorf("PlanNetwork() routes for %s = %v; wanted just the default one", node, routes)
+		}
+	}
+	if !cmp.Equal(plan.NAT, []string{"192.168.240.0/24"}) {
+		t.Errorf("PlanNetwork() NAT = %v; wanted [192.168.240.0/24]", plan.NAT)
+	}
+	if len(plan.Warnings) != 0 {
+		t.Errorf("PlanNetwork() warnings = %v; wanted none", plan.Warnings)
+	}
+}
+
+func TestPlanNetworkLongNames(t *testing.T) {
+	defPath := filepath.Join(t.TempDir(), "net.json")
+	rawDef := `{
+		"name": "Long Names",
+		"subnets": {"A": {"cidr": "10.0.0.0/24", "hosts": {"a-very-long-host-name": {"image": "pcollado/dhost"}}}},
+		"routers": {}
+	}`
+	if err := os.WriteFile(defPath, []byte(rawDef), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanNetwork(defPath)
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+	if len(plan.Warnings) != 2 {
+		t.Errorf("PlanNetwork() warnings = %v; wanted one per veth end", plan.Warnings)
+	}
+}
+
+func TestPlanP2PNetwork(t *testing.T) {
+	plan, err := PlanNetwork("../demos/p2p/net.json")
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+
+	gotBridges := []string{}
+	for _, bridge := range plan.Bridges {
+		gotBridges = append(gotBridges, bridge.Name)
+	}
+	if want := []string{"dvn-a", "dvn-b", "dvn-dvhop"}; !cmp.Equal(gotBridges, want) {
+		t.Errorf("PlanNetwork() bridges = %v; wanted %v", gotBridges, want)
+	}
+
+	gotP2P := []linkInfo{}
+	for _, link := range plan.Links {
+		if link.Subnet == "C" {
+			gotP2P = append(gotP2P, link)
+		}
+	}
+	wantP2P := []linkInfo{
+		{Node: "R-1", Subnet: "C", NodeEnd: "ethr-1-c", Peer: "R-2", CIDR: "10.0.2.0/31"},
+		{Node: "R-2", Subnet: "C", NodeEnd: "ethr-2-c", Peer: "R-1", CIDR: "10.0.2.1/31"},
+	}
+	if diff := cmp.Diff(wantP2P, gotP2P); diff != "" {
+		t.Errorf("PlanNetwork() point-to-point links mismatch (-want +got):\n%s", diff)
+	}
+	if !contains(plan.Steps, "create veth pair ethr-1-c <-> ethr-2-c") {
+		t.Errorf("PlanNetwork() should join R-1 and R-2 through a single veth pair")
+	}
+}
+
+func TestPlanVLANNetwork(t *testing.T) {
+	plan, err := PlanNetwork("../demos/vlan/net.json")
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+
+	if want := []plannedBridge{{Name: "dvn-trunk", VLANFiltering: true}}; !cmp.Equal(plan.Bridges, want) {
+		t.Errorf("PlanNetwork() bridges = %v; wanted %v", plan.Bridges, want)
+	}
+
+	wantSteps := []string{
+		"make bth-a-1 an access port for VLAN 10",
+		"make bth-b-2 an access port for VLAN 20",
+		"tag VLAN 10 on trunk port bth-r-1-trunk",
+		"tag VLAN 20 on trunk port bth-r-1-trunk",
+	}
+	for _, step := range wantSteps {
+		if !contains(plan.Steps, step) {
+			t.Errorf("PlanNetwork() should %q", step)
+		}
+	}
+	trunkPorts := 0
+	for _, step := range plan.Steps {
+		if step == "create veth pair bth-r-1-trunk <-> ethr-1-trunk" {
+			trunkPorts++
+		}
+	}
+	if trunkPorts != 1 {
+		t.Errorf("PlanNetwork() created %d trunk ports for R-1; wanted 1", trunkPorts)
+	}
+
+	for _, link := range plan.Links {
+		if link.Node != "R-1" {
+			continue
+		}
+		if want := "ethr-1-trunk." + map[string]string{"A": "10", "B": "20"}[link.Subnet]; link.NodeEnd != want || !link.Trunk {
+			t.Errorf("PlanNetwork() R-1's link to %s = %+v; wanted it on trunk sub-interface %s", link.Subnet, link, want)
+		}
+	}
+}
+
+func TestPlanSwitchedNetwork(t *testing.T) {
+	plan, err := PlanNetwork("../demos/switches/net.json")
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+
+	priority := func(p int) *int { return &p }
+	wantBridges := []plannedBridge{
+		{Name: "dvn-b"},
+		{Name: "dvn-sw-1", STP: true, Priority: priority(4096)},
+		{Name: "dvn-sw-2", STP: true, Priority: priority(8192)},
+		{Name: "dvn-sw-3", STP: true},
+	}
+	if !cmp.Equal(plan.Bridges, wantBridges) {
+		t.Errorf("PlanNetwork() bridges = %v; wanted %v", plan.Bridges, wantBridges)
+	}
+
+	wantSteps := []string{
+		"create veth pair sw-sw-1-sw-2 <-> sw-sw-2-sw-1",
+		"create veth pair sw-sw-1-sw-3 <-> sw-sw-3-sw-1",
+		"create veth pair sw-sw-2-sw-3 <-> sw-sw-3-sw-2",
+		"attach bth-a-2 to bridge dvn-sw-2",
+		"attach bth-r-1-a to bridge dvn-sw-1",
+	}
+	for _, step := range wantSteps {
+		if !contains(plan.Steps, step) {
+			t.Errorf("PlanNetwork() should %q", step)
+		}
+	}
+
+	for _, link := range plan.Links {
+		if link.Subnet == "A" && link.Switch == "" {
+			t.Errorf("PlanNetwork() %s isn't plugged into a switch on A", link.Node)
+		}
+	}
+
+	// Switches are left out of the routes: A-3 reaches B through R-1 even
+	// though it has to go through SW-3 and SW-1 to get there.
+	var r1Addr string
+	for _, link := range plan.Links {
+		if link.Node == "R-1" && link.Subnet == "A" {
+			r1Addr = strings.Split(link.CIDR, "/")[0]
+		}
+	}
+	if want := (routeInfo{Dst: "10.0.20.0/24", Gw: r1Addr}); !containsRoute(plan.Routes["A-3"], want) {
+		t.Errorf("PlanNetwork() A-3 routes = %v; wanted %v among them", plan.Routes["A-3"], want)
+	}
+}
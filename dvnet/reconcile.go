@@ -0,0 +1,396 @@
+package dvnet
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+
+	"github.com/RyanCarrier/dijkstra"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// nodeRef identifies a node (i.e. a host or a router) on a given subnet.
+type nodeRef struct {
+	Subnet string
+	Node   string
+}
+
+// defDiff is what needs to change for a running network to match a
+// new definition. Hosts and attachments belonging to removed subnets
+// or routers are implicitly included in those removals.
+type defDiff struct {
+	removedSubnets  []string
+	addedSubnets    []string
+	removedHosts    []nodeRef
+	addedHosts      []nodeRef
+	removedRouters  []string
+	addedRouters    []string
+	detachedRouters []nodeRef
+	attachedRouters []nodeRef
+	changedFWRules  []string
+}
+
+// nodesChanged tells whether any node comes or goes, in
+// which case firewall rules might resolve differently.
+func (dd defDiff) nodesChanged() bool {
+	return len(dd.removedSubnets)+len(dd.addedSubnets)+len(dd.removedHosts)+len(dd.addedHosts)+
+		len(dd.removedRouters)+len(dd.addedRouters)+len(dd.detachedRouters)+len(dd.attachedRouters) > 0
+}
+
+func (dd defDiff) String() string {
+	return fmt.Sprintf("subnets -%v +%v; hosts -%v +%v; routers -%v +%v; attachments -%v +%v; firewalls ~%v",
+		dd.removedSubnets, dd.addedSubnets, dd.removedHosts, dd.addedHosts, dd.removedRouters,
+		dd.addedRouters, dd.detachedRouters, dd.attachedRouters, dd.changedFWRules)
+}
+
+// diffState compares what's running as described by ns against newDef. Which
+// nodes and links exist comes from ns itself so that we can pick up after a
+// partially failed reconciliation; their settings come from the definition
+// they were created with. Subnets changing their CIDR block, type, VLAN or
+// OVS settings, nodes changing their image or switch and routers changing
+// how they attach to VLANs are replaced altogether.
+func diffState(ns *NetworkState, newDef netDef) defDiff {
+	oldDef := ns.Definition
+	dd := defDiff{}
+
+	recreatedSubnets := map[string]bool{}
+	for subnetName := range ns.Subnets {
+		if subnetName == outboundSubnetName {
+			continue
+		}
+		newSubnet, ok := newDef.Subnets[subnetName]
+		if !ok || subnetChanged(ns, subnetName, newSubnet) {
+			dd.removedSubnets = append(dd.removedSubnets, subnetName)
+			recreatedSubnets[subnetName] = ok
+			continue
+		}
+		for host := range ns.Subnets[subnetName].Containers {
+			newHost, ok := newSubnet.Hosts[host]
+			if !ok || hostChanged(oldDef.Subnets[subnetName].Hosts, host, newHost) {
+				dd.removedHosts = append(dd.removedHosts, nodeRef{subnetName, host})
+			}
+		}
+	}
+
+	for subnetName, newSubnet := range newDef.Subnets {
+		if _, ok := ns.Subnets[subnetName]; !ok || recreatedSubnets[subnetName] {
+			dd.addedSubnets = append(dd.addedSubnets, subnetName)
+			continue
+		}
+		for host, newHost := range newSubnet.Hosts {
+			_, running := ns.Subnets[subnetName].Containers[host]
+			if !running || hostChanged(oldDef.Subnets[subnetName].Hosts, host, newHost) {
+				dd.addedHosts = append(dd.addedHosts, nodeRef{subnetName, host})
+			}
+		}
+	}
+
+	for routerName := range ns.Routers {
+		newRouter, ok := newDef.Routers[routerName]
+		oldRouter, known := oldDef.Routers[routerName]
+		if !ok || (known && routerChanged(oldRouter, newRouter)) {
+			dd.removedRouters = append(dd.removedRouters, routerName)
+			if ok {
+				dd.addedRouters = append(dd.addedRouters, routerName)
+			}
+			continue
+		}
+
+		wantedSubnets := map[string]bool{}
+		for _, subnetName := range newRouter.Subnets {
+			wantedSubnets[subnetName] = true
+		}
+		for _, link := range ns.Links {
+			if link.Node != routerName || link.Subnet == outboundSubnetName {
+				continue
+			}
+			if _, recreated := recreatedSubnets[link.Subnet]; recreated || !wantedSubnets[link.Subnet] {
+				dd.detachedRouters = append(dd.detachedRouters, nodeRef{link.Subnet, routerName})
+			}
+		}
+		for _, subnetName := range newRouter.Subnets {
+			_, attached := ns.Links[linkKey(routerName, subnetName)]
+			if _, recreated := recreatedSubnets[subnetName]; recreated || !attached {
+				dd.attachedRouters = append(dd.attachedRouters, nodeRef{subnetName, routerName})
+			}
+		}
+
+		if known && !reflect.DeepEqual(oldRouter.FWRules, newRouter.FWRules) {
+			dd.changedFWRules = append(dd.changedFWRules, routerName)
+		}
+	}
+
+	for routerName := range newDef.Routers {
+		if _, ok := ns.Routers[routerName]; !ok {
+			dd.addedRouters = append(dd.addedRouters, routerName)
+		}
+	}
+
+	dd.sort()
+	return dd
+}
+
+// subnetChanged tells whether the live subnetName can't be turned into newSubnet in place.
+func subnetChanged(ns *NetworkState, subnetName string, newSubnet subnetDef) bool {
+	live := ns.Subnets[subnetName]
+	liveCIDR := ns.Addressers[subnetName].cidrBlock
+	if liveCIDR.String() != newSubnet.CIDRBlock.String() || live.P2P != newSubnet.isP2P() {
+		return true
+	}
+	if live.VLAN != newSubnet.VLAN || !sameSettings(live.OVS, newSubnet.OVS) {
+		return true
+	}
+	return live.VLAN != 0 && live.Trunk != newSubnet.trunk()
+}
+
+// hostChanged tells whether host must be replaced to become newHost.
+func hostChanged(oldHosts map[string]HostDef, host string, newHost HostDef) bool {
+	oldHost, known := oldHosts[host]
+	return known && (oldHost.Image != newHost.Image || oldHost.Switch != newHost.Switch ||
+		!sameSettings(oldHost.ContainerOptions, newHost.ContainerOptions))
+}
+
+// sameSettings tells whether two bits of a definition are equivalent. Empty and nil
+// slices and maps are: omitempty turns the former into the latter in the store.
+func sameSettings(x, y interface{}) bool {
+	return cmp.Equal(x, y, cmpopts.EquateEmpty())
+}
+
+// routerChanged tells whether oldRouter must be replaced to become newRouter.
+func routerChanged(oldRouter, newRouter routerDef) bool {
+	return oldRouter.Image != newRouter.Image || oldRouter.TrunkPorts != newRouter.TrunkPorts ||
+		!sameSettings(oldRouter.Switches, newRouter.Switches) ||
+		!sameSettings(oldRouter.ContainerOptions, newRouter.ContainerOptions)
+}
+
+// sort makes diffs deterministic so that they're easy to read and test.
+func (dd defDiff) sort() {
+	for _, names := range [][]string{dd.removedSubnets, dd.addedSubnets, dd.removedRouters, dd.addedRouters, dd.changedFWRules} {
+		sort.Strings(names)
+	}
+	for _, refs := range [][]nodeRef{dd.removedHosts, dd.addedHosts, dd.detachedRouters, dd.attachedRouters} {
+		sort.Slice(refs, func(i, j int) bool {
+			if refs[i].Subnet != refs[j].Subnet {
+				return refs[i].Subnet < refs[j].Subnet
+			}
+			return refs[i].Node < refs[j].Node
+		})
+	}
+}
+
+// ReconcileNetwork brings the network identified by networkID in line with the
+// definition at defPath (or the one it was created with if defPath is empty)
+// touching only what changed: untouched nodes are left running as they are.
+func (d Driver) ReconcileNetwork(networkID, defPath string) error {
+	return d.alterNetwork(networkID, func(ns *NetworkState) error {
+		if defPath == "" {
+			defPath = ns.DefPath
+		}
+
+		newDef, err := loadDef(defPath)
+		if err != nil {
+			return fmt.Errorf("couldn't load the network definition: %w", err)
+		}
+
+		if err := reconcileNetwork(ns, newDef); err != nil {
+			return err
+		}
+		ns.DefPath = defPath
+		return nil
+	})
+}
+
+func reconcileNetwork(ns *NetworkState, newDef netDef) error {
+	// Compare the hop CIDR as a string: its IP comes back 16 bytes long after a trip through the store.
+	oldOutbound, newOutbound := ns.Definition.OutboundAccess, newDef.OutboundAccess
+	if oldOutbound.Enabled != newOutbound.Enabled || oldOutbound.HopCIDR.String() != newOutbound.HopCIDR.String() {
+		return fmt.Errorf("changing the outbound access settings requires recreating the network")
+	}
+	if !sameSettings(ns.Definition.Switches, newDef.Switches) {
+		return fmt.Errorf("changing the switches requires recreating the network")
+	}
+
+	// Check the new topology makes sense before touching anything.
+	netGraph, err := genGraph(newDef)
+	if err != nil {
+		return err
+	}
+
+	dd := diffState(ns, newDef)
+	log.debug("reconciling network %s: %s\n", newDef.Name, dd)
+
+	for _, ref := range dd.detachedRouters {
+		if err := detachRouter(ns, ref.Node, ref.Subnet); err != nil {
+			return err
+		}
+	}
+	for _, routerName := range dd.removedRouters {
+		if err := removeRouter(ns, routerName); err != nil {
+			return err
+		}
+	}
+	for _, ref := range dd.removedHosts {
+		if err := removeHost(ns, ref.Subnet, ref.Node); err != nil {
+			return err
+		}
+	}
+	for _, subnetName := range dd.removedSubnets {
+		if err := removeSubnet(ns, subnetName); err != nil {
+			return err
+		}
+	}
+
+	newNodes := []string{}
+	for _, subnetName := range dd.addedSubnets {
+		if err := createSubnet(ns, subnetName, newDef.Subnets[subnetName]); err != nil {
+			return err
+		}
+		for host := range newDef.Subnets[subnetName].Hosts {
+			newNodes = append(newNodes, host)
+		}
+	}
+	for _, ref := range dd.addedHosts {
+		if err := addHost(ns, ref.Subnet, ref.Node, newDef.Subnets[ref.Subnet].Hosts[ref.Node]); err != nil {
+			return err
+		}
+		newNodes = append(newNodes, ref.Node)
+	}
+	for _, routerName := range dd.addedRouters {
+		if err := createRouter(ns, routerName, newDef.Routers[routerName]); err != nil {
+			return err
+		}
+		newNodes = append(newNodes, routerName)
+	}
+	for _, ref := range dd.attachedRouters {
+		if err := attachRouter(ns, ref.Node, ref.Subnet, newDef.Routers[ref.Node]); err != nil {
+			return err
+		}
+	}
+	if err := connectP2PSubnets(ns, newDef); err != nil {
+		return err
+	}
+
+	if newDef.OutboundAccess.Enabled {
+		for _, node := range newNodes {
+			if err := connectOutbound(ns, node); err != nil {
+				return err
+			}
+		}
+	}
+
+	for routerName, routerDef := range newDef.Routers {
+		if dd.nodesChanged() || contains(dd.changedFWRules, routerName) || contains(dd.addedRouters, routerName) {
+			if err := applyFWRules(ns, routerName, routerDef.FWRules); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := reconcileRoutes(ns, newDef, netGraph); err != nil {
+		return err
+	}
+
+	if err := applyImpairments(ns, newDef); err != nil {
+		return err
+	}
+
+	if err := applyMirrors(ns, newDef); err != nil {
+		return err
+	}
+
+	ns.Definition = newDef
+	return nil
+}
+
+// desiredRoutes computes the routes every node should have according to def.
+func desiredRoutes(ns *NetworkState, def netDef, netGraph *dijkstra.Graph) (map[string][]routeInfo, error) {
+	desired := map[string][]routeInfo{}
+
+	if def.AutomaticRouting {
+		for subnetName, subnetDef := range def.Subnets {
+			if len(subnetDef.Hosts) == 0 {
+				continue
+			}
+			routes, err := findSubnetRoutes(netGraph, def, subnetDef)
+			if err != nil {
+				return nil, err
+			}
+			for host := range subnetDef.Hosts {
+				for _, route := range routes {
+					gwIP := ns.Addressers[subnetName].AssignedIPs[route.rawPath[0]]
+					desired[host] = append(desired[host], routeInfo{Dst: route.destCIDR.String(), Gw: gwIP.String()})
+				}
+			}
+		}
+	}
+
+	if def.OutboundAccess.Enabled {
+		hopBrdIP := ns.Addressers[outboundSubnetName].AssignedIPs[defaultGatewayName]
+		for _, link := range ns.Links {
+			if link.Subnet == outboundSubnetName {
+				desired[link.Node] = append(desired[link.Node], routeInfo{Dst: defaultRoute, Gw: hopBrdIP.String()})
+			}
+		}
+	}
+
+	return desired, nil
+}
+
+// reconcileRoutes removes the routes we installed that are no longer
+// wanted before adding the ones that are missing.
+func reconcileRoutes(ns *NetworkState, def netDef, netGraph *dijkstra.Graph) error {
+	desired, err := desiredRoutes(ns, def, netGraph)
+	if err != nil {
+		return err
+	}
+
+	for node, installed := range ns.Routes {
+		for _, route := range installed {
+			if containsRoute(desired[node], route) {
+				continue
+			}
+			if err := uninstallRoute(ns, node, route); err != nil {
+				log.warn("couldn't remove route to %s through %s on %s: %v\n", route.Dst, route.Gw, node, err)
+				ns.Routes[node] = removeRoute(ns.Routes[node], route)
+			}
+		}
+	}
+
+	for node, routes := range desired {
+		for _, route := range routes {
+			if containsRoute(ns.Routes[node], route) {
+				continue
+			}
+			if err := installRoute(ns, node, route); err != nil {
+				return fmt.Errorf("couldn't add route to %s through %s on %s: %w", route.Dst, route.Gw, node, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// watchReloads reconciles every network against its definition whenever we
+// get a SIGHUP, which is what `systemctl reload dvnet` ends up sending.
+func (d Driver) watchReloads() {
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	for range reloads {
+		networkIDs, err := d.store.ids()
+		if err != nil {
+			log.error("couldn't list the networks we manage: %v\n", err)
+			continue
+		}
+		for _, networkID := range networkIDs {
+			log.info("reloading the definition of network %s\n", networkID)
+			if err := d.ReconcileNetwork(networkID, ""); err != nil {
+				log.error("couldn't reconcile network %s: %v\n", networkID, err)
+			}
+		}
+	}
+}
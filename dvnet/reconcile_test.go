@@ -0,0 +1,273 @@
+package dvnet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var reconcileBaseDef = `{
+	"name": "Reconcile Net",
+	"subnets": {
+		"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "pcollado/dhost"}, "A-2": {"image": "pcollado/dhost"}}},
+		"B": {"cidr": "10.0.1.0/24", "hosts": {"B-1": {"image": "pcollado/dhost"}}}
+	},
+	"routers": {
+		"R-1": {"subnets": ["A", "B"], "image": "pcollado/drouter"},
+		"R-2": {"subnets": ["B"], "image": "pcollado/drouter"}
+	}
+}`
+
+// liveState mimics the state CreateNetwork would have built for def
+// without needing to touch the host at all.
+func liveState(t *testing.T, rawDef string) *NetworkState {
+	def, err := parseDef([]byte(rawDef))
+	if err != nil {
+		t.Fatalf("couldn't parse the base definition: %v", err)
+	}
+	ns := &NetworkState{
+		Subnets:    map[string]SubnetResources{},
+		Addressers: map[string]subnetAddresser{},
+		Routers:    map[string]containerInfo{},
+		Links:      map[string]linkInfo{},
+		Routes:     map[string][]routeInfo{},
+		Definition: def,
+	}
+	for subnetName, subnet := range def.Subnets {
+		addresser, _ := newSubnetAddresser(ns, subnetName, subnet.CIDRBlock)
+		ns.Subnets[subnetName] = SubnetResources{Containers: map[string]containerInfo{}}
+		for host := range subnet.Hosts {
+			ns.Subnets[subnetName].Containers[host] = containerInfo{}
+			ns.Links[linkKey(host, subnetName)] = linkInfo{Node: host, Subnet: subnetName, CIDR: addresser.nextCIDR(host)}
+		}
+	}
+	for routerName, router := range def.Routers {
+		ns.Routers[routerName] = containerInfo{}
+		for _, subnetName := range router.Subnets {
+			ns.Links[linkKey(routerName, subnetName)] = linkInfo{
+				Node: routerName, Subnet: subnetName, CIDR: ns.Addressers[subnetName].nextCIDR(routerName)}
+		}
+	}
+	return ns
+}
+
+func TestDiffState(t *testing.T) {
+	tests := []struct {
+		name   string
+		newDef string
+		want   defDiff
+	}{
+		{"unchanged", reconcileBaseDef, defDiff{}},
+		{
+			"hosts added, removed and replaced",
+			`{
+				"name": "Reconcile Net",
+				"subnets": {
+					"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "pcollado/dhost"}, "A-3": {"image": "pcollado/dhost"}}},
+					"B": {"cidr": "10.0.1.0/24", "hosts": {"B-1": {"image": "pcollado/other"}}}
+				},
+				"routers": {
+					"R-1": {"subnets": ["A", "B"], "image": "pcollado/drouter"},
+					"R-2": {"subnets": ["B"], "image": "pcollado/drouter"}
+				}
+			}`,
+			defDiff{
+				removedHosts: []nodeRef{{"A", "A-2"}, {"B", "B-1"}},
+				addedHosts:   []nodeRef{{"A", "A-3"}, {"B", "B-1"}},
+			},
+		},
+		{
+			"subnet added, subnet readdressed and attachments moved",
+			`{
+				"name": "Reconcile Net",
+				"subnets": {
+					"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "pcollado/dhost"}, "A-2": {"image": "pcollado/dhost"}}},
+					"B": {"cidr": "10.0.9.0/24", "hosts": {"B-1": {"image": "pcollado/dhost"}}},
+					"C": {"cidr": "10.0.2.0/24", "hosts": {}}
+				},
+				"routers": {
+					"R-1": {"subnets": ["A", "C"], "image": "pcollado/drouter"},
+					"R-2": {"subnets": ["B", "C"], "image": "pcollado/drouter"}
+				}
+			}`,
+			defDiff{
+				removedSubnets:  []string{"B"},
+				addedSubnets:    []string{"B", "C"},
+				detachedRouters: []nodeRef{{"B", "R-1"}, {"B", "R-2"}},
+				attachedRouters: []nodeRef{{"B", "R-2"}, {"C", "R-1"}, {"C", "R-2"}},
+			},
+		},
+		{
+			"routers removed, replaced and refirewalled",
+			`{
+				"name": "Reconcile Net",
+				"subnets": {
+					"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "pcollado/dhost"}, "A-2": {"image": "pcollado/dhost"}}},
+					"B": {"cidr": "10.0.1.0/24", "hosts": {"B-1": {"image": "pcollado/dhost"}}}
+				},
+				"routers": {
+					"R-1": {"subnets": ["A", "B"], "image": "pcollado/drouter", "fw_rules": {"policy": "DROP"}},
+					"R-3": {"subnets": ["A"], "image": "pcollado/drouter"}
+				}
+			}`,
+			defDiff{
+				removedRouters: []string{"R-2"},
+				addedRouters:   []string{"R-3"},
+				changedFWRules: []string{"R-1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		newDef, err := parseDef([]byte(test.newDef))
+		if err != nil {
+			t.Fatalf("%s: couldn't parse the new definition: %v", test.name, err)
+		}
+		got := diffState(liveState(t, reconcileBaseDef), newDef)
+		if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(defDiff{}), cmpEmptySlices); diff != "" {
+			t.Errorf("%s: diffState() mismatch (-want +got):\n%s", test.name, diff)
+		}
+	}
+}
+
+// cmpEmptySlices considers nil and empty slices to be equal.
+var cmpEmptySlices = cmp.FilterValues(func(x, y interface{}) bool {
+	return isEmptySlice(x) && isEmptySlice(y)
+}, cmp.Comparer(func(_, _ interface{}) bool { return true }))
+
+func isEmptySlice(v interface{}) bool {
+	switch s := v.(type) {
+	case []string:
+		return len(s) == 0
+	case []nodeRef:
+		return len(s) == 0
+	}
+	return false
+}
+
+func TestReconcileP2P(t *testing.T) {
+	ns := plannedState(t, "../demos/p2p/net.json")
+
+	newDef := ns.Definition.clone()
+	newDef.Routers["R-3"] = newDef.Routers["R-2"]
+	delete(newDef.Routers, "R-2")
+	if err := reconcileNetwork(ns, newDef); err != nil {
+		t.Fatalf("reconcileNetwork() err %v", err)
+	}
+
+	if _, ok := ns.Links[linkKey("R-2", "C")]; ok {
+		t.Errorf("R-2's link to C should be gone")
+	}
+	r1, r3 := ns.Links[linkKey("R-1", "C")], ns.Links[linkKey("R-3", "C")]
+	if r1.Peer != "R-3" || r1.CIDR != "10.0.2.0/31" {
+		t.Errorf("R-1's link to C = %+v; wanted it joined to R-3 as 10.0.2.0/31", r1)
+	}
+	if r3.Peer != "R-1" || r3.CIDR != "10.0.2.1/31" {
+		t.Errorf("R-3's link to C = %+v; wanted it joined to R-1 as 10.0.2.1/31", r3)
+	}
+}
+
+func TestReconcileTrunkPorts(t *testing.T) {
+	ns := plannedState(t, "../demos/vlan/net.json")
+	pb := ns.backend.(*planBackend)
+	pid := ns.Routers["R-1"].PID
+
+	detach := func(subnets ...string) {
+		t.Helper()
+		newDef := ns.Definition.clone()
+		// Subnets left without a router can't be routed to.
+		newDef.AutomaticRouting = false
+		router := newDef.Routers["R-1"]
+		router.Subnets = subnets
+		newDef.Routers["R-1"] = router
+		if err := reconcileNetwork(ns, newDef); err != nil {
+			t.Fatalf("reconcileNetwork() err %v", err)
+		}
+	}
+
+	// The trunk port stays put as long as the router's on any VLAN.
+	detach("A")
+	wantSteps := []string{
+		fmt.Sprintf("remove sub-interface ethr-1-trunk.20 on container #%d", pid),
+		"untag VLAN 20 on trunk port bth-r-1-trunk",
+	}
+	for _, step := range wantSteps {
+		if !contains(pb.plan.Steps, step) {
+			t.Errorf("should have done %q", step)
+		}
+	}
+	if contains(pb.plan.Steps, "remove veth bth-r-1-trunk") {
+		t.Errorf("the trunk port should have been kept")
+	}
+
+	detach()
+	if !contains(pb.plan.Steps, "remove veth bth-r-1-trunk") {
+		t.Errorf("the trunk port should have been removed along with the last VLAN")
+	}
+	if len(ns.Links) != 4 {
+		t.Errorf("only the links of the hosts should be left; got %v", ns.Links)
+	}
+}
+
+// reloadDef spells out empty settings the store won't keep around.
+var reloadDef = `{
+	"name": "Reload Net",
+	"automatic_routing": true,
+	"subnets": {
+		"A": {"cidr": "10.0.0.0/24", "ovs": {"controllers": []}, "hosts": {"A-1": {"image": "pcollado/dhost", "command": [], "env": {}, "cap_add": []}}},
+		"B": {"cidr": "10.0.1.0/24", "hosts": {"B-1": {"image": "pcollado/dhost", "switch": "SW-1", "shaping": {
+			"egress": {"rate": "10mbit", "classes": [{"name": "bulk", "rate": "1mbit", "dscp": []}]},
+			"ingress": {"rate": "10mbit", "classes": []}
+		}}}}
+	},
+	"switches": {"SW-1": {"subnet": "B", "links": []}},
+	"routers": {
+		"R-1": {"subnets": ["A", "B"], "image": "pcollado/drouter", "switches": {"B": "SW-1"}},
+		"R-2": {"subnets": ["A"], "image": "pcollado/drouter", "switches": {}, "sysctls": {}, "volumes": []}
+	}
+}`
+
+func TestReconcileReloadedState(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	store, err := newStateStore()
+	if err != nil {
+		t.Fatalf("newStateStore() err %v", err)
+	}
+
+	reloadDefPath := filepath.Join(t.TempDir(), "net.json")
+	if err := os.WriteFile(reloadDefPath, []byte(reloadDef), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, defPath := range []string{"../demos/quagga/net.json", "../demos/switches/net.json", "../demos/ovs/net.json", reloadDefPath} {
+		if err := store.save("0123456789", plannedState(t, defPath)); err != nil {
+			t.Fatalf("%s: save() err %v", defPath, err)
+		}
+		ns, err := store.load("0123456789")
+		if err != nil {
+			t.Fatalf("%s: load() err %v", defPath, err)
+		}
+		ns.backend = newPlanBackend()
+
+		def, err := loadDef(defPath)
+		if err != nil {
+			t.Fatalf("%s: loadDef() err %v", defPath, err)
+		}
+		// Reloading the very definition a network was created with should be a no-op.
+		if diff := cmp.Diff(defDiff{}, diffState(ns, def), cmp.AllowUnexported(defDiff{}), cmpEmptySlices); diff != "" {
+			t.Errorf("%s: diffState() mismatch (-want +got):\n%s", defPath, diff)
+		}
+		if err := reconcileNetwork(ns, def); err != nil {
+			t.Errorf("%s: reconcileNetwork() err %v", defPath, err)
+		}
+		for _, step := range ns.backend.(*planBackend).plan.Steps {
+			if strings.HasPrefix(step, "shape ") || strings.HasPrefix(step, "impair ") {
+				t.Errorf("%s: reconcileNetwork() shouldn't have touched the links; did %q", defPath, step)
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package dvnet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/vishvananda/netlink"
+)
+
+// nodeLabel is the label carrying the name of the node each of our containers runs.
+const nodeLabel string = "dvnet.node"
+
+// eventsRetryDelay is how long we wait before following the Docker daemon's events again.
+var eventsRetryDelay = 5 * time.Second
+
+// watchRestarts replumbs the nodes whose containers are restarted by following
+// the start events of our containers. Every time we (re)start following them
+// every node is checked, as containers might have restarted in the meantime.
+func (d Driver) watchRestarts() {
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		msgs, errs := dockerCli.Events(ctx, types.EventsOptions{Filters: filters.NewArgs(
+			filters.Arg("type", "container"), filters.Arg("event", "start"), filters.Arg("label", nodeLabel))})
+		d.replumbRestarted("")
+
+		var err error
+		for err == nil {
+			select {
+			case msg := <-msgs:
+				log.debug("container %s running node %s started\n", shortID(msg.Actor.ID), msg.Actor.Attributes[nodeLabel])
+				d.replumbRestarted(msg.Actor.ID)
+			case err = <-errs:
+			}
+		}
+		cancel()
+		log.warn("stopped following the Docker daemon's events, retrying in %s: %v\n", eventsRetryDelay, err)
+		time.Sleep(eventsRetryDelay)
+	}
+}
+
+// replumbRestarted replumbs the node running on container containerID if it
+// was restarted or, with an empty containerID, every node which was.
+func (d Driver) replumbRestarted(containerID string) {
+	unlock, err := d.lock()
+	if err != nil {
+		log.error("%v\n", err)
+		return
+	}
+	defer unlock()
+
+	networkIDs, err := d.store.ids()
+	if err != nil {
+		log.error("couldn't list the networks we manage: %v\n", err)
+		return
+	}
+	for _, networkID := range networkIDs {
+		ns, err := d.network(networkID)
+		if err != nil {
+			log.error("couldn't load the state of network %s: %v\n", networkID, err)
+			continue
+		}
+
+		replumbed := false
+		nodes := ns.nodes()
+		for _, node := range sortedKeys(nodes) {
+			info := nodes[node]
+			if containerID != "" && info.ID != containerID {
+				continue
+			}
+			log := ns.log().with("node", node)
+			status, err := ns.backend.inspectContainer(info.ID)
+			if err != nil {
+				log.error("couldn't inspect container %s: %v\n", shortID(info.ID), err)
+				continue
+			}
+			if status.State != "running" || status.PID == info.PID {
+				continue
+			}
+
+			log.info("container %s was restarted with PID %d: replumbing %s\n", shortID(info.ID), status.PID, node)
+			if err := replumbNode(ns, node, status.PID); err != nil {
+				log.error("%s might have been partially replumbed: %v\n", node, err)
+			}
+			replumbed = true
+		}
+
+		if !replumbed {
+			continue
+		}
+		if err := d.store.save(networkID, ns); err != nil {
+			log.error("couldn't save the state of network %s: %v\n", networkID, err)
+		}
+	}
+}
+
+// replumbNode sets up node anew on the fresh network namespace of its restarted
+// container, whose init process is now containerPID: its veth pairs (and those
+// of its point-to-point peers), its addresses, its routes (and those of its
+// peers through the pairs) and its firewall, as well as the impairments, mirrors
+// and state of its links. Addresses are the ones the node had: everyone else
+// still expects them.
+func replumbNode(ns *NetworkState, node string, containerPID int) error {
+	setNodePID(ns, node, containerPID)
+
+	affected, trunkPorts := []string{}, map[string]bool{}
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		if link.Node != node {
+			continue
+		}
+		affected = append(affected, key)
+
+		var err error
+		switch {
+		case link.Trunk:
+			err = replumbTrunkLink(ns, link, containerPID, trunkPorts)
+		case link.Peer != "":
+			affected = append(affected, linkKey(link.Peer, link.Subnet))
+			err = replumbP2PLink(ns, link, containerPID)
+		default:
+			err = replumbLink(ns, link, containerPID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, route := range ns.Routes[node] {
+		ns.log().with("node", node).debug("adding route to %s through %s on container with PID %d\n", route.Dst, route.Gw, containerPID)
+		if err := ns.backend.addRoute(route, containerPID); err != nil {
+			return fmt.Errorf("couldn't add the route to %s on %s: %w", route.Dst, node, err)
+		}
+	}
+	// Point-to-point peers lost their ends, and the routes through them, along with node.
+	for _, key := range affected {
+		if link := ns.Links[key]; link.Node != node {
+			if err := reinstallRoutesVia(ns, link.Node, link.CIDR); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, ok := ns.Routers[node]; ok {
+		def := ns.Definition.Routers[node].FWRules
+		if def.Policy != "" || len(ns.FWRules[node]) > 0 {
+			policy := strings.ToUpper(def.Policy)
+			if policy == "" {
+				policy = "ACCEPT"
+			}
+			if err := ns.backend.installFWRules(containerPID, policy, ns.FWRules[node]); err != nil {
+				return fmt.Errorf("couldn't install the firewall rules on %s: %w", node, err)
+			}
+		}
+	}
+
+	// The links' qdiscs went away with their interfaces: forgetting
+	// them gets both them and the mirrors onto them back in place.
+	for _, key := range affected {
+		link := ns.Links[key]
+		link.Impairments, link.Shaping, link.Mirror, link.MirrorSink = nil, nil, nil, false
+		ns.Links[key] = link
+	}
+	if err := applyImpairments(ns, ns.Definition); err != nil {
+		return err
+	}
+	if err := applyMirrors(ns, ns.Definition); err != nil {
+		return err
+	}
+	for _, key := range affected {
+		if ns.Links[key].Down {
+			if err := setLinkState(ns, key, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setNodePID records that node now runs on a container whose init process is containerPID.
+func setNodePID(ns *NetworkState, node string, containerPID int) {
+	if info, ok := ns.Routers[node]; ok {
+		info.PID = containerPID
+		ns.Routers[node] = info
+		return
+	}
+	for _, subnet := range ns.Subnets {
+		if info, ok := subnet.Containers[node]; ok {
+			info.PID = containerPID
+			subnet.Containers[node] = info
+		}
+	}
+}
+
+// replumbLink recreates the veth pair plugging link's node into its bridge.
+// Open vSwitch bridges hold on to the port the old pair left behind.
+func replumbLink(ns *NetworkState, link linkInfo, containerPID int) error {
+	subnet := ns.Subnets[link.Subnet]
+	bridge := subnet.Bridge
+	if link.Switch != "" {
+		bridge = ns.Switches[link.Switch].bridge()
+	}
+	log := ns.log().with("subnet", link.Subnet, "node", link.Node)
+
+	if subnet.OVS != nil {
+		if err := ns.bridgesFor(link.Subnet).disconnectFromBridge(link.BridgeEnd, bridge); err != nil {
+			log.debug("couldn't disconnect %s from %s: %v\n", link.BridgeEnd, bridge.Name, err)
+		}
+	}
+	veth, bridgeEnd, nodeEnd, err := ns.backend.createVethPair(link.BridgeEnd, link.NodeEnd)
+	if err != nil {
+		return fmt.Errorf("couldn't create veth %s: %w", link.BridgeEnd, err)
+	}
+	log.debug("connecting %s to %s\n", veth.Name, bridge.Name)
+	if err := ns.bridgesFor(link.Subnet).connectToBridge(bridgeEnd, bridge); err != nil {
+		return fmt.Errorf("couldn't connect %s to %s: %w", veth.Name, bridge.Name, err)
+	}
+	if subnet.VLAN != 0 {
+		if err := ns.backend.addPortVLAN(veth.Name, subnet.VLAN, true); err != nil {
+			return fmt.Errorf("couldn't make %s an access port for VLAN %d: %w", veth.Name, subnet.VLAN, err)
+		}
+	}
+	return connectAndAddress(ns, link, nodeEnd, containerPID)
+}
+
+// replumbP2PLink recreates the veth pair joining link's node and its peer.
+func replumbP2PLink(ns *NetworkState, link linkInfo, containerPID int) error {
+	peerLink, ok := ns.Links[linkKey(link.Peer, link.Subnet)]
+	if !ok {
+		return fmt.Errorf("the link between %s and %s has no other end", link.Node, link.Subnet)
+	}
+	peerPID, ok := ns.nodePID(link.Peer)
+	if !ok {
+		return errUnknownNode(link.Peer)
+	}
+
+	_, end, peerEnd, err := ns.backend.createVethPair(link.NodeEnd, peerLink.NodeEnd)
+	if err != nil {
+		return fmt.Errorf("couldn't create veth %s: %w", link.NodeEnd, err)
+	}
+	if err := connectAndAddress(ns, link, end, containerPID); err != nil {
+		return err
+	}
+	return connectAndAddress(ns, peerLink, peerEnd, peerPID)
+}
+
+// replumbTrunkLink recreates the sub-interface of a trunk link along with the
+// trunk port it hangs from, unless another of the node's VLANs did so already.
+func replumbTrunkLink(ns *NetworkState, link linkInfo, containerPID int, trunkPorts map[string]bool) error {
+	subnet := ns.Subnets[link.Subnet]
+	parentName := link.NodeEnd[:strings.LastIndex(link.NodeEnd, ".")]
+
+	if !trunkPorts[link.BridgeEnd] {
+		veth, port, parent, err := ns.backend.createVethPair(link.BridgeEnd, parentName)
+		if err != nil {
+			return fmt.Errorf("couldn't create veth %s: %w", link.BridgeEnd, err)
+		}
+		if err := ns.backend.connectToBridge(port, subnet.Bridge); err != nil {
+			return fmt.Errorf("couldn't connect %s to %s: %w", veth.Name, subnet.BridgeName, err)
+		}
+		if err := ns.backend.connectToContainer(parent, containerPID); err != nil {
+			return fmt.Errorf("couldn't connect %s to %s: %w", veth.PeerName, link.Node, err)
+		}
+		trunkPorts[link.BridgeEnd] = true
+	}
+
+	if err := ns.backend.addPortVLAN(link.BridgeEnd, subnet.VLAN, false); err != nil {
+		return fmt.Errorf("couldn't tag VLAN %d on %s: %w", subnet.VLAN, link.BridgeEnd, err)
+	}
+	iface, err := ns.backend.addVLANIface(parentName, subnet.VLAN, containerPID)
+	if err != nil {
+		return fmt.Errorf("couldn't create the sub-interface for VLAN %d on %s: %w", subnet.VLAN, link.Node, err)
+	}
+	if err := ns.backend.addressContainer(link.CIDR, iface, containerPID); err != nil {
+		return fmt.Errorf("couldn't address %s to %s on %s: %w", link.CIDR, link.NodeEnd, link.Node, err)
+	}
+	return nil
+}
+
+// connectAndAddress moves the node's end of link into its container and gives it the link's address back.
+func connectAndAddress(ns *NetworkState, link linkInfo, nodeEnd netlink.Link, containerPID int) error {
+	if err := ns.backend.connectToContainer(nodeEnd, containerPID); err != nil {
+		return fmt.Errorf("couldn't connect %s to %s: %w", link.NodeEnd, link.Node, err)
+	}
+	if err := ns.backend.addressContainer(link.CIDR, nodeEnd, containerPID); err != nil {
+		return fmt.Errorf("couldn't address %s to %s on %s: %w", link.CIDR, link.NodeEnd, link.Node, err)
+	}
+	return nil
+}
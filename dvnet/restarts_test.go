@@ -0,0 +1,89 @@
+package dvnet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// restartContainer restarts a planned container, which comes back
+// with a new PID and a network namespace with nothing of ours in it.
+func restartContainer(pb *planBackend, id string) int {
+	oldPID := pb.containers[id]
+	for name := range pb.namespace(oldPID) {
+		pb.removeIface(name, oldPID)
+	}
+	delete(pb.ifaces, oldPID)
+	delete(pb.tables, oldPID)
+	delete(pb.firewalls, oldPID)
+
+	pid := pb.nextPID
+	pb.nextPID++
+	pb.containers[id] = pid
+	return pid
+}
+
+func TestReplumbRestarted(t *testing.T) {
+	d, pb := testDriver(t)
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routerPID := restartContainer(pb, ns.Routers["R-1"].ID)
+	hostPID := restartContainer(pb, ns.Subnets["A"].Containers["A-1"].ID)
+	if drifts := detectDrift(ns).Drifts; len(drifts) != 2 {
+		t.Fatalf("restarting R-1 and A-1 should show up as drift; got %v", drifts)
+	}
+
+	d.replumbRestarted("")
+	ns, err = d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Routers["R-1"].PID != routerPID || ns.Subnets["A"].Containers["A-1"].PID != hostPID {
+		t.Errorf("replumbRestarted() left R-1 on PID %d and A-1 on PID %d; wanted %d and %d",
+			ns.Routers["R-1"].PID, ns.Subnets["A"].Containers["A-1"].PID, routerPID, hostPID)
+	}
+	if drifts := detectDrift(ns).Drifts; len(drifts) != 0 {
+		t.Errorf("replumbed nodes shouldn't drift; got %v", drifts)
+	}
+	for _, route := range ns.Routes["A-1"] {
+		if !containsRoute(pb.tables[hostPID], route) {
+			t.Errorf("route %v wasn't installed on A-1 again; got %v", route, pb.tables[hostPID])
+		}
+	}
+	if fw, ok := pb.firewalls[routerPID]; !ok || !cmp.Equal(fw.Rules, ns.FWRules["R-1"]) {
+		t.Errorf("R-1's firewall wasn't installed again; got %+v", fw)
+	}
+
+	// Nothing's done for containers which weren't restarted.
+	steps := len(pb.plan.Steps)
+	d.replumbRestarted(ns.Routers["R-2"].ID)
+	if len(pb.plan.Steps) != steps {
+		t.Errorf("replumbRestarted() replumbed R-2, which wasn't restarted: %v", pb.plan.Steps[steps:])
+	}
+}
+
+func TestReplumbP2PPeer(t *testing.T) {
+	defPath := filepath.Join(t.TempDir(), "net.json")
+	if err := os.WriteFile(defPath, []byte(p2pHostDef), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ns := plannedState(t, defPath)
+	pb := ns.backend.(*planBackend)
+	hostPID := ns.Subnets["C"].Containers["C-1"].PID
+
+	// C-1's end of the pair goes away along with R-1's, and so do its routes.
+	routerPID := restartContainer(pb, ns.Routers["R-1"].ID)
+	if err := replumbNode(ns, "R-1", routerPID); err != nil {
+		t.Fatalf("replumbNode() err %v", err)
+	}
+	for _, route := range ns.Routes["C-1"] {
+		if !containsRoute(pb.tables[hostPID], route) {
+			t.Errorf("route %v wasn't installed on C-1 again; got %v", route, pb.tables[hostPID])
+		}
+	}
+}
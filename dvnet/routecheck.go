@@ -0,0 +1,339 @@
+package dvnet
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/RyanCarrier/dijkstra"
+)
+
+// Where expected routes come from.
+const (
+	routeConnected string = "connected"
+	routeInstalled string = "installed"
+	routeComputed  string = "computed"
+)
+
+// ExpectedRoute is a route a node should have. Connected routes come with
+// the node's addresses and have no gateway, installed ones were added by
+// us and computed ones are what routing daemons should converge to going
+// by the definition's graph. Alternatives are gateways just as good as Gw.
+type ExpectedRoute struct {
+	Dst          string   `json:"dst"`
+	Gw           string   `json:"gw"`
+	Origin       string   `json:"origin"`
+	Alternatives []string `json:"alternatives,omitempty"`
+}
+
+func (er ExpectedRoute) String() string {
+	if er.Gw == "" {
+		return fmt.Sprintf("%s (%s)", er.Dst, er.Origin)
+	}
+	gws := append([]string{er.Gw}, er.Alternatives...)
+	return fmt.Sprintf("%s via %s (%s)", er.Dst, strings.Join(gws, " or "), er.Origin)
+}
+
+// RouteMismatch is a route to the right destination through the wrong gateways.
+type RouteMismatch struct {
+	Expected ExpectedRoute `json:"expected"`
+	Gws      []string      `json:"gws"`
+}
+
+func (rm RouteMismatch) String() string {
+	gws := []string{}
+	for _, gw := range rm.Gws {
+		if gw == "" {
+			gw = "directly connected"
+		}
+		gws = append(gws, gw)
+	}
+	return fmt.Sprintf("%s, but it goes %s", rm.Expected, strings.Join(gws, ", "))
+}
+
+// NodeRoutes compares the routing table of a node with what it should hold.
+// Error tells why the table couldn't be read, if it couldn't.
+type NodeRoutes struct {
+	Node      string          `json:"node"`
+	Matching  int             `json:"matching"`
+	Missing   []ExpectedRoute `json:"missing"`
+	Extra     []routeInfo     `json:"extra"`
+	Differing []RouteMismatch `json:"differing"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Differs tells whether the node's routing table isn't what it should be.
+func (nr NodeRoutes) Differs() bool {
+	return len(nr.Missing) > 0 || len(nr.Extra) > 0 || len(nr.Differing) > 0 || nr.Error != ""
+}
+
+// RouteReport holds the comparison of the routing tables of every node of a network.
+type RouteReport struct {
+	Network string       `json:"network"`
+	Nodes   []NodeRoutes `json:"nodes"`
+}
+
+// Differing returns the nodes whose routing tables aren't what they should be.
+func (rr *RouteReport) Differing() []NodeRoutes {
+	differing := []NodeRoutes{}
+	for _, nr := range rr.Nodes {
+		if nr.Differs() {
+			differing = append(differing, nr)
+		}
+	}
+	return differing
+}
+
+// CheckRoutes reads the routing table of every node of the network with the
+// given name, ID or ID prefix and compares it with what it should hold.
+func (d Driver) CheckRoutes(network string) (*RouteReport, error) {
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := d.network(networkID)
+	if err != nil {
+		return nil, err
+	}
+	return checkRoutes(ns)
+}
+
+func checkRoutes(ns *NetworkState) (*RouteReport, error) {
+	expected, err := expectedRoutes(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RouteReport{Network: ns.Definition.Name, Nodes: []NodeRoutes{}}
+	for _, node := range sortedKeys(expected) {
+		nr := NodeRoutes{Node: node, Missing: []ExpectedRoute{}, Extra: []routeInfo{}, Differing: []RouteMismatch{}}
+		pid, _ := ns.nodePID(node)
+		actual, err := ns.backend.routes(pid)
+		if err != nil {
+			nr.Error = fmt.Sprintf("couldn't read the routing table: %v", err)
+		} else {
+			compareRoutes(&nr, expected[node], actual)
+		}
+		if nr.Differs() {
+			ns.log().with("node", node).warn("%d missing, %d extra and %d differing routes\n", len(nr.Missing), len(nr.Extra), len(nr.Differing))
+		}
+		report.Nodes = append(report.Nodes, nr)
+	}
+	return report, nil
+}
+
+// compareRoutes sorts the actual routes of a node into those matching what's
+// expected, those going through the wrong gateways and those not expected at all.
+func compareRoutes(nr *NodeRoutes, expected []ExpectedRoute, actual []routeInfo) {
+	gws := map[string][]string{}
+	for _, route := range actual {
+		gws[route.Dst] = append(gws[route.Dst], route.Gw)
+	}
+	expectedDsts := map[string]bool{}
+	for _, er := range expected {
+		expectedDsts[er.Dst] = true
+		found, ok := gws[er.Dst]
+		switch {
+		case !ok:
+			nr.Missing = append(nr.Missing, er)
+		case contains(found, er.Gw) || anyContained(er.Alternatives, found):
+			nr.Matching++
+		default:
+			nr.Differing = append(nr.Differing, RouteMismatch{Expected: er, Gws: found})
+		}
+	}
+	for _, route := range actual {
+		if !expectedDsts[route.Dst] {
+			nr.Extra = append(nr.Extra, route)
+		}
+	}
+}
+
+func anyContained(items, list []string) bool {
+	for _, item := range items {
+		if contains(list, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedRoutes returns the routes every node should have: a connected route
+// per address, the routes we installed and, on routers, a route to every
+// other subnet through the next hop on the shortest paths to it. Only one
+// route per destination is expected, connected ones winning over installed
+// ones, which in turn win over computed ones.
+func expectedRoutes(ns *NetworkState) (map[string][]ExpectedRoute, error) {
+	graph, err := genGraph(ns.Definition)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't build the network's graph: %w", err)
+	}
+
+	expected := map[string][]ExpectedRoute{}
+	seen := map[string]map[string]bool{}
+	add := func(node string, er ExpectedRoute) {
+		if seen[node] == nil {
+			seen[node] = map[string]bool{}
+		}
+		if !seen[node][er.Dst] {
+			seen[node][er.Dst] = true
+			expected[node] = append(expected[node], er)
+		}
+	}
+
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		if _, subnet, err := net.ParseCIDR(link.CIDR); err == nil {
+			add(link.Node, ExpectedRoute{Dst: subnet.String(), Origin: routeConnected})
+		}
+	}
+	for _, node := range sortedKeys(ns.Routes) {
+		for _, route := range ns.Routes[node] {
+			add(node, ExpectedRoute{Dst: route.Dst, Gw: route.Gw, Origin: routeInstalled})
+		}
+	}
+	for _, router := range sortedKeys(ns.Routers) {
+		routes, err := computeRouterRoutes(ns, graph, router)
+		if err != nil {
+			return nil, err
+		}
+		for _, er := range routes {
+			add(router, er)
+		}
+	}
+	return expected, nil
+}
+
+// computeRouterRoutes returns a route to every subnet the router isn't attached to
+// through the first hop of the shortest paths leading there. Subnets are reached
+// through their hosts or, if they've got none, through the routers attached to them.
+func computeRouterRoutes(ns *NetworkState, graph *dijkstra.Graph, router string) ([]ExpectedRoute, error) {
+	def := ns.Definition
+	srcID, err := graph.GetMapping(router)
+	if err != nil {
+		return nil, fmt.Errorf("router %s isn't part of the network's graph: %w", router, err)
+	}
+
+	routes := []ExpectedRoute{}
+	for _, subnetName := range sortedKeys(def.Subnets) {
+		subnet := def.Subnets[subnetName]
+		if contains(def.Routers[router].Subnets, subnetName) {
+			continue
+		}
+		dst := ""
+		if hosts := sortedKeys(subnet.Hosts); len(hosts) > 0 {
+			dst = hosts[0]
+		} else {
+			for _, other := range sortedKeys(def.Routers) {
+				if contains(def.Routers[other].Subnets, subnetName) {
+					dst = other
+					break
+				}
+			}
+		}
+		dstID, err := graph.GetMapping(dst)
+		if err != nil {
+			continue
+		}
+		best, err := graph.ShortestAll(srcID, dstID)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find shortest path from %s to %s: %w", router, dst, err)
+		}
+
+		gws := []string{}
+		for _, path := range best {
+			if gw := nextHopAddr(ns, graph, router, path.Path); gw != "" && !contains(gws, gw) {
+				gws = append(gws, gw)
+			}
+		}
+		if len(gws) == 0 {
+			continue
+		}
+		sort.Strings(gws)
+		er := ExpectedRoute{Dst: subnet.CIDRBlock.String(), Gw: gws[0], Origin: routeComputed}
+		if len(gws) > 1 {
+			er.Alternatives = gws[1:]
+		}
+		routes = append(routes, er)
+	}
+	return routes, nil
+}
+
+// nextHopAddr returns the address of the first node after router on path
+// on a subnet they share. Switches are transparent as far as routing is concerned.
+func nextHopAddr(ns *NetworkState, graph *dijkstra.Graph, router string, path []int) string {
+	for _, vertex := range path[1:] {
+		name, _ := graph.GetMapped(vertex)
+		if _, isSwitch := ns.Definition.Switches[name]; isSwitch {
+			continue
+		}
+		for _, subnet := range ns.Definition.Routers[router].Subnets {
+			if link, ok := ns.Links[linkKey(name, subnet)]; ok && link.CIDR != "" {
+				return strings.Split(link.CIDR, "/")[0]
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// Write writes the report in the given format.
+func (rr *RouteReport) Write(w io.Writer, format string) error {
+	return writeReport(w, format, rr, rr.WriteText, rr.WriteJUnit)
+}
+
+// WriteText writes what's wrong with the routing table of every node.
+func (rr *RouteReport) WriteText(w io.Writer) error {
+	for _, nr := range rr.Nodes {
+		if _, err := io.WriteString(w, nr.describe()); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d nodes, %d with differing routes\n", len(rr.Nodes), len(rr.Differing()))
+	return err
+}
+
+// describe tells in a few lines what's wrong with the routing table of the node.
+func (nr NodeRoutes) describe() string {
+	if nr.Error != "" {
+		return fmt.Sprintf("%s: %s\n", nr.Node, nr.Error)
+	}
+	if !nr.Differs() {
+		return fmt.Sprintf("%s: all %d routes as expected\n", nr.Node, nr.Matching)
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s: %d routes as expected\n", nr.Node, nr.Matching)
+	for _, er := range nr.Missing {
+		fmt.Fprintf(b, "\tmissing   %s\n", er)
+	}
+	for _, rm := range nr.Differing {
+		fmt.Fprintf(b, "\tdiffering %s\n", rm)
+	}
+	for _, route := range nr.Extra {
+		fmt.Fprintf(b, "\textra     %s\n", describeRoutes([]routeInfo{route}))
+	}
+	return b.String()
+}
+
+// WriteJUnit writes the report as a JUnit XML test suite where every node is
+// a test case which fails if its routing table isn't what it should be.
+func (rr *RouteReport) WriteJUnit(w io.Writer) error {
+	suite := junitSuite{Name: "routes of " + rr.Network, Cases: []junitCase{}}
+	for _, nr := range rr.Nodes {
+		c := junitCase{Name: nr.Node, ClassName: rr.Network}
+		if nr.Differs() {
+			c.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d missing, %d extra and %d differing routes", len(nr.Missing), len(nr.Extra), len(nr.Differing)),
+				Type:    "differing routes",
+				Details: nr.describe(),
+			}
+			if nr.Error != "" {
+				c.Failure.Message = nr.Error
+			}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	return writeJUnit(w, suite)
+}
@@ -0,0 +1,108 @@
+package dvnet
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckRoutes(t *testing.T) {
+	d, pb := testDriver(t)
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrOf := func(node, subnet string) string {
+		return strings.Split(ns.Links[linkKey(node, subnet)].CIDR, "/")[0]
+	}
+	pidOf := func(node string) int {
+		pid, _ := ns.nodePID(node)
+		return pid
+	}
+
+	// R-1's routing daemon did its job while R-2's went astray, a student
+	// added a route to A-1 and B-1 lost the route to its own subnet.
+	pb.tables[pidOf("R-1")] = append(pb.tables[pidOf("R-1")], routeInfo{Dst: "10.0.1.0/24", Gw: addrOf("R-2", "C")})
+	pb.tables[pidOf("R-2")] = append(pb.tables[pidOf("R-2")], routeInfo{Dst: "10.0.0.0/24", Gw: addrOf("B-1", "B")})
+	pb.tables[pidOf("A-1")] = append(pb.tables[pidOf("A-1")], routeInfo{Dst: "192.168.7.0/24", Gw: addrOf("A-2", "A")})
+	pb.tables[pidOf("B-1")] = removeRoute(pb.tables[pidOf("B-1")], routeInfo{Dst: "10.0.1.0/24"})
+
+	report, err := d.CheckRoutes("0123")
+	if err != nil {
+		t.Fatalf("CheckRoutes() err %v", err)
+	}
+	nodes := map[string]NodeRoutes{}
+	for _, nr := range report.Nodes {
+		nodes[nr.Node] = nr
+	}
+	if len(nodes) != 6 {
+		t.Errorf("CheckRoutes() looked at %d nodes; wanted 6", len(nodes))
+	}
+
+	if nr := nodes["R-1"]; nr.Differs() {
+		t.Errorf("R-1's routes should be as expected; got %+v", nr)
+	}
+	wantDiffering := []RouteMismatch{{
+		Expected: ExpectedRoute{Dst: "10.0.0.0/24", Gw: addrOf("R-1", "C"), Origin: routeComputed},
+		Gws:      []string{addrOf("B-1", "B")},
+	}}
+	if nr := nodes["R-2"]; !cmp.Equal(nr.Differing, wantDiffering) || len(nr.Missing) != 0 || len(nr.Extra) != 0 {
+		t.Errorf("R-2 should have a route to A through the wrong gateway; got %+v", nr)
+	}
+	if nr := nodes["A-1"]; !cmp.Equal(nr.Extra, []routeInfo{{Dst: "192.168.7.0/24", Gw: addrOf("A-2", "A")}}) || len(nr.Missing) != 0 {
+		t.Errorf("A-1 should have an extra route; got %+v", nr)
+	}
+	if nr := nodes["B-1"]; !cmp.Equal(nr.Missing, []ExpectedRoute{{Dst: "10.0.1.0/24", Origin: routeConnected}}) {
+		t.Errorf("B-1 should be missing its connected route; got %+v", nr)
+	}
+	if got := len(report.Differing()); got != 3 {
+		t.Errorf("Differing() returned %d nodes; wanted 3", got)
+	}
+
+	text := &strings.Builder{}
+	if err := report.Write(text, ReportText); err != nil {
+		t.Fatalf("Write(%s) err %v", ReportText, err)
+	}
+	for _, want := range []string{
+		"R-1: all 5 routes as expected\n",
+		"\tdiffering 10.0.0.0/24 via " + addrOf("R-1", "C") + " (computed), but it goes " + addrOf("B-1", "B") + "\n",
+		"\tmissing   10.0.1.0/24 (connected)\n",
+		"6 nodes, 3 with differing routes\n",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text report lacks %q; got\n%s", want, text)
+		}
+	}
+
+	junit := &strings.Builder{}
+	if err := report.Write(junit, ReportJUnit); err != nil {
+		t.Fatalf("Write(%s) err %v", ReportJUnit, err)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal([]byte(junit.String()), &suites); err != nil {
+		t.Fatalf("couldn't parse the JUnit report: %v\n%s", err, junit)
+	}
+	if suites.Tests != 6 || suites.Failures != 3 {
+		t.Errorf("JUnit report has %d tests and %d failures; wanted 6 and 3", suites.Tests, suites.Failures)
+	}
+}
+
+func TestCompareRoutes(t *testing.T) {
+	expected := []ExpectedRoute{
+		{Dst: "10.0.0.0/24", Origin: routeConnected},
+		{Dst: "10.0.1.0/24", Gw: "10.0.0.1", Origin: routeComputed, Alternatives: []string{"10.0.0.2"}},
+	}
+	// Equally short paths are just as good, be it one of them or both.
+	for _, actual := range [][]routeInfo{
+		{{Dst: "10.0.0.0/24"}, {Dst: "10.0.1.0/24", Gw: "10.0.0.2"}},
+		{{Dst: "10.0.0.0/24"}, {Dst: "10.0.1.0/24", Gw: "10.0.0.1"}, {Dst: "10.0.1.0/24", Gw: "10.0.0.2"}},
+	} {
+		nr := NodeRoutes{}
+		compareRoutes(&nr, expected, actual)
+		if nr.Differs() || nr.Matching != 2 {
+			t.Errorf("compareRoutes(%v) = %+v; wanted 2 matching routes", actual, nr)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package dvnet
 
 import (
+	"fmt"
 	"net"
 	"runtime"
 
@@ -13,37 +14,114 @@ type graphRoute struct {
 	rawPath  []string
 }
 
-func routeContainer(ns *NetworkState, subnetName string, route graphRoute, containerPID int) error {
+// routeInfo is a route we installed on a node. We keep
+// track of them so that we can undo them later on.
+type routeInfo struct {
+	Dst string `json:"dst"`
+	Gw  string `json:"gw"`
+}
+
+func routeContainer(ns *NetworkState, subnetName, host string, route graphRoute) error {
 	subnetAddresser := ns.Addressers[subnetName]
 
-	// Lock the OS Thread so we don't accidentally switch namespaces
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+	gwIP := subnetAddresser.AssignedIPs[route.rawPath[0]]
+	return installRoute(ns, host, routeInfo{Dst: route.destCIDR.String(), Gw: gwIP.String()})
+}
 
-	origNS, _ := netns.Get()
-	defer origNS.Close()
+func addDefaultRoute(ns *NetworkState, node string, gwIP net.IP) error {
+	return installRoute(ns, node, routeInfo{Dst: defaultRoute, Gw: gwIP.String()})
+}
 
-	containerNS, err := netns.GetFromPid(containerPID)
-	if err != nil {
+// installRoute adds route to node's routing table and records it on ns.
+func installRoute(ns *NetworkState, node string, route routeInfo) error {
+	pid, ok := ns.nodePID(node)
+	if !ok {
+		return errUnknownNode(node)
+	}
+
+	ns.log().with("node", node).debug("adding route to %s through %s on container with PID %d\n", route.Dst, route.Gw, pid)
+	if err := ns.backend.addRoute(route, pid); err != nil {
 		return err
 	}
-	defer containerNS.Close()
 
-	netns.Set(containerNS)
+	ns.Routes[node] = append(ns.Routes[node], route)
+	return nil
+}
 
-	gwIP := subnetAddresser.AssignedIPs[route.rawPath[0]]
-	log.debug("adding route to %s through %s on container with PID %d\n", route.destCIDR.String(), gwIP.String(), containerPID)
-	nlRoute := netlink.Route{Dst: &route.destCIDR, Gw: gwIP}
+// uninstallRoute undoes what installRoute did.
+func uninstallRoute(ns *NetworkState, node string, route routeInfo) error {
+	pid, ok := ns.nodePID(node)
+	if !ok {
+		return errUnknownNode(node)
+	}
 
-	if err := netlink.RouteAdd(&nlRoute); err != nil {
-		netns.Set(origNS)
+	ns.log().with("node", node).debug("removing route to %s through %s on container with PID %d\n", route.Dst, route.Gw, pid)
+	if err := ns.backend.delRoute(route, pid); err != nil {
 		return err
 	}
 
-	return netns.Set(origNS)
+	ns.Routes[node] = removeRoute(ns.Routes[node], route)
+	return nil
 }
 
-func addDefaultRoute(gwIP net.IP, containerPID int) error {
+func containsRoute(routes []routeInfo, route routeInfo) bool {
+	for _, r := range routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// via tells whether the route goes through the interface addressed with cidr,
+// i.e. whether its gateway lies within cidr's block. Routes with no gateway
+// are the kernel's own and come and go with the interface.
+func (r routeInfo) via(cidr string) bool {
+	_, block, err := net.ParseCIDR(cidr)
+	return err == nil && r.Gw != "" && block.Contains(net.ParseIP(r.Gw))
+}
+
+// reinstallRoutesVia adds the routes we recorded for node through the interface
+// addressed with cidr back to its routing table. The kernel flushes them when
+// the interface goes down or away, and they're not put back on their own.
+func reinstallRoutesVia(ns *NetworkState, node, cidr string) error {
+	pid, ok := ns.nodePID(node)
+	if !ok {
+		return errUnknownNode(node)
+	}
+	for _, route := range ns.Routes[node] {
+		if !route.via(cidr) {
+			continue
+		}
+		ns.log().with("node", node).debug("adding route to %s through %s on container with PID %d\n", route.Dst, route.Gw, pid)
+		if err := ns.backend.addRoute(route, pid); err != nil {
+			return fmt.Errorf("couldn't add the route to %s on %s: %w", route.Dst, node, err)
+		}
+	}
+	return nil
+}
+
+func removeRoute(routes []routeInfo, route routeInfo) []routeInfo {
+	remaining := []routeInfo{}
+	for _, r := range routes {
+		if r != route {
+			remaining = append(remaining, r)
+		}
+	}
+	return remaining
+}
+
+func (r routeInfo) netlinkRoute() (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(r.Dst)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Route{Dst: dst, Gw: net.ParseIP(r.Gw)}, nil
+}
+
+// inContainerNS runs f within the network namespace of
+// the process whose PID is containerPID.
+func inContainerNS(containerPID int, f func() error) error {
 	// Lock the OS Thread so we don't accidentally switch namespaces
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -57,14 +135,11 @@ func addDefaultRoute(gwIP net.IP, containerPID int) error {
 	}
 	defer containerNS.Close()
 
-	netns.Set(containerNS)
-
-	log.debug("adding route to default through %s on container with PID %d\n", gwIP, containerPID)
-	nlRoute := netlink.Route{
-		Dst: func() *net.IPNet { _, ipNet, _ := net.ParseCIDR("0.0.0.0/0"); return ipNet }(),
-		Gw:  gwIP}
+	if err := netns.Set(containerNS); err != nil {
+		return err
+	}
 
-	if err := netlink.RouteAdd(&nlRoute); err != nil {
+	if err := f(); err != nil {
 		netns.Set(origNS)
 		return err
 	}
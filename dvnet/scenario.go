@@ -0,0 +1,262 @@
+package dvnet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Scenario actions.
+const (
+	actionDown    string = "down"
+	actionUp      string = "up"
+	actionImpair  string = "impair"
+	actionClear   string = "clear"
+	actionRestore string = "restore"
+)
+
+// Scenario is a timeline of failures and impairments to be
+// inflicted on a running network, as read from a scenario file.
+type Scenario struct {
+	Name  string         `json:"name"`
+	Steps []ScenarioStep `json:"steps"`
+}
+
+// ScenarioStep is an action to be carried out At some time after the scenario starts.
+// The links it acts on are selected through Node and Subnet: both select the link
+// joining them, just the Node selects every link of that node and just the Subnet
+// selects every link on that subnet. Restoring needs no selection at all.
+type ScenarioStep struct {
+	At          string           `json:"at"`
+	Action      string           `json:"action"`
+	Node        string           `json:"node,omitempty"`
+	Subnet      string           `json:"subnet,omitempty"`
+	Impairments *LinkImpairments `json:"impairments,omitempty"`
+
+	at time.Duration
+}
+
+// scenarioTarget is what a scenario is run against.
+type scenarioTarget interface {
+	Inspect(network string) (NetworkInfo, error)
+	SetLinkState(network, node, subnet string, up bool) error
+	SetNodeState(network, node string, up bool) error
+	SetLinkImpairments(network, node, subnet string, li *LinkImpairments) error
+}
+
+// LoadScenario reads and validates the scenario file at path.
+func LoadScenario(path string) (Scenario, error) {
+	rawScenario, err := os.ReadFile(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	var sc Scenario
+	if err := json.Unmarshal(rawScenario, &sc); err != nil {
+		return Scenario{}, err
+	}
+	return sc, sc.validate()
+}
+
+// validate checks every step makes sense on its own and sorts them in time.
+func (sc *Scenario) validate() error {
+	for i := range sc.Steps {
+		step := &sc.Steps[i]
+		at, err := time.ParseDuration(step.At)
+		if err != nil || at < 0 {
+			return fmt.Errorf("step %d: wrong time %q: it should look like 10s", i, step.At)
+		}
+		step.at = at
+
+		switch step.Action {
+		case actionDown, actionUp, actionClear:
+			if step.Node == "" && step.Subnet == "" {
+				return fmt.Errorf("step %d: %s needs a node, a subnet or both", i, step.Action)
+			}
+		case actionImpair:
+			if step.Node == "" && step.Subnet == "" {
+				return fmt.Errorf("step %d: %s needs a node, a subnet or both", i, step.Action)
+			}
+			if step.Impairments == nil {
+				return fmt.Errorf("step %d: %s needs some impairments", i, step.Action)
+			}
+			if err := step.Impairments.validate(); err != nil {
+				return fmt.Errorf("step %d: %w", i, err)
+			}
+		case actionRestore:
+		default:
+			return fmt.Errorf("step %d: unknown action %q", i, step.Action)
+		}
+	}
+	sort.SliceStable(sc.Steps, func(i, j int) bool { return sc.Steps[i].at < sc.Steps[j].at })
+	return nil
+}
+
+func (step ScenarioStep) String() string {
+	var target string
+	switch {
+	case step.Node != "" && step.Subnet != "":
+		target = fmt.Sprintf("link %s <-> %s", step.Node, step.Subnet)
+	case step.Node != "":
+		target = "node " + step.Node
+	case step.Subnet != "":
+		target = "subnet " + step.Subnet
+	}
+	switch step.Action {
+	case actionRestore:
+		return "restore everything"
+	case actionImpair:
+		return fmt.Sprintf("impair %s: %s", target, step.Impairments)
+	case actionClear:
+		return "clear the impairments on " + target
+	}
+	return fmt.Sprintf("bring %s %s", target, step.Action)
+}
+
+// selectLinks returns the links of info step acts on.
+func (step ScenarioStep) selectLinks(info NetworkInfo) ([]LinkDetails, error) {
+	links := []LinkDetails{}
+	for _, link := range info.Links {
+		if (step.Node == "" || link.Node == step.Node) && (step.Subnet == "" || link.Subnet == step.Subnet) {
+			links = append(links, link)
+		}
+	}
+	if len(links) == 0 {
+		return nil, notFoundError{fmt.Sprintf("no link matches %s", step)}
+	}
+	return links, nil
+}
+
+// RunScenario runs sc against network logging each step to logW. If ctx
+// is cancelled or a step fails halfway through every link is restored to
+// the state it was in when the scenario started. The scenario is checked against the network
+// before anything's done to it.
+func (d Driver) RunScenario(ctx context.Context, network string, sc Scenario, logW io.Writer) error {
+	return runScenario(ctx, d, network, sc, logW)
+}
+
+func runScenario(ctx context.Context, target scenarioTarget, network string, sc Scenario, logW io.Writer) error {
+	initial, err := target.Inspect(network)
+	if err != nil {
+		return err
+	}
+	for i, step := range sc.Steps {
+		if step.Action == actionRestore {
+			continue
+		}
+		if _, err := step.selectLinks(initial); err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+	}
+
+	start := time.Now()
+	logStep := func(format string, args ...interface{}) {
+		now := time.Now()
+		fmt.Fprintf(logW, "%s +%s %s\n", now.Format(time.RFC3339), now.Sub(start).Round(time.Millisecond), fmt.Sprintf(format, args...))
+	}
+	logStep("running scenario %q on network %s", sc.Name, initial.Name)
+
+	restore := func() error {
+		if err := restoreLinks(target, network, initial); err != nil {
+			logStep("couldn't restore every link: %v", err)
+			return err
+		}
+		logStep("restored every link")
+		return nil
+	}
+
+	for _, step := range sc.Steps {
+		timer := time.NewTimer(time.Until(start.Add(step.at)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logStep("aborted: restoring every link")
+			if err := restore(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		logStep("%s", step)
+		if err := runStep(target, network, step, initial); err != nil {
+			logStep("failed: %v: restoring every link", err)
+			// The step's error is the one worth reporting: restore already logs its own.
+			restore()
+			return err
+		}
+	}
+
+	logStep("scenario %q done", sc.Name)
+	return nil
+}
+
+func runStep(target scenarioTarget, network string, step ScenarioStep, initial NetworkInfo) error {
+	if step.Action == actionRestore {
+		return restoreLinks(target, network, initial)
+	}
+
+	if step.Subnet == "" && (step.Action == actionDown || step.Action == actionUp) {
+		return target.SetNodeState(network, step.Node, step.Action == actionUp)
+	}
+
+	current, err := target.Inspect(network)
+	if err != nil {
+		return err
+	}
+	links, err := step.selectLinks(current)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		// Outbound access is no link of the definition's, so it can't be impaired.
+		if link.Subnet == outboundSubnetName && (step.Action == actionImpair || step.Action == actionClear) {
+			continue
+		}
+		switch step.Action {
+		case actionDown, actionUp:
+			err = target.SetLinkState(network, link.Node, link.Subnet, step.Action == actionUp)
+		case actionImpair:
+			err = target.SetLinkImpairments(network, link.Node, link.Subnet, step.Impairments)
+		case actionClear:
+			err = target.SetLinkImpairments(network, link.Node, link.Subnet, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreLinks brings every link back to the state and impairments they had in initial.
+func restoreLinks(target scenarioTarget, network string, initial NetworkInfo) error {
+	current, err := target.Inspect(network)
+	if err != nil {
+		return err
+	}
+	currentLinks := map[string]LinkDetails{}
+	for _, link := range current.Links {
+		currentLinks[linkKey(link.Node, link.Subnet)] = link
+	}
+
+	for _, link := range initial.Links {
+		cur, ok := currentLinks[linkKey(link.Node, link.Subnet)]
+		if !ok {
+			continue
+		}
+		if cur.Down != link.Down {
+			if err := target.SetLinkState(network, link.Node, link.Subnet, !link.Down); err != nil {
+				return err
+			}
+		}
+		if !sameSettings(cur.Impairments, link.Impairments) {
+			if err := target.SetLinkImpairments(network, link.Node, link.Subnet, link.Impairments); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package dvnet
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestScenarioValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []ScenarioStep
+		wantErr bool
+	}{
+		{"valid", []ScenarioStep{
+			{At: "30s", Action: actionRestore},
+			{At: "10s", Action: actionDown, Node: "R-1", Subnet: "C"},
+			{At: "20s", Action: actionImpair, Subnet: "B", Impairments: &LinkImpairments{Delay: "200ms"}},
+		}, false},
+		{"bad time", []ScenarioStep{{At: "10", Action: actionDown, Node: "R-1"}}, true},
+		{"unknown action", []ScenarioStep{{At: "10s", Action: "explode", Node: "R-1"}}, true},
+		{"no selection", []ScenarioStep{{At: "10s", Action: actionDown}}, true},
+		{"no impairments", []ScenarioStep{{At: "10s", Action: actionImpair, Node: "R-1"}}, true},
+		{"bad impairments", []ScenarioStep{{At: "10s", Action: actionImpair, Node: "R-1", Impairments: &LinkImpairments{Loss: 120}}}, true},
+	}
+	for _, tt := range tests {
+		sc := Scenario{Name: tt.name, Steps: tt.steps}
+		if err := sc.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() err %v; wanted error %t", tt.name, err, tt.wantErr)
+		}
+	}
+
+	sc := Scenario{Steps: tests[0].steps}
+	sc.validate()
+	gotActions := []string{}
+	for _, step := range sc.Steps {
+		gotActions = append(gotActions, step.Action)
+	}
+	if want := []string{actionDown, actionImpair, actionRestore}; !cmp.Equal(gotActions, want) {
+		t.Errorf("validate() sorted steps into %v; wanted %v", gotActions, want)
+	}
+}
+
+func TestRunScenario(t *testing.T) {
+	d, _ := testDriver(t)
+	initial, err := d.Inspect("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := Scenario{Name: "reconvergence", Steps: []ScenarioStep{
+		{At: "0s", Action: actionDown, Node: "R-1", Subnet: "C"},
+		{At: "5ms", Action: actionImpair, Subnet: "B", Impairments: &LinkImpairments{Delay: "200ms"}},
+		{At: "10ms", Action: actionDown, Node: "A-1"},
+	}}
+	if err := sc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	var logW strings.Builder
+	if err := d.RunScenario(context.Background(), "0123", sc, &logW); err != nil {
+		t.Fatalf("RunScenario() err %v", err)
+	}
+	for _, want := range []string{"bring link R-1 <-> C down", "impair subnet B: delay 200ms", "bring node A-1 down", "done"} {
+		if !strings.Contains(logW.String(), want) {
+			t.Errorf("RunScenario() log should contain %q; got:\n%s", want, logW.String())
+		}
+	}
+
+	ns, _ := d.State("0123")
+	if !ns.Links[linkKey("R-1", "C")].Down || !ns.Links[linkKey("A-1", "A")].Down {
+		t.Errorf("RunScenario() should have brought R-1 <-> C and A-1 down")
+	}
+	for _, node := range []string{"B-1", "B-2", "R-2"} {
+		if li := ns.Links[linkKey(node, "B")].Impairments; li == nil || li.Delay != "200ms" {
+			t.Errorf("RunScenario() should have delayed %s's link to B; got %v", node, li)
+		}
+	}
+
+	if err := restoreLinks(d, "0123", initial); err != nil {
+		t.Fatalf("restoreLinks() err %v", err)
+	}
+	got, _ := d.Inspect("0123")
+	if diff := cmp.Diff(initial, got); diff != "" {
+		t.Errorf("restoreLinks() left the network different (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunScenarioAbort(t *testing.T) {
+	d, _ := testDriver(t)
+	initial, _ := d.Inspect("0123")
+
+	sc := Scenario{Steps: []ScenarioStep{
+		{At: "0s", Action: actionDown, Node: "R-2"},
+		{At: "1h", Action: actionUp, Node: "R-2"},
+	}}
+	sc.validate()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var logW strings.Builder
+	if err := d.RunScenario(ctx, "0123", sc, &logW); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunScenario() err %v; wanted it to be aborted", err)
+	}
+	if !strings.Contains(logW.String(), "restored every link") {
+		t.Errorf("RunScenario() log should mention the restoration; got:\n%s", logW.String())
+	}
+	got, _ := d.Inspect("0123")
+	if diff := cmp.Diff(initial, got); diff != "" {
+		t.Errorf("RunScenario() didn't restore the network (-want +got):\n%s", diff)
+	}
+
+	withRestore := Scenario{Steps: []ScenarioStep{
+		{At: "0s", Action: actionImpair, Node: "R-2", Impairments: &LinkImpairments{Loss: 10}},
+		{At: "5ms", Action: actionRestore},
+	}}
+	withRestore.validate()
+	if err := d.RunScenario(context.Background(), "0123", withRestore, &logW); err != nil {
+		t.Fatalf("RunScenario() err %v", err)
+	}
+	got, _ = d.Inspect("0123")
+	if diff := cmp.Diff(initial, got); diff != "" {
+		t.Errorf("RunScenario() didn't restore the network (-want +got):\n%s", diff)
+	}
+
+	unknown := Scenario{Steps: []ScenarioStep{{At: "0s", Action: actionDown, Node: "Z-1"}}}
+	unknown.validate()
+	if err := d.RunScenario(context.Background(), "0123", unknown, &logW); err == nil {
+		t.Errorf("RunScenario() should reject steps on unknown nodes")
+	}
+}
+
+// failingTarget is a Driver whose nodes named failNode can't be brought up or down.
+type failingTarget struct {
+	Driver
+	failNode string
+}
+
+func (ft failingTarget) SetNodeState(network, node string, up bool) error {
+	if node == ft.failNode {
+		return errors.New("injected failure")
+	}
+	return ft.Driver.SetNodeState(network, node, up)
+}
+
+func TestRunScenarioFailure(t *testing.T) {
+	d, _ := testDriver(t)
+	initial, _ := d.Inspect("0123")
+
+	sc := Scenario{Steps: []ScenarioStep{
+		{At: "0s", Action: actionDown, Node: "R-1", Subnet: "C"},
+		{At: "0s", Action: actionImpair, Subnet: "B", Impairments: &LinkImpairments{Delay: "200ms"}},
+		{At: "5ms", Action: actionDown, Node: "A-1"},
+		{At: "10ms", Action: actionDown, Node: "R-2"},
+	}}
+	if err := sc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	var logW strings.Builder
+	if err := runScenario(context.Background(), failingTarget{d, "A-1"}, "0123", sc, &logW); err == nil {
+		t.Fatalf("runScenario() should have failed on A-1")
+	}
+	if !strings.Contains(logW.String(), "restored every link") {
+		t.Errorf("runScenario() log should mention the restoration; got:\n%s", logW.String())
+	}
+	if strings.Contains(logW.String(), "bring node R-2 down") {
+		t.Errorf("runScenario() shouldn't go on after a step fails; got:\n%s", logW.String())
+	}
+	got, _ := d.Inspect("0123")
+	if diff := cmp.Diff(initial, got); diff != "" {
+		t.Errorf("runScenario() didn't restore the network (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,266 @@
+package dvnet
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// BandwidthShaping caps the bandwidth of a host's link with tc-htb(8).
+// Egress shapes what the host sends and Ingress what it receives.
+type BandwidthShaping struct {
+	Egress  *ShapingPolicy `json:"egress,omitempty"`
+	Ingress *ShapingPolicy `json:"ingress,omitempty"`
+}
+
+// ShapingPolicy shapes one direction of a link: Classes share its Rate, each
+// one being guaranteed its own and allowed to borrow up to its Ceil. Packets
+// go to the class listing their DSCP value or else to the one listing none.
+// Without classes the whole link is simply capped at Rate.
+type ShapingPolicy struct {
+	Rate    string         `json:"rate"`
+	Classes []ShapingClass `json:"classes,omitempty"`
+}
+
+// ShapingClass is a class of traffic within a ShapingPolicy. Its Ceil
+// defaults to the policy's rate and classes with a lower Priority
+// get to borrow spare bandwidth first.
+type ShapingClass struct {
+	Name     string `json:"name"`
+	Rate     string `json:"rate"`
+	Ceil     string `json:"ceil,omitempty"`
+	Priority uint32 `json:"priority,omitempty"`
+	DSCP     []int  `json:"dscp,omitempty"`
+}
+
+const (
+	maxDSCP         int    = 63
+	maxHTBPriority  uint32 = 7
+	htbClassMinor   uint16 = 10
+	dscpFilterPrio  uint16 = 1
+	dscpFilterMask  uint32 = 0x00fc0000
+	dscpFilterShift int    = 18
+)
+
+// Handle of the HTB qdisc shaping a link: it hangs from the netem impairing
+// the link, if any, or else from the root. Its classes go below 20:1.
+var htbHandle uint32 = netlink.MakeHandle(20, 0)
+
+func (bs *BandwidthShaping) egress() *ShapingPolicy {
+	if bs == nil {
+		return nil
+	}
+	return bs.Egress
+}
+
+func (bs *BandwidthShaping) ingress() *ShapingPolicy {
+	if bs == nil {
+		return nil
+	}
+	return bs.Ingress
+}
+
+func (bs BandwidthShaping) String() string {
+	parts := []string{}
+	if bs.Egress != nil {
+		parts = append(parts, "egress "+bs.Egress.String())
+	}
+	if bs.Ingress != nil {
+		parts = append(parts, "ingress "+bs.Ingress.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (sp ShapingPolicy) String() string {
+	if len(sp.Classes) == 0 {
+		return sp.Rate
+	}
+	classes := []string{}
+	for _, class := range sp.Classes {
+		desc := class.Name + " " + class.Rate
+		if class.Ceil != "" {
+			desc += "-" + class.Ceil
+		}
+		if len(class.DSCP) != 0 {
+			desc += fmt.Sprintf(" dscp %v", class.DSCP)
+		}
+		classes = append(classes, desc)
+	}
+	return fmt.Sprintf("%s (%s)", sp.Rate, strings.Join(classes, ", "))
+}
+
+func (bs BandwidthShaping) validate() error {
+	if bs.Egress == nil && bs.Ingress == nil {
+		return fmt.Errorf("shaping needs either an egress or an ingress policy")
+	}
+	for _, p := range []struct {
+		name   string
+		policy *ShapingPolicy
+	}{{"egress", bs.Egress}, {"ingress", bs.Ingress}} {
+		if p.policy == nil {
+			continue
+		}
+		if err := p.policy.validate(); err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the classes fit within the policy's rate and that there's
+// exactly one class for the traffic not matching any DSCP value.
+func (sp ShapingPolicy) validate() error {
+	rate, err := parseRate(sp.Rate)
+	if err != nil {
+		return err
+	}
+
+	var guaranteed uint64
+	names, dscps := map[string]bool{}, map[int]string{}
+	defaults := 0
+	for _, class := range sp.Classes {
+		if class.Name == "" || names[class.Name] {
+			return fmt.Errorf("classes need a unique name; got %q", class.Name)
+		}
+		names[class.Name] = true
+
+		classRate, err := parseRate(class.Rate)
+		if err != nil {
+			return fmt.Errorf("class %s: %w", class.Name, err)
+		}
+		guaranteed += classRate
+		if class.Ceil != "" {
+			ceil, err := parseRate(class.Ceil)
+			if err != nil {
+				return fmt.Errorf("class %s: %w", class.Name, err)
+			}
+			if ceil < classRate || ceil > rate {
+				return fmt.Errorf("class %s: the ceiling should be between the class' rate and %s", class.Name, sp.Rate)
+			}
+		}
+		if class.Priority > maxHTBPriority {
+			return fmt.Errorf("class %s: priority %d is not within [0, %d]", class.Name, class.Priority, maxHTBPriority)
+		}
+
+		if len(class.DSCP) == 0 {
+			defaults++
+		}
+		for _, dscp := range class.DSCP {
+			if dscp < 0 || dscp > maxDSCP {
+				return fmt.Errorf("class %s: DSCP %d is not within [0, %d]", class.Name, dscp, maxDSCP)
+			}
+			if other, ok := dscps[dscp]; ok {
+				return fmt.Errorf("classes %s and %s both match DSCP %d", other, class.Name, dscp)
+			}
+			dscps[dscp] = class.Name
+		}
+	}
+	if guaranteed > rate {
+		return fmt.Errorf("the classes are guaranteed more than %s", sp.Rate)
+	}
+	if len(sp.Classes) != 0 && defaults != 1 {
+		return fmt.Errorf("exactly one class should match no DSCP values; got %d", defaults)
+	}
+	return nil
+}
+
+// classes returns the policy's classes, which boil down
+// to a single one taking all of the rate if there are none.
+func (sp ShapingPolicy) classes() []ShapingClass {
+	if len(sp.Classes) == 0 {
+		return []ShapingClass{{Name: "default", Rate: sp.Rate}}
+	}
+	return sp.Classes
+}
+
+// tc returns the HTB qdisc shaping the link with the given index as described by
+// sp below parent, together with its classes and the filters sorting packets
+// into them by their DSCP value.
+func (sp ShapingPolicy) tc(linkIndex int, parent uint32) (netlink.Qdisc, []netlink.Class, []netlink.Filter, error) {
+	if err := sp.validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	rate, _ := parseRate(sp.Rate)
+	rootClass := netlink.MakeHandle(20, 1)
+
+	htb := netlink.NewHtb(netlink.QdiscAttrs{LinkIndex: linkIndex, Handle: htbHandle, Parent: parent})
+	classes := []netlink.Class{netlink.NewHtbClass(
+		netlink.ClassAttrs{LinkIndex: linkIndex, Handle: rootClass, Parent: htbHandle},
+		netlink.HtbClassAttrs{Rate: rate * 8, Ceil: rate * 8})}
+	filters := []netlink.Filter{}
+
+	for i, class := range sp.classes() {
+		classID := netlink.MakeHandle(20, htbClassMinor+uint16(i))
+		classRate, _ := parseRate(class.Rate)
+		ceil := rate
+		if class.Ceil != "" {
+			ceil, _ = parseRate(class.Ceil)
+		}
+		classes = append(classes, netlink.NewHtbClass(
+			netlink.ClassAttrs{LinkIndex: linkIndex, Handle: classID, Parent: rootClass},
+			netlink.HtbClassAttrs{Rate: classRate * 8, Ceil: ceil * 8, Prio: class.Priority}))
+
+		if len(class.DSCP) == 0 {
+			htb.Defcls = uint32(htbClassMinor) + uint32(i)
+		}
+		// The DSCP lives in the upper 6 bits of the second byte of the IPv4 header.
+		for _, dscp := range class.DSCP {
+			filters = append(filters, &netlink.U32{
+				FilterAttrs: netlink.FilterAttrs{LinkIndex: linkIndex, Parent: htbHandle, Priority: dscpFilterPrio, Protocol: unix.ETH_P_IP},
+				ClassId:     classID,
+				Sel: &netlink.TcU32Sel{Flags: netlink.TC_U32_TERMINAL, Nkeys: 1, Keys: []netlink.TcU32Key{
+					{Mask: dscpFilterMask, Val: uint32(dscp) << dscpFilterShift}}},
+			})
+		}
+	}
+	return htb, classes, filters, nil
+}
+
+// desiredShaping returns the shaping def places on the link between node and
+// subnet: the host's own or else the subnet's. Routers aren't shaped.
+func desiredShaping(def netDef, node, subnet string) *BandwidthShaping {
+	subnetDef := def.Subnets[subnet]
+	hDef, ok := subnetDef.Hosts[node]
+	if !ok {
+		return nil
+	}
+	if hDef.Shaping != nil {
+		return hDef.Shaping
+	}
+	return subnetDef.Shaping
+}
+
+// validateShaping checks the shaping on every host can be installed:
+// ingress shaping happens on the bridge end, which point-to-point
+// links lack, and rate impairments take the place HTB would.
+func validateShaping(def netDef) error {
+	for _, subnetName := range sortedKeys(def.Subnets) {
+		subnet := def.Subnets[subnetName]
+		if subnet.Shaping != nil {
+			if err := subnet.Shaping.validate(); err != nil {
+				return fmt.Errorf("subnet %s: %w", subnetName, err)
+			}
+		}
+		for _, host := range sortedKeys(subnet.Hosts) {
+			hDef := subnet.Hosts[host]
+			if hDef.Shaping != nil {
+				if err := hDef.Shaping.validate(); err != nil {
+					return fmt.Errorf("host %s: %w", host, err)
+				}
+			}
+			shaping := desiredShaping(def, host, subnetName)
+			if shaping == nil {
+				continue
+			}
+			if shaping.Ingress != nil && subnet.isP2P() {
+				return fmt.Errorf("host %s: ingress shaping isn't supported on point-to-point subnets", host)
+			}
+			if hDef.Link != nil && hDef.Link.Rate != "" {
+				return fmt.Errorf("host %s: rate impairments can't be combined with shaping", host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package dvnet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+)
+
+func TestShapingPolicyValidation(t *testing.T) {
+	tests := []struct {
+		sp      ShapingPolicy
+		wantErr bool
+	}{
+		{ShapingPolicy{Rate: "10mbit"}, false},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{
+			{Name: "voice", Rate: "2mbit", Ceil: "4mbit", DSCP: []int{46}},
+			{Name: "bulk", Rate: "8mbit", Priority: 3},
+		}}, false},
+		{ShapingPolicy{Rate: "fast"}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "6mbit"}, {Name: "b", Rate: "6mbit", DSCP: []int{10}}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "2mbit", Ceil: "20mbit"}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "2mbit", Ceil: "1mbit"}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "2mbit"}, {Name: "b", Rate: "2mbit"}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "2mbit", DSCP: []int{46}}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "2mbit"}, {Name: "a", Rate: "2mbit", DSCP: []int{46}}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "2mbit"}, {Name: "b", Rate: "2mbit", DSCP: []int{64}}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{
+			{Name: "a", Rate: "2mbit"}, {Name: "b", Rate: "2mbit", DSCP: []int{46}}, {Name: "c", Rate: "2mbit", DSCP: []int{46}}}}, true},
+		{ShapingPolicy{Rate: "10mbit", Classes: []ShapingClass{{Name: "a", Rate: "2mbit", Priority: 8}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.sp.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s.validate() err %v; wanted error %t", tt.sp, err, tt.wantErr)
+		}
+	}
+}
+
+func TestShapingValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnets string
+		wantErr bool
+	}{
+		{"shaping a subnet", `"A": {"cidr": "10.0.0.0/24", "shaping": {"egress": {"rate": "10mbit"}}, "hosts": {"A-1": {"image": "h"}}}`, false},
+		{"an empty shaping", `"A": {"cidr": "10.0.0.0/24", "hosts": {"A-1": {"image": "h", "shaping": {}}}}`, true},
+		{"shaping with a rate impairment", `"A": {"cidr": "10.0.0.0/24", "shaping": {"egress": {"rate": "10mbit"}}, "hosts": {"A-1": {"image": "h", "link": {"rate": "1mbit"}}}}`, true},
+		{"shaping with a delay", `"A": {"cidr": "10.0.0.0/24", "shaping": {"egress": {"rate": "10mbit"}}, "hosts": {"A-1": {"image": "h", "link": {"delay": "10ms"}}}}`, false},
+		{"ingress shaping on a point-to-point subnet", `"A": {"cidr": "10.0.0.0/31", "type": "p2p", "hosts": {"A-1": {"image": "h", "shaping": {"ingress": {"rate": "1mbit"}}}, "A-2": {"image": "h"}}}`, true},
+	}
+
+	for _, test := range tests {
+		rawDef := `{"name": "Shaping", "subnets": {` + test.subnets + `}, "routers": {}}`
+		if _, err := parseDef([]byte(rawDef)); (err != nil) != test.wantErr {
+			t.Errorf("%s: parseDef() err %v; wanted an error: %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestShapingPolicyTC(t *testing.T) {
+	sp := ShapingPolicy{Rate: "8mbit", Classes: []ShapingClass{
+		{Name: "voice", Rate: "2mbit", Ceil: "4mbit", DSCP: []int{46, 40}},
+		{Name: "bulk", Rate: "1mbit"},
+	}}
+	qdisc, classes, filters, err := sp.tc(7, netlink.MakeHandle(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	htb, ok := qdisc.(*netlink.Htb)
+	if !ok || htb.Parent != netlink.MakeHandle(1, 1) || htb.Defcls != 11 {
+		t.Errorf("tc() qdisc = %+v; wanted an HTB below the netem defaulting to class 20:11", qdisc)
+	}
+	if len(classes) != 3 {
+		t.Fatalf("tc() classes = %v; wanted a root class and two leaves", classes)
+	}
+	voice := classes[1].(*netlink.HtbClass)
+	if voice.Handle != netlink.MakeHandle(20, 10) || voice.Parent != netlink.MakeHandle(20, 1) || voice.Rate != 250000 || voice.Ceil != 500000 {
+		t.Errorf("tc() voice class = %+v; wanted 250000 bytes/s borrowing up to 500000 below 20:1", voice)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("tc() filters = %v; wanted one per DSCP value", filters)
+	}
+	ef := filters[0].(*netlink.U32)
+	if key := ef.Sel.Keys[0]; ef.ClassId != netlink.MakeHandle(20, 10) || key.Val != 46<<18 || key.Mask != 0x00fc0000 {
+		t.Errorf("tc() filter = %+v; wanted DSCP 46 into class 20:10", ef)
+	}
+
+	qdisc, classes, filters, err = ShapingPolicy{Rate: "1mbit"}.tc(7, netlink.HANDLE_ROOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qdisc.(*netlink.Htb).Defcls != 10 || len(classes) != 2 || len(filters) != 0 {
+		t.Errorf("tc() = %+v %v %v; wanted a single class taking everything", qdisc, classes, filters)
+	}
+}
+
+func TestPlanShapedNetwork(t *testing.T) {
+	plan, err := PlanNetwork("../demos/shaping/net.json")
+	if err != nil {
+		t.Fatalf("PlanNetwork() err %v", err)
+	}
+
+	// PIDs depend on the order containers are run in, so leave them out.
+	shaped := map[string]string{}
+	for _, step := range plan.Steps {
+		if strings.HasPrefix(step, "shape ") {
+			iface := strings.Fields(step)[1]
+			shaped[iface] = step[strings.Index(step, ": ")+2:]
+		}
+	}
+	want := map[string]string{
+		"bth-a-2": "20mbit",
+		"etha-2":  "10mbit",
+		"etha-1":  "10mbit (voice 2mbit-4mbit dscp [46], video 5mbit dscp [34 36 38], bulk 1mbit)",
+	}
+	if !cmp.Equal(shaped, want) {
+		t.Errorf("PlanNetwork() shaped %v; wanted %v", shaped, want)
+	}
+}
@@ -0,0 +1,201 @@
+package dvnet
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NetworkStatus summarises a network we manage.
+type NetworkStatus struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Origin  string       `json:"origin"`
+	DefPath string       `json:"def_path"`
+	Nodes   []NodeStatus `json:"nodes"`
+}
+
+// NodeStatus summarises a host or router and the state of its container.
+// DownLinks are the subnets whose link has been administratively brought
+// down and Isolated tells whether every one of them has.
+type NodeStatus struct {
+	Name        string   `json:"name"`
+	Kind        string   `json:"kind"`
+	Subnets     []string `json:"subnets"`
+	ContainerID string   `json:"container_id"`
+	State       string   `json:"state"`
+	DownLinks   []string `json:"down_links,omitempty"`
+	Isolated    bool     `json:"isolated,omitempty"`
+}
+
+// Up brings up the network defined at defPath without going through
+// the Docker daemon's plugin machinery. It returns the network's ID.
+// The network's topology is exported in every one of topologyFormats.
+func (d Driver) Up(defPath string, topologyFormats ...string) (string, error) {
+	absDefPath, err := filepath.Abs(defPath)
+	if err != nil {
+		return "", err
+	}
+
+	netDefinition, err := loadDef(absDefPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't load the network definition: %w", err)
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Only look at names: a new network's name might well look like a prefix of some other's ID.
+	networkIDs, err := d.networksNamed(netDefinition.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(networkIDs) > 0 {
+		return "", fmt.Errorf("network %q is already up with ID %s", netDefinition.Name, networkIDs[0])
+	}
+
+	networkID, err := newNetworkID()
+	if err != nil {
+		return "", err
+	}
+
+	netOpts := globalOpts{netDefPath: absDefPath, bridgeName: bridgePrefix + truncateID(networkID), topologyFormats: topologyFormats}
+	if err := d.createNetwork(networkID, originCLI, netOpts); err != nil {
+		return "", err
+	}
+	return networkID, nil
+}
+
+// Down brings down a network given its name, its ID or a prefix of the latter,
+// regardless of it having been brought up by the Docker daemon or by Up.
+func (d Driver) Down(network string) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	networkID, err := d.resolveNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	return d.deleteNetwork(networkID)
+}
+
+// resolveNetwork finds the ID of a network given its ID, its name (i.e.
+// the one in its definition) or a prefix of its ID, in that order.
+func (d Driver) resolveNetwork(network string) (string, error) {
+	networkIDs, err := d.store.ids()
+	if err != nil {
+		return "", err
+	}
+
+	prefixMatches := []string{}
+	for _, networkID := range networkIDs {
+		if networkID == network {
+			return networkID, nil
+		}
+		if strings.HasPrefix(networkID, network) {
+			prefixMatches = append(prefixMatches, networkID)
+		}
+	}
+
+	matches, err := d.networksNamed(network)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		matches = prefixMatches
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", notFoundError{fmt.Sprintf("there's no network named %q", network)}
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%q matches several networks: %v", network, matches)
+	}
+}
+
+// networksNamed returns the IDs of the networks whose definition is named name.
+// Networks whose state can't be loaded are skipped.
+func (d Driver) networksNamed(name string) ([]string, error) {
+	networkIDs, err := d.store.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []string{}
+	for _, networkID := range networkIDs {
+		ns, err := d.store.load(networkID)
+		if err != nil {
+			log.warn("couldn't load the state of network %s: %v\n", networkID, err)
+			continue
+		}
+		if ns.Definition.Name == name {
+			matches = append(matches, networkID)
+		}
+	}
+	return matches, nil
+}
+
+// Status summarises every network we manage, skipping those whose state can't be loaded.
+func (d Driver) Status() ([]NetworkStatus, error) {
+	networkIDs, err := d.store.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []NetworkStatus{}
+	for _, networkID := range networkIDs {
+		ns, err := d.network(networkID)
+		if err != nil {
+			log.warn("couldn't load the state of network %s: %v\n", networkID, err)
+			continue
+		}
+		statuses = append(statuses, networkStatus(ns, containerState))
+	}
+	return statuses, nil
+}
+
+// networkStatus summarises ns relying on stateOf to get the state of each container.
+func networkStatus(ns *NetworkState, stateOf func(id string) string) NetworkStatus {
+	status := NetworkStatus{ID: ns.ID, Name: ns.Definition.Name, Origin: ns.Origin, DefPath: ns.DefPath}
+
+	subnetsOf, downLinksOf, linksOf := map[string][]string{}, map[string][]string{}, map[string]int{}
+	for _, link := range ns.Links {
+		linksOf[link.Node]++
+		if link.Subnet != outboundSubnetName {
+			subnetsOf[link.Node] = append(subnetsOf[link.Node], link.Subnet)
+		}
+		if link.Down {
+			downLinksOf[link.Node] = append(downLinksOf[link.Node], link.Subnet)
+		}
+	}
+
+	addNode := func(name, kind string, info containerInfo) {
+		subnets, downLinks := subnetsOf[name], downLinksOf[name]
+		sort.Strings(subnets)
+		sort.Strings(downLinks)
+		status.Nodes = append(status.Nodes, NodeStatus{
+			Name: name, Kind: kind, Subnets: subnets, ContainerID: info.ID, State: stateOf(info.ID),
+			DownLinks: downLinks, Isolated: linksOf[name] > 0 && len(downLinks) == linksOf[name]})
+	}
+	for _, subnet := range ns.Subnets {
+		for host, info := range subnet.Containers {
+			addNode(host, nodeKindHost, info)
+		}
+	}
+	for routerName, info := range ns.Routers {
+		addNode(routerName, nodeKindRouter, info)
+	}
+
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].Name < status.Nodes[j].Name })
+	return status
+}
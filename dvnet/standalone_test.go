@@ -0,0 +1,70 @@
+package dvnet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveNetwork(t *testing.T) {
+	d, _ := testDriver(t)
+
+	// A second network named just like a prefix of the first one's ID.
+	ns, err := d.store.load("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Definition.Name = "0123"
+	if err := d.store.save("fedcba9876543210", ns); err != nil {
+		t.Fatal(err)
+	}
+	// Unreadable states shouldn't get in the way.
+	if err := os.WriteFile(d.store.path("0123456789badbad"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		network string
+		want    string
+		wantErr bool
+	}{
+		{"0123456789abcdef", "0123456789abcdef", false},
+		{"Test Net 0", "0123456789abcdef", false},
+		{"0123", "fedcba9876543210", false},
+		{"01234567", "", true}, // Both 0123456789abcdef and 0123456789badbad.
+		{"0123456789a", "0123456789abcdef", false},
+		{"fed", "fedcba9876543210", false},
+		{"nope", "", true},
+	}
+	for _, test := range tests {
+		got, err := d.resolveNetwork(test.network)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("resolveNetwork(%q) = %q, err %v; wanted %q", test.network, got, err, test.want)
+		}
+	}
+}
+
+func TestUpChecksNames(t *testing.T) {
+	d, _ := testDriver(t)
+
+	defPath := filepath.Join(t.TempDir(), "net.json")
+	writeDef := func(name string) {
+		t.Helper()
+		rawDef := strings.Replace(reconcileBaseDef, "Reconcile Net", name, 1)
+		if err := os.WriteFile(defPath, []byte(rawDef), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeDef("Test Net 0")
+	if _, err := d.Up(defPath); err == nil || !strings.Contains(err.Error(), "already up") {
+		t.Errorf("Up() of a network named like a running one err %v; wanted it to be already up", err)
+	}
+
+	// Names looking like a prefix of some other network's ID are fine.
+	writeDef("0123")
+	if _, err := d.Up(defPath); err != nil {
+		t.Errorf("Up() err %v", err)
+	}
+}
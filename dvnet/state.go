@@ -0,0 +1,156 @@
+package dvnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	stateDirEnv  string = "DVNET_STATE_DIR"
+	stateFileExt string = ".json"
+	stateLock    string = ".lock"
+)
+
+var defaultStateDir string = "/var/lib/dvnet"
+
+// stateStore persists the state of every network we manage as a JSON
+// document named after the network's ID. Both the plugin and the CLI
+// go through it, so it's the source of truth on what's running.
+type stateStore struct {
+	dir string
+}
+
+func newStateStore() (stateStore, error) {
+	dir := defaultStateDir
+	if envDir := os.Getenv(stateDirEnv); envDir != "" {
+		dir = envDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return stateStore{}, fmt.Errorf("couldn't create the state directory %s: %w", dir, err)
+	}
+	return stateStore{dir: dir}, nil
+}
+
+func (s stateStore) path(networkID string) string {
+	return filepath.Join(s.dir, networkID+stateFileExt)
+}
+
+// lock grabs an exclusive lock on the store so that other dvnet processes
+// don't alter the networks we're working on. The returned function releases it.
+func (s stateStore) lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, stateLock), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (s stateStore) save(networkID string, ns *NetworkState) error {
+	rawState, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	// Write and rename so that readers never see half-written states.
+	tmpPath := s.path(networkID) + ".tmp"
+	if err := os.WriteFile(tmpPath, rawState, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path(networkID))
+}
+
+// load returns the state of networkID. The returned error satisfies
+// os.IsNotExist if the store knows nothing about the network.
+func (s stateStore) load(networkID string) (*NetworkState, error) {
+	rawState, err := os.ReadFile(s.path(networkID))
+	if err != nil {
+		return nil, err
+	}
+	ns := &NetworkState{}
+	if err := json.Unmarshal(rawState, ns); err != nil {
+		return nil, fmt.Errorf("corrupted state for network %s: %w", networkID, err)
+	}
+	for subnetName, subnet := range ns.Subnets {
+		if subnet.P2P || subnet.Switched {
+			continue
+		}
+		subnet.Bridge = &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: subnet.BridgeName}}
+		ns.Subnets[subnetName] = subnet
+	}
+	return ns, nil
+}
+
+func (s stateStore) remove(networkID string) error {
+	if err := os.Remove(s.path(networkID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ids returns the IDs of every network in the store, sorted.
+func (s stateStore) ids() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasSuffix(name, stateFileExt) {
+			ids = append(ids, strings.TrimSuffix(name, stateFileExt))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// newNetworkID generates an ID just like the ones handed out by the Docker daemon.
+func newNetworkID() (string, error) {
+	rawID := make([]byte, 32)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(rawID), nil
+}
+
+type persistedAddresser struct {
+	CIDRBlock   string            `json:"cidr"`
+	CurrentIP   net.IP            `json:"current_ip"`
+	AssignedIPs map[string]net.IP `json:"assigned_ips"`
+}
+
+func (sA subnetAddresser) MarshalJSON() ([]byte, error) {
+	return json.Marshal(persistedAddresser{
+		CIDRBlock: sA.cidrBlock.String(), CurrentIP: sA.currentIP, AssignedIPs: sA.AssignedIPs})
+}
+
+func (sA *subnetAddresser) UnmarshalJSON(data []byte) error {
+	var pA persistedAddresser
+	if err := json.Unmarshal(data, &pA); err != nil {
+		return err
+	}
+	_, cidrBlock, err := net.ParseCIDR(pA.CIDRBlock)
+	if err != nil {
+		return err
+	}
+	*sA = subnetAddresser{cidrBlock: *cidrBlock, currentIP: pA.CurrentIP.To4(), AssignedIPs: pA.AssignedIPs}
+	if sA.AssignedIPs == nil {
+		sA.AssignedIPs = map[string]net.IP{}
+	}
+	return nil
+}
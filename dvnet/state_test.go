@@ -0,0 +1,80 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStateStoreRoundTrip(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	store, err := newStateStore()
+	if err != nil {
+		t.Fatalf("newStateStore() err %v", err)
+	}
+
+	want := plannedState(t, "../demos/quagga/net.json")
+
+	if err := store.save("0123456789", want); err != nil {
+		t.Fatalf("save() err %v", err)
+	}
+	got, err := store.load("0123456789")
+	if err != nil {
+		t.Fatalf("load() err %v", err)
+	}
+
+	if diff := cmp.Diff(want.Links, got.Links); diff != "" {
+		t.Errorf("load() links mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want.Routes, got.Routes); diff != "" {
+		t.Errorf("load() routes mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want.Definition, got.Definition); diff != "" {
+		t.Errorf("load() definition mismatch (-want +got):\n%s", diff)
+	}
+	for subnetName, subnet := range want.Subnets {
+		if got.Subnets[subnetName].Bridge.Name != subnet.Bridge.Name {
+			t.Errorf("load() bridge for %s = %s; wanted %s", subnetName, got.Subnets[subnetName].Bridge.Name, subnet.Bridge.Name)
+		}
+	}
+	rawWant, _ := json.Marshal(want.Addressers)
+	rawGot, _ := json.Marshal(got.Addressers)
+	if string(rawWant) != string(rawGot) {
+		t.Errorf("load() addressers = %s; wanted %s", rawGot, rawWant)
+	}
+
+	// Restored addressers should keep on handing out addresses where they left off.
+	if next := got.Addressers["A"].nextCIDR("A-3"); next != "10.0.0.4/24" {
+		t.Errorf("nextCIDR() after load() = %s; wanted 10.0.0.4/24", next)
+	}
+
+	if ids, err := store.ids(); err != nil || !cmp.Equal(ids, []string{"0123456789"}) {
+		t.Errorf("ids() = %v; wanted [0123456789]; err %v", ids, err)
+	}
+	if err := store.remove("0123456789"); err != nil {
+		t.Errorf("remove() err %v", err)
+	}
+	if ids, _ := store.ids(); len(ids) != 0 {
+		t.Errorf("ids() after remove() = %v; wanted none", ids)
+	}
+}
+
+// plannedState builds the network defined at defPath on a planBackend
+// so that tests get a NetworkState without touching the host.
+func plannedState(t *testing.T, defPath string) *NetworkState {
+	t.Helper()
+	def, err := loadDef(defPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netGraph, err := genGraph(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := newNetworkState(newPlanBackend(), globalOpts{netDefPath: defPath})
+	if err := buildNetwork(ns, def, netGraph); err != nil {
+		t.Fatalf("buildNetwork() err %v", err)
+	}
+	return ns
+}
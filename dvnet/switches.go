@@ -0,0 +1,247 @@
+package dvnet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	switchLinkPrefix string = "sw-"
+	minSTPPriority   int    = 0
+	maxSTPPriority   int    = 65535
+)
+
+// switchInfo is a switch we created: the bridge backing it and its subnet.
+type switchInfo struct {
+	Subnet     string `json:"subnet"`
+	BridgeName string `json:"bridge_name"`
+}
+
+// switchLinkInfo is the veth pair wiring two switches together.
+type switchLinkInfo struct {
+	Switches [2]string `json:"switches"`
+	Ends     [2]string `json:"ends"`
+}
+
+// switchLinkKey identifies the link between switches a and b regardless of their order.
+func switchLinkKey(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return a + "/" + b
+}
+
+// switchLinks returns the sorted pairs of switches def wires together.
+func switchLinks(def netDef) [][2]string {
+	seen := map[string]bool{}
+	links := [][2]string{}
+	for _, switchName := range sortedKeys(def.Switches) {
+		for _, other := range def.Switches[switchName].Links {
+			if key := switchLinkKey(switchName, other); !seen[key] {
+				seen[key] = true
+				pair := [2]string{switchName, other}
+				if other < switchName {
+					pair = [2]string{other, switchName}
+				}
+				links = append(links, pair)
+			}
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return switchLinkKey(links[i][0], links[i][1]) < switchLinkKey(links[j][0], links[j][1])
+	})
+	return links
+}
+
+// subnetSwitches returns the sorted names of the switches def places on subnetName.
+func subnetSwitches(def netDef, subnetName string) []string {
+	switches := []string{}
+	for _, switchName := range sortedKeys(def.Switches) {
+		if def.Switches[switchName].Subnet == subnetName {
+			switches = append(switches, switchName)
+		}
+	}
+	return switches
+}
+
+// validateSwitches checks switches are on plain subnets, are wired to other
+// switches on the same subnet and are the only thing nodes are plugged into
+// on their subnets. Switches can't share their names with subnets or trunks
+// either: they all end up backed by a bridge named after them.
+func validateSwitches(def netDef) error {
+	for _, switchName := range sortedKeys(def.Switches) {
+		sw := def.Switches[switchName]
+		subnet, ok := def.Subnets[sw.Subnet]
+		if !ok {
+			return fmt.Errorf("switch %s: subnet %q doesn't exist", switchName, sw.Subnet)
+		}
+		if subnet.isP2P() || subnet.VLAN != 0 {
+			return fmt.Errorf("switch %s: subnet %s can't have switches: it's either point-to-point or on a VLAN", switchName, sw.Subnet)
+		}
+		if _, ok := def.Subnets[switchName]; ok {
+			return fmt.Errorf("switch %s has the same name as a subnet", switchName)
+		}
+		if sw.Priority != nil {
+			if !sw.STP {
+				return fmt.Errorf("switch %s: priorities only make sense with STP enabled", switchName)
+			}
+			if *sw.Priority < minSTPPriority || *sw.Priority > maxSTPPriority {
+				return fmt.Errorf("switch %s: priority %d is not within [%d, %d]", switchName, *sw.Priority, minSTPPriority, maxSTPPriority)
+			}
+		}
+		for _, other := range sw.Links {
+			otherSw, ok := def.Switches[other]
+			if !ok {
+				return fmt.Errorf("switch %s: linked to switch %q which doesn't exist", switchName, other)
+			}
+			if other == switchName {
+				return fmt.Errorf("switch %s is linked to itself", switchName)
+			}
+			if otherSw.Subnet != sw.Subnet {
+				return fmt.Errorf("switch %s: linked to switch %s on a different subnet", switchName, other)
+			}
+		}
+	}
+
+	for subnetName, subnet := range def.Subnets {
+		if _, ok := def.Switches[subnet.trunk()]; ok && subnet.VLAN != 0 {
+			return fmt.Errorf("subnet %s: trunk %s has the same name as a switch", subnetName, subnet.trunk())
+		}
+		switches := subnetSwitches(def, subnetName)
+		for host, hDef := range subnet.Hosts {
+			if hDef.Switch != "" && !contains(switches, hDef.Switch) {
+				return fmt.Errorf("host %s: there's no switch %s on subnet %s", host, hDef.Switch, subnetName)
+			}
+		}
+	}
+	for routerName, router := range def.Routers {
+		for subnetName, switchName := range router.Switches {
+			if !contains(router.Subnets, subnetName) {
+				return fmt.Errorf("router %s: plugged into a switch on subnet %s it's not attached to", routerName, subnetName)
+			}
+			if !contains(subnetSwitches(def, subnetName), switchName) {
+				return fmt.Errorf("router %s: there's no switch %s on subnet %s", routerName, switchName, subnetName)
+			}
+		}
+	}
+	return nil
+}
+
+// createSwitches creates a bridge for every switch on def and wires them together.
+func createSwitches(netState *NetworkState, def netDef) error {
+	if netState.Switches == nil {
+		netState.Switches = map[string]switchInfo{}
+	}
+	if netState.SwitchLinks == nil {
+		netState.SwitchLinks = map[string]switchLinkInfo{}
+	}
+
+	for _, switchName := range sortedKeys(def.Switches) {
+		sw := def.Switches[switchName]
+		log.debug("creating switch %s on subnet %s\n", switchName, sw.Subnet)
+		bridge, err := netState.backend.createSwitch(switchName, sw.STP, sw.Priority)
+		if err != nil {
+			return fmt.Errorf("couldn't create switch %s: %w", switchName, err)
+		}
+		netState.Switches[switchName] = switchInfo{Subnet: sw.Subnet, BridgeName: bridge.Name}
+	}
+
+	for _, pair := range switchLinks(def) {
+		ends := [2]string{}
+		for i, switchName := range pair {
+			ends[i] = switchLinkPrefix + strings.ToLower(fmt.Sprintf("%s-%s", switchName, pair[1-i]))
+		}
+		_, end, peerEnd, err := netState.backend.createVethPair(ends[0], ends[1])
+		if err != nil {
+			log.error("couldn't create veth %s-%s: %v\n", pair[0], pair[1], err)
+			return err
+		}
+		for i, iface := range []netlink.Link{end, peerEnd} {
+			bridge := netState.Switches[pair[i]].bridge()
+			log.debug("connecting %s to %s\n", ends[i], bridge.Name)
+			if err := netState.backend.connectToBridge(iface, bridge); err != nil {
+				log.error("couldn't connect %s to %s: %v\n", ends[i], bridge.Name, err)
+				return err
+			}
+		}
+		netState.SwitchLinks[switchLinkKey(pair[0], pair[1])] = switchLinkInfo{Switches: pair, Ends: ends}
+	}
+	return nil
+}
+
+// removeSwitches undoes what createSwitches did. The veth pairs wiring
+// switches together live on the host, so they must be removed explicitly.
+func removeSwitches(netState *NetworkState) {
+	for _, key := range sortedKeys(netState.SwitchLinks) {
+		link := netState.SwitchLinks[key]
+		if err := netState.backend.removeVeth(link.Ends[0], 0); err != nil {
+			log.error("couldn't remove veth %s: %v\n", link.Ends[0], err)
+		}
+	}
+	for _, switchName := range sortedKeys(netState.Switches) {
+		if err := netState.backend.removeBridge(netState.Switches[switchName].bridge()); err != nil {
+			log.error("couldn't remove switch %s: %v\n", switchName, err)
+		}
+	}
+}
+
+func (sw switchInfo) bridge() *netlink.Bridge {
+	return &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: sw.BridgeName}}
+}
+
+// isSwitched tells whether subnetName is made up of switches.
+func (netState *NetworkState) isSwitched(subnetName string) bool {
+	for _, sw := range netState.Switches {
+		if sw.Subnet == subnetName {
+			return true
+		}
+	}
+	return false
+}
+
+// switchOn returns the switch a node on subnetName should be plugged into:
+// switchName if given or else the subnet's first switch. Subnets without
+// switches have nothing to choose from, so an empty name is returned.
+func (netState *NetworkState) switchOn(subnetName, switchName string) (string, error) {
+	if switchName != "" {
+		if sw, ok := netState.Switches[switchName]; !ok || sw.Subnet != subnetName {
+			return "", fmt.Errorf("there's no switch %s on subnet %s", switchName, subnetName)
+		}
+		return switchName, nil
+	}
+	for _, name := range sortedKeys(netState.Switches) {
+		if netState.Switches[name].Subnet == subnetName {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// createSwitch creates the bridge backing switch name, enabling the spanning tree
+// protocol if need be. The kernel's STP settings are only exposed through sysfs.
+func (linuxBackend) createSwitch(name string, stp bool, priority *int) (*netlink.Bridge, error) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)}}
+	if err := netlink.LinkAdd(bridge); err != nil {
+		return nil, err
+	}
+
+	bridgeDir := filepath.Join("/sys/class/net", bridge.Name, "bridge")
+	if stp {
+		if err := os.WriteFile(filepath.Join(bridgeDir, "stp_state"), []byte("1"), 0644); err != nil {
+			return nil, fmt.Errorf("couldn't enable STP on %s: %w", bridge.Name, err)
+		}
+	}
+	if priority != nil {
+		if err := os.WriteFile(filepath.Join(bridgeDir, "priority"), []byte(strconv.Itoa(*priority)), 0644); err != nil {
+			return nil, fmt.Errorf("couldn't set the priority of %s: %w", bridge.Name, err)
+		}
+	}
+
+	return bridge, netlink.LinkSetUp(bridge)
+}
@@ -0,0 +1,334 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Formats a topology can be exported in.
+const (
+	TopologyDOT     string = "dot"
+	TopologyMermaid string = "mermaid"
+	TopologyJSON    string = "json"
+)
+
+// topologyExts are the extensions of the files topologies are exported to
+// at creation time. JSON ones would otherwise overwrite the definition.
+var topologyExts = map[string]string{
+	TopologyDOT:     ".dot",
+	TopologyMermaid: ".mmd",
+	TopologyJSON:    ".topology.json",
+}
+
+// Kinds of vertices besides nodeKindHost and nodeKindRouter.
+const (
+	vertexKindSubnet   string = "subnet"
+	vertexKindSwitch   string = "switch"
+	vertexKindOutbound string = "outbound"
+)
+
+// Topology is a network drawn as a graph. Subnets, switches, hosts and routers
+// are its vertices and the interfaces joining them its edges. Point-to-point
+// subnets are drawn as an edge joining their two nodes and switched subnets
+// through their switches.
+type Topology struct {
+	Name     string           `json:"name"`
+	Vertices []TopologyVertex `json:"vertices"`
+	Edges    []TopologyEdge   `json:"edges"`
+}
+
+// TopologyVertex is a subnet, switch, host or router. Subnets and switches
+// carry the bridge backing them and the CIDR block of their subnet.
+type TopologyVertex struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	CIDR   string `json:"cidr,omitempty"`
+	Bridge string `json:"bridge,omitempty"`
+	VLAN   int    `json:"vlan,omitempty"`
+}
+
+// TopologyEdge is the interface of vertex From plugged into vertex To. Edges
+// joining two nodes or two switches carry the interface at the To end too.
+type TopologyEdge struct {
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Subnet        string `json:"subnet,omitempty"`
+	Interface     string `json:"interface"`
+	Address       string `json:"address,omitempty"`
+	PeerInterface string `json:"peer_interface,omitempty"`
+	PeerAddress   string `json:"peer_address,omitempty"`
+	Down          bool   `json:"down,omitempty"`
+}
+
+func vertexID(kind, name string) string {
+	return kind + ":" + name
+}
+
+// networkTopology draws ns as it stands.
+func networkTopology(ns *NetworkState) *Topology {
+	topo := &Topology{Name: ns.Definition.Name, Vertices: []TopologyVertex{}, Edges: []TopologyEdge{}}
+
+	for _, subnetName := range sortedKeys(ns.Subnets) {
+		subnet := ns.Subnets[subnetName]
+		if subnet.P2P || subnet.Switched {
+			continue
+		}
+		addresser := ns.Addressers[subnetName]
+		vertex := TopologyVertex{ID: vertexID(vertexKindSubnet, subnetName), Kind: vertexKindSubnet, Name: subnetName,
+			CIDR: addresser.cidrBlock.String(), Bridge: subnet.BridgeName, VLAN: subnet.VLAN}
+		if subnetName == outboundSubnetName {
+			vertex.ID, vertex.Kind, vertex.Name = vertexID(vertexKindOutbound, subnetName), vertexKindOutbound, "outbound access"
+		}
+		topo.Vertices = append(topo.Vertices, vertex)
+	}
+
+	for _, switchName := range sortedKeys(ns.Switches) {
+		sw := ns.Switches[switchName]
+		addresser := ns.Addressers[sw.Subnet]
+		topo.Vertices = append(topo.Vertices, TopologyVertex{ID: vertexID(vertexKindSwitch, switchName), Kind: vertexKindSwitch,
+			Name: switchName, CIDR: addresser.cidrBlock.String(), Bridge: sw.BridgeName})
+	}
+	for _, key := range sortedKeys(ns.SwitchLinks) {
+		link := ns.SwitchLinks[key]
+		topo.Edges = append(topo.Edges, TopologyEdge{
+			From: vertexID(vertexKindSwitch, link.Switches[0]), To: vertexID(vertexKindSwitch, link.Switches[1]),
+			Interface: link.Ends[0], PeerInterface: link.Ends[1]})
+	}
+
+	kinds := map[string]string{}
+	for routerName := range ns.Routers {
+		kinds[routerName] = nodeKindRouter
+	}
+	for _, subnet := range ns.Subnets {
+		for host := range subnet.Containers {
+			kinds[host] = nodeKindHost
+		}
+	}
+	for _, node := range sortedKeys(kinds) {
+		topo.Vertices = append(topo.Vertices, TopologyVertex{ID: vertexID(kinds[node], node), Kind: kinds[node], Name: node})
+	}
+
+	for _, key := range sortedKeys(ns.Links) {
+		link := ns.Links[key]
+		edge := TopologyEdge{From: vertexID(kinds[link.Node], link.Node), Subnet: link.Subnet,
+			Interface: link.NodeEnd, Address: link.CIDR, Down: link.Down}
+		switch {
+		case link.Peer != "":
+			// Both ends share an edge, which is drawn from the first one.
+			if link.Peer < link.Node {
+				continue
+			}
+			peer := ns.Links[linkKey(link.Peer, link.Subnet)]
+			edge.To, edge.PeerInterface, edge.PeerAddress = vertexID(kinds[link.Peer], link.Peer), peer.NodeEnd, peer.CIDR
+			edge.Down = edge.Down || peer.Down
+		case link.Switch != "":
+			edge.To = vertexID(vertexKindSwitch, link.Switch)
+		case link.Subnet == outboundSubnetName:
+			edge.To = vertexID(vertexKindOutbound, link.Subnet)
+		default:
+			edge.To = vertexID(vertexKindSubnet, link.Subnet)
+		}
+		topo.Edges = append(topo.Edges, edge)
+	}
+
+	return topo
+}
+
+// PlanTopology draws the network defined at defPath as it'd be brought up.
+// Just like PlanNetwork, it doesn't touch the host at all.
+func PlanTopology(defPath string) (*Topology, error) {
+	ns, _, err := planState(defPath)
+	if err != nil {
+		return nil, err
+	}
+	return networkTopology(ns), nil
+}
+
+// ParseTopologyFormats parses a comma-separated list of topology formats.
+func ParseTopologyFormats(list string) ([]string, error) {
+	formats := []string{}
+	for _, format := range strings.Split(list, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if _, ok := topologyExts[format]; !ok {
+			return nil, fmt.Errorf("unknown topology format %q: it should be one of %s, %s or %s",
+				format, TopologyDOT, TopologyMermaid, TopologyJSON)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// Write writes the topology in the given format.
+func (topo *Topology) Write(w io.Writer, format string) error {
+	switch format {
+	case TopologyDOT:
+		return topo.WriteDOT(w)
+	case TopologyMermaid:
+		return topo.WriteMermaid(w)
+	case TopologyJSON:
+		return topo.WriteJSON(w)
+	}
+	return fmt.Errorf("unknown topology format %q", format)
+}
+
+// WriteJSON dumps the topology as an indented JSON document.
+func (topo *Topology) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(topo)
+}
+
+// lines are the lines vertices are labelled with.
+func (v TopologyVertex) lines() []string {
+	lines := []string{v.Name}
+	switch {
+	case v.Kind == vertexKindSwitch:
+		lines[0] = "switch " + v.Name
+	case v.VLAN != 0:
+		lines = append(lines, fmt.Sprintf("VLAN %d", v.VLAN))
+	}
+	if v.CIDR != "" {
+		lines = append(lines, v.CIDR)
+	}
+	if v.Bridge != "" {
+		lines = append(lines, v.Bridge)
+	}
+	return lines
+}
+
+// lines are the lines edges are labelled with: the interface at
+// each end followed by its address, if it has one.
+func (e TopologyEdge) lines() []string {
+	lines := []string{}
+	for _, end := range [][2]string{{e.Interface, e.Address}, {e.PeerInterface, e.PeerAddress}} {
+		if end[0] == "" {
+			continue
+		}
+		if end[1] != "" {
+			lines = append(lines, end[0]+" "+end[1])
+		} else {
+			lines = append(lines, end[0])
+		}
+	}
+	if e.Down {
+		lines = append(lines, "(down)")
+	}
+	return lines
+}
+
+// dotShapes are the Graphviz shapes each kind of vertex is drawn with.
+var dotShapes = map[string]string{
+	vertexKindSubnet:   `shape=ellipse, style=dashed`,
+	vertexKindOutbound: `shape=ellipse, style="dashed,bold"`,
+	vertexKindSwitch:   `shape=box3d`,
+	nodeKindHost:       `shape=box`,
+	nodeKindRouter:     `shape=octagon`,
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// WriteDOT writes the topology as an undirected Graphviz graph.
+func (topo *Topology) WriteDOT(w io.Writer) error {
+	quote := func(s string) string {
+		return `"` + dotEscaper.Replace(s) + `"`
+	}
+	label := func(lines []string) string {
+		for i, line := range lines {
+			lines[i] = dotEscaper.Replace(line)
+		}
+		return `"` + strings.Join(lines, `\n`) + `"`
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "graph %s {\n", quote(topo.Name))
+	fmt.Fprintf(&b, "\tlabel=%s;\n\tfontsize=10;\n\tnode [fontsize=10];\n\tedge [fontsize=8];\n", quote(topo.Name))
+	for _, v := range topo.Vertices {
+		fmt.Fprintf(&b, "\t%s [label=%s, %s];\n", quote(v.ID), label(v.lines()), dotShapes[v.Kind])
+	}
+	for _, e := range topo.Edges {
+		style := ""
+		if e.Down {
+			style = ", style=dotted"
+		}
+		fmt.Fprintf(&b, "\t%s -- %s [label=%s%s];\n", quote(e.From), quote(e.To), label(e.lines()), style)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidShapes are the brackets each kind of vertex is drawn within.
+var mermaidShapes = map[string][2]string{
+	vertexKindSubnet:   {"((", "))"},
+	vertexKindOutbound: {"((", "))"},
+	vertexKindSwitch:   {"[[", "]]"},
+	nodeKindHost:       {"[", "]"},
+	nodeKindRouter:     {"{{", "}}"},
+}
+
+var mermaidEscaper = strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+
+// WriteMermaid writes the topology as a Mermaid flowchart. Mermaid
+// IDs are rather restricted, so vertices are numbered instead.
+func (topo *Topology) WriteMermaid(w io.Writer) error {
+	label := func(lines []string) string {
+		for i, line := range lines {
+			lines[i] = mermaidEscaper.Replace(line)
+		}
+		return `"` + strings.Join(lines, "<br/>") + `"`
+	}
+
+	ids := map[string]string{}
+	var b strings.Builder
+	fmt.Fprintf(&b, "---\ntitle: %s\n---\ngraph LR\n", topo.Name)
+	for i, v := range topo.Vertices {
+		ids[v.ID] = fmt.Sprintf("v%d", i)
+		shape := mermaidShapes[v.Kind]
+		fmt.Fprintf(&b, "\t%s%s%s%s\n", ids[v.ID], shape[0], label(v.lines()), shape[1])
+	}
+	for _, e := range topo.Edges {
+		arrow := "---"
+		if e.Down {
+			arrow = "-.-"
+		}
+		fmt.Fprintf(&b, "\t%s %s|%s| %s\n", ids[e.From], arrow, label(e.lines()), ids[e.To])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// exportTopology writes ns's topology next to its definition in every one of
+// the given formats. Files are named after the definition: net.json gives
+// way to net.dot, net.mmd and net.topology.json.
+func exportTopology(ns *NetworkState, formats []string) error {
+	if len(formats) == 0 {
+		return nil
+	}
+	topo := networkTopology(ns)
+	base := strings.TrimSuffix(ns.DefPath, ".json")
+	for _, format := range formats {
+		path := base + topologyExts[format]
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := topo.Write(f, format); err != nil {
+			f.Close()
+			return fmt.Errorf("couldn't export the topology to %s: %w", path, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		ns.log().debug("exported the topology to %s\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPlanTopology(t *testing.T) {
+	topo, err := PlanTopology("../demos/p2p/net.json")
+	if err != nil {
+		t.Fatalf("PlanTopology() err %v", err)
+	}
+
+	ids := []string{}
+	for _, v := range topo.Vertices {
+		ids = append(ids, v.ID)
+	}
+	// Point-to-point subnet C is drawn as an edge instead.
+	wantIDs := []string{"subnet:A", "subnet:B", "outbound:outboundSubnet",
+		"host:A-1", "host:A-2", "host:B-1", "host:B-2", "router:R-1", "router:R-2"}
+	if !cmp.Equal(ids, wantIDs) {
+		t.Errorf("PlanTopology() vertices = %v; wanted %v", ids, wantIDs)
+	}
+
+	var p2pEdge *TopologyEdge
+	for i, e := range topo.Edges {
+		if e.Address == "" {
+			t.Errorf("edge %v should carry the address of its interface", e)
+		}
+		if e.Subnet == "C" {
+			if p2pEdge != nil {
+				t.Errorf("subnet C should be drawn as a single edge; got %v and %v", *p2pEdge, e)
+			}
+			p2pEdge = &topo.Edges[i]
+		}
+	}
+	if p2pEdge == nil {
+		t.Fatalf("PlanTopology() didn't draw point-to-point subnet C: %v", topo.Edges)
+	}
+	if p2pEdge.From != "router:R-1" || p2pEdge.To != "router:R-2" || p2pEdge.Interface != "ethr-1-c" || p2pEdge.PeerInterface != "ethr-2-c" {
+		t.Errorf("PlanTopology() drew subnet C as %+v; wanted R-1's ethr-1-c joined to R-2's ethr-2-c", *p2pEdge)
+	}
+}
+
+func TestTopologyWriters(t *testing.T) {
+	topo := &Topology{
+		Name: "Lab",
+		Vertices: []TopologyVertex{
+			{ID: "subnet:A", Kind: vertexKindSubnet, Name: "A", CIDR: "10.0.0.0/24", Bridge: "dvn-a", VLAN: 10},
+			{ID: "host:A-1", Kind: nodeKindHost, Name: "A-1"},
+			{ID: "router:R-1", Kind: nodeKindRouter, Name: `R"1`},
+		},
+		Edges: []TopologyEdge{
+			{From: "host:A-1", To: "subnet:A", Subnet: "A", Interface: "etha-1", Address: "10.0.0.1/24"},
+			{From: "router:R-1", To: "subnet:A", Subnet: "A", Interface: "ethr-1-a", Address: "10.0.0.2/24", Down: true},
+		},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{TopologyDOT, `graph "Lab" {
+	label="Lab";
+	fontsize=10;
+	node [fontsize=10];
+	edge [fontsize=8];
+	"subnet:A" [label="A\nVLAN 10\n10.0.0.0/24\ndvn-a", shape=ellipse, style=dashed];
+	"host:A-1" [label="A-1", shape=box];
+	"router:R-1" [label="R\"1", shape=octagon];
+	"host:A-1" -- "subnet:A" [label="etha-1 10.0.0.1/24"];
+	"router:R-1" -- "subnet:A" [label="ethr-1-a 10.0.0.2/24\n(down)", style=dotted];
+}
+`},
+		{TopologyMermaid, `---
+title: Lab
+---
+graph LR
+	v0(("A<br/>VLAN 10<br/>10.0.0.0/24<br/>dvn-a"))
+	v1["A-1"]
+	v2{{"R#quot;1"}}
+	v1 ---|"etha-1 10.0.0.1/24"| v0
+	v2 -.-|"ethr-1-a 10.0.0.2/24<br/>(down)"| v0
+`},
+	}
+	for _, test := range tests {
+		out := &strings.Builder{}
+		if err := topo.Write(out, test.format); err != nil {
+			t.Fatalf("Write(%s) err %v", test.format, err)
+		}
+		if diff := cmp.Diff(test.want, out.String()); diff != "" {
+			t.Errorf("Write(%s) mismatch (-want +got):\n%s", test.format, diff)
+		}
+	}
+
+	out := &strings.Builder{}
+	if err := topo.Write(out, TopologyJSON); err != nil {
+		t.Fatalf("Write(%s) err %v", TopologyJSON, err)
+	}
+	decoded := &Topology{}
+	if err := json.Unmarshal([]byte(out.String()), decoded); err != nil {
+		t.Fatalf("couldn't decode the JSON topology: %v", err)
+	}
+	if diff := cmp.Diff(topo, decoded); diff != "" {
+		t.Errorf("JSON topology mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExportTopology(t *testing.T) {
+	ns, _, err := planState("../demos/p2p/net.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.DefPath = filepath.Join(t.TempDir(), "net.json")
+
+	formats, err := ParseTopologyFormats("dot, Mermaid,json")
+	if err != nil {
+		t.Fatalf("ParseTopologyFormats() err %v", err)
+	}
+	if err := exportTopology(ns, formats); err != nil {
+		t.Fatalf("exportTopology() err %v", err)
+	}
+	for _, name := range []string{"net.dot", "net.mmd", "net.topology.json"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(ns.DefPath), name)); err != nil {
+			t.Errorf("exportTopology() should've written %s: %v", name, err)
+		}
+	}
+
+	if _, err := ParseTopologyFormats("dot,svg"); err == nil {
+		t.Errorf("ParseTopologyFormats() should reject unknown formats")
+	}
+}
@@ -3,11 +3,9 @@ package dvnet
 import (
 	"errors"
 	"fmt"
-	"os"
+	"sort"
 	"strings"
 
-	sysctl "github.com/lorenzosaino/go-sysctl"
-
 	"github.com/docker/go-plugins-helpers/network"
 )
 
@@ -34,6 +32,13 @@ func parseOptions(req *network.CreateNetworkRequest, netOpts *globalOpts) {
 		} else {
 			netOpts.netDefPath = defaultNetDefPath
 		}
+		if formatList, ok := genericOpts[topologyOption].(string); ok {
+			formats, err := ParseTopologyFormats(formatList)
+			if err != nil {
+				log.warn("ignoring option %s: %v\n", topologyOption, err)
+			}
+			netOpts.topologyFormats = formats
+		}
 	}
 
 	gateway, mask, err := getGatewayIP(req)
@@ -75,11 +80,29 @@ func truncateID(id string) string {
 	return id[:5]
 }
 
-func systemSetup() (map[string]string, error) {
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func systemSetup(backend hostBackend) (map[string]string, error) {
 	prevSysctls := map[string]string{}
 
 	for sctl := range configurableSysctls {
-		confdSysctl, err := sysctl.Get(sctl)
+		confdSysctl, err := backend.getSysctl(sctl)
 		if err != nil {
 			log.warn("couldn't retrieve sysctl value for %s...\n", sctl)
 			continue
@@ -88,33 +111,27 @@ func systemSetup() (map[string]string, error) {
 	}
 
 	log.debug("configuring sysctl net.ipv4.ip_forward = 1\n")
-	if err := sysctl.Set("net.ipv4.ip_forward", "1"); err != nil {
+	if err := backend.setSysctl("net.ipv4.ip_forward", "1"); err != nil {
 		return nil, fmt.Errorf("couldn't set up IPv4 forwarding on the host")
 	}
 
 	log.debug("configuring sysctl net.bridge.bridge-nf-call-iptables = 0\n")
-	if err := sysctl.Set("net.bridge.bridge-nf-call-iptables", "0"); err != nil {
+	if err := backend.setSysctl("net.bridge.bridge-nf-call-iptables", "0"); err != nil {
 		log.warn("couldn't set up IPv4 forwarding on the host. Is the br_netfilter module loaded?")
 	}
 
-	if _, err := os.Stat("/var/run/netns"); os.IsNotExist(err) {
-		log.debug("creating /var/run/netns\n")
-		err := os.Mkdir("/var/run/netns", 0755)
-		if err != nil {
-			log.warn("couldn't create /var/run/netns...\n")
-		}
-	} else {
-		log.debug("directory /var/run/netns already existed\n")
+	if err := backend.ensureDir("/var/run/netns"); err != nil {
+		log.warn("couldn't create /var/run/netns...\n")
 	}
 
 	return prevSysctls, nil
 }
 
-func restoreSysctls(prevSysctls map[string]string) error {
+func restoreSysctls(backend hostBackend, prevSysctls map[string]string) error {
 	globalErr := errors.New("error restoring previous sysctls")
 	retErr := false
 	for sctl, val := range prevSysctls {
-		if err := sysctl.Set(sctl, val); err != nil {
+		if err := backend.setSysctl(sctl, val); err != nil {
 			retErr = true
 			globalErr = fmt.Errorf("%w; couldn't restore %s to %s", globalErr, sctl, val)
 		}
@@ -0,0 +1,207 @@
+package dvnet
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	minVLAN          int    = 1
+	maxVLAN          int    = 4094
+	defaultVLAN      int    = 1
+	defaultTrunkName string = "trunk"
+)
+
+// trunk returns the name of the trunk a VLAN subnet is on.
+func (subnet subnetDef) trunk() string {
+	if subnet.Trunk == "" {
+		return defaultTrunkName
+	}
+	return subnet.Trunk
+}
+
+// ensureTrunk returns the bridge backing trunk, creating it if need be.
+func ensureTrunk(netState *NetworkState, trunk string) (*netlink.Bridge, error) {
+	if netState.Trunks == nil {
+		netState.Trunks = map[string]string{}
+	}
+	if bridgeName, ok := netState.Trunks[trunk]; ok {
+		return &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}}, nil
+	}
+
+	log.debug("creating trunk %s\n", trunk)
+	bridge, err := netState.backend.createTrunkBridge(trunk)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create trunk %s: %w", trunk, err)
+	}
+	netState.Trunks[trunk] = bridge.Name
+	return bridge, nil
+}
+
+// releaseTrunk removes the bridge backing trunk once no subnet is on it.
+func releaseTrunk(netState *NetworkState, trunk string) error {
+	for _, subnet := range netState.Subnets {
+		if subnet.VLAN != 0 && subnet.Trunk == trunk {
+			return nil
+		}
+	}
+	bridgeName, ok := netState.Trunks[trunk]
+	if !ok {
+		return nil
+	}
+
+	log.debug("removing trunk %s\n", trunk)
+	if err := netState.backend.removeBridge(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}}); err != nil {
+		return fmt.Errorf("couldn't remove bridge %s: %w", bridgeName, err)
+	}
+	delete(netState.Trunks, trunk)
+	return nil
+}
+
+// attachTrunkVLAN attaches routerName to the VLAN subnetName is on through a
+// tagged port on the subnet's trunk, which is shared by every VLAN the router
+// is attached to on that trunk, and an 802.1Q sub-interface within the router.
+func attachTrunkVLAN(netState *NetworkState, routerName, subnetName string, routerPID int) error {
+	subnet := netState.Subnets[subnetName]
+	suffix := strings.ToLower(fmt.Sprintf("%s-%s", routerName, subnet.Trunk))
+	portName, parentName := bridgeEthPrefix+suffix, containerEthPrefix+suffix
+
+	if !hasTrunkPort(netState, routerName, portName) {
+		veth, port, parent, err := netState.backend.createVethPair(portName, parentName)
+		if err != nil {
+			log.error("couldn't create veth %s-%s: %v\n", subnet.BridgeName, routerName, err)
+			return err
+		}
+		log.debug("connecting %s to %s\n", veth.Name, subnet.BridgeName)
+		if err := netState.backend.connectToBridge(port, subnet.Bridge); err != nil {
+			log.error("couldn't connect %s to %s: %v\n", veth.Name, subnet.BridgeName, err)
+			return err
+		}
+		log.debug("connecting %s to %s\n", veth.PeerName, routerName)
+		if err := netState.backend.connectToContainer(parent, routerPID); err != nil {
+			log.error("couldn't connect %s to %s: %v\n", veth.PeerName, routerName, err)
+			return err
+		}
+	}
+
+	log.debug("tagging VLAN %d on %s\n", subnet.VLAN, portName)
+	if err := netState.backend.addPortVLAN(portName, subnet.VLAN, false); err != nil {
+		return fmt.Errorf("couldn't tag VLAN %d on %s: %w", subnet.VLAN, portName, err)
+	}
+	iface, err := netState.backend.addVLANIface(parentName, subnet.VLAN, routerPID)
+	if err != nil {
+		return fmt.Errorf("couldn't create the sub-interface for VLAN %d on %s: %w", subnet.VLAN, routerName, err)
+	}
+
+	assignedCIDR := netState.Addressers[subnetName].nextCIDR(routerName)
+	log.debug("assigning %s to %s on %s\n", assignedCIDR, iface.Attrs().Name, routerName)
+	if err := netState.backend.addressContainer(assignedCIDR, iface, routerPID); err != nil {
+		log.error("couldn't address %s to %s on %s: %v\n", assignedCIDR, iface.Attrs().Name, routerName, err)
+		return err
+	}
+
+	netState.Links[linkKey(routerName, subnetName)] = linkInfo{Node: routerName, Subnet: subnetName,
+		BridgeEnd: portName, NodeEnd: iface.Attrs().Name, CIDR: assignedCIDR, Trunk: true}
+	return nil
+}
+
+// detachTrunkVLAN undoes what attachTrunkVLAN did, removing the trunk
+// port altogether once the router's not on any of its VLANs.
+func detachTrunkVLAN(netState *NetworkState, link linkInfo, routerPID int) error {
+	vlan := netState.Subnets[link.Subnet].VLAN
+	if err := netState.backend.removeVLANIface(link.NodeEnd, routerPID); err != nil {
+		return fmt.Errorf("couldn't remove %s on %s: %w", link.NodeEnd, link.Node, err)
+	}
+	delete(netState.Links, linkKey(link.Node, link.Subnet))
+
+	if hasTrunkPort(netState, link.Node, link.BridgeEnd) {
+		if err := netState.backend.delPortVLAN(link.BridgeEnd, vlan); err != nil {
+			return fmt.Errorf("couldn't untag VLAN %d on %s: %w", vlan, link.BridgeEnd, err)
+		}
+		return nil
+	}
+	if err := netState.backend.removeVeth(link.BridgeEnd, 0); err != nil {
+		return fmt.Errorf("couldn't remove veth %s: %w", link.BridgeEnd, err)
+	}
+	return nil
+}
+
+// hasTrunkPort tells whether routerName is on any VLAN through portName.
+func hasTrunkPort(netState *NetworkState, routerName, portName string) bool {
+	for _, link := range netState.Links {
+		if link.Node == routerName && link.Trunk && link.BridgeEnd == portName {
+			return true
+		}
+	}
+	return false
+}
+
+func (linuxBackend) createTrunkBridge(name string) (*netlink.Bridge, error) {
+	vlanFiltering := true
+	bridge := &netlink.Bridge{
+		LinkAttrs:     netlink.LinkAttrs{Name: bridgePrefix + strings.ToLower(name)},
+		VlanFiltering: &vlanFiltering,
+	}
+	if err := netlink.LinkAdd(bridge); err != nil {
+		return nil, err
+	}
+	return bridge, netlink.LinkSetUp(bridge)
+}
+
+// addPortVLAN lets vlan through the bridge port portName. Access ports carry
+// a single VLAN untagged whilst trunk ports carry every one of theirs tagged.
+// Ports are taken off the default VLAN so that they only carry what we add.
+func (linuxBackend) addPortVLAN(portName string, vlan int, access bool) error {
+	port, err := netlink.LinkByName(portName)
+	if err != nil {
+		return fmt.Errorf("couldn't find port %s: %w", portName, err)
+	}
+	if err := netlink.BridgeVlanDel(port, uint16(defaultVLAN), true, true, false, true); err != nil {
+		log.debug("%s wasn't on the default VLAN: %v\n", portName, err)
+	}
+	return netlink.BridgeVlanAdd(port, uint16(vlan), access, access, false, true)
+}
+
+func (linuxBackend) delPortVLAN(portName string, vlan int) error {
+	port, err := netlink.LinkByName(portName)
+	if err != nil {
+		return fmt.Errorf("couldn't find port %s: %w", portName, err)
+	}
+	return netlink.BridgeVlanDel(port, uint16(vlan), false, false, false, true)
+}
+
+// addVLANIface creates and brings up the sub-interface of parent for vlan
+// within the namespace of the container whose PID is containerPID.
+func (linuxBackend) addVLANIface(parent string, vlan, containerPID int) (netlink.Link, error) {
+	var iface netlink.Link
+	err := inContainerNS(containerPID, func() error {
+		parentLink, err := netlink.LinkByName(parent)
+		if err != nil {
+			return fmt.Errorf("couldn't find %s: %w", parent, err)
+		}
+		name := fmt.Sprintf("%s.%d", parent, vlan)
+		if err := netlink.LinkAdd(&netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parentLink.Attrs().Index},
+			VlanId:    vlan,
+		}); err != nil {
+			return err
+		}
+		if iface, err = netlink.LinkByName(name); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(iface)
+	})
+	return iface, err
+}
+
+func (linuxBackend) removeVLANIface(name string, containerPID int) error {
+	return inContainerNS(containerPID, func() error {
+		iface, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("couldn't find %s: %w", name, err)
+		}
+		return netlink.LinkDel(iface)
+	})
+}
@@ -0,0 +1,129 @@
+package dvnet
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// uiAddrEnv is where the web UI is served from. It's off unless set.
+const uiAddrEnv string = "DVNET_UI_ADDR"
+
+// uiAssets are the page, script and stylesheet making up the web UI. They're
+// embedded so that it works on classroom networks without Internet access.
+//
+//go:embed webui
+var uiAssets embed.FS
+
+// UIAddr returns the address the web UI is served on as given by the
+// DVNET_UI_ADDR environment variable: either a TCP address or, if it's an
+// absolute path, a Unix socket. It's empty unless the UI has been asked for.
+func UIAddr() string {
+	return os.Getenv(uiAddrEnv)
+}
+
+// NetworkView is what the web UI draws a network from: its topology, the
+// state of every node and the links joining them.
+type NetworkView struct {
+	ID       string              `json:"id"`
+	Name     string              `json:"name"`
+	Topology *Topology           `json:"topology"`
+	Nodes    map[string]NodeView `json:"nodes"`
+	Links    []LinkDetails       `json:"links"`
+}
+
+// networkSummary is how networks are listed for the user to pick one.
+type networkSummary struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// NodeView is a host or router together with the state
+// of its container and the routes we installed on it.
+type NodeView struct {
+	NodeInfo
+	State  string      `json:"state"`
+	Routes []routeInfo `json:"routes"`
+}
+
+// networkView describes ns for the web UI relying on stateOf to get the state of each container.
+func networkView(ns *NetworkState, stateOf func(id string) string) NetworkView {
+	info := networkInfo(ns)
+	view := NetworkView{ID: ns.ID, Name: ns.Definition.Name, Topology: networkTopology(ns),
+		Nodes: map[string]NodeView{}, Links: info.Links}
+	for _, node := range info.Nodes {
+		routes := ns.Routes[node.Name]
+		if routes == nil {
+			routes = []routeInfo{}
+		}
+		view.Nodes[node.Name] = NodeView{NodeInfo: node, State: stateOf(node.ContainerID), Routes: routes}
+	}
+	return view
+}
+
+// ServeUI serves a web page drawing the topology of every running network.
+// Absolute paths are taken as Unix sockets and anything else as TCP addresses.
+func (d Driver) ServeUI(addr string) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+
+	log.info("serving the web UI on %s\n", addr)
+	return http.Serve(listener, d.uiHandler(containerState))
+}
+
+// uiHandler serves the embedded assets on / and, under /api/networks, the list
+// of networks and a view of each one of them. Everything is read-only.
+func (d Driver) uiHandler(stateOf func(id string) string) http.Handler {
+	assets, err := fs.Sub(uiAssets, "webui")
+	if err != nil {
+		// The assets are embedded, so this can't really happen.
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/api/networks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed on %s", r.Method, r.URL.Path))
+			return
+		}
+		networkIDs, err := d.store.ids()
+		if err != nil {
+			writeAPIError(w, apiErrorStatus(err), err)
+			return
+		}
+		networks := []networkSummary{}
+		for _, networkID := range networkIDs {
+			ns, err := d.network(networkID)
+			if err != nil {
+				writeAPIError(w, apiErrorStatus(err), err)
+				return
+			}
+			networks = append(networks, networkSummary{ID: ns.ID, Name: ns.Definition.Name})
+		}
+		writeJSON(w, http.StatusOK, networks)
+	})
+	mux.HandleFunc("/api/networks/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed on %s", r.Method, r.URL.Path))
+			return
+		}
+		networkID, err := d.resolveNetwork(strings.TrimPrefix(r.URL.Path, "/api/networks/"))
+		if err != nil {
+			writeAPIError(w, apiErrorStatus(err), err)
+			return
+		}
+		ns, err := d.network(networkID)
+		if err != nil {
+			writeAPIError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, networkView(ns, stateOf))
+	})
+	return mux
+}
@@ -0,0 +1,404 @@
+"use strict";
+
+// How often the drawing is brought up to date, in milliseconds.
+const refreshInterval = 3000;
+
+const svgNS = "http://www.w3.org/2000/svg";
+
+const networkSelect = document.getElementById("network");
+const statusLine = document.getElementById("status");
+const canvas = document.getElementById("topology");
+const details = document.getElementById("details");
+
+// positions keeps where every vertex was drawn so that refreshing
+// the view doesn't shuffle the drawing around.
+let positions = {};
+let view = null;
+let selected = null;
+
+async function getJSON(path) {
+	const resp = await fetch(path);
+	const body = await resp.json();
+	if (!resp.ok) {
+		throw new Error(body.error || resp.statusText);
+	}
+	return body;
+}
+
+function setStatus(msg, isError) {
+	statusLine.textContent = msg;
+	statusLine.classList.toggle("error", !!isError);
+}
+
+// el creates an HTML element with the given attributes and children.
+function el(tag, attrs, ...children) {
+	const e = document.createElement(tag);
+	for (const [k, v] of Object.entries(attrs || {})) {
+		e.setAttribute(k, v);
+	}
+	e.append(...children);
+	return e;
+}
+
+// svg creates an SVG element with the given attributes.
+function svg(tag, attrs) {
+	const e = document.createElementNS(svgNS, tag);
+	for (const [k, v] of Object.entries(attrs || {})) {
+		e.setAttribute(k, v);
+	}
+	return e;
+}
+
+async function loadNetworks() {
+	const networks = await getJSON("api/networks");
+	const current = networkSelect.value || decodeURIComponent(location.hash.slice(1));
+	networkSelect.replaceChildren(...networks.map(n => new Option(n.name, n.id)));
+	const match = networks.find(n => n.id === current || n.name === current);
+	if (match) {
+		networkSelect.value = match.id;
+	}
+	return networks.length;
+}
+
+async function refresh() {
+	try {
+		if (await loadNetworks() === 0) {
+			view = null;
+			canvas.replaceChildren();
+			showDetails();
+			setStatus("no networks are running");
+			return;
+		}
+		view = await getJSON("api/networks/" + encodeURIComponent(networkSelect.value));
+		draw();
+		showDetails();
+		setStatus("updated at " + new Date().toLocaleTimeString());
+	} catch (err) {
+		setStatus("couldn't refresh: " + err.message, true);
+	}
+}
+
+// stateClass tells how a node is coloured given the state of its container.
+function stateClass(state) {
+	switch (state) {
+	case "running":
+		return "running";
+	case "exited":
+	case "dead":
+	case "missing":
+		return "stopped";
+	}
+	return "other";
+}
+
+// edgeLinks returns the links behind an edge: one per end with an interface on a node.
+function edgeLinks(edge) {
+	const vertices = vertexIndex();
+	const ends = [[edge.from, edge.interface], [edge.to, edge.peer_interface]];
+	return view.links.filter(link => ends.some(([id, iface]) =>
+		vertices[id] && vertices[id].name === link.node && iface === link.node_end));
+}
+
+function vertexIndex() {
+	const index = {};
+	for (const v of view.topology.vertices) {
+		index[v.id] = v;
+	}
+	return index;
+}
+
+function edgeID(edge) {
+	return edge.from + "/" + edge.interface;
+}
+
+// layout places vertices we haven't placed yet by simulating springs
+// along the edges and repulsion between every pair of vertices.
+function layout(width, height) {
+	const vertices = view.topology.vertices;
+	const fresh = vertices.filter(v => !positions[v.id]);
+	if (fresh.length === 0) {
+		return;
+	}
+	fresh.forEach((v, i) => {
+		const angle = 2 * Math.PI * i / fresh.length;
+		positions[v.id] = {
+			x: width / 2 + Math.cos(angle) * width / 3,
+			y: height / 2 + Math.sin(angle) * height / 3,
+		};
+	});
+
+	const movable = new Set(fresh.map(v => v.id));
+	const k = Math.sqrt(width * height / vertices.length) * 0.6;
+	const margin = 50;
+	const rounds = 300;
+	for (let round = 0; round < rounds; round++) {
+		const disp = {};
+		for (const v of vertices) {
+			disp[v.id] = {x: 0, y: 0};
+		}
+		for (let i = 0; i < vertices.length; i++) {
+			for (let j = i + 1; j < vertices.length; j++) {
+				const a = positions[vertices[i].id], b = positions[vertices[j].id];
+				const dx = a.x - b.x, dy = a.y - b.y;
+				const d = Math.max(Math.hypot(dx, dy), 1);
+				const f = k * k / d;
+				disp[vertices[i].id].x += dx / d * f;
+				disp[vertices[i].id].y += dy / d * f;
+				disp[vertices[j].id].x -= dx / d * f;
+				disp[vertices[j].id].y -= dy / d * f;
+			}
+		}
+		for (const e of view.topology.edges) {
+			const a = positions[e.from], b = positions[e.to];
+			if (!a || !b) {
+				continue;
+			}
+			const dx = a.x - b.x, dy = a.y - b.y;
+			const d = Math.max(Math.hypot(dx, dy), 1);
+			const f = d * d / k;
+			disp[e.from].x -= dx / d * f;
+			disp[e.from].y -= dy / d * f;
+			disp[e.to].x += dx / d * f;
+			disp[e.to].y += dy / d * f;
+		}
+
+		const temperature = (k / 2) * (1 - round / rounds);
+		for (const v of vertices) {
+			if (!movable.has(v.id)) {
+				continue;
+			}
+			const p = positions[v.id], dv = disp[v.id];
+			const d = Math.max(Math.hypot(dv.x, dv.y), 1);
+			p.x += dv.x / d * Math.min(d, temperature);
+			p.y += dv.y / d * Math.min(d, temperature);
+			p.x = Math.min(width - margin, Math.max(margin, p.x));
+			p.y = Math.min(height - margin, Math.max(margin, p.y));
+		}
+	}
+}
+
+function draw() {
+	const width = canvas.clientWidth, height = canvas.clientHeight;
+	canvas.setAttribute("viewBox", `0 0 ${width} ${height}`);
+	layout(width, height);
+	canvas.replaceChildren();
+
+	for (const edge of view.topology.edges) {
+		drawEdge(edge);
+	}
+	for (const vertex of view.topology.vertices) {
+		drawVertex(vertex);
+	}
+}
+
+function drawEdge(edge) {
+	const a = positions[edge.from], b = positions[edge.to];
+	if (!a || !b) {
+		return;
+	}
+	const links = edgeLinks(edge);
+	const classes = ["edge"];
+	if (edge.down) {
+		classes.push("down");
+	} else if (links.some(link => link.impairments)) {
+		classes.push("impaired");
+	}
+	if (selected && selected.edge === edgeID(edge)) {
+		classes.push("selected");
+	}
+
+	const g = svg("g", {class: classes.join(" ")});
+	const ends = {x1: a.x, y1: a.y, x2: b.x, y2: b.y};
+	g.append(svg("line", {...ends, class: "wire"}), svg("line", {...ends, class: "hitbox"}));
+	const label = svg("text", {x: (a.x + b.x) / 2, y: (a.y + b.y) / 2 - 4});
+	label.textContent = [edge.interface, edge.peer_interface].filter(Boolean).join(" ↔ ");
+	g.append(label);
+	g.addEventListener("click", () => select({edge: edgeID(edge)}));
+	canvas.append(g);
+}
+
+function drawVertex(vertex) {
+	const p = positions[vertex.id];
+	const classes = ["vertex", vertex.kind];
+	const node = view.nodes[vertex.name];
+	if (node && (vertex.kind === "host" || vertex.kind === "router")) {
+		classes.push(stateClass(node.state));
+	}
+	if (selected && selected.vertex === vertex.id) {
+		classes.push("selected");
+	}
+
+	const g = svg("g", {class: classes.join(" "), transform: `translate(${p.x},${p.y})`});
+	switch (vertex.kind) {
+	case "host":
+		g.append(svg("rect", {x: -36, y: -15, width: 72, height: 30, rx: 4}));
+		break;
+	case "router": {
+		const r = 24, points = [];
+		for (let i = 0; i < 8; i++) {
+			const angle = Math.PI / 8 + i * Math.PI / 4;
+			points.push(`${r * Math.cos(angle)},${r * Math.sin(angle)}`);
+		}
+		g.append(svg("polygon", {points: points.join(" ")}));
+		break;
+	}
+	case "switch":
+		g.append(svg("rect", {x: -42, y: -14, width: 84, height: 28}));
+		break;
+	default:
+		g.append(svg("ellipse", {rx: 48, ry: 24}));
+	}
+
+	const lines = [vertex.name];
+	if (vertex.cidr) {
+		lines.push(vertex.cidr);
+	}
+	lines.forEach((line, i) => {
+		const text = svg("text", {y: (i - (lines.length - 1) / 2) * 12 + 4});
+		text.textContent = line;
+		g.append(text);
+	});
+
+	makeDraggable(g, vertex);
+	canvas.append(g);
+}
+
+// makeDraggable lets vertices be moved around. Releasing
+// a vertex without moving it selects it instead.
+function makeDraggable(g, vertex) {
+	g.addEventListener("pointerdown", down => {
+		const start = {x: down.clientX, y: down.clientY};
+		const origin = {...positions[vertex.id]};
+		let moved = false;
+		const move = ev => {
+			const dx = ev.clientX - start.x, dy = ev.clientY - start.y;
+			if (!moved && Math.hypot(dx, dy) < 3) {
+				return;
+			}
+			moved = true;
+			positions[vertex.id] = {x: origin.x + dx, y: origin.y + dy};
+			draw();
+		};
+		const up = () => {
+			window.removeEventListener("pointermove", move);
+			window.removeEventListener("pointerup", up);
+			if (!moved) {
+				select({vertex: vertex.id});
+			}
+		};
+		window.addEventListener("pointermove", move);
+		window.addEventListener("pointerup", up);
+	});
+}
+
+function select(what) {
+	selected = what;
+	draw();
+	showDetails();
+}
+
+function table(headers, rows) {
+	return el("table", {},
+		el("tr", {}, ...headers.map(h => el("th", {}, h))),
+		...rows.map(row => el("tr", {}, ...row.map(cell => el("td", {}, cell || "")))));
+}
+
+function showDetails() {
+	if (!view || !selected) {
+		details.replaceChildren(el("p", {class: "hint"}, "Click on a node or a link to see its details."));
+		return;
+	}
+	if (selected.vertex) {
+		const vertex = vertexIndex()[selected.vertex];
+		if (vertex) {
+			details.replaceChildren(...vertexDetails(vertex));
+			return;
+		}
+	}
+	if (selected.edge) {
+		const edge = view.topology.edges.find(e => edgeID(e) === selected.edge);
+		if (edge) {
+			details.replaceChildren(...edgeDetails(edge));
+			return;
+		}
+	}
+	// Whatever was selected is gone.
+	selected = null;
+	showDetails();
+}
+
+function vertexDetails(vertex) {
+	const node = view.nodes[vertex.name];
+	if (!node) {
+		const rows = [["CIDR", vertex.cidr], ["Bridge", vertex.bridge]];
+		if (vertex.vlan) {
+			rows.push(["VLAN", String(vertex.vlan)]);
+		}
+		return [el("h2", {}, `${vertex.name} (${vertex.kind})`), table(["", ""], rows)];
+	}
+
+	const downLinks = view.links.filter(link => link.node === node.name && link.down).map(link => link.node_end);
+	return [
+		el("h2", {}, `${node.name} (${node.kind})`),
+		table(["", ""], [
+			["State", node.state],
+			["Container", node.container_id.slice(0, 12)],
+			["PID", String(node.pid)],
+		]),
+		el("h3", {}, "Addresses"),
+		table(["Interface", "Subnet", "Address"], node.interfaces.map(iface => [
+			iface.name + (downLinks.includes(iface.name) ? " (down)" : ""), iface.subnet, iface.address])),
+		el("h3", {}, "Routes"),
+		node.routes.length > 0 ?
+			table(["Destination", "Gateway"], node.routes.map(route => [route.dst, route.gw])) :
+			el("p", {class: "hint"}, "No routes were installed."),
+	];
+}
+
+function edgeDetails(edge) {
+	const children = [el("h2", {}, edge.subnet ? `Link on ${edge.subnet}` : "Link between switches")];
+	const links = edgeLinks(edge);
+	if (links.length === 0) {
+		children.push(table(["", ""], [
+			["Interface", edge.interface],
+			["Peer interface", edge.peer_interface],
+		]));
+		return children;
+	}
+	for (const link of links) {
+		const rows = [
+			["Interface", link.node_end],
+			["State", link.down ? "down" : "up"],
+			["Bridge", link.bridge],
+			["Bridge end", link.bridge_end],
+		];
+		if (link.peer) {
+			rows.push(["Peer", link.peer]);
+		}
+		if (link.switch) {
+			rows.push(["Switch", link.switch]);
+		}
+		for (const [k, v] of Object.entries(link.impairments || {})) {
+			rows.push(["Impairment: " + k, String(v)]);
+		}
+		for (const [k, v] of Object.entries(link.shaping || {})) {
+			rows.push(["Shaping: " + k, typeof v === "object" ? JSON.stringify(v) : String(v)]);
+		}
+		if (link.mirrored_to) {
+			rows.push(["Mirrored to", link.mirrored_to]);
+		}
+		children.push(el("h3", {}, link.node), table(["", ""], rows));
+	}
+	return children;
+}
+
+networkSelect.addEventListener("change", () => {
+	positions = {};
+	selected = null;
+	location.hash = encodeURIComponent(networkSelect.value);
+	refresh();
+});
+window.addEventListener("resize", () => view && draw());
+
+refresh();
+setInterval(refresh, refreshInterval);
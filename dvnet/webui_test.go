@@ -0,0 +1,104 @@
+package dvnet
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUI(t *testing.T) {
+	d, _ := testDriver(t)
+	if err := d.SetLinkState("0123", "A-1", "A", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLinkImpairments("0123", "A-2", "A", &LinkImpairments{Delay: "100ms"}); err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]string{}
+	srv := httptest.NewServer(d.uiHandler(func(id string) string {
+		if state, ok := states[id]; ok {
+			return state
+		}
+		return "running"
+	}))
+	defer srv.Close()
+
+	get := func(path string, wantStatus int) []byte {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Errorf("GET %s got status %d; wanted %d", path, resp.StatusCode, wantStatus)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	for _, path := range []string{"/", "/app.js", "/style.css"} {
+		// Classrooms may well be offline, so nothing can be fetched from elsewhere.
+		if body := string(get(path, http.StatusOK)); strings.Contains(body, "https://") || strings.Contains(body, "//cdn") {
+			t.Errorf("GET %s should only refer to embedded assets", path)
+		}
+	}
+
+	networks := []networkSummary{}
+	if err := json.Unmarshal(get("/api/networks", http.StatusOK), &networks); err != nil {
+		t.Fatal(err)
+	}
+	if want := []networkSummary{{ID: "0123456789abcdef", Name: "Test Net 0"}}; !cmp.Equal(networks, want) {
+		t.Errorf("GET /api/networks = %v; wanted %v", networks, want)
+	}
+	get("/api/networks/nope", http.StatusNotFound)
+
+	ns, err := d.State("0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	states[ns.Routers["R-1"].ID] = "exited"
+
+	view := NetworkView{}
+	if err := json.Unmarshal(get("/api/networks/Test%20Net%200", http.StatusOK), &view); err != nil {
+		t.Fatal(err)
+	}
+	if len(view.Topology.Vertices) == 0 || len(view.Topology.Edges) == 0 {
+		t.Errorf("GET /api/networks/Test Net 0 should carry the network's topology; got %+v", view.Topology)
+	}
+	if got := view.Nodes["R-1"].State; got != "exited" {
+		t.Errorf("R-1's state = %q; wanted exited", got)
+	}
+	if got := view.Nodes["A-1"].State; got != "running" {
+		t.Errorf("A-1's state = %q; wanted running", got)
+	}
+	a1 := view.Nodes["A-1"]
+	if len(a1.Interfaces) == 0 || a1.Interfaces[0].Address == "" {
+		t.Errorf("A-1 should carry the addresses of its interfaces; got %+v", a1.Interfaces)
+	}
+	if !cmp.Equal(a1.Routes, ns.Routes["A-1"]) {
+		t.Errorf("A-1's routes = %v; wanted %v", a1.Routes, ns.Routes["A-1"])
+	}
+
+	for _, link := range view.Links {
+		switch {
+		case link.Node == "A-1" && link.Subnet == "A" && !link.Down:
+			t.Errorf("A-1's link on A should be down")
+		case link.Node == "A-2" && link.Subnet == "A" && (link.Impairments == nil || link.Impairments.Delay != "100ms"):
+			t.Errorf("A-2's link on A should be impaired; got %+v", link.Impairments)
+		}
+	}
+	for _, edge := range view.Topology.Edges {
+		if edge.From == vertexID(nodeKindHost, "A-1") && edge.Subnet == "A" && !edge.Down {
+			t.Errorf("the edge of A-1's link on A should be drawn as down")
+		}
+	}
+}
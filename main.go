@@ -1,20 +1,844 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/pcolladosoto/dvnet/dvnet"
 )
 
+type command struct {
+	run   func(args []string) int
+	usage string
+}
+
+var commands = map[string]command{
+	"serve":    {serve, "serve the Docker network plugin (the default)"},
+	"plan":     {plan, "show what bringing up a network definition would do"},
+	"up":       {up, "bring up a network without going through Docker"},
+	"down":     {down, "bring down a network, however it was brought up"},
+	"status":   {status, "show the networks being managed and their nodes"},
+	"inspect":  {inspect, "show the subnets, nodes, addresses and links of a network"},
+	"exec":     {execNode, "run a command within one of a network's nodes"},
+	"impair":   {impair, "delay, drop or rate limit the traffic going through a link"},
+	"link":     {link, "bring the link between a node and a subnet up or down"},
+	"node":     {node, "bring every link of a node up or down, isolating it"},
+	"scenario": {scenario, "run a timeline of failures and impairments against a network"},
+	"capture":  {captureLink, "capture the traffic on a link or bridge into a pcapng file"},
+	"topology": {topology, "draw a network definition as a DOT, Mermaid or JSON graph"},
+	"probe":    {probe, "probe every node from every host and compare with what's expected"},
+	"assert":   {assert, "check a network against the assertions written for it"},
+	"routes":   {routes, "compare the routing table of every node with what it should hold"},
+	"drift":    {drift, "look for differences between a network and the host's kernel and Docker state"},
+}
+
 func main() {
+	cmdName, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		cmdName, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[cmdName]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(args))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: dvnet <command> [arguments]\n\ncommands:\n")
+	for _, name := range []string{"serve", "plan", "up", "down", "status", "inspect", "exec", "impair", "link", "node", "scenario", "capture", "topology", "probe", "assert", "routes", "drift"} {
+		fmt.Fprintf(os.Stderr, "\t%-8s %s\n", name, commands[name].usage)
+	}
+}
+
+func newFlagSet(name, argsUsage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dvnet %s %s\n", name, argsUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func newDriver() (dvnet.Driver, bool) {
+	d, err := dvnet.NewDriver()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't initialise the driver: %v\n", err)
+		return dvnet.Driver{}, false
+	}
+	return d, true
+}
+
+// truncateID shortens id to the 12 characters docker(1) shows IDs with.
+func truncateID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func serve(args []string) int {
+	fs := newFlagSet("serve", "[-api socket] [-metrics address] [-ui address] [-drift-interval interval] [-log-level level] [-log-format format]")
+	apiSocket := fs.String("api", dvnet.APISocket(), "serve the control API on this Unix socket (empty to disable it)")
+	metricsAddr := fs.String("metrics", dvnet.MetricsAddr(), "serve metrics on this TCP address or Unix socket (empty to disable them)")
+	uiAddr := fs.String("ui", dvnet.UIAddr(), "serve the web UI on this TCP address or Unix socket (empty to disable it)")
+	driftInterval := fs.Duration("drift-interval", dvnet.DriftInterval(), "check networks for drift this often (0 to disable it)")
+	defLevel, defFormat := dvnet.LogSettings()
+	logLevel := fs.String("log-level", defLevel, "log messages at or above this level: debug, info, warn or error")
+	logFormat := fs.String("log-format", defFormat, "log in this format: text, json or logfmt")
+	fs.Parse(args)
+
+	level, err := dvnet.ParseLogLevel(*logLevel)
+	if err == nil {
+		err = dvnet.ConfigureLogger(level, *logFormat)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't configure logging: %v\n", err)
+		return 2
+	}
+
 	fmt.Printf("booting up the dvnet network driver...\n")
-	h := dvnet.GetHandler()
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+	h := dvnet.GetHandler(d)
+
+	if *apiSocket != "" {
+		go func() {
+			if err := d.ServeAPI(*apiSocket); err != nil {
+				fmt.Printf("unable to serve the control API: %v\n", err)
+			}
+		}()
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := d.ServeMetrics(*metricsAddr); err != nil {
+				fmt.Printf("unable to serve metrics: %v\n", err)
+			}
+		}()
+	}
+
+	if *uiAddr != "" {
+		go func() {
+			if err := d.ServeUI(*uiAddr); err != nil {
+				fmt.Printf("unable to serve the web UI: %v\n", err)
+			}
+		}()
+	}
+
+	if *driftInterval > 0 {
+		go d.WatchDrift(*driftInterval)
+	}
 
 	if err := h.ServeUnix("dvnet", 0); err != nil {
 		fmt.Printf("unable to listen over a Unix socket: %v\n", err)
+		return 1
 	}
 
 	// if err := h.ServeTCP("dvnet", ":7777", "", nil); err != nil {
 	// 	fmt.Printf("unable to listen over TCP: %v\n", err)
 	// }
+	return 0
+}
+
+// plan shows what bringing up a network definition would do without
+// doing it: no root privileges nor Docker daemon are needed.
+func plan(args []string) int {
+	fs := newFlagSet("plan", "[-json] [-o file] <network definition>")
+	asJSON := fs.Bool("json", false, "dump the plan as JSON")
+	outPath := fs.String("o", "", "write the plan to this file instead of the standard output")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+
+	netPlan, err := dvnet.PlanNetwork(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't plan the network: %v\n", err)
+		return 1
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't create %s: %v\n", *outPath, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *asJSON {
+		err = netPlan.WriteJSON(out)
+	} else {
+		err = netPlan.WriteText(out)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't write the plan: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// topology draws a network definition as it'd be brought up. Just like
+// plan, it needs neither root privileges nor a Docker daemon.
+func topology(args []string) int {
+	fs := newFlagSet("topology", "[-format dot|mermaid|json] [-o file] <network definition>")
+	format := fs.String("format", dvnet.TopologyDOT, "draw the topology in this format: dot, mermaid or json")
+	outPath := fs.String("o", "", "write the topology to this file instead of the standard output")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	formats, err := dvnet.ParseTopologyFormats(*format)
+	if err != nil || len(formats) != 1 {
+		fmt.Fprintf(os.Stderr, "a single format among dot, mermaid and json should be given\n")
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+
+	topo, err := dvnet.PlanTopology(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't draw the network: %v\n", err)
+		return 1
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't create %s: %v\n", *outPath, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := topo.Write(out, formats[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't write the topology: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func up(args []string) int {
+	fs := newFlagSet("up", "[-topology formats] <network definition>")
+	topologyList := fs.String("topology", "", "export the network's topology next to its definition in these comma-separated formats: dot, mermaid or json")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	topologyFormats, err := dvnet.ParseTopologyFormats(*topologyList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	networkID, err := d.Up(fs.Arg(0), topologyFormats...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't bring the network up: %v\n", err)
+		return 1
+	}
+	fmt.Println(networkID)
+	return 0
+}
+
+func down(args []string) int {
+	fs := newFlagSet("down", "<network name or ID>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	if err := d.Down(fs.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't bring the network down: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func status(args []string) int {
+	fs := newFlagSet("status", "[-json]")
+	asJSON := fs.Bool("json", false, "dump the status as JSON")
+	fs.Parse(args)
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	statuses, err := d.Status()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't get the status of the networks: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(statuses); err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't encode the status: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, netStatus := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t(%s, %s)\n", truncateID(netStatus.ID), netStatus.Name, netStatus.Origin, netStatus.DefPath)
+		for _, node := range netStatus.Nodes {
+			links := ""
+			if node.Isolated {
+				links = "isolated"
+			} else if len(node.DownLinks) > 0 {
+				links = "down: " + strings.Join(node.DownLinks, ",")
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\t%s\t%s\n", node.Name, node.Kind, strings.Join(node.Subnets, ","), node.State, links)
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+func inspect(args []string) int {
+	fs := newFlagSet("inspect", "[-json] <network name or ID>")
+	asJSON := fs.Bool("json", false, "dump the network's description as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	netInfo, err := d.Inspect(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't inspect the network: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(netInfo); err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't encode the network's description: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "network %s (%s, %s)\n", netInfo.Name, truncateID(netInfo.ID), netInfo.Origin)
+
+	fmt.Fprintf(tw, "\nsubnets:\n")
+	for _, subnet := range netInfo.Subnets {
+		if subnet.Type == "p2p" {
+			fmt.Fprintf(tw, "\t%s\t%s\tpoint-to-point\n", subnet.Name, subnet.CIDR)
+			continue
+		}
+		if subnet.VLAN != 0 {
+			fmt.Fprintf(tw, "\t%s\t%s\t%s (VLAN %d)\n", subnet.Name, subnet.CIDR, subnet.Bridge, subnet.VLAN)
+			continue
+		}
+		if subnet.OVS {
+			fmt.Fprintf(tw, "\t%s\t%s\t%s (Open vSwitch)\n", subnet.Name, subnet.CIDR, subnet.Bridge)
+			continue
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\t%s\n", subnet.Name, subnet.CIDR, subnet.Bridge)
+	}
+
+	if len(netInfo.Switches) != 0 {
+		fmt.Fprintf(tw, "\nswitches:\n")
+		for _, sw := range netInfo.Switches {
+			stp := "no STP"
+			if sw.Priority != nil {
+				stp = fmt.Sprintf("STP, priority %d", *sw.Priority)
+			} else if sw.STP {
+				stp = "STP"
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s (%s)\t%s\n", sw.Name, sw.Subnet, sw.Bridge, stp, strings.Join(sw.Links, ", "))
+		}
+	}
+
+	fmt.Fprintf(tw, "\nnodes:\n")
+	for _, node := range netInfo.Nodes {
+		fmt.Fprintf(tw, "\t%s\t%s\t%s\t\t\n", node.Name, node.Kind, truncateID(node.ContainerID))
+		for _, iface := range node.Interfaces {
+			fmt.Fprintf(tw, "\t\t\t\t%s\t%s (%s)\n", iface.Name, iface.Address, iface.Subnet)
+		}
+	}
+
+	fmt.Fprintf(tw, "\nlinks:\n")
+	for _, link := range netInfo.Links {
+		state, impairments := "up", ""
+		if link.Down {
+			state = "down"
+		}
+		if link.Impairments != nil {
+			impairments = link.Impairments.String()
+		}
+		if link.Shaping != nil {
+			impairments = strings.TrimSpace(impairments + " " + link.Shaping.String())
+		}
+		if link.MirroredTo != "" {
+			impairments = strings.TrimSpace(impairments + " mirrored to " + link.MirroredTo)
+		}
+		otherEnd := link.Bridge + ":" + link.BridgeEnd
+		if link.Peer != "" {
+			otherEnd = link.Peer
+		}
+		fmt.Fprintf(tw, "\t%s:%s\t<->\t%s\t%s\t%s\n", link.Node, link.NodeEnd, otherEnd, state, impairments)
+	}
+	tw.Flush()
+	return 0
+}
+
+func execNode(args []string) int {
+	fs := newFlagSet("exec", "<network name or ID> <node> -- <command> [arguments]")
+	fs.Parse(args)
+
+	cmd := fs.Args()
+	if len(cmd) > 2 && cmd[2] == "--" {
+		cmd = append(cmd[:2], cmd[3:]...)
+	}
+	if len(cmd) < 3 {
+		fs.Usage()
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	exitCode, err := d.Exec(cmd[0], cmd[1], cmd[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't run the command: %v\n", err)
+		return 1
+	}
+	return exitCode
+}
+
+func impair(args []string) int {
+	fs := newFlagSet("impair", "[flags] <network name or ID> <node> <subnet>\n\nImpairments apply in each direction; giving none removes the link's impairments.")
+	var li dvnet.LinkImpairments
+	var loss, duplicate, reorder, corrupt float64
+	var limit uint
+	fs.StringVar(&li.Delay, "delay", "", "delay packets this long (e.g. 100ms)")
+	fs.StringVar(&li.Jitter, "jitter", "", "vary the delay up to this much (e.g. 10ms)")
+	fs.Float64Var(&loss, "loss", 0, "percentage of packets to drop")
+	fs.Float64Var(&duplicate, "duplicate", 0, "percentage of packets to duplicate")
+	fs.Float64Var(&reorder, "reorder", 0, "percentage of packets to send right away, ahead of the delayed ones")
+	fs.Float64Var(&corrupt, "corrupt", 0, "percentage of packets to corrupt")
+	fs.StringVar(&li.Rate, "rate", "", "limit the link's bandwidth (e.g. 10mbit)")
+	fs.UintVar(&limit, "limit", 0, "packets the link can hold on to")
+	fs.Parse(args)
+
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return 2
+	}
+	li.Loss, li.Duplicate, li.Reorder, li.Corrupt = float32(loss), float32(duplicate), float32(reorder), float32(corrupt)
+	li.Limit = uint32(limit)
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	if err := d.SetLinkImpairments(fs.Arg(0), fs.Arg(1), fs.Arg(2), &li); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't impair the link: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseUpDown tells whether state asks for something to be brought up.
+func parseUpDown(fs *flag.FlagSet, state string) (bool, bool) {
+	switch state {
+	case "up":
+		return true, true
+	case "down":
+		return false, true
+	}
+	fs.Usage()
+	return false, false
+}
+
+func link(args []string) int {
+	fs := newFlagSet("link", "<network name or ID> <node> <subnet> up|down")
+	fs.Parse(args)
+
+	if fs.NArg() != 4 {
+		fs.Usage()
+		return 2
+	}
+	up, ok := parseUpDown(fs, fs.Arg(3))
+	if !ok {
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	if err := d.SetLinkState(fs.Arg(0), fs.Arg(1), fs.Arg(2), up); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't change the link's state: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func node(args []string) int {
+	fs := newFlagSet("node", "<network name or ID> <node> up|down")
+	fs.Parse(args)
+
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return 2
+	}
+	up, ok := parseUpDown(fs, fs.Arg(2))
+	if !ok {
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	if err := d.SetNodeState(fs.Arg(0), fs.Arg(1), up); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't change the node's state: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func scenario(args []string) int {
+	fs := newFlagSet("scenario", "<network name or ID> <scenario file>\n\nInterrupting the scenario restores every link to how it was when it started.")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	sc, err := dvnet.LoadScenario(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't load the scenario: %v\n", err)
+		return 1
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := d.RunScenario(ctx, fs.Arg(0), sc, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "the scenario didn't run to completion: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// reportFlags are the -format and -o flags of the commands writing reports.
+type reportFlags struct {
+	format  *string
+	outPath *string
+}
+
+// addReportFlags adds the report flags to fs. Formats describes the formats
+// the command's report can be written in, e.g. "text or json".
+func addReportFlags(fs *flag.FlagSet, formats string) reportFlags {
+	return reportFlags{
+		format:  fs.String("format", dvnet.ReportText, "write the report in this format: "+formats),
+		outPath: fs.String("o", "", "write the report to this file instead of the standard output"),
+	}
+}
+
+// write writes report in the format and to the file the flags ask for,
+// complaining on the standard error if it can't.
+func (rf reportFlags) write(report interface{ Write(io.Writer, string) error }) bool {
+	out := os.Stdout
+	if *rf.outPath != "" {
+		f, err := os.Create(*rf.outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't create %s: %v\n", *rf.outPath, err)
+			return false
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := report.Write(out, *rf.format); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't write the report: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// probe checks connectivity: it probes every address of a network's nodes from within
+// each one of its hosts. It fails if any probe's outcome differs from
+// what the network's definition predicts.
+func probe(args []string) int {
+	fs := newFlagSet("probe", "[-tcp ports] [-timeout duration] [-format text|json|junit] [-o file] <network name or ID>")
+	tcpPorts := fs.String("tcp", "", "probe these comma-separated TCP ports too")
+	timeout := fs.Duration("timeout", dvnet.DefaultProbeTimeout, "wait this long for every probe to be answered")
+	output := addReportFlags(fs, "text, json or junit")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	opts := dvnet.ConnectivityOptions{Timeout: timeout.String()}
+	for _, rawPort := range strings.Split(*tcpPorts, ",") {
+		if rawPort = strings.TrimSpace(rawPort); rawPort == "" {
+			continue
+		}
+		port, err := strconv.Atoi(rawPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid TCP port %q\n", rawPort)
+			return 2
+		}
+		opts.TCPPorts = append(opts.TCPPorts, port)
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	report, err := d.CheckConnectivity(fs.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't check the network's connectivity: %v\n", err)
+		return 1
+	}
+	if !output.write(report) {
+		return 1
+	}
+
+	if len(report.Unexpected()) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func assert(args []string) int {
+	fs := newFlagSet("assert", "[-timeout duration] [-format text|json|junit] [-o file] <network name or ID> [assertions file]\n\n"+
+		"Without an assertions file the one next to the network's definition, named like net.tests.json for net.json, is used.")
+	timeout := fs.Duration("timeout", 0, "wait this long for every probe to be answered instead of what the assertions file says")
+	output := addReportFlags(fs, "text, json or junit")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 && fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	suitePath := fs.Arg(1)
+	if suitePath == "" {
+		ns, err := d.State(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't find the network: %v\n", err)
+			return 1
+		}
+		suitePath = dvnet.AssertionsPath(ns.DefPath)
+	}
+	suite, err := dvnet.LoadAssertions(suitePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't load the assertions: %v\n", err)
+		return 1
+	}
+	if *timeout != 0 {
+		suite.Timeout = timeout.String()
+	}
+
+	report, err := d.RunAssertions(fs.Arg(0), suite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't check the assertions: %v\n", err)
+		return 1
+	}
+	if !output.write(report) {
+		return 1
+	}
+
+	if len(report.Failed()) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func routes(args []string) int {
+	fs := newFlagSet("routes", "[-format text|json|junit] [-o file] <network name or ID>")
+	output := addReportFlags(fs, "text, json or junit")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelErr)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	report, err := d.CheckRoutes(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't check the network's routes: %v\n", err)
+		return 1
+	}
+	if !output.write(report) {
+		return 1
+	}
+
+	if len(report.Differing()) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func captureLink(args []string) int {
+	fs := newFlagSet("capture", "[flags] <network name or ID> <subnet> [node or switch]\n\nWithout a node the subnet's bridge is captured on. The capture runs until interrupted.")
+	filter := fs.String("filter", "", "only capture packets matching this expression (e.g. 'tcp port 179')")
+	dir := fs.String("dir", ".", "write the pcapng file to this directory")
+	duration := fs.Duration("duration", 0, "stop capturing after this long")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 && fs.NArg() != 3 {
+		fs.Usage()
+		return 2
+	}
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't resolve %s: %v\n", *dir, err)
+		return 1
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelWarn)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	info, err := d.StartCapture(fs.Arg(0), dvnet.CaptureRequest{Node: fs.Arg(2), Subnet: fs.Arg(1), Filter: *filter, Dir: absDir})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't start the capture: %v\n", err)
+		return 1
+	}
+	fmt.Printf("capturing on %s into %s\n", info.Interface, info.File)
+	<-ctx.Done()
+
+	info, err = d.StopCapture(fs.Arg(0), info.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't stop the capture: %v\n", err)
+		return 1
+	}
+	fmt.Printf("captured %d packets in %s\n", info.Packets, time.Since(info.Started).Round(time.Second))
+	if info.Error != "" {
+		fmt.Fprintf(os.Stderr, "the capture stopped early: %s\n", info.Error)
+		return 1
+	}
+	return 0
+}
+
+func drift(args []string) int {
+	fs := newFlagSet("drift", "[-format text|json] [-o file] <network name or ID>")
+	output := addReportFlags(fs, "text or json")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	dvnet.InitLogger(dvnet.LogLevelErr)
+	d, ok := newDriver()
+	if !ok {
+		return 1
+	}
+
+	report, err := d.DetectDrift(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't look for drift: %v\n", err)
+		return 1
+	}
+	if !output.write(report) {
+		return 1
+	}
+
+	if len(report.Drifts) > 0 {
+		return 1
+	}
+	return 0
 }